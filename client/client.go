@@ -1,27 +1,61 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/phoops/ngsiv2/model"
 )
 
+// NgsiV2Client is a client of an NGSIv2 context broker.
+// It is safe for concurrent use by multiple goroutines, provided that the functions
+// set through its options, like the logger, observer and interceptor, are too.
 type NgsiV2Client struct {
 	c                   *http.Client
 	url                 string
+	basePath            string
 	timeout             time.Duration
+	apiResMu            sync.Mutex
 	apiRes              *model.APIResources
 	customGlobalHeaders map[string]string
+	entityDecodeHook    func(*model.Entity) error
+	basicAuth           *basicAuth
+	tlsConfig           *tls.Config
+	logger              func(format string, args ...interface{})
+	retry               *retryPolicy
+	compression         bool
+	requestCompression  bool
+	observer            func(op string, statusCode int, duration time.Duration, err error)
+	interceptor         func(*http.Request) error
+	lastHeaderMu        sync.Mutex
+	lastHeader          http.Header
+}
+
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+}
+
+type basicAuth struct {
+	username string
+	password string
 }
 
 // ClientOptionFunc is a function that configures a NgsiV2Client.
@@ -31,6 +65,7 @@ type ClientOptionFunc func(*NgsiV2Client) error
 func NewNgsiV2Client(options ...ClientOptionFunc) (*NgsiV2Client, error) {
 	c := &NgsiV2Client{
 		timeout:             time.Second * 15,
+		basePath:            defaultBasePath,
 		customGlobalHeaders: make(map[string]string),
 	}
 
@@ -44,6 +79,11 @@ func NewNgsiV2Client(options ...ClientOptionFunc) (*NgsiV2Client, error) {
 	c.c = &http.Client{
 		Timeout: c.timeout,
 	}
+	if c.tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = c.tlsConfig
+		c.c.Transport = transport
+	}
 
 	return c, nil
 }
@@ -64,6 +104,25 @@ func SetUrl(url string) ClientOptionFunc {
 	}
 }
 
+// defaultBasePath is the path of the NGSIv2 API in Orion.
+const defaultBasePath = "/v2"
+
+// SetBasePath is used to set the path of the NGSIv2 API, "/v2" by default,
+// e.g. "/orion/v2" when the context broker is behind a proxy adding a prefix.
+// It applies to the API entry point and to the batch operations; the resource
+// paths returned by the context broker, which is unaware of the prefix, are moved
+// from "/v2" to the base path as well.
+func SetBasePath(path string) ClientOptionFunc {
+	return func(c *NgsiV2Client) error {
+		path = strings.TrimRight(path, "/")
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("Invalid base path '%s': it must start with '/' and not be the root", path)
+		}
+		c.basePath = path
+		return nil
+	}
+}
+
 // SetGlobalHeader is used a custom header applied to all the requests
 // made to the context broker
 func SetGlobalHeader(key string, value string) ClientOptionFunc {
@@ -73,292 +132,627 @@ func SetGlobalHeader(key string, value string) ClientOptionFunc {
 	}
 }
 
-type additionalHeader struct {
-	key   string
-	value string
+// SetBasicAuth is used to set the credentials for HTTP basic authentication,
+// sent with all the requests made to the context broker.
+func SetBasicAuth(username, password string) ClientOptionFunc {
+	return func(c *NgsiV2Client) error {
+		if username == "" {
+			return fmt.Errorf("Basic auth username cannot be empty")
+		}
+		c.basicAuth = &basicAuth{username, password}
+		return nil
+	}
 }
 
-func (c *NgsiV2Client) newRequest(method, url string, body io.Reader, additionalHeaders ...additionalHeader) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		return nil, err
+// SetTLSConfig is used to set the TLS configuration of the connections
+// to the context broker, e.g. for trusting a self-signed certificate.
+func SetTLSConfig(cfg *tls.Config) ClientOptionFunc {
+	return func(c *NgsiV2Client) error {
+		if cfg == nil {
+			return fmt.Errorf("TLS configuration cannot be nil")
+		}
+		c.tlsConfig = cfg
+		return nil
 	}
-	req.Header.Add("User-Agent", "ngsiv2-client")
-	req.Header.Add("Accept", "application/json")
+}
 
-	// set the global headers
-	for header, value := range c.customGlobalHeaders {
-		req.Header.Add(header, value)
+// SetLogger is used to set a function logging, for debugging purposes,
+// every request made to the context broker and its response, bodies included;
+// response bodies are truncated to their first 8KiB.
+// Nothing is logged by default.
+func SetLogger(logger func(format string, args ...interface{})) ClientOptionFunc {
+	return func(c *NgsiV2Client) error {
+		c.logger = logger
+		return nil
 	}
+}
 
-	for _, ah := range additionalHeaders {
-		req.Header.Add(ah.key, ah.value)
+// SetRetry is used to retry the idempotent requests failed with a network
+// error or a 5xx status code, up to maxAttempts attempts overall.
+// Between the attempts the client waits an exponential backoff starting
+// from baseDelay, with some jitter, giving up if the request context is done.
+// Idempotent requests are GET, HEAD, PUT and DELETE ones, and the batch
+// operations; POST requests creating entities, subscriptions or
+// registrations are never retried, to avoid creating duplicates.
+func SetRetry(maxAttempts int, baseDelay time.Duration) ClientOptionFunc {
+	return func(c *NgsiV2Client) error {
+		if maxAttempts < 1 {
+			return fmt.Errorf("Retry max attempts must be at least 1, got %d", maxAttempts)
+		}
+		if baseDelay < 0 {
+			return fmt.Errorf("Retry base delay cannot be negative")
+		}
+		c.retry = &retryPolicy{maxAttempts, baseDelay}
+		return nil
 	}
-	return req, nil
 }
 
-func (c *NgsiV2Client) BatchUpdate(msg *model.BatchUpdate) error {
-	jsonValue, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("Could not serialize message: %+v", err)
+// SetCompression is used to ask the context broker for gzip compressed
+// responses, transparently decompressed by the client.
+// Responses that are not compressed, from brokers ignoring the request, are read as they are.
+func SetCompression(enabled bool) ClientOptionFunc {
+	return func(c *NgsiV2Client) error {
+		c.compression = enabled
+		return nil
 	}
-	req, err := c.newRequest("POST", fmt.Sprintf("%s/v2/op/update", c.url), bytes.NewBuffer(jsonValue))
-	if err != nil {
-		return fmt.Errorf("Could not create request for batch update: %+v", err)
+}
+
+// SetRequestCompression is used to gzip the bodies of the batch operations requests,
+// sent with the Content-Encoding: gzip header.
+// The context broker, or a proxy in front of it, must support compressed requests.
+func SetRequestCompression(enabled bool) ClientOptionFunc {
+	return func(c *NgsiV2Client) error {
+		c.requestCompression = enabled
+		return nil
 	}
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := c.c.Do(req)
-	if err != nil {
-		return fmt.Errorf("Error invoking batch update: %+v", err)
+}
+
+// SetObserver is used to set a function invoked after every request made to the
+// context broker, e.g. for collecting metrics. It receives the name of the client
+// method issuing the request, like "RetrieveEntity" or "CreateEntity", the
+// response status code and the time taken until the response headers were
+// received, retries included. When no response was received, the status code is 0
+// and err is the network or context error.
+func SetObserver(observer func(op string, statusCode int, duration time.Duration, err error)) ClientOptionFunc {
+	return func(c *NgsiV2Client) error {
+		c.observer = observer
+		return nil
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusNoContent {
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
+}
+
+// SetRequestInterceptor is used to set a function invoked with every request
+// right before sending it to the context broker, e.g. for inspecting or changing it.
+// If the interceptor returns an error the request is not sent, and the error is
+// returned by the client method; return ErrDryRun for capturing the requests in tests,
+// without a context broker. The body can be read through the request GetBody.
+// The API resources are not retrieved, unless by RetrieveAPIResources and the like:
+// the standard ones of Orion are assumed, so that each client method only sends its
+// own request.
+func SetRequestInterceptor(interceptor func(*http.Request) error) ClientOptionFunc {
+	return func(c *NgsiV2Client) error {
+		c.interceptor = interceptor
+		return nil
+	}
+}
+
+// SetEntityDecodeHook is used to set a function invoked on every entity
+// returned by the client, right after it has been decoded.
+// It is useful for applying a common normalization to all the entities;
+// if the hook returns an error, the whole operation fails.
+func SetEntityDecodeHook(hook func(*model.Entity) error) ClientOptionFunc {
+	return func(c *NgsiV2Client) error {
+		c.entityDecodeHook = hook
+		return nil
+	}
+}
+
+// applyEntityDecodeHook invokes the entity decode hook, if set, on each entity.
+func (c *NgsiV2Client) applyEntityDecodeHook(entities ...*model.Entity) error {
+	if c.entityDecodeHook == nil {
+		return nil
+	}
+	for _, e := range entities {
+		if err := c.entityDecodeHook(e); err != nil {
+			return fmt.Errorf("Entity decode hook failed for entity '%s': %w", e.Id, err)
+		}
 	}
 	return nil
 }
 
-func (c *NgsiV2Client) BatchQuery(msg *model.BatchQuery, options ...BatchQueryParamFunc) ([]*model.Entity, error) {
-	params := new(batchQueryParams)
+type additionalHeader struct {
+	key   string
+	value string
+}
 
-	// apply the options
-	for _, option := range options {
-		if err := option(params); err != nil {
+func (c *NgsiV2Client) newRequest(ctx context.Context, method, url string, body io.Reader, additionalHeaders ...additionalHeader) (*http.Request, error) {
+	compressBody := c.requestCompression && body != nil && strings.Contains(url, c.basePath+"/op/")
+	if compressBody {
+		compressed, err := gzipBody(body)
+		if err != nil {
 			return nil, err
 		}
+		body = compressed
 	}
-
-	jsonValue, err := json.Marshal(msg)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		return nil, fmt.Errorf("could not serialize message: %+v", err)
+		return nil, err
 	}
-	req, err := c.newRequest("POST", fmt.Sprintf("%s/v2/op/query", c.url), bytes.NewBuffer(jsonValue))
-	if err != nil {
-		return nil, fmt.Errorf("could not create request for batch query: %+v", err)
+	req.Header.Add("User-Agent", "ngsiv2-client")
+	req.Header.Add("Accept", "application/json")
+	if compressBody {
+		req.Header.Set("Content-Encoding", "gzip")
 	}
-	req.Header.Add("Content-Type", "application/json")
-	q := req.URL.Query()
-
-	if params.limit > 0 {
-		q.Add("limit", strconv.Itoa(params.limit))
+	if c.compression {
+		req.Header.Set("Accept-Encoding", "gzip")
 	}
 
-	if params.offset > 0 {
-		q.Add("offset", strconv.Itoa(params.offset))
+	if c.basicAuth != nil {
+		req.SetBasicAuth(c.basicAuth.username, c.basicAuth.password)
 	}
 
-	orderByStr := strings.Join(params.orderBy, ",")
-	if orderByStr != "" {
-		q.Add("orderBy", orderByStr)
-	}
-	if params.options != "" {
-		q.Add("options", string(params.options))
+	// set the global headers
+	for header, value := range c.customGlobalHeaders {
+		req.Header.Add(header, value)
 	}
-	req.URL.RawQuery = q.Encode()
 
-	resp, err := c.c.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("Error invoking batch update: %+v", err)
+	for _, ah := range additionalHeaders {
+		req.Header.Add(ah.key, ah.value)
 	}
-	defer resp.Body.Close()
-	bodyBytes, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
+	return req, nil
+}
+
+func gzipBody(body io.Reader) (*bytes.Reader, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, body); err != nil {
+		return nil, fmt.Errorf("Could not compress request body: %w", err)
 	}
-	var ret []*model.Entity
-	if err := json.Unmarshal(bodyBytes, &ret); err != nil {
-		return nil, fmt.Errorf("Error reading batch query response: %+v", err)
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("Could not compress request body: %w", err)
 	}
-	return ret, nil
+	return bytes.NewReader(buf.Bytes()), nil
 }
 
-type batchQueryParams struct {
-	limit   int
-	offset  int
-	orderBy []string
-	options string
+// gzipReadCloser reads a gzip compressed response body, closing both
+// the gzip reader and the body.
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.Closer
 }
 
-type BatchQueryParamFunc func(params *batchQueryParams) error
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
 
-func BatchQuerySetLimit(limit int) BatchQueryParamFunc {
-	return func(p *batchQueryParams) error {
-		if limit <= 0 {
-			return fmt.Errorf("limit cannot be less than or equal 0")
-		}
-		p.limit = limit
+// decompressResponse replaces the body of a gzip compressed response with its
+// decompressed content. The body is checked for the gzip magic number, since
+// some brokers send plain JSON with the gzip Content-Encoding anyway.
+func decompressResponse(resp *http.Response) error {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	br := bufio.NewReader(resp.Body)
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	if magic, err := br.Peek(2); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{br, resp.Body}
 		return nil
 	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return fmt.Errorf("Could not decompress response body: %w", err)
+	}
+	resp.Body = &gzipReadCloser{zr, resp.Body}
+	return nil
 }
 
-func BatchQuerySetOffset(offset int) BatchQueryParamFunc {
-	return func(p *batchQueryParams) error {
-		if offset < 0 {
-			return fmt.Errorf("offset cannot be less than 0")
+// do sends the request of the op operation, unless the interceptor fails, returning the
+// context error if the request was cancelled or its deadline exceeded, and reports
+// its outcome to the observer, if set, recording the response headers.
+// Idempotent requests are retried according to the retry policy, if set.
+func (c *NgsiV2Client) do(op string, req *http.Request) (*http.Response, error) {
+	if c.interceptor != nil {
+		if err := c.interceptor(req); err != nil {
+			return nil, err
 		}
-		p.offset = offset
-		return nil
 	}
+	start := time.Now()
+	resp, err := c.sendRetrying(req)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+		c.lastHeaderMu.Lock()
+		c.lastHeader = resp.Header.Clone()
+		c.lastHeaderMu.Unlock()
+	}
+	if c.observer != nil {
+		c.observer(op, statusCode, time.Since(start), err)
+	}
+	return resp, err
 }
 
-func BatchQueryAddOrderBy(attr string, ascending bool) BatchQueryParamFunc {
-	return func(p *batchQueryParams) error {
-		if !model.IsValidFieldSyntax(attr) {
-			return fmt.Errorf("'%s' is not a valid attribute name", attr)
+// LastResponseHeaders returns a copy of the headers of the most recent response
+// received by the client, e.g. to read rate limiting or correlation headers, or nil
+// if no response was received yet.
+// When the client is used by several goroutines at once, the most recent response
+// may belong to a request of another goroutine.
+func (c *NgsiV2Client) LastResponseHeaders() http.Header {
+	c.lastHeaderMu.Lock()
+	defer c.lastHeaderMu.Unlock()
+	return c.lastHeader.Clone()
+}
+
+func (c *NgsiV2Client) sendRetrying(req *http.Request) (*http.Response, error) {
+	if c.retry == nil || c.retry.maxAttempts == 1 || !isRetryable(req, c.basePath+"/op/") {
+		return c.send(req)
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(req)
+		if attempt == c.retry.maxAttempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			if resp.StatusCode < 500 {
+				return resp, nil
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
 		}
 
-		if ascending {
-			p.orderBy = append(p.orderBy, attr)
-		} else {
-			p.orderBy = append(p.orderBy, "!"+attr)
+		timer := time.NewTimer(c.retry.backoff(attempt))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("Could not rewind request body: %w", err)
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
 		}
-		return nil
 	}
 }
 
-func BatchQuerySetOptions(opts string) BatchQueryParamFunc {
-	return func(p *batchQueryParams) error {
-		return fmt.Errorf("not supported")
+// isRetryable tells whether the request can be sent again safely,
+// opPath being the path prefix of the batch operations.
+func isRetryable(req *http.Request, opPath string) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	case "POST":
+		return strings.Contains(req.URL.Path, opPath)
 	}
+	return false
 }
 
-// RetrieveAPIResources gives url link values for retrieving resources.
-// See: https://orioncontextbroker.docs.apiary.io/#reference/api-entry-point/retrieve-api-resources/retrieve-api-resources
-func (c *NgsiV2Client) RetrieveAPIResources() (*model.APIResources, error) {
-	req, err := c.newRequest("GET", fmt.Sprintf("%s/v2", c.url), nil)
-	if err != nil {
-		return nil, fmt.Errorf("Could not create request for API resources: %+v", err)
+// backoff returns the delay before the next attempt: the base delay doubled
+// at each attempt, randomized between half and the whole of it.
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	if p.baseDelay == 0 {
+		return 0
+	}
+	d := p.baseDelay << uint(attempt-1)
+	// cap the delay, also guarding against overflows
+	if d <= 0 || d > time.Minute {
+		d = time.Minute
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// send sends the request once, logging it if a logger is set.
+func (c *NgsiV2Client) send(req *http.Request) (*http.Response, error) {
+	if c.logger != nil {
+		c.logRequest(req)
 	}
 	resp, err := c.c.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("Could not retrieve API resources: %+v", err)
-	}
-	defer resp.Body.Close()
-	bodyBytes, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
-	} else {
-		ret := new(model.APIResources)
-		if err := json.Unmarshal(bodyBytes, ret); err != nil {
-			return nil, fmt.Errorf("Error reading API resources response: %+v", err)
-		} else {
-			return ret, nil
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		if c.logger != nil {
+			c.logger("%s %s failed: %v", req.Method, req.URL, err)
 		}
+		return nil, err
 	}
-}
-
-func (c *NgsiV2Client) getEntitiesUrl() (string, error) {
-	if c.apiRes == nil {
-		var err error
-		if c.apiRes, err = c.RetrieveAPIResources(); err != nil {
-			return "", err
+	if err := decompressResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if c.logger != nil {
+		if err := c.logResponse(req, resp); err != nil {
+			resp.Body.Close()
+			return nil, err
 		}
 	}
-	return fmt.Sprintf("%s%s", c.url, c.apiRes.EntitiesUrl), nil
+	return resp, nil
 }
 
-func (c *NgsiV2Client) getSubscriptionsUrl() (string, error) {
-	if c.apiRes == nil {
-		var err error
-		if c.apiRes, err = c.RetrieveAPIResources(); err != nil {
-			return "", err
+func (c *NgsiV2Client) logRequest(req *http.Request) {
+	var body []byte
+	if req.GetBody != nil {
+		if rc, err := req.GetBody(); err == nil {
+			var r io.Reader = rc
+			if req.Header.Get("Content-Encoding") == "gzip" {
+				if zr, err := gzip.NewReader(rc); err == nil {
+					r = zr
+				}
+			}
+			body, _ = ioutil.ReadAll(r)
+			rc.Close()
 		}
 	}
-	return fmt.Sprintf("%s%s", c.url, c.apiRes.SubscriptionsUrl), nil
+	c.logger("%s %s\nRequest body: %s", req.Method, req.URL, body)
 }
 
-type fiwareHeaderParams struct {
-	fiwareService     string
-	fiwareServicePath string
-}
+// maxLoggedResponseBody is the size of the response body prefix that is logged.
+const maxLoggedResponseBody = 8 * 1024
 
-func (f fiwareHeaderParams) headers() []additionalHeader {
-	var ret []additionalHeader
-	if f.fiwareService != "" {
-		ret = append(ret, additionalHeader{"Fiware-Service", f.fiwareService})
-	}
-	if f.fiwareServicePath != "" {
-		ret = append(ret, additionalHeader{"Fiware-ServicePath", f.fiwareServicePath})
+// logResponse logs the response, restoring its body for the caller.
+// Only a prefix of the body is read, so that large responses are still streamed.
+func (c *NgsiV2Client) logResponse(req *http.Request, resp *http.Response) error {
+	prefix, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxLoggedResponseBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return fmt.Errorf("Could not read response body: %w", err)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), resp.Body), resp.Body}
+	if len(prefix) > maxLoggedResponseBody {
+		c.logger("%s %s returned %d\nResponse body: %s... (truncated)", req.Method, req.URL, resp.StatusCode, prefix[:maxLoggedResponseBody])
+	} else {
+		c.logger("%s %s returned %d\nResponse body: %s", req.Method, req.URL, resp.StatusCode, prefix)
 	}
-	return ret
+	return nil
 }
 
-type retrieveEntityParams struct {
+type batchUpdateParams struct {
 	fiwareHeaderParams
-	id         string
-	entityType string
-	attrs      []string
-	options    model.SimplifiedEntityRepresentation
 }
 
-type RetrieveEntityParamFunc func(*retrieveEntityParams) error
+type BatchUpdateParamFunc func(*batchUpdateParams) error
 
-func setRetrieveEntityType(p *retrieveEntityParams, entityType string) error {
-	if !model.IsValidFieldSyntax(entityType) {
-		return fmt.Errorf("'%s' is not a valid entity type name", entityType)
+func BatchUpdateSetFiwareService(fiwareService string) BatchUpdateParamFunc {
+	return func(p *batchUpdateParams) error {
+		p.fiwareService = fiwareService
+		return nil
 	}
-	p.entityType = entityType
-	return nil
 }
 
-func RetrieveEntitySetType(entityType string) RetrieveEntityParamFunc {
-	return func(p *retrieveEntityParams) error {
-		return setRetrieveEntityType(p, entityType)
+func BatchUpdateSetFiwareServicePath(fiwareServicePath string) BatchUpdateParamFunc {
+	return func(p *batchUpdateParams) error {
+		p.fiwareServicePath = fiwareServicePath
+		return nil
 	}
 }
 
-func addRetrieveEntityAttribute(p *retrieveEntityParams, attr string) error {
-	if !model.IsValidFieldSyntax(attr) {
-		return fmt.Errorf("'%s' is not a valid attribute name", attr)
-	}
-	p.attrs = append(p.attrs, attr)
-	return nil
+func (c *NgsiV2Client) BatchUpdate(msg *model.BatchUpdate, options ...BatchUpdateParamFunc) error {
+	return c.BatchUpdateWithContext(context.Background(), msg, options...)
 }
 
-func RetrieveEntityAddAttribute(attr string) RetrieveEntityParamFunc {
-	return func(p *retrieveEntityParams) error {
-		return addRetrieveEntityAttribute(p, attr)
-	}
-}
+// BatchUpdateWithContext is like BatchUpdate, but uses ctx for the requests.
+func (c *NgsiV2Client) BatchUpdateWithContext(ctx context.Context, msg *model.BatchUpdate, options ...BatchUpdateParamFunc) error {
+	params := new(batchUpdateParams)
 
-func setRetrieveEntityOptions(p *retrieveEntityParams, opts model.SimplifiedEntityRepresentation) error {
-	if opts != "" {
-		return fmt.Errorf("Simplified entity representation is not supported yet!")
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return err
+		}
 	}
 
+	jsonValue, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("Could not serialize message: %w", err)
+	}
+	req, err := c.newRequest(ctx, "POST", c.opUrl("update"), bytes.NewBuffer(jsonValue), params.headers()...)
+	if err != nil {
+		return fmt.Errorf("Could not create request for batch update: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := c.do("BatchUpdate", req)
+	if err != nil {
+		return fmt.Errorf("Error invoking batch update: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return newAPIError(resp.StatusCode, bodyBytes)
+	}
 	return nil
 }
 
-func RetrieveEntitySetOptions(opts model.SimplifiedEntityRepresentation) RetrieveEntityParamFunc {
-	return func(p *retrieveEntityParams) error {
-		return setRetrieveEntityOptions(p, opts)
+// BatchUpdateChunked sends the entities of msg in consecutive batch updates
+// of at most chunkSize entities each, all with the action type of msg.
+// The chunks are sent sequentially and a failed chunk does not stop the
+// following ones: the failures are reported together by a *BatchChunkedError.
+func (c *NgsiV2Client) BatchUpdateChunked(msg *model.BatchUpdate, chunkSize int, options ...BatchUpdateParamFunc) error {
+	return c.BatchUpdateChunkedWithContext(context.Background(), msg, chunkSize, options...)
+}
+
+// BatchUpdateChunkedWithContext is like BatchUpdateChunked, but uses ctx for the requests.
+// It stops at the first chunk not sent because the context is done, returning the context error.
+func (c *NgsiV2Client) BatchUpdateChunkedWithContext(ctx context.Context, msg *model.BatchUpdate, chunkSize int, options ...BatchUpdateParamFunc) error {
+	if msg == nil {
+		return fmt.Errorf("Cannot send a nil batch update")
+	}
+	if chunkSize < 1 {
+		return fmt.Errorf("Chunk size cannot be less than 1")
+	}
+
+	var failures []BatchChunkFailure
+	for offset, chunk := 0, 0; offset < len(msg.Entities); offset, chunk = offset+chunkSize, chunk+1 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := offset + chunkSize
+		if end > len(msg.Entities) {
+			end = len(msg.Entities)
+		}
+		batch := &model.BatchUpdate{ActionType: msg.ActionType, Entities: msg.Entities[offset:end]}
+		if err := c.BatchUpdateWithContext(ctx, batch, options...); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			failures = append(failures, BatchChunkFailure{Chunk: chunk, Offset: offset, Size: end - offset, Err: err})
+		}
 	}
+	if len(failures) > 0 {
+		return &BatchChunkedError{Failures: failures}
+	}
+	return nil
 }
 
-func RetrieveEntitySetFiwareService(fiwareService string) RetrieveEntityParamFunc {
-	return func(p *retrieveEntityParams) error {
-		p.fiwareService = fiwareService
-		return nil
+// BatchDeleteEntities deletes the entities with the given ids and type
+// with a single batch update. The type can be empty to match any type.
+func (c *NgsiV2Client) BatchDeleteEntities(ids []string, entityType string, options ...BatchUpdateParamFunc) error {
+	return c.BatchDeleteEntitiesWithContext(context.Background(), ids, entityType, options...)
+}
+
+// BatchDeleteEntitiesWithContext is like BatchDeleteEntities, but uses ctx for the requests.
+func (c *NgsiV2Client) BatchDeleteEntitiesWithContext(ctx context.Context, ids []string, entityType string, options ...BatchUpdateParamFunc) error {
+	if len(ids) == 0 {
+		return fmt.Errorf("Cannot batch delete without entity ids")
+	}
+	if entityType != "" && !model.IsValidFieldSyntax(entityType) {
+		return fmt.Errorf("'%s' is not a valid entity type name", entityType)
+	}
+	var invalid []string
+	for _, id := range ids {
+		if !model.IsValidFieldSyntax(id) {
+			invalid = append(invalid, fmt.Sprintf("'%s'", id))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("Invalid entity ids: %s", strings.Join(invalid, ", "))
 	}
+
+	msg := model.NewBatchUpdate(model.DeleteAction)
+	for _, id := range ids {
+		msg.AddEntity(&model.Entity{Id: id, Type: entityType, Attributes: make(map[string]*model.Attribute)})
+	}
+	return c.BatchUpdateWithContext(ctx, msg, options...)
 }
 
-func RetrieveEntitySetFiwareServicePath(fiwareServicePath string) RetrieveEntityParamFunc {
-	return func(p *retrieveEntityParams) error {
-		p.fiwareServicePath = fiwareServicePath
+// BatchUpdateStream reads the entities from the channel and sends them to the
+// context broker in batches with the given action.
+// A batch is flushed when it reaches flushSize entities or when flushInterval
+// elapses, whatever comes first; a non positive flushInterval disables the time based flush.
+// It returns when the channel is closed, after flushing the pending entities,
+// or when the context is cancelled, discarding them.
+func (c *NgsiV2Client) BatchUpdateStream(ctx context.Context, entities <-chan *model.Entity, action model.ActionType, flushSize int, flushInterval time.Duration, options ...BatchUpdateParamFunc) error {
+	if flushSize < 1 {
+		return fmt.Errorf("Flush size cannot be less than 1")
+	}
+
+	var tick <-chan time.Time
+	if flushInterval > 0 {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	batch := model.NewBatchUpdate(action)
+	flush := func() error {
+		if len(batch.Entities) == 0 {
+			return nil
+		}
+		if err := c.BatchUpdateWithContext(ctx, batch, options...); err != nil {
+			return fmt.Errorf("Could not flush %d entities: %w", len(batch.Entities), err)
+		}
+		batch = model.NewBatchUpdate(action)
 		return nil
 	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-entities:
+			if !ok {
+				return flush()
+			}
+			batch.AddEntity(e)
+			if len(batch.Entities) >= flushSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-tick:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
 }
 
-// RetrieveEntity retrieves an object representing the entity identified by the given id.
-// See: https://orioncontextbroker.docs.apiary.io/#reference/entities/entity-by-id/retrieve-entity
-func (c *NgsiV2Client) RetrieveEntity(id string, options ...RetrieveEntityParamFunc) (*model.Entity, error) {
-	if id == "" {
-		return nil, fmt.Errorf("Cannot retrieve entity with empty 'id'")
+// UpsertAndDiff upserts the entity with a batch append, reads it back and compares
+// what the context broker stored with what was sent.
+// It returns the stored entity, the names of the attributes added by the broker,
+// the ones whose type or value changed and the ones sent but not stored.
+// The options are applied when the entity is retrieved.
+func (c *NgsiV2Client) UpsertAndDiff(e *model.Entity, options ...RetrieveEntityParamFunc) (stored *model.Entity, added, changed, removed []string, err error) {
+	return c.UpsertAndDiffWithContext(context.Background(), e, options...)
+}
+
+// UpsertAndDiffWithContext is like UpsertAndDiff, but uses ctx for the requests.
+func (c *NgsiV2Client) UpsertAndDiffWithContext(ctx context.Context, e *model.Entity, options ...RetrieveEntityParamFunc) (stored *model.Entity, added, changed, removed []string, err error) {
+	if e == nil {
+		return nil, nil, nil, nil, fmt.Errorf("Cannot upsert a nil entity")
 	}
 
-	params := new(retrieveEntityParams)
-	params.id = id
+	batch := model.NewBatchUpdate(model.AppendAction)
+	batch.AddEntity(e)
+	if err := c.BatchUpdateWithContext(ctx, batch); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	retrieveOptions := []RetrieveEntityParamFunc{}
+	if e.Type != "" {
+		retrieveOptions = append(retrieveOptions, RetrieveEntitySetType(e.Type))
+	}
+	retrieveOptions = append(retrieveOptions, options...)
+	stored, err = c.RetrieveEntityWithContext(ctx, e.Id, retrieveOptions...)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	diff, removed := e.Diff(stored)
+	for name := range diff {
+		if _, ok := e.Attributes[name]; ok {
+			changed = append(changed, name)
+		} else {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(changed)
+	return stored, added, changed, removed, nil
+}
+
+func (c *NgsiV2Client) BatchQuery(msg *model.BatchQuery, options ...BatchQueryParamFunc) ([]*model.Entity, error) {
+	return c.BatchQueryWithContext(context.Background(), msg, options...)
+}
+
+// BatchQueryWithContext is like BatchQuery, but uses ctx for the requests.
+func (c *NgsiV2Client) BatchQueryWithContext(ctx context.Context, msg *model.BatchQuery, options ...BatchQueryParamFunc) ([]*model.Entity, error) {
+	params := new(batchQueryParams)
 
 	// apply the options
 	for _, option := range options {
@@ -367,118 +761,154 @@ func (c *NgsiV2Client) RetrieveEntity(id string, options ...RetrieveEntityParamF
 		}
 	}
 
-	eUrl, err := c.getEntitiesUrl()
-	if err != nil {
-		return nil, err
+	ret, _, err := c.batchQuery(ctx, msg, params)
+	return ret, err
+}
+
+// BatchQueryWithCount is like BatchQuery, but it also returns the total number
+// of entities matching the query, regardless of limit and offset.
+func (c *NgsiV2Client) BatchQueryWithCount(msg *model.BatchQuery, options ...BatchQueryParamFunc) ([]*model.Entity, int, error) {
+	return c.BatchQueryWithCountWithContext(context.Background(), msg, options...)
+}
+
+// BatchQueryWithCountWithContext is like BatchQueryWithCount, but uses ctx for the requests.
+func (c *NgsiV2Client) BatchQueryWithCountWithContext(ctx context.Context, msg *model.BatchQuery, options ...BatchQueryParamFunc) ([]*model.Entity, int, error) {
+	params := new(batchQueryParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return nil, 0, err
+		}
+	}
+	params.count = true
+
+	return c.batchQuery(ctx, msg, params)
+}
+
+func (c *NgsiV2Client) batchQuery(ctx context.Context, msg *model.BatchQuery, params *batchQueryParams) ([]*model.Entity, int, error) {
+	if params.representation == model.ValuesRepresentation && len(msg.Attrs) == 0 {
+		return nil, 0, fmt.Errorf("The values representation requires the attributes to be listed in the query")
 	}
 
-	req, err := c.newRequest("GET", fmt.Sprintf("%s/%s", eUrl, params.id), nil, params.headers()...)
+	jsonValue, err := json.Marshal(msg)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not serialize message: %w", err)
+	}
+	req, err := c.newRequest(ctx, "POST", c.opUrl("query"), bytes.NewBuffer(jsonValue), params.headers()...)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create request for API resources: %+v", err)
+		return nil, 0, fmt.Errorf("could not create request for batch query: %w", err)
 	}
+	req.Header.Add("Content-Type", "application/json")
 	q := req.URL.Query()
-	if params.entityType != "" {
-		q.Add("type", params.entityType)
+
+	if params.limit > 0 {
+		q.Add("limit", strconv.Itoa(params.limit))
 	}
-	attributes := strings.Join(params.attrs, ",")
-	if attributes != "" {
-		q.Add("attrs", attributes)
+
+	if params.offset > 0 {
+		q.Add("offset", strconv.Itoa(params.offset))
 	}
-	if params.options != "" {
-		q.Add("options", string(params.options))
+
+	orderByStr := strings.Join(params.orderBy, ",")
+	if orderByStr != "" {
+		q.Add("orderBy", orderByStr)
+	}
+	if opts := params.optionsValue(); opts != "" {
+		q.Add("options", opts)
 	}
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := c.c.Do(req)
+	resp, err := c.do("BatchQuery", req)
 	if err != nil {
-		return nil, fmt.Errorf("Could not retrieve entity: %+v", err)
+		return nil, 0, fmt.Errorf("Error invoking batch update: %w", err)
 	}
 	defer resp.Body.Close()
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode == http.StatusConflict {
-		return nil, fmt.Errorf("Conflict (id non-unique?).\nResponse body: %s", string(bodyBytes))
-	}
-
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
-	} else {
-		ret := new(model.Entity)
-		if err := json.Unmarshal(bodyBytes, ret); err != nil {
-			return nil, fmt.Errorf("Error reading retrieve entity response: %+v", err)
-		} else {
-			return ret, nil
-		}
+		return nil, 0, newAPIError(resp.StatusCode, bodyBytes)
 	}
-}
-
-type listEntitiesParams struct {
-	retrieveEntityParams
-	idPattern string
-	q         []string
-	georel    string
-	geometry  string
-	coords    []string
-	limit     int
-	offset    int
-	orderBy   []string
-}
-
-type ListEntitiesParamFunc func(*listEntitiesParams) error
-
-func ListEntitiesSetId(id string) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		if !model.IsValidFieldSyntax(id) {
-			return fmt.Errorf("'%s' is not a valid entity id", id)
+	ret, err := decodeBatchQueryResponse(bodyBytes, params.representation, msg.Attrs)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error reading batch query response: %w", err)
+	}
+	if err := c.applyEntityDecodeHook(ret...); err != nil {
+		return nil, 0, err
+	}
+	total := 0
+	if params.count {
+		if total, err = strconv.Atoi(resp.Header.Get("Fiware-Total-Count")); err != nil {
+			return nil, 0, errors.New("Fiware-Total-Count not found in header")
 		}
-		p.id = id
-		return nil
-
 	}
+	return ret, total, nil
 }
 
-func ListEntitiesSetIds(ids []string) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		for _, id := range ids {
-			if !model.IsValidFieldSyntax(id) {
-				return fmt.Errorf("'%s' is not a valid entity id", id)
+// decodeBatchQueryResponse decodes the entities in the given representation.
+// In the values representation the attributes are named after attrs, in order,
+// while the entity id and type are not available.
+func decodeBatchQueryResponse(b []byte, representation model.SimplifiedEntityRepresentation, attrs []string) ([]*model.Entity, error) {
+	var ret []*model.Entity
+	switch representation {
+	case model.KeyValuesRepresentation:
+		var raws []json.RawMessage
+		if err := json.Unmarshal(b, &raws); err != nil {
+			return nil, err
+		}
+		for _, raw := range raws {
+			e, err := model.UnmarshalKeyValuesEntity(raw)
+			if err != nil {
+				return nil, err
 			}
+			ret = append(ret, e)
 		}
-		p.id = strings.Join(ids, ",")
-		return nil
-
-	}
-}
-
-func ListEntitiesSetIdPattern(idPattern string) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		if _, err := regexp.Compile(idPattern); err != nil {
-			return err
+	case model.ValuesRepresentation:
+		var rows [][]interface{}
+		if err := json.Unmarshal(b, &rows); err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if len(row) != len(attrs) {
+				return nil, fmt.Errorf("Expected %d values, got %d", len(attrs), len(row))
+			}
+			kv := &model.Entity{Attributes: make(map[string]*model.Attribute, len(row))}
+			for i, v := range row {
+				kv.Attributes[attrs[i]] = model.NewAttribute("", v)
+			}
+			ret = append(ret, model.KeyValuesToNormalized(kv, nil))
+		}
+	default:
+		if err := json.Unmarshal(b, &ret); err != nil {
+			return nil, err
 		}
-		p.idPattern = idPattern
-		return nil
 	}
+	return ret, nil
 }
 
-func ListEntitiesSetType(entityType string) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		return setRetrieveEntityType(&p.retrieveEntityParams, entityType)
-	}
+type batchQueryParams struct {
+	fiwareHeaderParams
+	limit          int
+	offset         int
+	orderBy        []string
+	representation model.SimplifiedEntityRepresentation
+	count          bool
 }
 
-func ListEntitiesAddAttribute(attr string) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		return addRetrieveEntityAttribute(&p.retrieveEntityParams, attr)
+func (p *batchQueryParams) optionsValue() string {
+	options := []string{}
+	if p.representation != "" {
+		options = append(options, string(p.representation))
 	}
-}
-
-func ListEntitiesSetOptions(opts model.SimplifiedEntityRepresentation) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		return setRetrieveEntityOptions(&p.retrieveEntityParams, opts)
+	if p.count {
+		options = append(options, string(model.CountRepresentation))
 	}
+	return strings.Join(options, ",")
 }
 
-func ListEntitiesSetLimit(limit int) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
+type BatchQueryParamFunc func(params *batchQueryParams) error
+
+func BatchQuerySetLimit(limit int) BatchQueryParamFunc {
+	return func(p *batchQueryParams) error {
 		if limit <= 0 {
 			return fmt.Errorf("limit cannot be less than or equal 0")
 		}
@@ -487,8 +917,8 @@ func ListEntitiesSetLimit(limit int) ListEntitiesParamFunc {
 	}
 }
 
-func ListEntitiesSetOffset(offset int) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
+func BatchQuerySetOffset(offset int) BatchQueryParamFunc {
+	return func(p *batchQueryParams) error {
 		if offset < 0 {
 			return fmt.Errorf("offset cannot be less than 0")
 		}
@@ -497,8 +927,8 @@ func ListEntitiesSetOffset(offset int) ListEntitiesParamFunc {
 	}
 }
 
-func ListEntitiesAddOrderBy(attr string, ascending bool) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
+func BatchQueryAddOrderBy(attr string, ascending bool) BatchQueryParamFunc {
+	return func(p *batchQueryParams) error {
 		if !model.IsValidFieldSyntax(attr) {
 			return fmt.Errorf("'%s' is not a valid attribute name", attr)
 		}
@@ -512,346 +942,2258 @@ func ListEntitiesAddOrderBy(attr string, ascending bool) ListEntitiesParamFunc {
 	}
 }
 
-func ListEntitiesAddCoord(latitude float64, longitude float64) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		p.coords = append(p.coords, fmt.Sprintf("%v,%v", latitude, longitude))
+func BatchQuerySetFiwareService(fiwareService string) BatchQueryParamFunc {
+	return func(p *batchQueryParams) error {
+		p.fiwareService = fiwareService
 		return nil
 	}
 }
 
-func ListEntitiesSetGeometry(slfGeometry model.SimpleLocationFormatGeometry) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		p.geometry = string(slfGeometry)
+func BatchQuerySetFiwareServicePath(fiwareServicePath string) BatchQueryParamFunc {
+	return func(p *batchQueryParams) error {
+		p.fiwareServicePath = fiwareServicePath
 		return nil
 	}
 }
 
-func ListEntitiesSetGeoRel(georel model.GeospatialRelationship, modifiers ...model.GeorelModifier) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		var s []string
-		s = append(s, string(georel))
-		for _, m := range modifiers {
-			s = append(s, string(m))
-		}
-		p.georel = strings.Join(s, ";")
-		return nil
+// BatchQuerySetFiwareServicePaths queries several service paths at once.
+func BatchQuerySetFiwareServicePaths(fiwareServicePaths []string) BatchQueryParamFunc {
+	return func(p *batchQueryParams) error {
+		return p.setFiwareServicePaths(fiwareServicePaths)
 	}
 }
 
-func ListEntitiesAddQueryStatement(statement model.SimpleQueryStatement) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		p.q = append(p.q, string(statement))
+// BatchQuerySetOptions sets an option of the batch query: keyValues or values
+// for a simplified representation of the entities, count for the total number
+// of matching entities (see BatchQueryWithCount).
+// It can be used more than once, to combine count with a representation.
+func BatchQuerySetOptions(opts model.SimplifiedEntityRepresentation) BatchQueryParamFunc {
+	return func(p *batchQueryParams) error {
+		switch opts {
+		case model.KeyValuesRepresentation, model.ValuesRepresentation:
+			if p.representation != "" && p.representation != opts {
+				return fmt.Errorf("Cannot use '%s' and '%s' options together", p.representation, opts)
+			}
+			p.representation = opts
+		case model.CountRepresentation:
+			p.count = true
+		default:
+			return fmt.Errorf("Invalid value for options param: '%s', expected one of '%s', '%s' or '%s'",
+				opts, model.KeyValuesRepresentation, model.ValuesRepresentation, model.CountRepresentation)
+		}
 		return nil
 	}
 }
 
-func ListEntitiesSetFiwareService(fiwareService string) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		p.fiwareService = fiwareService
-		return nil
-	}
+// RetrieveAPIResources gives url link values for retrieving resources.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/api-entry-point/retrieve-api-resources/retrieve-api-resources
+func (c *NgsiV2Client) RetrieveAPIResources() (*model.APIResources, error) {
+	return c.RetrieveAPIResourcesWithContext(context.Background())
 }
 
-func ListEntitiesSetFiwareServicePath(fiwareServicePath string) ListEntitiesParamFunc {
-	return func(p *listEntitiesParams) error {
-		p.fiwareServicePath = fiwareServicePath
-		return nil
+// RetrieveAPIResourcesWithContext is like RetrieveAPIResources, but uses ctx for the requests.
+func (c *NgsiV2Client) RetrieveAPIResourcesWithContext(ctx context.Context) (*model.APIResources, error) {
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s%s", c.url, c.basePath), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request for API resources: %w", err)
+	}
+	resp, err := c.do("RetrieveAPIResources", req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve API resources: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
+	} else {
+		ret := new(model.APIResources)
+		if err := json.Unmarshal(bodyBytes, ret); err != nil {
+			return nil, fmt.Errorf("Error reading API resources response: %w", err)
+		} else {
+			return ret, nil
+		}
 	}
 }
 
-// ListEntities retrieves a list of entities that match all criteria.
-// See: https://orioncontextbroker.docs.apiary.io/#reference/entities/list-entities
-func (c *NgsiV2Client) ListEntities(options ...ListEntitiesParamFunc) ([]*model.Entity, error) {
-	params := new(listEntitiesParams)
+// GetVersion retrieves the version information of the Orion context broker.
+// It returns ErrVersionUnavailable if the broker does not expose it.
+// See: https://fiware-orion.readthedocs.io/en/master/user/walkthrough_apiv2/index.html#checking-the-orion-version
+func (c *NgsiV2Client) GetVersion() (*model.OrionVersion, error) {
+	return c.GetVersionWithContext(context.Background())
+}
 
-	// apply the options
-	for _, option := range options {
-		if err := option(params); err != nil {
-			return nil, err
-		}
+// GetVersionWithContext is like GetVersion, but uses ctx for the requests.
+func (c *NgsiV2Client) GetVersionWithContext(ctx context.Context) (*model.OrionVersion, error) {
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s/version", c.url), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request for version: %w", err)
 	}
-
-	if params.id != "" && params.idPattern != "" {
-		return nil, fmt.Errorf("Cannot use 'id' and 'idPattern' together")
-	}
-
-	eUrl, err := c.getEntitiesUrl()
-	if err != nil {
-		return nil, err
-	}
-
-	req, err := c.newRequest("GET", fmt.Sprintf("%s", eUrl), nil, params.headers()...)
+	resp, err := c.do("GetVersion", req)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create request for API resources: %+v", err)
+		return nil, fmt.Errorf("Could not retrieve version: %w", err)
 	}
-	q := req.URL.Query()
-	if params.id != "" {
-		q.Add("id", params.id)
-	}
-	if params.idPattern != "" {
-		q.Add("idPattern", params.idPattern)
+	defer resp.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrVersionUnavailable
 	}
-	if params.entityType != "" {
-		q.Add("type", params.entityType)
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
 	}
-	attributes := strings.Join(params.attrs, ",")
-	if attributes != "" {
-		q.Add("attrs", attributes)
+	var payload struct {
+		Orion *model.OrionVersion `json:"orion"`
 	}
-	qExpr := strings.Join(params.q, ";")
-	if qExpr != "" {
-		q.Add("q", qExpr)
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		return nil, fmt.Errorf("Error reading version response: %w", err)
 	}
-	if params.limit > 0 {
-		q.Add("limit", strconv.Itoa(params.limit))
+	if payload.Orion == nil {
+		return nil, ErrVersionUnavailable
 	}
-	if params.offset > 0 {
-		q.Add("offset", strconv.Itoa(params.offset))
+	return payload.Orion, nil
+}
+
+type getIntoParams struct {
+	fiwareHeaderParams
+	query url.Values
+}
+
+type GetIntoParamFunc func(*getIntoParams) error
+
+func GetIntoSetFiwareService(fiwareService string) GetIntoParamFunc {
+	return func(p *getIntoParams) error {
+		p.fiwareService = fiwareService
+		return nil
 	}
-	if params.georel != "" {
-		q.Add("georel", params.georel)
+}
+
+func GetIntoSetFiwareServicePath(fiwareServicePath string) GetIntoParamFunc {
+	return func(p *getIntoParams) error {
+		p.fiwareServicePath = fiwareServicePath
+		return nil
 	}
-	if params.geometry != "" {
-		q.Add("geometry", params.geometry)
+}
+
+// GetIntoAddQuery adds a query parameter to the request.
+func GetIntoAddQuery(key, value string) GetIntoParamFunc {
+	return func(p *getIntoParams) error {
+		if key == "" {
+			return fmt.Errorf("Query parameter name cannot be empty")
+		}
+		p.query.Add(key, value)
+		return nil
 	}
-	coordsStr := strings.Join(params.coords, ";")
-	if coordsStr != "" {
-		q.Add("coords", coordsStr)
+}
+
+// GetInto is a low level call that GETs {url}{path} from the context broker
+// and decodes the JSON response into out, e.g. for endpoints not modeled
+// by this client, like the admin ones or vendor extensions.
+// No check is made on the path, and the response is decoded as it is.
+func (c *NgsiV2Client) GetInto(path string, out interface{}, options ...GetIntoParamFunc) error {
+	return c.GetIntoWithContext(context.Background(), path, out, options...)
+}
+
+// GetIntoWithContext is like GetInto, but uses ctx for the requests.
+func (c *NgsiV2Client) GetIntoWithContext(ctx context.Context, path string, out interface{}, options ...GetIntoParamFunc) error {
+	params := &getIntoParams{query: url.Values{}}
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return err
+		}
 	}
-	orderByStr := strings.Join(params.orderBy, ",")
-	if orderByStr != "" {
-		q.Add("orderBy", orderByStr)
+
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s%s", c.url, path), nil, params.headers()...)
+	if err != nil {
+		return fmt.Errorf("Could not create request for '%s': %w", path, err)
 	}
-	if params.options != "" {
-		q.Add("options", string(params.options))
+	q := req.URL.Query()
+	for key, values := range params.query {
+		for _, value := range values {
+			q.Add(key, value)
+		}
 	}
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := c.c.Do(req)
+	resp, err := c.do("GetInto", req)
 	if err != nil {
-		return nil, fmt.Errorf("Could not list entities: %+v", err)
+		return fmt.Errorf("Could not retrieve '%s': %w", path, err)
 	}
 	defer resp.Body.Close()
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
+		return newAPIError(resp.StatusCode, bodyBytes)
+	}
+	if err := json.Unmarshal(bodyBytes, out); err != nil {
+		return fmt.Errorf("Error reading '%s' response: %w", path, err)
+	}
+	return nil
+}
+
+// standardAPIResources are the API resources exposed by Orion.
+var standardAPIResources = model.APIResources{
+	EntitiesUrl:      "/v2/entities",
+	TypesUrl:         "/v2/types",
+	SubscriptionsUrl: "/v2/subscriptions",
+	RegistrationsUrl: "/v2/registrations",
+}
+
+// PreloadAPIResources retrieves the API resources, which the client needs for
+// building most of the URLs, unless already done; otherwise they are retrieved
+// by the first request needing them.
+// It is useful at startup, for checking the connectivity to the context broker.
+// A failed retrieval is not cached, so it can be retried.
+func (c *NgsiV2Client) PreloadAPIResources() error {
+	return c.PreloadAPIResourcesWithContext(context.Background())
+}
+
+// PreloadAPIResourcesWithContext is like PreloadAPIResources, but uses ctx for the requests.
+func (c *NgsiV2Client) PreloadAPIResourcesWithContext(ctx context.Context) error {
+	_, err := c.apiResources(ctx)
+	return err
+}
+
+// RefreshAPIResources retrieves the API resources again, replacing the ones
+// in use by the client. On failure, the ones in use are kept.
+func (c *NgsiV2Client) RefreshAPIResources() error {
+	return c.RefreshAPIResourcesWithContext(context.Background())
+}
+
+// RefreshAPIResourcesWithContext is like RefreshAPIResources, but uses ctx for the requests.
+func (c *NgsiV2Client) RefreshAPIResourcesWithContext(ctx context.Context) error {
+	apiRes, err := c.RetrieveAPIResourcesWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	c.apiResMu.Lock()
+	c.apiRes = c.rebaseAPIResources(apiRes)
+	c.apiResMu.Unlock()
+	return nil
+}
+
+// apiResources returns the API resources, retrieving them on first use.
+// With a request interceptor, which may not let requests through, the standard
+// resources are assumed instead, so that only the requests of the client methods
+// are intercepted.
+// The lock is not held while retrieving, so that a slow first request doesn't block
+// the others: concurrent first uses may retrieve the resources more than once.
+func (c *NgsiV2Client) apiResources(ctx context.Context) (*model.APIResources, error) {
+	c.apiResMu.Lock()
+	apiRes := c.apiRes
+	c.apiResMu.Unlock()
+	if apiRes != nil {
+		return apiRes, nil
+	}
+
+	if c.interceptor != nil {
+		res := standardAPIResources
+		apiRes = &res
 	} else {
-		var ret []*model.Entity
-		if err := json.Unmarshal(bodyBytes, &ret); err != nil {
-			return nil, fmt.Errorf("Error reading list entities response: %+v", err)
-		} else {
-			return ret, nil
+		retrieved, err := c.RetrieveAPIResourcesWithContext(ctx)
+		if err != nil {
+			return nil, err
 		}
+		apiRes = retrieved
 	}
+	apiRes = c.rebaseAPIResources(apiRes)
+	c.apiResMu.Lock()
+	defer c.apiResMu.Unlock()
+	if c.apiRes == nil {
+		c.apiRes = apiRes
+	}
+	return c.apiRes, nil
 }
 
-// CountEntities returns how many entities are compliant with parameters
-func (c *NgsiV2Client) CountEntities(options ...ListEntitiesParamFunc) (int, error) {
-	params := new(listEntitiesParams)
-
-	// apply the options
-	for _, option := range options {
-		if err := option(params); err != nil {
-			return 0, err
+// rebaseAPIResources moves the resource paths from "/v2" to the base path, if set.
+func (c *NgsiV2Client) rebaseAPIResources(apiRes *model.APIResources) *model.APIResources {
+	if c.basePath == defaultBasePath {
+		return apiRes
+	}
+	rebase := func(path string) string {
+		if strings.HasPrefix(path, defaultBasePath+"/") {
+			return c.basePath + strings.TrimPrefix(path, defaultBasePath)
 		}
+		return path
 	}
+	apiRes.EntitiesUrl = rebase(apiRes.EntitiesUrl)
+	apiRes.TypesUrl = rebase(apiRes.TypesUrl)
+	apiRes.SubscriptionsUrl = rebase(apiRes.SubscriptionsUrl)
+	apiRes.RegistrationsUrl = rebase(apiRes.RegistrationsUrl)
+	return apiRes
+}
 
-	if params.id != "" && params.idPattern != "" {
-		return 0, fmt.Errorf("Cannot use 'id' and 'idPattern' together")
+// locationId returns the id in the Location of a resource created under resourceUrl.
+func (c *NgsiV2Client) locationId(location string, resourceUrl string) string {
+	if id := strings.TrimPrefix(location, resourceUrl+"/"); id != location {
+		return id
 	}
+	// behind a proxy, the context broker may return the path without the base path prefix
+	return strings.TrimPrefix(location, defaultBasePath+strings.TrimPrefix(resourceUrl, c.basePath)+"/")
+}
+
+// opUrl returns the URL of the op batch operation.
+func (c *NgsiV2Client) opUrl(op string) string {
+	return fmt.Sprintf("%s%s/op/%s", c.url, c.basePath, op)
+}
 
-	eUrl, err := c.getEntitiesUrl()
+func (c *NgsiV2Client) getEntitiesUrl(ctx context.Context) (string, error) {
+	apiRes, err := c.apiResources(ctx)
 	if err != nil {
-		return 0, err
+		return "", err
 	}
+	return fmt.Sprintf("%s%s", c.url, apiRes.EntitiesUrl), nil
+}
 
-	req, err := c.newRequest("GET", fmt.Sprintf("%s", eUrl), nil, params.headers()...)
+func (c *NgsiV2Client) getSubscriptionsUrl(ctx context.Context) (string, error) {
+	apiRes, err := c.apiResources(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("Could not create request for API resources: %+v", err)
+		return "", err
 	}
-	q := req.URL.Query()
-	if params.id != "" {
-		q.Add("id", params.id)
+	return fmt.Sprintf("%s%s", c.url, apiRes.SubscriptionsUrl), nil
+}
+
+func (c *NgsiV2Client) getTypesUrl(ctx context.Context) (string, error) {
+	apiRes, err := c.apiResources(ctx)
+	if err != nil {
+		return "", err
 	}
-	if params.idPattern != "" {
-		q.Add("idPattern", params.idPattern)
+	return fmt.Sprintf("%s%s", c.url, apiRes.TypesUrl), nil
+}
+
+func (c *NgsiV2Client) getRegistrationsUrl(ctx context.Context) (string, error) {
+	apiRes, err := c.apiResources(ctx)
+	if err != nil {
+		return "", err
 	}
-	if params.entityType != "" {
-		q.Add("type", params.entityType)
+	return fmt.Sprintf("%s%s", c.url, apiRes.RegistrationsUrl), nil
+}
+
+type fiwareHeaderParams struct {
+	fiwareService     string
+	fiwareServicePath string
+}
+
+// maxServicePaths is the maximum number of service paths Orion accepts in a query.
+const maxServicePaths = 10
+
+// setFiwareServicePaths sets a comma separated list of service paths,
+// only supported by the query operations.
+func (f *fiwareHeaderParams) setFiwareServicePaths(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("At least one service path is required")
 	}
-	attributes := strings.Join(params.attrs, ",")
+	if len(paths) > maxServicePaths {
+		return fmt.Errorf("At most %d service paths can be queried at once, got %d", maxServicePaths, len(paths))
+	}
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("Service path '%s' must begin with '/'", path)
+		}
+		if strings.Contains(path, ",") {
+			return fmt.Errorf("Service path '%s' cannot contain ','", path)
+		}
+	}
+	f.fiwareServicePath = strings.Join(paths, ",")
+	return nil
+}
+
+func (f fiwareHeaderParams) headers() []additionalHeader {
+	var ret []additionalHeader
+	if f.fiwareService != "" {
+		ret = append(ret, additionalHeader{"Fiware-Service", f.fiwareService})
+	}
+	if f.fiwareServicePath != "" {
+		ret = append(ret, additionalHeader{"Fiware-ServicePath", f.fiwareServicePath})
+	}
+	return ret
+}
+
+type retrieveEntityParams struct {
+	fiwareHeaderParams
+	id             string
+	entityType     string
+	attrs          []string
+	options        model.SimplifiedEntityRepresentation
+	skipForwarding bool
+}
+
+type RetrieveEntityParamFunc func(*retrieveEntityParams) error
+
+// addQuery adds type, attrs and options query params for retrieving a single entity.
+func (p *retrieveEntityParams) addQuery(q url.Values) {
+	if p.entityType != "" {
+		q.Add("type", p.entityType)
+	}
+	attributes := strings.Join(p.attrs, ",")
 	if attributes != "" {
 		q.Add("attrs", attributes)
 	}
-	qExpr := strings.Join(params.q, ";")
-	if qExpr != "" {
-		q.Add("q", qExpr)
+	if opts := p.optionsValue(false); opts != "" {
+		q.Add("options", opts)
 	}
+}
 
-	q.Add("limit", strconv.Itoa(1))
+// skipForwardingOption makes the context broker answer with local data only,
+// without forwarding the query to the registered context providers.
+const skipForwardingOption = "skipForwarding"
 
-	if params.offset > 0 {
-		q.Add("offset", strconv.Itoa(params.offset))
-	}
-	if params.georel != "" {
-		q.Add("georel", params.georel)
+// optionsValue returns the comma separated value for the options query param:
+// the representation, then count if requested, then skipForwarding.
+func (p *retrieveEntityParams) optionsValue(count bool) string {
+	var opts []string
+	if p.options != "" {
+		opts = append(opts, string(p.options))
 	}
-	if params.geometry != "" {
-		q.Add("geometry", params.geometry)
+	if count {
+		opts = append(opts, string(model.CountRepresentation))
 	}
-	coordsStr := strings.Join(params.coords, ";")
-	if coordsStr != "" {
-		q.Add("coords", coordsStr)
+	if p.skipForwarding {
+		opts = append(opts, skipForwardingOption)
 	}
+	return strings.Join(opts, ",")
+}
 
-	q.Add("options", string(model.CountRepresentation))
-
-	req.URL.RawQuery = q.Encode()
-	resp, err := c.c.Do(req)
-	if err != nil {
-		return 0, fmt.Errorf("Could not list entities: %+v", err)
+func setRetrieveEntityType(p *retrieveEntityParams, entityType string) error {
+	if !model.IsValidFieldSyntax(entityType) {
+		return fmt.Errorf("'%s' is not a valid entity type name", entityType)
 	}
-	defer resp.Body.Close()
+	p.entityType = entityType
+	return nil
+}
 
-	bodyBytes, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
+func RetrieveEntitySetType(entityType string) RetrieveEntityParamFunc {
+	return func(p *retrieveEntityParams) error {
+		return setRetrieveEntityType(p, entityType)
 	}
+}
 
-	totalCount := resp.Header.Get("Fiware-Total-Count")
-	if totalCount == "" {
-		return 0, errors.New("Fiware-Total-Count not found in header")
+func addRetrieveEntityAttribute(p *retrieveEntityParams, attr string) error {
+	if attr != model.AllAttributesName && !model.IsValidFieldSyntax(attr) {
+		return fmt.Errorf("'%s' is not a valid attribute name", attr)
 	}
-	cnt, err := strconv.Atoi(totalCount)
-	if err != nil {
-		return 0, err
+	p.attrs = append(p.attrs, attr)
+	return nil
+}
+
+func addRetrieveEntityBuiltinAttribute(p *retrieveEntityParams, name string) error {
+	if !model.IsBuiltinAttributeName(name) {
+		return fmt.Errorf("'%s' is not a builtin attribute name", name)
 	}
-	return cnt, nil
+	p.attrs = append(p.attrs, name)
+	return nil
+}
 
+// RetrieveEntityAddAttribute adds an attribute to retrieve; use model.AllAttributesName
+// for all the regular attributes.
+func RetrieveEntityAddAttribute(attr string) RetrieveEntityParamFunc {
+	return func(p *retrieveEntityParams) error {
+		return addRetrieveEntityAttribute(p, attr)
+	}
 }
 
-type createEntityOption string
+// RetrieveEntityAddBuiltinAttribute adds a builtin attribute, like dateModified, to retrieve.
+// Builtin attributes are returned only when requested: add model.AllAttributesName
+// too for getting them along with all the regular attributes.
+func RetrieveEntityAddBuiltinAttribute(name string) RetrieveEntityParamFunc {
+	return func(p *retrieveEntityParams) error {
+		return addRetrieveEntityBuiltinAttribute(p, name)
+	}
+}
 
-const (
-	keyValuesCreateEntityOption createEntityOption = "keyValues"
-	upsertCreateEntityOption    createEntityOption = "upsert"
-)
+func setRetrieveEntityOptions(p *retrieveEntityParams, opts model.SimplifiedEntityRepresentation) error {
+	if opts != "" {
+		return fmt.Errorf("Simplified entity representation is not supported yet!")
+	}
 
-type createEntityParams struct {
-	fiwareHeaderParams
-	options createEntityOption
+	return nil
 }
 
-type CreateEntityParamFunc func(*createEntityParams) error
-
-func CreateEntitySetOptionsUpsert() CreateEntityParamFunc {
-	return func(p *createEntityParams) error {
-		p.options = upsertCreateEntityOption
-		return nil
+func RetrieveEntitySetOptions(opts model.SimplifiedEntityRepresentation) RetrieveEntityParamFunc {
+	return func(p *retrieveEntityParams) error {
+		return setRetrieveEntityOptions(p, opts)
 	}
 }
 
-func CreateEntitySetOptionsKeyValues() CreateEntityParamFunc {
-	return func(p *createEntityParams) error {
-		p.options = keyValuesCreateEntityOption
+// RetrieveEntitySetSkipForwarding makes the context broker answer with its local
+// data only, without forwarding the query to the registered context providers.
+func RetrieveEntitySetSkipForwarding() RetrieveEntityParamFunc {
+	return func(p *retrieveEntityParams) error {
+		p.skipForwarding = true
 		return nil
 	}
 }
 
-func CreateEntitySetFiwareService(fiwareService string) CreateEntityParamFunc {
-	return func(p *createEntityParams) error {
+func RetrieveEntitySetFiwareService(fiwareService string) RetrieveEntityParamFunc {
+	return func(p *retrieveEntityParams) error {
 		p.fiwareService = fiwareService
 		return nil
 	}
 }
 
-func CreateEntitySetFiwareServicePath(fiwareServicePath string) CreateEntityParamFunc {
-	return func(p *createEntityParams) error {
+func RetrieveEntitySetFiwareServicePath(fiwareServicePath string) RetrieveEntityParamFunc {
+	return func(p *retrieveEntityParams) error {
 		p.fiwareServicePath = fiwareServicePath
 		return nil
 	}
-}
+}
+
+// RetrieveEntity retrieves an object representing the entity identified by the given id.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/entities/entity-by-id/retrieve-entity
+func (c *NgsiV2Client) RetrieveEntity(id string, options ...RetrieveEntityParamFunc) (*model.Entity, error) {
+	return c.RetrieveEntityWithContext(context.Background(), id, options...)
+}
+
+// RetrieveEntityWithContext is like RetrieveEntity, but uses ctx for the requests.
+func (c *NgsiV2Client) RetrieveEntityWithContext(ctx context.Context, id string, options ...RetrieveEntityParamFunc) (*model.Entity, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Cannot retrieve entity with empty 'id'")
+	}
+
+	params := new(retrieveEntityParams)
+	params.id = id
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return nil, err
+		}
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s/%s", eUrl, url.PathEscape(params.id)), nil, params.headers()...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request for API resources: %w", err)
+	}
+	q := req.URL.Query()
+	params.addQuery(q)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.do("RetrieveEntity", req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve entity: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusConflict {
+		return nil, fmt.Errorf("Conflict (id non-unique?): %w", newAPIError(resp.StatusCode, bodyBytes))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
+	} else {
+		ret := new(model.Entity)
+		if err := json.Unmarshal(bodyBytes, ret); err != nil {
+			return nil, fmt.Errorf("Error reading retrieve entity response: %w", err)
+		} else if err := c.applyEntityDecodeHook(ret); err != nil {
+			return nil, err
+		} else {
+			return ret, nil
+		}
+	}
+}
+
+// EntityExists tells whether the entity identified by the given id exists.
+// Only the dateCreated attribute is requested, and the response is not decoded.
+func (c *NgsiV2Client) EntityExists(id string, options ...RetrieveEntityParamFunc) (bool, error) {
+	return c.EntityExistsWithContext(context.Background(), id, options...)
+}
+
+// EntityExistsWithContext is like EntityExists, but uses ctx for the requests.
+func (c *NgsiV2Client) EntityExistsWithContext(ctx context.Context, id string, options ...RetrieveEntityParamFunc) (bool, error) {
+	if id == "" {
+		return false, fmt.Errorf("Cannot check entity with empty 'id'")
+	}
+
+	params := new(retrieveEntityParams)
+	params.id = id
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return false, err
+		}
+	}
+	params.attrs = []string{model.DateCreatedAttributeName}
+	params.options = model.KeyValuesRepresentation
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s/%s", eUrl, url.PathEscape(params.id)), nil, params.headers()...)
+	if err != nil {
+		return false, fmt.Errorf("Could not create request for entity existence: %w", err)
+	}
+	q := req.URL.Query()
+	params.addQuery(q)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.do("EntityExists", req)
+	if err != nil {
+		return false, fmt.Errorf("Could not check entity existence: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		io.Copy(ioutil.Discard, resp.Body)
+		return true, nil
+	case http.StatusNotFound:
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	default:
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return false, newAPIError(resp.StatusCode, bodyBytes)
+	}
+}
+
+// RetrieveEntityAnyType retrieves the entity identified by the given id, trying each of the
+// given types in order and returning the first match. It is useful when entity ids
+// are not unique across types.
+func (c *NgsiV2Client) RetrieveEntityAnyType(id string, types []string, options ...RetrieveEntityParamFunc) (*model.Entity, error) {
+	return c.RetrieveEntityAnyTypeWithContext(context.Background(), id, types, options...)
+}
+
+// RetrieveEntityAnyTypeWithContext is like RetrieveEntityAnyType, but uses ctx for the requests.
+func (c *NgsiV2Client) RetrieveEntityAnyTypeWithContext(ctx context.Context, id string, types []string, options ...RetrieveEntityParamFunc) (*model.Entity, error) {
+	if len(types) == 0 {
+		return nil, fmt.Errorf("Cannot retrieve entity without candidate types")
+	}
+	for _, entityType := range types {
+		// full slice expression, so the caller's options are never overwritten
+		opts := append(options[:len(options):len(options)], RetrieveEntitySetType(entityType))
+		e, err := c.RetrieveEntityWithContext(ctx, id, opts...)
+		if err == nil {
+			return e, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("Entity '%s' not found with any of the types %v: %w", id, types, ErrNotFound)
+}
+
+// RetrieveEntityAttributes retrieves the attributes of the entity identified by the given id,
+// without the id and type envelope.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/entities/entity-attributes/retrieve-entity-attributes
+func (c *NgsiV2Client) RetrieveEntityAttributes(id string, options ...RetrieveEntityParamFunc) (map[string]*model.Attribute, error) {
+	return c.RetrieveEntityAttributesWithContext(context.Background(), id, options...)
+}
+
+// RetrieveEntityAttributesWithContext is like RetrieveEntityAttributes, but uses ctx for the requests.
+func (c *NgsiV2Client) RetrieveEntityAttributesWithContext(ctx context.Context, id string, options ...RetrieveEntityParamFunc) (map[string]*model.Attribute, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Cannot retrieve attributes of entity with empty 'id'")
+	}
+
+	params := new(retrieveEntityParams)
+	params.id = id
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return nil, err
+		}
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s/%s/attrs", eUrl, url.PathEscape(params.id)), nil, params.headers()...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request for entity attributes: %w", err)
+	}
+	q := req.URL.Query()
+	params.addQuery(q)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.do("RetrieveEntityAttributes", req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve entity attributes: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
+	}
+	// the attributes object is decoded as an entity without id and type,
+	// so that the attribute values get the same conversions
+	attrs := new(model.Entity)
+	if err := json.Unmarshal(bodyBytes, attrs); err != nil {
+		return nil, fmt.Errorf("Error reading retrieve entity attributes response: %w", err)
+	}
+	return attrs.Attributes, nil
+}
+
+// GetEntityAttribute retrieves the attribute named attrName of the entity identified by the given id.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/attributes/attribute-by-entity-id/get-attribute-data
+func (c *NgsiV2Client) GetEntityAttribute(id, attrName string, options ...RetrieveEntityParamFunc) (*model.Attribute, error) {
+	return c.GetEntityAttributeWithContext(context.Background(), id, attrName, options...)
+}
+
+// GetEntityAttributeWithContext is like GetEntityAttribute, but uses ctx for the requests.
+func (c *NgsiV2Client) GetEntityAttributeWithContext(ctx context.Context, id, attrName string, options ...RetrieveEntityParamFunc) (*model.Attribute, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Cannot retrieve attribute of entity with empty 'id'")
+	}
+	if !model.IsValidFieldSyntax(attrName) {
+		return nil, fmt.Errorf("'%s' is not a valid attribute name", attrName)
+	}
+
+	params := new(retrieveEntityParams)
+	params.id = id
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return nil, err
+		}
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s/%s/attrs/%s", eUrl, url.PathEscape(params.id), url.PathEscape(attrName)), nil, params.headers()...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request for entity attribute: %w", err)
+	}
+	q := req.URL.Query()
+	params.addQuery(q)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.do("GetEntityAttribute", req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve entity attribute: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("Attribute '%s' of entity '%s' not found: %w", attrName, id, newAPIError(resp.StatusCode, bodyBytes))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
+	}
+	ret := new(model.Attribute)
+	if err := json.Unmarshal(bodyBytes, ret); err != nil {
+		return nil, fmt.Errorf("Error reading entity attribute response: %w", err)
+	}
+	return ret, nil
+}
+
+// GetEntityAttributeValue retrieves only the value of the attribute named attrName of the entity
+// identified by the given id. The value is decoded from JSON, so numbers are float64,
+// objects are map[string]interface{} and arrays are []interface{}.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/attribute-value/attribute-value-by-entity-id/get-attribute-value
+func (c *NgsiV2Client) GetEntityAttributeValue(id, attrName string, options ...RetrieveEntityParamFunc) (interface{}, error) {
+	return c.GetEntityAttributeValueWithContext(context.Background(), id, attrName, options...)
+}
+
+// GetEntityAttributeValueWithContext is like GetEntityAttributeValue, but uses ctx for the requests.
+func (c *NgsiV2Client) GetEntityAttributeValueWithContext(ctx context.Context, id, attrName string, options ...RetrieveEntityParamFunc) (interface{}, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Cannot retrieve attribute value of entity with empty 'id'")
+	}
+	if !model.IsValidFieldSyntax(attrName) {
+		return nil, fmt.Errorf("'%s' is not a valid attribute name", attrName)
+	}
+
+	params := new(retrieveEntityParams)
+	params.id = id
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return nil, err
+		}
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s/%s/attrs/%s/value", eUrl, url.PathEscape(params.id), url.PathEscape(attrName)), nil, params.headers()...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request for entity attribute value: %w", err)
+	}
+	q := req.URL.Query()
+	params.addQuery(q)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.do("GetEntityAttributeValue", req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve entity attribute value: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
+	}
+	var ret interface{}
+	if err := json.Unmarshal(bodyBytes, &ret); err != nil {
+		// some brokers return plain text for string values
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+			return string(bodyBytes), nil
+		}
+		return nil, fmt.Errorf("Error reading entity attribute value response: %w", err)
+	}
+	return ret, nil
+}
+
+type listEntitiesParams struct {
+	retrieveEntityParams
+	idPattern string
+	q         []string
+	georel    string
+	geometry  string
+	coords    []string
+	limit     int
+	offset    int
+	orderBy   []string
+}
+
+type ListEntitiesParamFunc func(*listEntitiesParams) error
+
+func ListEntitiesSetId(id string) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		if !model.IsValidFieldSyntax(id) {
+			return fmt.Errorf("'%s' is not a valid entity id", id)
+		}
+		p.id = id
+		return nil
+
+	}
+}
+
+func ListEntitiesSetIds(ids []string) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		for _, id := range ids {
+			if !model.IsValidFieldSyntax(id) {
+				return fmt.Errorf("'%s' is not a valid entity id", id)
+			}
+		}
+		p.id = strings.Join(ids, ",")
+		return nil
+
+	}
+}
+
+func ListEntitiesSetIdPattern(idPattern string) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		if _, err := regexp.Compile(idPattern); err != nil {
+			return err
+		}
+		p.idPattern = idPattern
+		return nil
+	}
+}
+
+func ListEntitiesSetType(entityType string) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		return setRetrieveEntityType(&p.retrieveEntityParams, entityType)
+	}
+}
+
+// ListEntitiesSetTypes restricts the list to the entities of any of the given types.
+func ListEntitiesSetTypes(types []string) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		if len(types) == 0 {
+			return fmt.Errorf("At least one entity type is required")
+		}
+		for _, entityType := range types {
+			if !model.IsValidFieldSyntax(entityType) {
+				return fmt.Errorf("'%s' is not a valid entity type name", entityType)
+			}
+		}
+		p.entityType = strings.Join(types, ",")
+		return nil
+	}
+}
+
+func ListEntitiesAddAttribute(attr string) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		return addRetrieveEntityAttribute(&p.retrieveEntityParams, attr)
+	}
+}
+
+// ListEntitiesAddBuiltinAttribute is like RetrieveEntityAddBuiltinAttribute, for listing entities.
+func ListEntitiesAddBuiltinAttribute(name string) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		return addRetrieveEntityBuiltinAttribute(&p.retrieveEntityParams, name)
+	}
+}
+
+func ListEntitiesSetOptions(opts model.SimplifiedEntityRepresentation) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		return setRetrieveEntityOptions(&p.retrieveEntityParams, opts)
+	}
+}
+
+// ListEntitiesSetSkipForwarding is like RetrieveEntitySetSkipForwarding, for listing
+// and counting entities.
+func ListEntitiesSetSkipForwarding() ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		p.skipForwarding = true
+		return nil
+	}
+}
+
+func ListEntitiesSetLimit(limit int) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		if limit <= 0 {
+			return fmt.Errorf("limit cannot be less than or equal 0")
+		}
+		p.limit = limit
+		return nil
+	}
+}
+
+func ListEntitiesSetOffset(offset int) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		if offset < 0 {
+			return fmt.Errorf("offset cannot be less than 0")
+		}
+		p.offset = offset
+		return nil
+	}
+}
+
+func ListEntitiesAddOrderBy(attr string, ascending bool) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		if !model.IsValidFieldSyntax(attr) {
+			return fmt.Errorf("'%s' is not a valid attribute name", attr)
+		}
+
+		if ascending {
+			p.orderBy = append(p.orderBy, attr)
+		} else {
+			p.orderBy = append(p.orderBy, "!"+attr)
+		}
+		return nil
+	}
+}
+
+func (p *listEntitiesParams) ordersByDistance() bool {
+	for _, o := range p.orderBy {
+		if strings.TrimPrefix(o, "!") == GeoDistanceOrderBy {
+			return true
+		}
+	}
+	return false
+}
+
+// GeoDistanceOrderBy is the orderBy token sorting the entities by their distance
+// from the reference point of a near georel query.
+const GeoDistanceOrderBy = "geo:distance"
+
+// ListEntitiesOrderByDistance sorts the entities by their distance from the
+// reference point, nearest first when ascending. It requires a near georel,
+// see ListEntitiesSetGeoRel.
+func ListEntitiesOrderByDistance(ascending bool) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		if ascending {
+			p.orderBy = append(p.orderBy, GeoDistanceOrderBy)
+		} else {
+			p.orderBy = append(p.orderBy, "!"+GeoDistanceOrderBy)
+		}
+		return nil
+	}
+}
+
+func ListEntitiesAddCoord(latitude float64, longitude float64) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		p.coords = append(p.coords, fmt.Sprintf("%v,%v", latitude, longitude))
+		return nil
+	}
+}
+
+// ListEntitiesSetPolygonCoords sets a polygon geometry with the given points as coords.
+// The polygon ring must be closed, i.e. the last point equal to the first one,
+// and have at least three vertices.
+func ListEntitiesSetPolygonCoords(points []*model.GeoPoint) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		if len(points) < 4 {
+			return fmt.Errorf("Polygon requires at least 3 vertices and the closing point, got %d points", len(points))
+		}
+		coords := make([]string, len(points))
+		for i, point := range points {
+			if point == nil {
+				return fmt.Errorf("Polygon point %d cannot be nil", i)
+			}
+			if err := point.Validate(); err != nil {
+				return fmt.Errorf("Invalid polygon point %d: %w", i, err)
+			}
+			coords[i] = fmt.Sprintf("%v,%v", point.Latitude, point.Longitude)
+		}
+		if *points[0] != *points[len(points)-1] {
+			return fmt.Errorf("Polygon ring is not closed: first and last points differ")
+		}
+		p.geometry = string(model.SLFPolygon)
+		p.coords = coords
+		return nil
+	}
+}
+
+func ListEntitiesSetGeometry(slfGeometry model.SimpleLocationFormatGeometry) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		p.geometry = string(slfGeometry)
+		return nil
+	}
+}
+
+func ListEntitiesSetGeoRel(georel model.GeospatialRelationship, modifiers ...model.GeorelModifier) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		var s []string
+		s = append(s, string(georel))
+		for _, m := range modifiers {
+			s = append(s, string(m))
+		}
+		p.georel = strings.Join(s, ";")
+		return nil
+	}
+}
+
+func ListEntitiesAddQueryStatement(statement model.SimpleQueryStatement) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		p.q = append(p.q, string(statement))
+		return nil
+	}
+}
+
+func ListEntitiesSetFiwareService(fiwareService string) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		p.fiwareService = fiwareService
+		return nil
+	}
+}
+
+func ListEntitiesSetFiwareServicePath(fiwareServicePath string) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		p.fiwareServicePath = fiwareServicePath
+		return nil
+	}
+}
+
+// ListEntitiesSetFiwareServicePaths queries several service paths at once.
+func ListEntitiesSetFiwareServicePaths(fiwareServicePaths []string) ListEntitiesParamFunc {
+	return func(p *listEntitiesParams) error {
+		return p.setFiwareServicePaths(fiwareServicePaths)
+	}
+}
+
+// ListEntities retrieves a list of entities that match all criteria.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/entities/list-entities
+func (c *NgsiV2Client) ListEntities(options ...ListEntitiesParamFunc) ([]*model.Entity, error) {
+	return c.ListEntitiesWithContext(context.Background(), options...)
+}
+
+// ListEntitiesWithContext is like ListEntities, but uses ctx for the requests.
+func (c *NgsiV2Client) ListEntitiesWithContext(ctx context.Context, options ...ListEntitiesParamFunc) ([]*model.Entity, error) {
+	params := new(listEntitiesParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return nil, err
+		}
+	}
+
+	ret, _, err := c.listEntitiesPage(ctx, params, false)
+	return ret, err
+}
+
+// ListEntitiesWithCount is like ListEntities, but also returns the total number
+// of entities matching the criteria, regardless of limit and offset.
+func (c *NgsiV2Client) ListEntitiesWithCount(options ...ListEntitiesParamFunc) ([]*model.Entity, int, error) {
+	return c.ListEntitiesWithCountWithContext(context.Background(), options...)
+}
+
+// ListEntitiesWithCountWithContext is like ListEntitiesWithCount, but uses ctx for the requests.
+func (c *NgsiV2Client) ListEntitiesWithCountWithContext(ctx context.Context, options ...ListEntitiesParamFunc) ([]*model.Entity, int, error) {
+	params := new(listEntitiesParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return c.listEntitiesPage(ctx, params, true)
+}
+
+// listEntitiesPage retrieves the entities matching the params.
+// When count is set, it also returns the total number of matching entities.
+func (c *NgsiV2Client) listEntitiesPage(ctx context.Context, params *listEntitiesParams, count bool) ([]*model.Entity, int, error) {
+	if params.id != "" && params.idPattern != "" {
+		return nil, 0, fmt.Errorf("Cannot use 'id' and 'idPattern' together")
+	}
+	if params.ordersByDistance() && !strings.HasPrefix(params.georel, string(model.GeorelNear)) {
+		return nil, 0, fmt.Errorf("Ordering by '%s' requires a '%s' georel", GeoDistanceOrderBy, model.GeorelNear)
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s", eUrl), nil, params.headers()...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not create request for API resources: %w", err)
+	}
+	q := req.URL.Query()
+	if params.id != "" {
+		q.Add("id", params.id)
+	}
+	if params.idPattern != "" {
+		q.Add("idPattern", params.idPattern)
+	}
+	if params.entityType != "" {
+		q.Add("type", params.entityType)
+	}
+	attributes := strings.Join(params.attrs, ",")
+	if attributes != "" {
+		q.Add("attrs", attributes)
+	}
+	qExpr := strings.Join(params.q, ";")
+	if qExpr != "" {
+		q.Add("q", qExpr)
+	}
+	if params.limit > 0 {
+		q.Add("limit", strconv.Itoa(params.limit))
+	}
+	if params.offset > 0 {
+		q.Add("offset", strconv.Itoa(params.offset))
+	}
+	if params.georel != "" {
+		q.Add("georel", params.georel)
+	}
+	if params.geometry != "" {
+		q.Add("geometry", params.geometry)
+	}
+	coordsStr := strings.Join(params.coords, ";")
+	if coordsStr != "" {
+		q.Add("coords", coordsStr)
+	}
+	orderByStr := strings.Join(params.orderBy, ",")
+	if orderByStr != "" {
+		q.Add("orderBy", orderByStr)
+	}
+	if opts := params.optionsValue(count); opts != "" {
+		q.Add("options", opts)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.do("ListEntities", req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not list entities: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, 0, newAPIError(resp.StatusCode, bodyBytes)
+	}
+	// decode while reading, large pages are never held in memory as raw bytes
+	var ret []*model.Entity
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, 0, fmt.Errorf("Error reading list entities response: %w", err)
+	}
+	if err := c.applyEntityDecodeHook(ret...); err != nil {
+		return nil, 0, err
+	}
+	total := 0
+	if count {
+		if total, err = strconv.Atoi(resp.Header.Get("Fiware-Total-Count")); err != nil {
+			return nil, 0, errors.New("Fiware-Total-Count not found in header")
+		}
+	}
+	return ret, total, nil
+}
+
+const defaultEntitiesPageSize = 100
+
+// ForEachEntity invokes fn on every entity matching the options, transparently
+// fetching the pages with increasing offset until all of them have been visited.
+// The page size can be set with ListEntitiesSetLimit.
+// It stops at the first error returned by fn, and returns it.
+func (c *NgsiV2Client) ForEachEntity(fn func(*model.Entity) error, options ...ListEntitiesParamFunc) error {
+	return c.ForEachEntityWithContext(context.Background(), fn, options...)
+}
+
+// ForEachEntityWithContext is like ForEachEntity, but uses ctx for the requests.
+func (c *NgsiV2Client) ForEachEntityWithContext(ctx context.Context, fn func(*model.Entity) error, options ...ListEntitiesParamFunc) error {
+	params := new(listEntitiesParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return err
+		}
+	}
+	if params.limit == 0 {
+		params.limit = defaultEntitiesPageSize
+	}
+
+	for {
+		page, total, err := c.listEntitiesPage(ctx, params, true)
+		if err != nil {
+			return err
+		}
+		for _, e := range page {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		params.offset += len(page)
+		if len(page) == 0 || params.offset >= total {
+			return nil
+		}
+	}
+}
+
+// CountEntities returns how many entities are compliant with parameters
+func (c *NgsiV2Client) CountEntities(options ...ListEntitiesParamFunc) (int, error) {
+	return c.CountEntitiesWithContext(context.Background(), options...)
+}
+
+// CountEntitiesWithContext is like CountEntities, but uses ctx for the requests.
+func (c *NgsiV2Client) CountEntitiesWithContext(ctx context.Context, options ...ListEntitiesParamFunc) (int, error) {
+	params := new(listEntitiesParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return 0, err
+		}
+	}
+
+	if params.id != "" && params.idPattern != "" {
+		return 0, fmt.Errorf("Cannot use 'id' and 'idPattern' together")
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s", eUrl), nil, params.headers()...)
+	if err != nil {
+		return 0, fmt.Errorf("Could not create request for API resources: %w", err)
+	}
+	q := req.URL.Query()
+	if params.id != "" {
+		q.Add("id", params.id)
+	}
+	if params.idPattern != "" {
+		q.Add("idPattern", params.idPattern)
+	}
+	if params.entityType != "" {
+		q.Add("type", params.entityType)
+	}
+	attributes := strings.Join(params.attrs, ",")
+	if attributes != "" {
+		q.Add("attrs", attributes)
+	}
+	qExpr := strings.Join(params.q, ";")
+	if qExpr != "" {
+		q.Add("q", qExpr)
+	}
+
+	q.Add("limit", strconv.Itoa(1))
+
+	if params.offset > 0 {
+		q.Add("offset", strconv.Itoa(params.offset))
+	}
+	if params.georel != "" {
+		q.Add("georel", params.georel)
+	}
+	if params.geometry != "" {
+		q.Add("geometry", params.geometry)
+	}
+	coordsStr := strings.Join(params.coords, ";")
+	if coordsStr != "" {
+		q.Add("coords", coordsStr)
+	}
+
+	q.Add("options", params.optionsValue(true))
+
+	req.URL.RawQuery = q.Encode()
+	resp, err := c.do("CountEntities", req)
+	if err != nil {
+		return 0, fmt.Errorf("Could not list entities: %w", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, newAPIError(resp.StatusCode, bodyBytes)
+	}
+
+	totalCount := resp.Header.Get("Fiware-Total-Count")
+	if totalCount == "" {
+		return 0, errors.New("Fiware-Total-Count not found in header")
+	}
+	cnt, err := strconv.Atoi(totalCount)
+	if err != nil {
+		return 0, err
+	}
+	return cnt, nil
+
+}
+
+type createEntityOption string
+
+const (
+	keyValuesCreateEntityOption createEntityOption = "keyValues"
+	upsertCreateEntityOption    createEntityOption = "upsert"
+)
+
+type createEntityParams struct {
+	fiwareHeaderParams
+	options createEntityOption
+}
+
+type CreateEntityParamFunc func(*createEntityParams) error
+
+func CreateEntitySetOptionsUpsert() CreateEntityParamFunc {
+	return func(p *createEntityParams) error {
+		p.options = upsertCreateEntityOption
+		return nil
+	}
+}
+
+func CreateEntitySetOptionsKeyValues() CreateEntityParamFunc {
+	return func(p *createEntityParams) error {
+		p.options = keyValuesCreateEntityOption
+		return nil
+	}
+}
+
+func CreateEntitySetFiwareService(fiwareService string) CreateEntityParamFunc {
+	return func(p *createEntityParams) error {
+		p.fiwareService = fiwareService
+		return nil
+	}
+}
+
+func CreateEntitySetFiwareServicePath(fiwareServicePath string) CreateEntityParamFunc {
+	return func(p *createEntityParams) error {
+		p.fiwareServicePath = fiwareServicePath
+		return nil
+	}
+}
+
+// CreateEntity creates a new entity passed as parameter.
+// See: http://fiware.github.io/specifications/ngsiv2/stable -> Entities -> Create Entity
+// It returns the resource location that has been created, if upsert is used or
+// not and any error encountered. ParseEntityLocation extracts the entity id and type
+// from the location.
+func (c *NgsiV2Client) CreateEntity(entity *model.Entity, options ...CreateEntityParamFunc) (string, bool, error) {
+	return c.CreateEntityWithContext(context.Background(), entity, options...)
+}
+
+// CreateEntityWithContext is like CreateEntity, but uses ctx for the requests.
+func (c *NgsiV2Client) CreateEntityWithContext(ctx context.Context, entity *model.Entity, options ...CreateEntityParamFunc) (string, bool, error) {
+	params := new(createEntityParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return "", false, err
+		}
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	jsonEntity, err := json.Marshal(entity)
+	if err != nil {
+		return "", false, fmt.Errorf("Could not serialize message: %w", err)
+	}
+	req, err := c.newRequest(ctx, "POST", eUrl, bytes.NewBuffer(jsonEntity), params.headers()...)
+	if err != nil {
+		return "", false, fmt.Errorf("Could not create request for batch update: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if params.options != "" {
+		q := req.URL.Query()
+		q.Add("options", string(params.options))
+		req.URL.RawQuery = q.Encode()
+	}
+
+	resp, err := c.do("CreateEntity", req)
+	if err != nil {
+		return "", false, fmt.Errorf("Error invoking entity creation: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusCreated {
+		return resp.Header.Get("Location"), false, nil
+	} else if resp.StatusCode == http.StatusNoContent {
+		return resp.Header.Get("Location"), true, nil
+	} else {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return "", false, newAPIError(resp.StatusCode, bodyBytes)
+	}
+	/*
+		q := req.URL.Query()
+		req.URL.RawQuery = q.Encode()
+
+		return nil*/
+}
+
+// ParseEntityLocation parses the location returned by CreateEntity, like
+// "/v2/entities/Bcn-Welt?type=Room", into the id and the type of the entity.
+// The type is empty if the location does not include it.
+func ParseEntityLocation(loc string) (id, entityType string, err error) {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid entity location '%s': %w", loc, err)
+	}
+	const entitiesPath = "/v2/entities/"
+	i := strings.LastIndex(u.EscapedPath(), entitiesPath)
+	if i < 0 {
+		return "", "", fmt.Errorf("Invalid entity location '%s': not an entity path", loc)
+	}
+	escapedId := u.EscapedPath()[i+len(entitiesPath):]
+	if escapedId == "" || strings.Contains(escapedId, "/") {
+		return "", "", fmt.Errorf("Invalid entity location '%s': not an entity path", loc)
+	}
+	if id, err = url.PathUnescape(escapedId); err != nil {
+		return "", "", fmt.Errorf("Invalid entity location '%s': %w", loc, err)
+	}
+	return id, u.Query().Get("type"), nil
+}
+
+type updateEntityOption string
+
+const (
+	keyValuesUpdateEntityOption    updateEntityOption = "keyValues"
+	appendUpdateEntityOption       updateEntityOption = "append"
+	overwriteUpdateEntityOption    updateEntityOption = "overwrite"
+	forcedUpdateUpdateEntityOption updateEntityOption = "forcedUpdate"
+)
+
+// updateEntityOptionsOrder is the order used when joining the options query param:
+// the body format comes first, then the merge behavior and the notification one.
+var updateEntityOptionsOrder = []updateEntityOption{
+	keyValuesUpdateEntityOption,
+	appendUpdateEntityOption,
+	overwriteUpdateEntityOption,
+	forcedUpdateUpdateEntityOption,
+}
+
+type updateEntityParams struct {
+	fiwareHeaderParams
+	entityType string
+	options    map[updateEntityOption]bool
+}
+
+type UpdateEntityParamFunc func(*updateEntityParams) error
+
+func (p *updateEntityParams) addOption(option updateEntityOption) {
+	if p.options == nil {
+		p.options = make(map[updateEntityOption]bool)
+	}
+	p.options[option] = true
+}
+
+// checkOptions verifies that only the options allowed by the operation have been set.
+func (p *updateEntityParams) checkOptions(operation string, allowed ...updateEntityOption) error {
+	for option := range p.options {
+		found := false
+		for _, a := range allowed {
+			if option == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("'%s' option cannot be used to %s", option, operation)
+		}
+	}
+	if p.options[appendUpdateEntityOption] && p.options[overwriteUpdateEntityOption] {
+		return fmt.Errorf("'%s' and '%s' options cannot be used together", appendUpdateEntityOption, overwriteUpdateEntityOption)
+	}
+	return nil
+}
+
+// query adds the type and options query params, if set.
+func (p *updateEntityParams) query(req *http.Request) {
+	q := req.URL.Query()
+	if p.entityType != "" {
+		q.Add("type", p.entityType)
+	}
+	if opts := p.optionsValue(); opts != "" {
+		q.Add("options", opts)
+	}
+	req.URL.RawQuery = q.Encode()
+}
+
+// optionsValue returns the comma separated value for the options query param.
+func (p *updateEntityParams) optionsValue() string {
+	var opts []string
+	for _, option := range updateEntityOptionsOrder {
+		if p.options[option] {
+			opts = append(opts, string(option))
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+// attributesBody serializes the attributes for the request body,
+// using the simplified keyValues format if requested.
+func (p *updateEntityParams) attributesBody(attrs map[string]*model.Attribute) ([]byte, error) {
+	if !p.options[keyValuesUpdateEntityOption] {
+		return json.Marshal(attrs)
+	}
+	values := make(map[string]interface{}, len(attrs))
+	for name, attr := range attrs {
+		values[name] = attr.Value
+	}
+	return json.Marshal(values)
+}
+
+// UpdateEntitySetOptionsKeyValues sends the attributes in the simplified keyValues format,
+// i.e. only their values. It can be combined with the merge behavior options.
+func UpdateEntitySetOptionsKeyValues() UpdateEntityParamFunc {
+	return func(p *updateEntityParams) error {
+		p.addOption(keyValuesUpdateEntityOption)
+		return nil
+	}
+}
+
+// UpdateEntitySetOptionsAppend makes the context broker reject the attributes that
+// already exist, instead of updating them. It is only allowed when appending attributes.
+func UpdateEntitySetOptionsAppend() UpdateEntityParamFunc {
+	return func(p *updateEntityParams) error {
+		p.addOption(appendUpdateEntityOption)
+		return nil
+	}
+}
+
+// UpdateEntitySetOptionsOverwrite makes the context broker replace the existing
+// attributes as a whole, metadata included, instead of merging them.
+// It is only allowed when appending attributes, and not in strict mode.
+func UpdateEntitySetOptionsOverwrite() UpdateEntityParamFunc {
+	return func(p *updateEntityParams) error {
+		p.addOption(overwriteUpdateEntityOption)
+		return nil
+	}
+}
+
+// UpdateEntitySetOptionsForcedUpdate makes the context broker consider the attributes
+// as changed, triggering the matching subscriptions even if their values are the same,
+// e.g. for heartbeats.
+func UpdateEntitySetOptionsForcedUpdate() UpdateEntityParamFunc {
+	return func(p *updateEntityParams) error {
+		p.addOption(forcedUpdateUpdateEntityOption)
+		return nil
+	}
+}
+
+func UpdateEntitySetType(entityType string) UpdateEntityParamFunc {
+	return func(p *updateEntityParams) error {
+		if !model.IsValidFieldSyntax(entityType) {
+			return fmt.Errorf("'%s' is not a valid entity type name", entityType)
+		}
+		p.entityType = entityType
+		return nil
+	}
+}
+
+func UpdateEntitySetFiwareService(fiwareService string) UpdateEntityParamFunc {
+	return func(p *updateEntityParams) error {
+		p.fiwareService = fiwareService
+		return nil
+	}
+}
+
+func UpdateEntitySetFiwareServicePath(fiwareServicePath string) UpdateEntityParamFunc {
+	return func(p *updateEntityParams) error {
+		p.fiwareServicePath = fiwareServicePath
+		return nil
+	}
+}
+
+// ReplaceEntityAttributes replaces all the attributes of the entity identified by the given id.
+// Unlike appending or updating attributes, any existing attribute not included in attrs
+// is removed by the context broker.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/entities/entity-attributes/replace-all-entity-attributes
+func (c *NgsiV2Client) ReplaceEntityAttributes(id string, attrs map[string]*model.Attribute, options ...UpdateEntityParamFunc) error {
+	return c.ReplaceEntityAttributesWithContext(context.Background(), id, attrs, options...)
+}
+
+// ReplaceEntityAttributesWithContext is like ReplaceEntityAttributes, but uses ctx for the requests.
+func (c *NgsiV2Client) ReplaceEntityAttributesWithContext(ctx context.Context, id string, attrs map[string]*model.Attribute, options ...UpdateEntityParamFunc) error {
+	if id == "" {
+		return fmt.Errorf("Cannot replace attributes of entity with empty 'id'")
+	}
+
+	params := new(updateEntityParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return err
+		}
+	}
+	if err := params.checkOptions("replace attributes", keyValuesUpdateEntityOption, forcedUpdateUpdateEntityOption); err != nil {
+		return err
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return err
+	}
+
+	jsonValue, err := params.attributesBody(attrs)
+	if err != nil {
+		return fmt.Errorf("Could not serialize attributes: %w", err)
+	}
+	req, err := c.newRequest(ctx, "PUT", fmt.Sprintf("%s/%s/attrs", eUrl, url.PathEscape(id)), bytes.NewBuffer(jsonValue), params.headers()...)
+	if err != nil {
+		return fmt.Errorf("Could not create request for attributes replacement: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	params.query(req)
+
+	resp, err := c.do("ReplaceEntityAttributes", req)
+	if err != nil {
+		return fmt.Errorf("Error invoking replace entity attributes: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return newAPIError(resp.StatusCode, bodyBytes)
+	}
+	return nil
+}
+
+// AppendEntityAttributes appends the given attributes to the entity identified by the given id.
+// Existing attributes are updated, unless strict is true: in that case the append option
+// is set and the context broker rejects the attributes that already exist.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/entities/entity-attributes/update-or-append-entity-attributes
+func (c *NgsiV2Client) AppendEntityAttributes(id string, attrs map[string]*model.Attribute, strict bool, options ...UpdateEntityParamFunc) error {
+	return c.AppendEntityAttributesWithContext(context.Background(), id, attrs, strict, options...)
+}
+
+// AppendEntityAttributesWithContext is like AppendEntityAttributes, but uses ctx for the requests.
+func (c *NgsiV2Client) AppendEntityAttributesWithContext(ctx context.Context, id string, attrs map[string]*model.Attribute, strict bool, options ...UpdateEntityParamFunc) error {
+	if id == "" {
+		return fmt.Errorf("Cannot append attributes to entity with empty 'id'")
+	}
+
+	params := new(updateEntityParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return err
+		}
+	}
+	if strict {
+		params.addOption(appendUpdateEntityOption)
+	}
+	if err := params.checkOptions("append attributes", keyValuesUpdateEntityOption, appendUpdateEntityOption, overwriteUpdateEntityOption, forcedUpdateUpdateEntityOption); err != nil {
+		return err
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return err
+	}
+
+	jsonValue, err := params.attributesBody(attrs)
+	if err != nil {
+		return fmt.Errorf("Could not serialize attributes: %w", err)
+	}
+	req, err := c.newRequest(ctx, "POST", fmt.Sprintf("%s/%s/attrs", eUrl, url.PathEscape(id)), bytes.NewBuffer(jsonValue), params.headers()...)
+	if err != nil {
+		return fmt.Errorf("Could not create request for attributes append: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	params.query(req)
+
+	resp, err := c.do("AppendEntityAttributes", req)
+	if err != nil {
+		return fmt.Errorf("Error invoking append entity attributes: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return newAPIError(resp.StatusCode, bodyBytes)
+	}
+	return nil
+}
+
+// UpdateEntityAttribute updates type, value and metadata of the attribute named attrName
+// of the entity identified by the given id.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/attributes/attribute-by-entity-id/update-attribute-data
+func (c *NgsiV2Client) UpdateEntityAttribute(id, attrName string, attr *model.Attribute, options ...UpdateEntityParamFunc) error {
+	return c.UpdateEntityAttributeWithContext(context.Background(), id, attrName, attr, options...)
+}
+
+// UpdateEntityAttributeWithContext is like UpdateEntityAttribute, but uses ctx for the requests.
+func (c *NgsiV2Client) UpdateEntityAttributeWithContext(ctx context.Context, id, attrName string, attr *model.Attribute, options ...UpdateEntityParamFunc) error {
+	if id == "" {
+		return fmt.Errorf("Cannot update attribute of entity with empty 'id'")
+	}
+	if !model.IsValidAttributeName(attrName) {
+		return fmt.Errorf("'%s' is not a valid attribute name", attrName)
+	}
+	if attr == nil {
+		return fmt.Errorf("Cannot update attribute '%s' with a nil attribute", attrName)
+	}
+
+	params := new(updateEntityParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return err
+		}
+	}
+	if err := params.checkOptions("update an attribute", forcedUpdateUpdateEntityOption); err != nil {
+		return err
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return err
+	}
+
+	jsonValue, err := json.Marshal(attr)
+	if err != nil {
+		return fmt.Errorf("Could not serialize attribute: %w", err)
+	}
+	req, err := c.newRequest(ctx, "PUT", fmt.Sprintf("%s/%s/attrs/%s", eUrl, url.PathEscape(id), url.PathEscape(attrName)), bytes.NewBuffer(jsonValue), params.headers()...)
+	if err != nil {
+		return fmt.Errorf("Could not create request for attribute update: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	params.query(req)
+
+	resp, err := c.do("UpdateEntityAttribute", req)
+	if err != nil {
+		return fmt.Errorf("Error invoking update entity attribute: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return newAPIError(resp.StatusCode, bodyBytes)
+	}
+	return nil
+}
+
+// UpdateEntityAttributeValue updates only the value of the attribute named attrName of the
+// entity identified by the given id. The value is sent as raw JSON, without type and metadata.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/attribute-value/attribute-value-by-entity-id/update-attribute-value
+func (c *NgsiV2Client) UpdateEntityAttributeValue(id, attrName string, value interface{}, options ...UpdateEntityParamFunc) error {
+	return c.UpdateEntityAttributeValueWithContext(context.Background(), id, attrName, value, options...)
+}
+
+// UpdateEntityAttributeValueWithContext is like UpdateEntityAttributeValue, but uses ctx for the requests.
+func (c *NgsiV2Client) UpdateEntityAttributeValueWithContext(ctx context.Context, id, attrName string, value interface{}, options ...UpdateEntityParamFunc) error {
+	if id == "" {
+		return fmt.Errorf("Cannot update attribute value of entity with empty 'id'")
+	}
+	if !model.IsValidAttributeName(attrName) {
+		return fmt.Errorf("'%s' is not a valid attribute name", attrName)
+	}
+
+	params := new(updateEntityParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return err
+		}
+	}
+	if err := params.checkOptions("update an attribute value", forcedUpdateUpdateEntityOption); err != nil {
+		return err
+	}
+
+	eUrl, err := c.getEntitiesUrl(ctx)
+	if err != nil {
+		return err
+	}
+
+	jsonValue, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("Could not serialize attribute value: %w", err)
+	}
+	req, err := c.newRequest(ctx, "PUT", fmt.Sprintf("%s/%s/attrs/%s/value", eUrl, url.PathEscape(id), url.PathEscape(attrName)), bytes.NewBuffer(jsonValue), params.headers()...)
+	if err != nil {
+		return fmt.Errorf("Could not create request for attribute value update: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	params.query(req)
+
+	resp, err := c.do("UpdateEntityAttributeValue", req)
+	if err != nil {
+		return fmt.Errorf("Error invoking update entity attribute value: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return newAPIError(resp.StatusCode, bodyBytes)
+	}
+	return nil
+}
+
+type subscriptionParams struct {
+	fiwareHeaderParams
+	options createEntityOption
+}
+
+type SubscriptionParamFunc func(*subscriptionParams) error
+
+func SubscriptionSetFiwareService(fiwareService string) SubscriptionParamFunc {
+	return func(p *subscriptionParams) error {
+		p.fiwareService = fiwareService
+		return nil
+	}
+}
+
+func SubscriptionSetFiwareServicePath(fiwareServicePath string) SubscriptionParamFunc {
+	return func(p *subscriptionParams) error {
+		p.fiwareServicePath = fiwareServicePath
+		return nil
+	}
+}
+
+// CreateSubscription creates a new subscription to the context broker.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions/subscription-list/create-a-new-subscription
+func (c *NgsiV2Client) CreateSubscription(subscription *model.Subscription, options ...SubscriptionParamFunc) (string, error) {
+	return c.CreateSubscriptionWithContext(context.Background(), subscription, options...)
+}
+
+// CreateSubscriptionWithContext is like CreateSubscription, but uses ctx for the requests.
+func (c *NgsiV2Client) CreateSubscriptionWithContext(ctx context.Context, subscription *model.Subscription, options ...SubscriptionParamFunc) (string, error) {
+	if subscription == nil {
+		return "", fmt.Errorf("Cannot create nil subscription")
+	}
+	if err := subscription.Validate(); err != nil {
+		return "", fmt.Errorf("Invalid subscription: %w", err)
+	}
+
+	params := new(subscriptionParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return "", err
+		}
+	}
+
+	jsonValue, err := json.Marshal(subscription)
+	if err != nil {
+		return "", fmt.Errorf("Could not serialize subscription: %w", err)
+	}
+
+	apiRes, err := c.apiResources(ctx)
+	if err != nil {
+		return "", err
+	}
+	sUrl := fmt.Sprintf("%s%s", c.url, apiRes.SubscriptionsUrl)
+	req, err := c.newRequest(ctx, "POST", sUrl, bytes.NewBuffer(jsonValue), params.headers()...)
+	if err != nil {
+		return "", fmt.Errorf("Could not create request for subscription creation: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := c.do("CreateSubscription", req)
+	if err != nil {
+		return "", fmt.Errorf("Error invoking create subscription: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return "", newAPIError(resp.StatusCode, bodyBytes)
+	}
+	return c.locationId(resp.Header.Get("Location"), apiRes.SubscriptionsUrl), nil
+}
+
+// RetrieveSubscription retrieves a subscription identified by the given id.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions/subscription-by-id/retrieve-subscription
+func (c *NgsiV2Client) RetrieveSubscription(id string, options ...SubscriptionParamFunc) (*model.Subscription, error) {
+	return c.RetrieveSubscriptionWithContext(context.Background(), id, options...)
+}
+
+// RetrieveSubscriptionWithContext is like RetrieveSubscription, but uses ctx for the requests.
+func (c *NgsiV2Client) RetrieveSubscriptionWithContext(ctx context.Context, id string, options ...SubscriptionParamFunc) (*model.Subscription, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Cannot retrieve subscription with empty 'id'")
+	}
+
+	params := new(subscriptionParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return nil, err
+		}
+	}
+
+	sUrl, err := c.getSubscriptionsUrl(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s/%s", sUrl, id), nil, params.headers()...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request for subscription retrieval: %w", err)
+	}
+
+	resp, err := c.do("RetrieveSubscription", req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve subscription: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
+	} else {
+		ret := new(model.Subscription)
+		if err := json.Unmarshal(bodyBytes, ret); err != nil {
+			return nil, fmt.Errorf("Error reading retrieve subscription response: %w", err)
+		} else {
+			return ret, nil
+		}
+	}
+}
+
+// SubscriptionDiagnostics retrieves the subscription identified by the given id and
+// returns its notification statistics, along with a verdict about its health.
+func (c *NgsiV2Client) SubscriptionDiagnostics(id string, options ...SubscriptionParamFunc) (*model.SubscriptionDiagnostics, error) {
+	return c.SubscriptionDiagnosticsWithContext(context.Background(), id, options...)
+}
+
+// SubscriptionDiagnosticsWithContext is like SubscriptionDiagnostics, but uses ctx for the requests.
+func (c *NgsiV2Client) SubscriptionDiagnosticsWithContext(ctx context.Context, id string, options ...SubscriptionParamFunc) (*model.SubscriptionDiagnostics, error) {
+	sub, err := c.RetrieveSubscriptionWithContext(ctx, id, options...)
+	if err != nil {
+		return nil, err
+	}
+	return model.NewSubscriptionDiagnostics(sub), nil
+}
+
+// RetrieveSubscriptionStatus retrieves the subscription identified by the given id and
+// returns just its notification, holding the statistics like TimesSent, LastFailure
+// and LastSuccessCode. See model.SubscriptionNotification.IsHealthy.
+func (c *NgsiV2Client) RetrieveSubscriptionStatus(id string, options ...SubscriptionParamFunc) (*model.SubscriptionNotification, error) {
+	return c.RetrieveSubscriptionStatusWithContext(context.Background(), id, options...)
+}
+
+// RetrieveSubscriptionStatusWithContext is like RetrieveSubscriptionStatus, but uses ctx for the requests.
+func (c *NgsiV2Client) RetrieveSubscriptionStatusWithContext(ctx context.Context, id string, options ...SubscriptionParamFunc) (*model.SubscriptionNotification, error) {
+	sub, err := c.RetrieveSubscriptionWithContext(ctx, id, options...)
+	if err != nil {
+		return nil, err
+	}
+	if sub.Notification == nil {
+		return nil, fmt.Errorf("Subscription '%s' has no notification", id)
+	}
+	return sub.Notification, nil
+}
+
+type retrieveSubscriptionsParams struct {
+	fiwareHeaderParams
+	limit   int
+	offset  int
+	options string
+}
+
+type RetrieveSubscriptionsParamFunc func(*retrieveSubscriptionsParams) error
+
+func RetrieveSubscriptionsSetLimit(limit int) RetrieveSubscriptionsParamFunc {
+	return func(p *retrieveSubscriptionsParams) error {
+		if limit <= 0 {
+			return fmt.Errorf("limit cannot be less than or equal 0")
+		}
+		p.limit = limit
+		return nil
+	}
+}
+
+func RetrieveSubscriptionsSetOffset(offset int) RetrieveSubscriptionsParamFunc {
+	return func(p *retrieveSubscriptionsParams) error {
+		if offset < 0 {
+			return fmt.Errorf("offset cannot be less than or equal 0")
+		}
+		p.offset = offset
+		return nil
+	}
+}
+
+func RetrieveSubscriptionsSetOptions(options string) RetrieveSubscriptionsParamFunc {
+	return func(p *retrieveSubscriptionsParams) error {
+		if options != "" && options != "count" {
+			return fmt.Errorf("Invalid value for options param")
+		}
+		p.options = options
+		return nil
+	}
+}
+
+func RetrieveSubscriptionsSetFiwareService(fiwareService string) RetrieveSubscriptionsParamFunc {
+	return func(p *retrieveSubscriptionsParams) error {
+		p.fiwareService = fiwareService
+		return nil
+	}
+}
+
+func RetrieveSubscriptionsSetFiwareServicePath(fiwareServicePath string) RetrieveSubscriptionsParamFunc {
+	return func(p *retrieveSubscriptionsParams) error {
+		p.fiwareServicePath = fiwareServicePath
+		return nil
+	}
+}
+
+type SubscriptionsResponse struct {
+	Count         int
+	Subscriptions []*model.Subscription
+}
+
+// SubscriptionSummary is a lightweight view of a subscription, e.g. for dashboards.
+type SubscriptionSummary struct {
+	Id              string
+	Status          model.SubscriptionStatus
+	NotificationURL string
+	TimesSent       uint
+	Healthy         bool
+}
+
+// Summaries returns a summary for each of the retrieved subscriptions.
+// A subscription is healthy unless it is failing to deliver notifications.
+func (r *SubscriptionsResponse) Summaries() []SubscriptionSummary {
+	ret := make([]SubscriptionSummary, 0, len(r.Subscriptions))
+	for _, sub := range r.Subscriptions {
+		d := model.NewSubscriptionDiagnostics(sub)
+		summary := SubscriptionSummary{
+			Id:        sub.Id,
+			Status:    sub.Status,
+			TimesSent: d.TimesSent,
+			Healthy:   d.Health != model.SubscriptionFailing,
+		}
+		if n := sub.Notification; n != nil {
+			if n.Http != nil {
+				summary.NotificationURL = n.Http.Url
+			} else if n.HttpCustom != nil {
+				summary.NotificationURL = n.HttpCustom.Url
+			} else if n.Mqtt != nil {
+				summary.NotificationURL = n.Mqtt.Url
+			} else if n.MqttCustom != nil {
+				summary.NotificationURL = n.MqttCustom.Url
+			}
+		}
+		ret = append(ret, summary)
+	}
+	return ret
+}
+
+// RetrieveSubscriptions returs the subscriptions present in the system.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions/subscription-list/retrieve-subscriptions
+func (c *NgsiV2Client) RetrieveSubscriptions(options ...RetrieveSubscriptionsParamFunc) (*SubscriptionsResponse, error) {
+	return c.RetrieveSubscriptionsWithContext(context.Background(), options...)
+}
+
+// RetrieveSubscriptionsWithContext is like RetrieveSubscriptions, but uses ctx for the requests.
+func (c *NgsiV2Client) RetrieveSubscriptionsWithContext(ctx context.Context, options ...RetrieveSubscriptionsParamFunc) (*SubscriptionsResponse, error) {
+	params := new(retrieveSubscriptionsParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return nil, err
+		}
+	}
+
+	sUrl, err := c.getSubscriptionsUrl(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "GET", sUrl, nil, params.headers()...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request for subscriptions retrieval: %w", err)
+	}
+	q := req.URL.Query()
+	if params.limit > 0 {
+		q.Add("limit", strconv.Itoa(params.limit))
+	}
+	if params.offset > 0 {
+		q.Add("offset", strconv.Itoa(params.offset))
+	}
+	if params.options != "" {
+		q.Add("options", string(params.options))
+	}
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.do("RetrieveSubscriptions", req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve subscriptions: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
+	} else {
+		var subs []*model.Subscription
+		if err := json.Unmarshal(bodyBytes, &subs); err != nil {
+			return nil, fmt.Errorf("Error reading retrieve subscriptions response: %w", err)
+		} else {
+			ret := new(SubscriptionsResponse)
+			ret.Subscriptions = subs
+			if c, err := strconv.Atoi(resp.Header.Get("Fiware-Total-Count")); err == nil {
+				ret.Count = c
+			}
+			return ret, nil
+		}
+	}
+}
+
+// UpdateSubscription updates a subscription identified by the given id with the field specified in the request.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions/subscription-by-id/update-subscription
+func (c *NgsiV2Client) UpdateSubscription(id string, patchSubscription *model.Subscription, options ...SubscriptionParamFunc) error {
+	return c.UpdateSubscriptionWithContext(context.Background(), id, patchSubscription, options...)
+}
+
+// UpdateSubscriptionWithContext is like UpdateSubscription, but uses ctx for the requests.
+func (c *NgsiV2Client) UpdateSubscriptionWithContext(ctx context.Context, id string, patchSubscription *model.Subscription, options ...SubscriptionParamFunc) error {
+	if id == "" {
+		return fmt.Errorf("Cannot update subscription with empty 'id'")
+	}
+	if patchSubscription == nil {
+		return fmt.Errorf("Cannot update subscription with nil patch")
+	}
+	// a patch carries only the fields to change, so validate just the parts present
+	if patchSubscription.Subject != nil {
+		if err := patchSubscription.Subject.Validate(); err != nil {
+			return fmt.Errorf("Invalid subscription: %w", err)
+		}
+	}
+	if patchSubscription.Notification != nil {
+		if err := patchSubscription.Notification.Validate(); err != nil {
+			return fmt.Errorf("Invalid subscription: %w", err)
+		}
+	}
+
+	jsonValue, err := json.Marshal(patchSubscription)
+	if err != nil {
+		return fmt.Errorf("Could not serialize subscription: %w", err)
+	}
+
+	sUrl, err := c.getSubscriptionsUrl(ctx)
+	if err != nil {
+		return err
+	}
+
+	params := new(subscriptionParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return err
+		}
+	}
+
+	req, err := c.newRequest(ctx, "PATCH", fmt.Sprintf("%s/%s", sUrl, id), bytes.NewBuffer(jsonValue), params.headers()...)
+	if err != nil {
+		return fmt.Errorf("Could not create request for subscription updating: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := c.do("UpdateSubscription", req)
+	if err != nil {
+		return fmt.Errorf("Error invoking update subscription: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return newAPIError(resp.StatusCode, bodyBytes)
+	}
+	return nil
+}
+
+// DeleteSubscription cancels a subscription identified by the given id.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions/subscription-by-id/delete-subscription
+func (c *NgsiV2Client) DeleteSubscription(id string, options ...SubscriptionParamFunc) error {
+	return c.DeleteSubscriptionWithContext(context.Background(), id, options...)
+}
+
+// DeleteSubscriptionWithContext is like DeleteSubscription, but uses ctx for the requests.
+func (c *NgsiV2Client) DeleteSubscriptionWithContext(ctx context.Context, id string, options ...SubscriptionParamFunc) error {
+	if id == "" {
+		return fmt.Errorf("Cannot delete subscription with empty 'id'")
+	}
 
-// CreateEntity creates a new entity passed as parameter.
-// See: http://fiware.github.io/specifications/ngsiv2/stable -> Entities -> Create Entity
-// It returns the resource location that has been created, if upsert is used or
-// not and any error encountered.
-func (c *NgsiV2Client) CreateEntity(entity *model.Entity, options ...CreateEntityParamFunc) (string, bool, error) {
-	params := new(createEntityParams)
+	sUrl, err := c.getSubscriptionsUrl(ctx)
+	if err != nil {
+		return err
+	}
+
+	params := new(subscriptionParams)
 
 	// apply the options
 	for _, option := range options {
 		if err := option(params); err != nil {
-			return "", false, err
+			return err
 		}
 	}
 
-	eUrl, err := c.getEntitiesUrl()
-	if err != nil {
-		return "", false, err
-	}
-
-	jsonEntity, err := json.Marshal(entity)
-	if err != nil {
-		return "", false, fmt.Errorf("Could not serialize message: %v", err)
-	}
-	req, err := c.newRequest("POST", eUrl, bytes.NewBuffer(jsonEntity), params.headers()...)
+	req, err := c.newRequest(ctx, "DELETE", fmt.Sprintf("%s/%s", sUrl, id), nil, params.headers()...)
 	if err != nil {
-		return "", false, fmt.Errorf("Could not create request for batch update: %v", err)
-	}
-	req.Header.Add("Content-Type", "application/json")
-	if params.options != "" {
-		q := req.URL.Query()
-		q.Add("options", string(params.options))
-		req.URL.RawQuery = q.Encode()
+		return fmt.Errorf("Could not create request for subscription deletion: %w", err)
 	}
-
-	resp, err := c.c.Do(req)
+	resp, err := c.do("DeleteSubscription", req)
 	if err != nil {
-		return "", false, fmt.Errorf("Error invoking entity creation: %w", err)
+		return fmt.Errorf("Error invoking delete subscription: %w", err)
 	}
 	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusCreated {
-		return resp.Header.Get("Location"), false, nil
-	} else if resp.StatusCode == http.StatusNoContent {
-		return resp.Header.Get("Location"), true, nil
-	} else {
+	if resp.StatusCode != http.StatusNoContent {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return "", false, fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
+		return newAPIError(resp.StatusCode, bodyBytes)
 	}
-	/*
-		q := req.URL.Query()
-		req.URL.RawQuery = q.Encode()
-
-		return nil*/
+	return nil
 }
 
-type subscriptionParams struct {
+type registrationParams struct {
 	fiwareHeaderParams
-	options createEntityOption
 }
 
-type SubscriptionParamFunc func(*subscriptionParams) error
+type RegistrationParamFunc func(*registrationParams) error
 
-func SubscriptionSetFiwareService(fiwareService string) SubscriptionParamFunc {
-	return func(p *subscriptionParams) error {
+func RegistrationSetFiwareService(fiwareService string) RegistrationParamFunc {
+	return func(p *registrationParams) error {
 		p.fiwareService = fiwareService
 		return nil
 	}
 }
 
-func SubscriptionSetFiwareServicePath(fiwareServicePath string) SubscriptionParamFunc {
-	return func(p *subscriptionParams) error {
+func RegistrationSetFiwareServicePath(fiwareServicePath string) RegistrationParamFunc {
+	return func(p *registrationParams) error {
 		p.fiwareServicePath = fiwareServicePath
 		return nil
 	}
 }
 
-// CreateSubscription creates a new subscription to the context broker.
-// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions/subscription-list/create-a-new-subscription
-func (c *NgsiV2Client) CreateSubscription(subscription *model.Subscription, options ...SubscriptionParamFunc) (string, error) {
-	params := new(subscriptionParams)
+// CreateRegistration creates a new context provider registration and returns its id.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/registrations/registration-list/create-registration
+func (c *NgsiV2Client) CreateRegistration(registration *model.Registration, options ...RegistrationParamFunc) (string, error) {
+	return c.CreateRegistrationWithContext(context.Background(), registration, options...)
+}
+
+// CreateRegistrationWithContext is like CreateRegistration, but uses ctx for the requests.
+func (c *NgsiV2Client) CreateRegistrationWithContext(ctx context.Context, registration *model.Registration, options ...RegistrationParamFunc) (string, error) {
+	params := new(registrationParams)
 
 	// apply the options
 	for _, option := range options {
@@ -860,77 +3202,89 @@ func (c *NgsiV2Client) CreateSubscription(subscription *model.Subscription, opti
 		}
 	}
 
-	jsonValue, err := json.Marshal(subscription)
+	jsonValue, err := json.Marshal(registration)
 	if err != nil {
-		return "", fmt.Errorf("Could not serialize subscription: %+v", err)
+		return "", fmt.Errorf("Could not serialize registration: %w", err)
 	}
 
-	sUrl, err := c.getSubscriptionsUrl()
+	apiRes, err := c.apiResources(ctx)
 	if err != nil {
 		return "", err
 	}
-	req, err := c.newRequest("POST", sUrl, bytes.NewBuffer(jsonValue), params.headers()...)
+	rUrl := fmt.Sprintf("%s%s", c.url, apiRes.RegistrationsUrl)
+	req, err := c.newRequest(ctx, "POST", rUrl, bytes.NewBuffer(jsonValue), params.headers()...)
 	if err != nil {
-		return "", fmt.Errorf("Could not create request for subscription creation: %+v", err)
+		return "", fmt.Errorf("Could not create request for registration creation: %w", err)
 	}
 	req.Header.Add("Content-Type", "application/json")
-	resp, err := c.c.Do(req)
+	resp, err := c.do("CreateRegistration", req)
 	if err != nil {
-		return "", fmt.Errorf("Error invoking create subscription: %+v", err)
+		return "", fmt.Errorf("Error invoking create registration: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusCreated {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return "", fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
+		return "", newAPIError(resp.StatusCode, bodyBytes)
 	}
-	return strings.TrimPrefix(resp.Header.Get("Location"), c.apiRes.SubscriptionsUrl+"/"), nil
+	return c.locationId(resp.Header.Get("Location"), apiRes.RegistrationsUrl), nil
 }
 
-// RetrieveSubscription retrieves a subscription identified by the given id.
-// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions/subscription-by-id/retrieve-subscription
-func (c *NgsiV2Client) RetrieveSubscription(id string) (*model.Subscription, error) {
+// RetrieveRegistration retrieves a registration identified by the given id.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/registrations/registration-by-id/retrieve-registration
+func (c *NgsiV2Client) RetrieveRegistration(id string, options ...RegistrationParamFunc) (*model.Registration, error) {
+	return c.RetrieveRegistrationWithContext(context.Background(), id, options...)
+}
+
+// RetrieveRegistrationWithContext is like RetrieveRegistration, but uses ctx for the requests.
+func (c *NgsiV2Client) RetrieveRegistrationWithContext(ctx context.Context, id string, options ...RegistrationParamFunc) (*model.Registration, error) {
 	if id == "" {
-		return nil, fmt.Errorf("Cannot retrieve subscription with empty 'id'")
+		return nil, fmt.Errorf("Cannot retrieve registration with empty 'id'")
+	}
+
+	params := new(registrationParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return nil, err
+		}
 	}
 
-	sUrl, err := c.getSubscriptionsUrl()
+	rUrl, err := c.getRegistrationsUrl(ctx)
 	if err != nil {
 		return nil, err
 	}
-	req, err := c.newRequest("GET", fmt.Sprintf("%s/%s", sUrl, id), nil)
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("%s/%s", rUrl, id), nil, params.headers()...)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create request for subscription retrieval: %+v", err)
+		return nil, fmt.Errorf("Could not create request for registration retrieval: %w", err)
 	}
 
-	resp, err := c.c.Do(req)
+	resp, err := c.do("RetrieveRegistration", req)
 	if err != nil {
-		return nil, fmt.Errorf("Could not retrieve subscription: %+v", err)
+		return nil, fmt.Errorf("Could not retrieve registration: %w", err)
 	}
 	defer resp.Body.Close()
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
-	} else {
-		ret := new(model.Subscription)
-		if err := json.Unmarshal(bodyBytes, ret); err != nil {
-			return nil, fmt.Errorf("Error reading retrieve subscription response: %+v", err)
-		} else {
-			return ret, nil
-		}
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
+	}
+	ret := new(model.Registration)
+	if err := json.Unmarshal(bodyBytes, ret); err != nil {
+		return nil, fmt.Errorf("Error reading retrieve registration response: %w", err)
 	}
+	return ret, nil
 }
 
-type retrieveSubscriptionsParams struct {
+type listRegistrationsParams struct {
 	fiwareHeaderParams
-	limit   int
-	offset  int
-	options string
+	limit  int
+	offset int
 }
 
-type RetrieveSubscriptionsParamFunc func(*retrieveSubscriptionsParams) error
+type ListRegistrationsParamFunc func(*listRegistrationsParams) error
 
-func RetrieveSubscriptionsSetLimit(limit int) RetrieveSubscriptionsParamFunc {
-	return func(p *retrieveSubscriptionsParams) error {
+func ListRegistrationsSetLimit(limit int) ListRegistrationsParamFunc {
+	return func(p *listRegistrationsParams) error {
 		if limit <= 0 {
 			return fmt.Errorf("limit cannot be less than or equal 0")
 		}
@@ -939,49 +3293,44 @@ func RetrieveSubscriptionsSetLimit(limit int) RetrieveSubscriptionsParamFunc {
 	}
 }
 
-func RetrieveSubscriptionsSetOffset(offset int) RetrieveSubscriptionsParamFunc {
-	return func(p *retrieveSubscriptionsParams) error {
+func ListRegistrationsSetOffset(offset int) ListRegistrationsParamFunc {
+	return func(p *listRegistrationsParams) error {
 		if offset < 0 {
-			return fmt.Errorf("offset cannot be less than or equal 0")
+			return fmt.Errorf("offset cannot be less than 0")
 		}
 		p.offset = offset
 		return nil
 	}
 }
 
-func RetrieveSubscriptionsSetOptions(options string) RetrieveSubscriptionsParamFunc {
-	return func(p *retrieveSubscriptionsParams) error {
-		if options != "" && options != "count" {
-			return fmt.Errorf("Invalid value for options param")
-		}
-		p.options = options
-		return nil
-	}
-}
-
-func RetrieveSubscriptionsSetFiwareService(fiwareService string) RetrieveSubscriptionsParamFunc {
-	return func(p *retrieveSubscriptionsParams) error {
+func ListRegistrationsSetFiwareService(fiwareService string) ListRegistrationsParamFunc {
+	return func(p *listRegistrationsParams) error {
 		p.fiwareService = fiwareService
 		return nil
 	}
 }
 
-func RetrieveSubscriptionsSetFiwareServicePath(fiwareServicePath string) RetrieveSubscriptionsParamFunc {
-	return func(p *retrieveSubscriptionsParams) error {
+func ListRegistrationsSetFiwareServicePath(fiwareServicePath string) ListRegistrationsParamFunc {
+	return func(p *listRegistrationsParams) error {
 		p.fiwareServicePath = fiwareServicePath
 		return nil
 	}
 }
 
-type SubscriptionsResponse struct {
+type RegistrationsResponse struct {
 	Count         int
-	Subscriptions []*model.Subscription
+	Registrations []*model.Registration
 }
 
-// RetrieveSubscriptions returs the subscriptions present in the system.
-// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions/subscription-list/retrieve-subscriptions
-func (c *NgsiV2Client) RetrieveSubscriptions(options ...RetrieveSubscriptionsParamFunc) (*SubscriptionsResponse, error) {
-	params := new(retrieveSubscriptionsParams)
+// ListRegistrations returns the registrations present in the system.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/registrations/registration-list/retrieve-registrations
+func (c *NgsiV2Client) ListRegistrations(options ...ListRegistrationsParamFunc) (*RegistrationsResponse, error) {
+	return c.ListRegistrationsWithContext(context.Background(), options...)
+}
+
+// ListRegistrationsWithContext is like ListRegistrations, but uses ctx for the requests.
+func (c *NgsiV2Client) ListRegistrationsWithContext(ctx context.Context, options ...ListRegistrationsParamFunc) (*RegistrationsResponse, error) {
+	params := new(listRegistrationsParams)
 
 	// apply the options
 	for _, option := range options {
@@ -990,13 +3339,13 @@ func (c *NgsiV2Client) RetrieveSubscriptions(options ...RetrieveSubscriptionsPar
 		}
 	}
 
-	sUrl, err := c.getSubscriptionsUrl()
+	rUrl, err := c.getRegistrationsUrl(ctx)
 	if err != nil {
 		return nil, err
 	}
-	req, err := c.newRequest("GET", sUrl, nil, params.headers()...)
+	req, err := c.newRequest(ctx, "GET", rUrl, nil, params.headers()...)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create request for subscriptions retrieval: %+v", err)
+		return nil, fmt.Errorf("Could not create request for registrations retrieval: %w", err)
 	}
 	q := req.URL.Query()
 	if params.limit > 0 {
@@ -1005,52 +3354,47 @@ func (c *NgsiV2Client) RetrieveSubscriptions(options ...RetrieveSubscriptionsPar
 	if params.offset > 0 {
 		q.Add("offset", strconv.Itoa(params.offset))
 	}
-	if params.options != "" {
-		q.Add("options", string(params.options))
-	}
+	q.Add("options", string(model.CountRepresentation))
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := c.c.Do(req)
+	resp, err := c.do("ListRegistrations", req)
 	if err != nil {
-		return nil, fmt.Errorf("Could not retrieve subscriptions: %+v", err)
+		return nil, fmt.Errorf("Could not retrieve registrations: %w", err)
 	}
 	defer resp.Body.Close()
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
-	} else {
-		var subs []*model.Subscription
-		if err := json.Unmarshal(bodyBytes, &subs); err != nil {
-			return nil, fmt.Errorf("Error reading retrieve subscriptions response: %+v", err)
-		} else {
-			ret := new(SubscriptionsResponse)
-			ret.Subscriptions = subs
-			if c, err := strconv.Atoi(resp.Header.Get("Fiware-Total-Count")); err == nil {
-				ret.Count = c
-			}
-			return ret, nil
-		}
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
 	}
+	var regs []*model.Registration
+	if err := json.Unmarshal(bodyBytes, &regs); err != nil {
+		return nil, fmt.Errorf("Error reading retrieve registrations response: %w", err)
+	}
+	ret := &RegistrationsResponse{Registrations: regs}
+	if c, err := strconv.Atoi(resp.Header.Get("Fiware-Total-Count")); err == nil {
+		ret.Count = c
+	}
+	return ret, nil
 }
 
-// UpdateSubscription updates a subscription identified by the given id with the field specified in the request.
-// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions/subscription-by-id/update-subscription
-func (c *NgsiV2Client) UpdateSubscription(id string, patchSubscription *model.Subscription, options ...SubscriptionParamFunc) error {
-	if id == "" {
-		return fmt.Errorf("Cannot update subscription with empty 'id'")
-	}
+// DeleteRegistration deletes a registration identified by the given id.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/registrations/registration-by-id/delete-registration
+func (c *NgsiV2Client) DeleteRegistration(id string, options ...RegistrationParamFunc) error {
+	return c.DeleteRegistrationWithContext(context.Background(), id, options...)
+}
 
-	jsonValue, err := json.Marshal(patchSubscription)
-	if err != nil {
-		return fmt.Errorf("Could not serialize subscription: %+v", err)
+// DeleteRegistrationWithContext is like DeleteRegistration, but uses ctx for the requests.
+func (c *NgsiV2Client) DeleteRegistrationWithContext(ctx context.Context, id string, options ...RegistrationParamFunc) error {
+	if id == "" {
+		return fmt.Errorf("Cannot delete registration with empty 'id'")
 	}
 
-	sUrl, err := c.getSubscriptionsUrl()
+	rUrl, err := c.getRegistrationsUrl(ctx)
 	if err != nil {
 		return err
 	}
 
-	params := new(subscriptionParams)
+	params := new(registrationParams)
 
 	// apply the options
 	for _, option := range options {
@@ -1059,56 +3403,262 @@ func (c *NgsiV2Client) UpdateSubscription(id string, patchSubscription *model.Su
 		}
 	}
 
-	req, err := c.newRequest("PATCH", fmt.Sprintf("%s/%s", sUrl, id), bytes.NewBuffer(jsonValue), params.headers()...)
+	req, err := c.newRequest(ctx, "DELETE", fmt.Sprintf("%s/%s", rUrl, id), nil, params.headers()...)
 	if err != nil {
-		return fmt.Errorf("Could not create request for subscription updating: %+v", err)
+		return fmt.Errorf("Could not create request for registration deletion: %w", err)
 	}
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := c.c.Do(req)
+	resp, err := c.do("DeleteRegistration", req)
 	if err != nil {
-		return fmt.Errorf("Error invoking update subscription: %+v", err)
+		return fmt.Errorf("Error invoking delete registration: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusNoContent {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
+		return newAPIError(resp.StatusCode, bodyBytes)
 	}
 	return nil
 }
 
-// DeleteSubscription cancels a subscription identified by the given id.
-// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions/subscription-by-id/delete-subscription
-func (c *NgsiV2Client) DeleteSubscription(id string, options ...SubscriptionParamFunc) error {
-	if id == "" {
-		return fmt.Errorf("Cannot delete subscription with empty 'id'")
+const defaultTypesPageSize = 100
+
+type listTypesParams struct {
+	fiwareHeaderParams
+	limit  int
+	offset int
+	values bool
+}
+
+type ListTypesParamFunc func(*listTypesParams) error
+
+func ListTypesSetOffset(offset int) ListTypesParamFunc {
+	return func(p *listTypesParams) error {
+		if offset < 0 {
+			return fmt.Errorf("offset cannot be less than 0")
+		}
+		p.offset = offset
+		return nil
+	}
+}
+
+// ListTypesSetOptions sets the representation of the types.
+// Only values is supported: just the type names are retrieved, without attributes and count.
+// Use CountEntityTypes to get the number of types.
+func ListTypesSetOptions(opts model.SimplifiedEntityRepresentation) ListTypesParamFunc {
+	return func(p *listTypesParams) error {
+		switch opts {
+		case "":
+			p.values = false
+		case model.ValuesRepresentation:
+			p.values = true
+		default:
+			return fmt.Errorf("Invalid value for options param: '%s'", opts)
+		}
+		return nil
+	}
+}
+
+func ListTypesSetLimit(limit int) ListTypesParamFunc {
+	return func(p *listTypesParams) error {
+		if limit <= 0 {
+			return fmt.Errorf("limit cannot be less than or equal 0")
+		}
+		p.limit = limit
+		return nil
+	}
+}
+
+func ListTypesSetFiwareService(fiwareService string) ListTypesParamFunc {
+	return func(p *listTypesParams) error {
+		p.fiwareService = fiwareService
+		return nil
+	}
+}
+
+func ListTypesSetFiwareServicePath(fiwareServicePath string) ListTypesParamFunc {
+	return func(p *listTypesParams) error {
+		p.fiwareServicePath = fiwareServicePath
+		return nil
 	}
+}
 
-	sUrl, err := c.getSubscriptionsUrl()
+// listEntityTypesPage retrieves a single page of entity types, along with
+// the total number of types known by the context broker.
+func (c *NgsiV2Client) listEntityTypesPage(ctx context.Context, params *listTypesParams) ([]*model.EntityType, int, error) {
+	tUrl, err := c.getTypesUrl(ctx)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
-	params := new(subscriptionParams)
+	req, err := c.newRequest(ctx, "GET", tUrl, nil, params.headers()...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not create request for entity types: %w", err)
+	}
+	q := req.URL.Query()
+	if params.limit > 0 {
+		q.Add("limit", strconv.Itoa(params.limit))
+	}
+	if params.offset > 0 {
+		q.Add("offset", strconv.Itoa(params.offset))
+	}
+	if params.values {
+		q.Add("options", fmt.Sprintf("%s,%s", model.ValuesRepresentation, model.CountRepresentation))
+	} else {
+		q.Add("options", string(model.CountRepresentation))
+	}
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.do("ListEntityTypes", req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not list entity types: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, newAPIError(resp.StatusCode, bodyBytes)
+	}
+	var ret []*model.EntityType
+	if params.values {
+		// only the type names are returned
+		var names []string
+		if err := json.Unmarshal(bodyBytes, &names); err != nil {
+			return nil, 0, fmt.Errorf("Error reading list entity types response: %w", err)
+		}
+		for _, name := range names {
+			ret = append(ret, &model.EntityType{Type: name})
+		}
+	} else if err := json.Unmarshal(bodyBytes, &ret); err != nil {
+		return nil, 0, fmt.Errorf("Error reading list entity types response: %w", err)
+	}
+	total, err := strconv.Atoi(resp.Header.Get("Fiware-Total-Count"))
+	if err != nil {
+		return nil, 0, errors.New("Fiware-Total-Count not found in header")
+	}
+	return ret, total, nil
+}
+
+// ListEntityTypes retrieves a list of the entity types, with their attributes and
+// the number of entities of each type.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/types/list-entity-types/retrieve-entity-types
+func (c *NgsiV2Client) ListEntityTypes(options ...ListTypesParamFunc) ([]*model.EntityType, error) {
+	return c.ListEntityTypesWithContext(context.Background(), options...)
+}
+
+// ListEntityTypesWithContext is like ListEntityTypes, but uses ctx for the requests.
+func (c *NgsiV2Client) ListEntityTypesWithContext(ctx context.Context, options ...ListTypesParamFunc) ([]*model.EntityType, error) {
+	params := new(listTypesParams)
 
 	// apply the options
 	for _, option := range options {
 		if err := option(params); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	req, err := c.newRequest("DELETE", fmt.Sprintf("%s/%s", sUrl, id), nil, params.headers()...)
+	ret, _, err := c.listEntityTypesPage(ctx, params)
 	if err != nil {
-		return fmt.Errorf("Could not create request for subscription deletion: %+v", err)
+		return nil, err
 	}
-	resp, err := c.c.Do(req)
+	return ret, nil
+}
+
+// CountEntityTypes returns how many entity types are known by the context broker.
+func (c *NgsiV2Client) CountEntityTypes(options ...ListTypesParamFunc) (int, error) {
+	return c.CountEntityTypesWithContext(context.Background(), options...)
+}
+
+// CountEntityTypesWithContext is like CountEntityTypes, but uses ctx for the requests.
+func (c *NgsiV2Client) CountEntityTypesWithContext(ctx context.Context, options ...ListTypesParamFunc) (int, error) {
+	params := new(listTypesParams)
+
+	// apply the options
+	for _, option := range options {
+		if err := option(params); err != nil {
+			return 0, err
+		}
+	}
+	params.limit = 1
+	params.values = true
+
+	_, total, err := c.listEntityTypesPage(ctx, params)
 	if err != nil {
-		return fmt.Errorf("Error invoking delete subscription: %+v", err)
+		return 0, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusNoContent {
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("Unexpected status code: '%d'\nResponse body: %s", resp.StatusCode, string(bodyBytes))
+	return total, nil
+}
+
+// EntityTypeIterator walks through all the entity types of the context broker,
+// transparently fetching the pages as needed.
+type EntityTypeIterator struct {
+	c       *NgsiV2Client
+	ctx     context.Context
+	params  *listTypesParams
+	page    []*model.EntityType
+	current *model.EntityType
+	total   int
+	fetched bool
+	err     error
+}
+
+// IterateEntityTypes returns an iterator over all the entity types.
+// The page size can be set with ListTypesSetLimit.
+func (c *NgsiV2Client) IterateEntityTypes(options ...ListTypesParamFunc) *EntityTypeIterator {
+	return c.IterateEntityTypesWithContext(context.Background(), options...)
+}
+
+// IterateEntityTypesWithContext is like IterateEntityTypes, but uses ctx for the requests.
+func (c *NgsiV2Client) IterateEntityTypesWithContext(ctx context.Context, options ...ListTypesParamFunc) *EntityTypeIterator {
+	it := &EntityTypeIterator{c: c, ctx: ctx, params: new(listTypesParams)}
+
+	// apply the options
+	for _, option := range options {
+		if err := option(it.params); err != nil {
+			it.err = err
+			return it
+		}
 	}
-	return nil
+	if it.params.limit == 0 {
+		it.params.limit = defaultTypesPageSize
+	}
+	return it
+}
+
+// Next advances the iterator to the next entity type, fetching a new page if needed.
+// It returns false when there are no more types or an error occurred.
+func (it *EntityTypeIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.page) == 0 {
+		if it.fetched && it.params.offset >= it.total {
+			it.current = nil
+			return false
+		}
+		page, total, err := it.c.listEntityTypesPage(it.ctx, it.params)
+		if err != nil {
+			it.err = err
+			it.current = nil
+			return false
+		}
+		it.fetched = true
+		it.total = total
+		it.params.offset += len(page)
+		it.page = page
+		if len(it.page) == 0 {
+			it.current = nil
+			return false
+		}
+	}
+	it.current = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+// EntityType returns the current entity type.
+func (it *EntityTypeIterator) EntityType() *model.EntityType {
+	return it.current
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (it *EntityTypeIterator) Err() error {
+	return it.err
 }
@@ -1,11 +1,20 @@
 package client_test
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -64,6 +73,153 @@ func TestBatchUpdateNoContent(t *testing.T) {
 	}
 }
 
+func TestBatchUpdateStream(t *testing.T) {
+	batches := make(chan *model.BatchUpdate, 10)
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				b := new(model.BatchUpdate)
+				if err := json.NewDecoder(r.Body).Decode(b); err != nil {
+					t.Errorf("Unexpected error: '%v'", err)
+				}
+				batches <- b
+				w.WriteHeader(http.StatusNoContent)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	entities := make(chan *model.Entity)
+	go func() {
+		for i := 0; i < 5; i++ {
+			e, _ := model.NewEntity(fmt.Sprintf("Room%d", i), "Room")
+			entities <- e
+		}
+		close(entities)
+	}()
+	if err := cli.BatchUpdateStream(context.Background(), entities, model.AppendAction, 2, 0); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	close(batches)
+
+	sizes := []int{}
+	for b := range batches {
+		if b.ActionType != model.AppendAction {
+			t.Fatalf("Expected action '%s', got '%s'", model.AppendAction, b.ActionType)
+		}
+		sizes = append(sizes, len(b.Entities))
+	}
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Fatalf("Unexpected batch sizes: %v", sizes)
+	}
+}
+
+func TestUpsertAndDiff(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if r.Method == http.MethodPost && r.URL.Path == "/v2/op/update" {
+					b := new(model.BatchUpdate)
+					json.NewDecoder(r.Body).Decode(b)
+					if b.ActionType != model.AppendAction || len(b.Entities) != 1 {
+						t.Errorf("Unexpected batch update: %v", b)
+					}
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				if r.Method == http.MethodGet && r.URL.Path == "/v2/entities/Car1" {
+					if r.URL.Query().Get("type") != "Car" {
+						t.Errorf("Expected type 'Car', got '%s'", r.URL.Query().Get("type"))
+					}
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprint(w, `{"id":"Car1","type":"Car","speed":{"type":"Number","value":98,"metadata":{}},"seenAt":{"type":"DateTime","value":"2020-04-01T10:00:00.000Z","metadata":{}},"brand":{"type":"Text","value":"FIAT","metadata":{}},"owner":{"type":"Text","value":"provider","metadata":{}}}`)
+					return
+				}
+				t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	e, _ := model.NewEntity("Car1", "Car")
+	e.SetAttributeAsNumber("speed", 98)
+	e.SetAttributeAsDateTime("seenAt", time.Date(2020, 4, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600)))
+	e.SetAttributeAsText("brand", "Fiat")
+	e.SetAttributeAsBoolean("parked", true)
+
+	stored, added, changed, removed, err := cli.UpsertAndDiff(e)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if stored.Id != "Car1" {
+		t.Fatalf("Expected stored entity 'Car1', got '%s'", stored.Id)
+	}
+	if len(added) != 1 || added[0] != "owner" {
+		t.Fatalf("Unexpected added attributes: %v", added)
+	}
+	if len(changed) != 1 || changed[0] != "brand" {
+		t.Fatalf("Unexpected changed attributes: %v", changed)
+	}
+	if len(removed) != 1 || removed[0] != "parked" {
+		t.Fatalf("Unexpected removed attributes: %v", removed)
+	}
+}
+
+func TestBatchUpdateStreamInterval(t *testing.T) {
+	flushed := make(chan int, 10)
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				b := new(model.BatchUpdate)
+				json.NewDecoder(r.Body).Decode(b)
+				flushed <- len(b.Entities)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	entities := make(chan *model.Entity)
+	done := make(chan error)
+	go func() {
+		done <- cli.BatchUpdateStream(ctx, entities, model.UpdateAction, 100, 10*time.Millisecond)
+	}()
+
+	e, _ := model.NewEntity("Room1", "Room")
+	entities <- e
+	select {
+	case n := <-flushed:
+		if n != 1 {
+			t.Fatalf("Expected 1 entity flushed, got %d", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a flush after the interval")
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context canceled error, got '%v'", err)
+	}
+
+	if err := cli.BatchUpdateStream(context.Background(), entities, model.UpdateAction, 0, 0); err == nil {
+		t.Fatal("Expected an error for invalid flush size")
+	}
+}
+
 func TestBatchQueryBadRequest(t *testing.T) {
 	ts := httptest.NewServer(
 		http.HandlerFunc(
@@ -127,6 +283,72 @@ func TestBatchQuery(t *testing.T) {
 	}
 }
 
+func TestBatchQuerySetOptions(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Fiware-Total-Count", "7")
+				switch r.URL.Query().Get("options") {
+				case "keyValues,count":
+					fmt.Fprint(w, `[{"id":"r1","type":"Room","pressure":720,"temperature":23.5,"name":"Kitchen"}]`)
+				case "values":
+					fmt.Fprint(w, `[[23.5,720],[21,710]]`)
+				default:
+					t.Fatalf("Unexpected options '%s'", r.URL.Query().Get("options"))
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	bq := &model.BatchQuery{}
+	bq.Match(model.NewEntityMatcher().ByType("Room"))
+	res, count, err := cli.BatchQueryWithCount(bq, client.BatchQuerySetOptions(model.KeyValuesRepresentation))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if count != 7 {
+		t.Fatalf("Expected count 7, got %d", count)
+	}
+	if len(res) != 1 || res[0].Id != "r1" || res[0].Type != "Room" {
+		t.Fatal("Invalid entity retrieved")
+	}
+	if temp, err := res[0].GetAttributeAsFloat("temperature"); err != nil || temp != 23.5 {
+		t.Fatalf("Invalid temperature: %v, %v", temp, err)
+	}
+	if name, err := res[0].GetAttributeAsString("name"); err != nil || name != "Kitchen" {
+		t.Fatalf("Invalid name: %v, %v", name, err)
+	}
+
+	if _, err := cli.BatchQuery(bq, client.BatchQuerySetOptions(model.ValuesRepresentation)); err == nil {
+		t.Fatal("Expected an error for values representation without attributes")
+	}
+	bq.Attrs = []string{"temperature", "pressure"}
+	res, err = cli.BatchQuery(bq, client.BatchQuerySetOptions(model.ValuesRepresentation))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("Expected 2 entities, got %d", len(res))
+	}
+	if pressure, err := res[1].GetAttributeAsFloat("pressure"); err != nil || pressure != 710 {
+		t.Fatalf("Invalid pressure: %v, %v", pressure, err)
+	}
+
+	if _, err := cli.BatchQuery(bq, client.BatchQuerySetOptions(model.UniqueRepresentation)); err == nil {
+		t.Fatal("Expected an error for unsupported option")
+	}
+	if _, err := cli.BatchQuery(bq,
+		client.BatchQuerySetOptions(model.ValuesRepresentation),
+		client.BatchQuerySetOptions(model.KeyValuesRepresentation)); err == nil {
+		t.Fatal("Expected an error for conflicting options")
+	}
+}
+
 func TestRetrieveAPIResources(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(apiResourcesHandler))
 	defer ts.Close()
@@ -180,6 +402,51 @@ func TestCountEntities(t *testing.T) {
 	}
 }
 
+func TestListEntitiesSetTypes(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if r.URL.Query().Get("type") != "Room,Office" {
+					t.Fatalf("Expected type 'Room,Office', got '%s'", r.URL.Query().Get("type"))
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Fiware-Total-Count", "2")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, `[{"id":"Room1","type":"Room"},{"id":"Office1","type":"Office"}]`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	entities, err := cli.ListEntities(client.ListEntitiesSetTypes([]string{"Room", "Office"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(entities) != 2 || entities[0].Type != "Room" || entities[1].Type != "Office" {
+		t.Fatal("Invalid entities retrieved")
+	}
+
+	if count, err := cli.CountEntities(client.ListEntitiesSetTypes([]string{"Room", "Office"})); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if count != 2 {
+		t.Fatalf("Expected 2 entities counted, got %d", count)
+	}
+
+	if _, err := cli.ListEntities(client.ListEntitiesSetTypes([]string{"Room", "Off ice"})); err == nil {
+		t.Fatal("Expected an error for invalid type name")
+	}
+	if _, err := cli.ListEntities(client.ListEntitiesSetTypes(nil)); err == nil {
+		t.Fatal("Expected an error for no types")
+	}
+}
+
 func TestRetrieveEntity(t *testing.T) {
 	ts := httptest.NewServer(
 		http.HandlerFunc(
@@ -256,7 +523,9 @@ func TestRetrieveEntityNotFound(t *testing.T) {
 	if res, err := cli.RetrieveEntity("r1", client.RetrieveEntitySetType("Room")); err == nil {
 		t.Fatal("Expected error (404), but got none")
 	} else {
-		// TODO check 404
+		if !errors.Is(err, client.ErrNotFound) {
+			t.Fatalf("Expected a not found error, got: '%v'", err)
+		}
 		if res != nil {
 			t.Fatalf("Expected a nil response, got: %+v", *res)
 		}
@@ -448,7 +717,14 @@ func TestCreateSubscriptionBadRequest(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unexpected error: '%v'", err)
 	}
-	if subId, err := cli.CreateSubscription(&model.Subscription{Description: "quite empty"}); err == nil {
+	sub := &model.Subscription{
+		Description: "rejected by the broker",
+		Subject:     &model.SubscriptionSubject{Entities: []*model.SubscriptionSubjectEntity{model.NewEntityMatcher().ById("Room1")}},
+		Notification: &model.SubscriptionNotification{
+			Http: &model.SubscriptionNotificationHttp{Url: "http://localhost:1234"},
+		},
+	}
+	if subId, err := cli.CreateSubscription(sub); err == nil {
 		t.Fatal("Expected an error")
 	} else if subId != "" {
 		t.Fatalf("Subscription id should be empty, got '%s' instead", subId)
@@ -472,13 +748,44 @@ func TestCreateSubscriptionCreated(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unexpected error: '%v'", err)
 	}
-	if subId, err := cli.CreateSubscription(&model.Subscription{Description: "quite empty, but we pretend it's ok"}); err != nil {
+	sub := &model.Subscription{
+		Description: "room subscription",
+		Subject:     &model.SubscriptionSubject{Entities: []*model.SubscriptionSubjectEntity{model.NewEntityMatcher().ById("Room1")}},
+		Notification: &model.SubscriptionNotification{
+			Http: &model.SubscriptionNotificationHttp{Url: "http://localhost:1234"},
+		},
+	}
+	if subId, err := cli.CreateSubscription(sub); err != nil {
 		t.Fatalf("Unexpected error: '%v'", err)
 	} else if subId != "abcde12345" {
 		t.Fatalf("Subscription id should be abcde12345, got '%s' instead", subId)
 	}
 }
 
+func TestCreateSubscriptionInvalid(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					t.Errorf("Invalid subscription should not reach the broker")
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.CreateSubscription(&model.Subscription{Description: "quite empty"}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if err := cli.UpdateSubscription("abcde12345", &model.Subscription{Notification: &model.SubscriptionNotification{}}); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
 func TestRetrieveSubscriptionNotFound(t *testing.T) {
 	ts := httptest.NewServer(
 		http.HandlerFunc(
@@ -576,7 +883,7 @@ func TestUpdateSubscriptionNotFound(t *testing.T) {
 		t.Fatalf("Unexpected error: '%v'", err)
 	}
 	et := time.Now()
-	if err := cli.UpdateSubscription("abcde12345", &model.Subscription{Expires: &model.OrionTime{et}}); err == nil {
+	if err := cli.UpdateSubscription("abcde12345", &model.Subscription{Expires: &model.OrionTime{Time: et}}); err == nil {
 		t.Fatal("Expected an error")
 	}
 }
@@ -598,7 +905,7 @@ func TestUpdateSubscriptionNoContent(t *testing.T) {
 		t.Fatalf("Unexpected error: '%v'", err)
 	}
 	et := time.Now()
-	if err := cli.UpdateSubscription("abcde12345", &model.Subscription{Expires: &model.OrionTime{et}}); err != nil {
+	if err := cli.UpdateSubscription("abcde12345", &model.Subscription{Expires: &model.OrionTime{Time: et}}); err != nil {
 		t.Fatalf("Unexpected error: '%v'", err)
 	}
 }
@@ -784,3 +1091,2410 @@ func TestGlobalHeadersSetInRequest(t *testing.T) {
 		t.Fatalf("Unexpected error: '%v'", err)
 	}
 }
+
+func TestIterateEntityTypes(t *testing.T) {
+	types := []string{"Room", "Office", "Building", "Car", "Street"}
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					if !strings.HasSuffix(r.URL.Path, "/v2/types") {
+						t.Fatalf("Unexpected path '%s'", r.URL.Path)
+					}
+					if r.URL.Query().Get("options") != "count" {
+						t.Fatalf("Expected 'count' options, got '%s'", r.URL.Query().Get("options"))
+					}
+					if r.Header.Get("Fiware-Service") != "sampleService" {
+						t.Errorf("Expected 'sampleService' as header in 'Fiware-Service', got '%s'", r.Header.Get("Fiware-Service"))
+					}
+					limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+					offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+					if limit != 2 {
+						t.Fatalf("Expected a limit value of '2', got '%d'", limit)
+					}
+					var page []string
+					for i := offset; i < offset+limit && i < len(types); i++ {
+						page = append(page, fmt.Sprintf(`{"type":"%s","attrs":{"temperature":{"types":["Number"]}},"count":%d}`, types[i], i+1))
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.Header().Set("Fiware-Total-Count", strconv.Itoa(len(types)))
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprintf(w, "[%s]", strings.Join(page, ","))
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	it := cli.IterateEntityTypes(client.ListTypesSetLimit(2), client.ListTypesSetFiwareService("sampleService"))
+	var got []string
+	for it.Next() {
+		et := it.EntityType()
+		if len(et.Attrs["temperature"].Types) != 1 {
+			t.Fatalf("Invalid entity type retrieved: %+v", et)
+		}
+		got = append(got, et.Type)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if strings.Join(got, ",") != strings.Join(types, ",") {
+		t.Fatalf("Expected types '%v', got '%v'", types, got)
+	}
+}
+
+func TestIterateEntityTypesError(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprint(w, `{"error":"InternalServerError","description":"database error"}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	it := cli.IterateEntityTypes()
+	if it.Next() {
+		t.Fatal("Expected no entity types")
+	}
+	if it.Err() == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestEntityDecodeHook(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else if strings.HasSuffix(r.URL.Path, "/v2/entities") {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `[{"id":"R2","type":"Room","temperature":{"type":"Float","value":34,"metadata":{}}},{"id":"R5","type":"Room","temperature":{"type":"Float","value":31,"metadata":{}}}]`)
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `{"id":"R1","type":"Room","temperature":{"type":"Float","value":23,"metadata":{}}}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(
+		client.SetUrl(ts.URL),
+		client.SetEntityDecodeHook(func(e *model.Entity) error {
+			e.Id = strings.ToLower(e.Id)
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if res, err := cli.RetrieveEntity("R1"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if res.Id != "r1" {
+		t.Fatalf("Expected 'r1' as id after hook, got '%s'", res.Id)
+	}
+
+	if res, err := cli.ListEntities(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if len(res) != 2 || res[0].Id != "r2" || res[1].Id != "r5" {
+		t.Fatal("Expected lowercase ids after hook")
+	}
+
+	failing, err := client.NewNgsiV2Client(
+		client.SetUrl(ts.URL),
+		client.SetEntityDecodeHook(func(e *model.Entity) error {
+			return errors.New("rejected")
+		}))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if res, err := failing.RetrieveEntity("R1"); err == nil {
+		t.Fatal("Expected an error from the decode hook")
+	} else if res != nil {
+		t.Fatalf("Expected a nil response, got: %+v", *res)
+	}
+}
+
+func TestReplaceEntityAttributes(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					if r.Method != "PUT" {
+						t.Fatalf("Expected PUT method, got '%s'", r.Method)
+					}
+					if !strings.HasSuffix(r.URL.Path, "/v2/entities/Bcn-Welt/attrs") {
+						t.Fatalf("Unexpected path '%s'", r.URL.Path)
+					}
+					if r.Header.Get("Content-Type") != "application/json" {
+						t.Fatal("Missing application/json Content-Type header")
+					}
+					if r.URL.Query().Get("type") != "Room" {
+						t.Fatalf("Expected 'type' value: 'Room', got '%s'", r.URL.Query().Get("type"))
+					}
+					if r.Header.Get("Fiware-Service") != "sampleService" {
+						t.Errorf("Expected 'sampleService' as header in 'Fiware-Service', got '%s'", r.Header.Get("Fiware-Service"))
+					}
+					if b, err := ioutil.ReadAll(r.Body); err != nil {
+						t.Fatalf("Unexpected error: '%v'", err)
+					} else if string(b) != `{"temperature":{"type":"Float","value":21.7}}` {
+						t.Fatalf("Unexpected request body: '%s'", string(b))
+					}
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	attrs := map[string]*model.Attribute{
+		"temperature": model.NewAttribute(model.FloatType, 21.7),
+	}
+	if err := cli.ReplaceEntityAttributes(
+		"Bcn-Welt",
+		attrs,
+		client.UpdateEntitySetType("Room"),
+		client.UpdateEntitySetFiwareService("sampleService")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+}
+
+func TestReplaceEntityAttributesNotFound(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"error":"NotFound","description":"The requested entity has not been found. Check type and id"}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.ReplaceEntityAttributes("Bcn-Welt", map[string]*model.Attribute{}); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected a not found error, got: '%v'", err)
+	}
+}
+
+func TestReplaceEntityAttributesOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []client.UpdateEntityParamFunc
+		want    string
+		body    string
+		fails   bool
+	}{
+		{"normalized", nil, "", `{"temperature":{"type":"Float","value":21.7}}`, false},
+		{"keyValues", []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsKeyValues()}, "keyValues", `{"temperature":21.7}`, false},
+		{"append", []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsAppend()}, "", "", true},
+		{"keyValues and append", []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsAppend(), client.UpdateEntitySetOptionsKeyValues()}, "", "", true},
+		{"forcedUpdate", []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsForcedUpdate(), client.UpdateEntitySetOptionsKeyValues()}, "keyValues,forcedUpdate", `{"temperature":21.7}`, false},
+		{"overwrite", []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsOverwrite()}, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						if strings.HasSuffix(r.URL.Path, "/v2") {
+							apiResourcesHandler(w, r)
+						} else {
+							if tt.fails {
+								t.Fatal("No request expected")
+							}
+							if r.URL.Query().Get("options") != tt.want {
+								t.Fatalf("Expected '%s' options value, got '%s'", tt.want, r.URL.Query().Get("options"))
+							}
+							if b, _ := ioutil.ReadAll(r.Body); string(b) != tt.body {
+								t.Fatalf("Expected request body '%s', got '%s'", tt.body, string(b))
+							}
+							w.WriteHeader(http.StatusNoContent)
+						}
+					}))
+			defer ts.Close()
+
+			cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			attrs := map[string]*model.Attribute{
+				"temperature": model.NewAttribute(model.FloatType, 21.7),
+			}
+			err = cli.ReplaceEntityAttributes("Bcn-Welt", attrs, tt.options...)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected not error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSubscriptionDiagnostics(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					if !strings.HasSuffix(r.URL.Path, "/v2/subscriptions/abcdef") {
+						t.Fatalf("Unexpected path '%s'", r.URL.Path)
+					}
+					if r.Header.Get("Fiware-Service") != "sampleService" {
+						t.Errorf("Expected 'sampleService' as header in 'Fiware-Service', got '%s'", r.Header.Get("Fiware-Service"))
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `{"id":"abcdef","status":"active","subject":{"entities":[{"idPattern":".*","type":"Room"}]},"notification":{"http":{"url":"http://localhost:1234"},"timesSent":12,"lastNotification":"2020-03-11T10:15:00.00Z","lastFailure":"2020-03-11T10:15:00.00Z","lastSuccess":"2020-03-11T10:00:00.00Z","lastSuccessCode":200}}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	d, err := cli.SubscriptionDiagnostics("abcdef", client.SubscriptionSetFiwareService("sampleService"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if d.Id != "abcdef" || d.TimesSent != 12 || d.LastSuccessCode == nil || *d.LastSuccessCode != 200 {
+		t.Fatalf("Unexpected diagnostics: %+v", d)
+	}
+	if d.Health != model.SubscriptionFailing {
+		t.Fatalf("Expected '%s' health, got '%s'", model.SubscriptionFailing, d.Health)
+	}
+}
+
+func TestAppendEntityAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		strict  bool
+		options []client.UpdateEntityParamFunc
+		want    string
+		body    string
+	}{
+		{"upsert", false, nil, "", `{"temperature":{"type":"Float","value":21.7}}`},
+		{"strict", true, nil, "append", `{"temperature":{"type":"Float","value":21.7}}`},
+		{"append option", false, []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsAppend()}, "append", `{"temperature":{"type":"Float","value":21.7}}`},
+		{"keyValues", false, []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsKeyValues()}, "keyValues", `{"temperature":21.7}`},
+		{"keyValues strict", true, []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsKeyValues()}, "keyValues,append", `{"temperature":21.7}`},
+		{"overwrite", false, []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsOverwrite()}, "overwrite", `{"temperature":{"type":"Float","value":21.7}}`},
+		{"forcedUpdate strict", true, []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsForcedUpdate()}, "append,forcedUpdate", `{"temperature":{"type":"Float","value":21.7}}`},
+		{"all but append", false, []client.UpdateEntityParamFunc{client.UpdateEntitySetOptionsForcedUpdate(), client.UpdateEntitySetOptionsOverwrite(), client.UpdateEntitySetOptionsKeyValues()}, "keyValues,overwrite,forcedUpdate", `{"temperature":21.7}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						if strings.HasSuffix(r.URL.Path, "/v2") {
+							apiResourcesHandler(w, r)
+						} else {
+							if r.Method != "POST" {
+								t.Fatalf("Expected POST method, got '%s'", r.Method)
+							}
+							if !strings.HasSuffix(r.URL.Path, "/v2/entities/Bcn-Welt/attrs") {
+								t.Fatalf("Unexpected path '%s'", r.URL.Path)
+							}
+							if r.URL.Query().Get("options") != tt.want {
+								t.Fatalf("Expected '%s' options value, got '%s'", tt.want, r.URL.Query().Get("options"))
+							}
+							if b, _ := ioutil.ReadAll(r.Body); string(b) != tt.body {
+								t.Fatalf("Expected request body '%s', got '%s'", tt.body, string(b))
+							}
+							w.WriteHeader(http.StatusNoContent)
+						}
+					}))
+			defer ts.Close()
+
+			cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			attrs := map[string]*model.Attribute{
+				"temperature": model.NewAttribute(model.FloatType, 21.7),
+			}
+			if err := cli.AppendEntityAttributes("Bcn-Welt", attrs, tt.strict, tt.options...); err != nil {
+				t.Fatalf("expected not error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAppendEntityAttributesUnprocessable(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					fmt.Fprint(w, `{"error":"Unprocessable","description":"one or more of the attributes in the request already exist: [ temperature ]"}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	attrs := map[string]*model.Attribute{
+		"temperature": model.NewAttribute(model.FloatType, 21.7),
+	}
+	err = cli.AppendEntityAttributes("Bcn-Welt", attrs, true)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !strings.Contains(err.Error(), "already exist") {
+		t.Fatalf("Expected the response body in the error, got '%v'", err)
+	}
+}
+
+func TestRetrieveEntityAttributes(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					if !strings.HasSuffix(r.URL.Path, "/v2/entities/r1/attrs") {
+						t.Fatalf("Unexpected path '%s'", r.URL.Path)
+					}
+					if r.URL.Query().Get("type") != "Room" {
+						t.Fatalf("Expected 'type' value: 'Room', got '%s'", r.URL.Query().Get("type"))
+					}
+					if r.URL.Query().Get("attrs") != "temperature,lastUpdate" {
+						t.Fatalf("Expected 'attrs' value: 'temperature,lastUpdate', got '%s'", r.URL.Query().Get("attrs"))
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `{"temperature":{"type":"Float","value":23,"metadata":{}},"lastUpdate":{"type":"DateTime","value":"2018-07-24T07:21:24.238Z","metadata":{}}}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	attrs, err := cli.RetrieveEntityAttributes(
+		"r1",
+		client.RetrieveEntitySetType("Room"),
+		client.RetrieveEntityAddAttribute("temperature"),
+		client.RetrieveEntityAddAttribute("lastUpdate"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(attrs) != 2 {
+		t.Fatalf("Expected 2 attributes, got %d", len(attrs))
+	}
+	if v, err := attrs["temperature"].GetAsFloat(); err != nil || v != 23 {
+		t.Fatalf("Expected 23 for temperature, got %v (%v)", v, err)
+	}
+	if _, err := attrs["lastUpdate"].GetAsDateTime(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+}
+
+func TestGetEntityAttribute(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else if strings.HasSuffix(r.URL.Path, "/v2/entities/r1/attrs/location") {
+					if r.URL.Query().Get("type") != "Room" {
+						t.Fatalf("Expected 'type' value: 'Room', got '%s'", r.URL.Query().Get("type"))
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `{"type":"geo:point","value":"43.8030095, 11.2385831","metadata":{}}`)
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"error":"NotFound","description":"The entity does not have such an attribute"}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	attr, err := cli.GetEntityAttribute("r1", "location", client.RetrieveEntitySetType("Room"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if p, err := attr.GetAsGeoPoint(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if p.Latitude != 43.8030095 || p.Longitude != 11.2385831 {
+		t.Fatalf("Unexpected location value: %v", p)
+	}
+
+	if _, err := cli.GetEntityAttribute("r1", "humidity"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected a not found error, got: '%v'", err)
+	}
+	if _, err := cli.GetEntityAttribute("r1", "bad/name"); err == nil {
+		t.Fatal("Expected an error for an invalid attribute name")
+	}
+}
+
+func TestSubscriptionsResponseSummaries(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `[
+{"id":"s1","status":"active","subject":{"entities":[{"idPattern":".*"}]},"notification":{"http":{"url":"http://localhost:1234"},"timesSent":3,"lastSuccess":"2020-03-11T10:15:00.00Z","lastSuccessCode":200}},
+{"id":"s2","status":"failed","subject":{"entities":[{"idPattern":".*"}]},"notification":{"httpCustom":{"url":"http://localhost:5678"},"timesSent":1,"lastFailure":"2020-03-11T10:15:00.00Z"}},
+{"id":"s3","status":"active","subject":{"entities":[{"idPattern":".*"}]},"notification":{"mqtt":{"url":"mqtt://localhost:1883","topic":"rooms"},"timesSent":2}},
+{"id":"s4","status":"active","subject":{"entities":[{"idPattern":".*"}]},"notification":{"mqttCustom":{"url":"mqtt://localhost:1884","topic":"rooms"}}}
+]`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	res, err := cli.RetrieveSubscriptions()
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	summaries := res.Summaries()
+	if len(summaries) != 4 {
+		t.Fatalf("Expected 4 summaries, got %d", len(summaries))
+	}
+	if s := summaries[0]; s.Id != "s1" || s.Status != model.SubscriptionActive || s.NotificationURL != "http://localhost:1234" || s.TimesSent != 3 || !s.Healthy {
+		t.Fatalf("Unexpected summary: %+v", s)
+	}
+	if s := summaries[1]; s.Id != "s2" || s.Status != model.SubscriptionFailed || s.NotificationURL != "http://localhost:5678" || s.TimesSent != 1 || s.Healthy {
+		t.Fatalf("Unexpected summary: %+v", s)
+	}
+	if s := summaries[2]; s.Id != "s3" || s.NotificationURL != "mqtt://localhost:1883" || s.TimesSent != 2 || !s.Healthy {
+		t.Fatalf("Unexpected summary: %+v", s)
+	}
+	if s := summaries[3]; s.Id != "s4" || s.NotificationURL != "mqtt://localhost:1884" || s.TimesSent != 0 {
+		t.Fatalf("Unexpected summary: %+v", s)
+	}
+}
+
+func TestUpdateEntityAttribute(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					if r.Method != "PUT" {
+						t.Fatalf("Expected PUT method, got '%s'", r.Method)
+					}
+					if !strings.HasSuffix(r.URL.Path, "/v2/entities/Bcn-Welt/attrs/temperature") {
+						t.Fatalf("Unexpected path '%s'", r.URL.Path)
+					}
+					if r.Header.Get("Content-Type") != "application/json" {
+						t.Fatal("Missing application/json Content-Type header")
+					}
+					if r.URL.Query().Get("type") != "Room" {
+						t.Fatalf("Expected 'type' value: 'Room', got '%s'", r.URL.Query().Get("type"))
+					}
+					if b, _ := ioutil.ReadAll(r.Body); string(b) != `{"type":"Float","value":25.5}` {
+						t.Fatalf("Unexpected request body: '%s'", string(b))
+					}
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.UpdateEntityAttribute("Bcn-Welt", "temperature", model.NewAttribute(model.FloatType, 25.5), client.UpdateEntitySetType("Room")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.UpdateEntityAttribute("Bcn-Welt", "dateCreated", model.NewAttribute(model.FloatType, 25.5)); err == nil {
+		t.Fatal("Expected an error for a reserved attribute name")
+	}
+	if err := cli.UpdateEntityAttribute("Bcn-Welt", "temperature", model.NewAttribute(model.FloatType, 25.5), client.UpdateEntitySetOptionsKeyValues()); err == nil {
+		t.Fatal("Expected an error for an unsupported option")
+	}
+}
+
+func TestRetrieveEntityAnyType(t *testing.T) {
+	var requestedTypes []string
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					entityType := r.URL.Query().Get("type")
+					requestedTypes = append(requestedTypes, entityType)
+					w.Header().Set("Content-Type", "application/json")
+					if entityType != "Office" {
+						w.WriteHeader(http.StatusNotFound)
+						fmt.Fprint(w, `{"description": "The requested entity has not been found. Check type and id", "error": "NotFound"}`)
+						return
+					}
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `{"id":"r1","type":"Office","temperature":{"type":"Float","value":23,"metadata":{}}}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	e, err := cli.RetrieveEntityAnyType("r1", []string{"Room", "Office", "Building"})
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if e.Type != "Office" {
+		t.Fatalf("Expected 'Office' entity, got '%s'", e.Type)
+	}
+	if strings.Join(requestedTypes, ",") != "Room,Office" {
+		t.Fatalf("Unexpected requested types: %v", requestedTypes)
+	}
+
+	if _, err := cli.RetrieveEntityAnyType("r1", []string{"Room", "Building"}); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected a not found error, got: '%v'", err)
+	}
+	if _, err := cli.RetrieveEntityAnyType("r1", nil); err == nil {
+		t.Fatal("Expected an error without types")
+	}
+}
+
+func TestGetEntityAttributeValue(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if r.Header.Get("Accept") != "application/json" {
+					t.Fatal("Missing application/json accept header")
+				}
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/v2/entities/r1/attrs/temperature/value"):
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `23.5`)
+				case strings.HasSuffix(r.URL.Path, "/v2/entities/r1/attrs/name/value"):
+					w.Header().Set("Content-Type", "text/plain")
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `Meeting room`)
+				case strings.HasSuffix(r.URL.Path, "/v2/entities/r1/attrs/dimensions/value"):
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `{"width":5,"height":3}`)
+				default:
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"error":"NotFound","description":"The entity does not have such an attribute"}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if v, err := cli.GetEntityAttributeValue("r1", "temperature"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if f, ok := v.(float64); !ok || f != 23.5 {
+		t.Fatalf("Expected 23.5 as temperature value, got %v", v)
+	}
+	if v, err := cli.GetEntityAttributeValue("r1", "name"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if s, ok := v.(string); !ok || s != "Meeting room" {
+		t.Fatalf("Expected 'Meeting room' as name value, got %v", v)
+	}
+	if v, err := cli.GetEntityAttributeValue("r1", "dimensions"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if m, ok := v.(map[string]interface{}); !ok || m["width"] != 5.0 {
+		t.Fatalf("Unexpected dimensions value %v", v)
+	}
+	if _, err := cli.GetEntityAttributeValue("r1", "humidity"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected a not found error, got: '%v'", err)
+	}
+}
+
+func TestUpdateEntityAttributeValue(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+				} else {
+					if r.Method != "PUT" {
+						t.Fatalf("Expected PUT method, got '%s'", r.Method)
+					}
+					if !strings.HasSuffix(r.URL.Path, "/v2/entities/Bcn-Welt/attrs/temperature/value") {
+						t.Fatalf("Unexpected path '%s'", r.URL.Path)
+					}
+					if r.Header.Get("Content-Type") != "application/json" {
+						t.Fatal("Missing application/json Content-Type header")
+					}
+					if r.Header.Get("Fiware-ServicePath") != "/a/path" {
+						t.Errorf("Expected '/a/path' as header in 'Fiware-ServicePath', got '%s'", r.Header.Get("Fiware-ServicePath"))
+					}
+					if b, _ := ioutil.ReadAll(r.Body); string(b) != `25.5` {
+						t.Fatalf("Unexpected request body: '%s'", string(b))
+					}
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.UpdateEntityAttributeValue("Bcn-Welt", "temperature", 25.5, client.UpdateEntitySetFiwareServicePath("/a/path")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.UpdateEntityAttributeValue("Bcn-Welt", "not valid", 25.5); err == nil {
+		t.Fatal("Expected an error for an invalid attribute name")
+	}
+}
+
+func TestListEntityTypes(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if r.Header.Get("Fiware-ServicePath") != "/a/path" {
+					t.Errorf("Expected '/a/path' as header in 'Fiware-ServicePath', got '%s'", r.Header.Get("Fiware-ServicePath"))
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Fiware-Total-Count", "12")
+				w.WriteHeader(http.StatusOK)
+				if strings.HasPrefix(r.URL.Query().Get("options"), "values") {
+					fmt.Fprint(w, `["Car","Room"]`)
+					return
+				}
+				if r.URL.Query().Get("limit") != "2" || r.URL.Query().Get("offset") != "4" {
+					t.Fatalf("Expected limit 2 and offset 4, got '%s' and '%s'", r.URL.Query().Get("limit"), r.URL.Query().Get("offset"))
+				}
+				fmt.Fprint(w, `[{"type":"Car","attrs":{"speed":{"types":["Number"]},"fuel":{"types":["Number"]}},"count":12},{"type":"Room","attrs":{"temperature":{"types":["Number","Float"]}},"count":7}]`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	types, err := cli.ListEntityTypes(
+		client.ListTypesSetLimit(2),
+		client.ListTypesSetOffset(4),
+		client.ListTypesSetFiwareServicePath("/a/path"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(types) != 2 ||
+		types[0].Type != "Car" || types[0].Count != 12 || len(types[0].Attrs) != 2 ||
+		types[1].Type != "Room" || types[1].Count != 7 || len(types[1].Attrs["temperature"].Types) != 2 {
+		t.Fatal("Invalid entity types retrieved")
+	}
+
+	names, err := cli.ListEntityTypes(
+		client.ListTypesSetOptions(model.ValuesRepresentation),
+		client.ListTypesSetFiwareServicePath("/a/path"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(names) != 2 || names[0].Type != "Car" || names[1].Type != "Room" {
+		t.Fatal("Invalid entity type names retrieved")
+	}
+
+	if cnt, err := cli.CountEntityTypes(client.ListTypesSetFiwareServicePath("/a/path")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if cnt != 12 {
+		t.Fatalf("Expected 12 entity types, got %d", cnt)
+	}
+
+	if _, err := cli.ListEntityTypes(client.ListTypesSetOptions(model.KeyValuesRepresentation)); err == nil {
+		t.Fatal("Expected an error for unsupported options")
+	}
+}
+
+func TestRegistrations(t *testing.T) {
+	registration := `{"id":"5ad5b9435c28633f0ae90671","description":"Example Context Source","dataProvided":{"entities":[{"id":"Bcn_Welt","type":"Room"}],"attrs":["temperature"]},"provider":{"http":{"url":"http://contextsource.example.org"},"supportedForwardingMode":"all"},"expires":"2017-10-31T12:00:00.000Z","status":"active","forwardingInformation":{"timesSent":12,"lastForwarding":"2017-10-06T16:00:00.000Z"}}`
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if r.Header.Get("Fiware-Service") != "city" {
+					t.Errorf("Expected 'city' as header in 'Fiware-Service', got '%s'", r.Header.Get("Fiware-Service"))
+				}
+				switch {
+				case r.Method == http.MethodPost && r.URL.Path == "/v2/registrations":
+					reg := new(model.Registration)
+					if err := json.NewDecoder(r.Body).Decode(reg); err != nil {
+						t.Errorf("Unexpected error: '%v'", err)
+					}
+					if reg.Provider == nil || reg.Provider.Http == nil || reg.Provider.Http.Url != "http://contextsource.example.org" {
+						t.Errorf("Unexpected registration provider")
+					}
+					w.Header().Set("Location", "/v2/registrations/5ad5b9435c28633f0ae90671")
+					w.WriteHeader(http.StatusCreated)
+				case r.Method == http.MethodGet && r.URL.Path == "/v2/registrations/5ad5b9435c28633f0ae90671":
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprint(w, registration)
+				case r.Method == http.MethodGet && r.URL.Path == "/v2/registrations":
+					if r.URL.Query().Get("limit") != "10" {
+						t.Errorf("Expected limit 10, got '%s'", r.URL.Query().Get("limit"))
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.Header().Set("Fiware-Total-Count", "1")
+					fmt.Fprintf(w, "[%s]", registration)
+				case r.Method == http.MethodDelete && r.URL.Path == "/v2/registrations/5ad5b9435c28633f0ae90671":
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	reg := &model.Registration{
+		Description: "Example Context Source",
+		DataProvided: &model.RegistrationDataProvided{
+			Entities: []*model.EntityMatcher{model.NewEntityMatcher().ById("Bcn_Welt").ByType("Room")},
+			Attrs:    []string{"temperature"},
+		},
+		Provider: &model.RegistrationProvider{
+			Http: &model.RegistrationProviderHttp{Url: "http://contextsource.example.org"},
+		},
+	}
+	id, err := cli.CreateRegistration(reg, client.RegistrationSetFiwareService("city"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if id != "5ad5b9435c28633f0ae90671" {
+		t.Fatalf("Expected id '5ad5b9435c28633f0ae90671', got '%s'", id)
+	}
+
+	retrieved, err := cli.RetrieveRegistration(id, client.RegistrationSetFiwareService("city"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if retrieved.Status != model.RegistrationActive ||
+		retrieved.Expires == nil ||
+		len(retrieved.DataProvided.Entities) != 1 ||
+		retrieved.DataProvided.Entities[0].Id != "Bcn_Welt" ||
+		retrieved.Provider.SupportedForwardingMode != "all" ||
+		retrieved.ForwardingInformation.TimesSent != 12 {
+		t.Fatal("Invalid registration retrieved")
+	}
+
+	regs, err := cli.ListRegistrations(
+		client.ListRegistrationsSetLimit(10),
+		client.ListRegistrationsSetFiwareService("city"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if regs.Count != 1 || len(regs.Registrations) != 1 || regs.Registrations[0].Id != id {
+		t.Fatal("Invalid registrations retrieved")
+	}
+
+	if err := cli.DeleteRegistration(id, client.RegistrationSetFiwareService("city")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.DeleteRegistration("unknown", client.RegistrationSetFiwareService("city")); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected not found error, got '%v'", err)
+	}
+}
+
+func TestRetrieveEntityWithContext(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				<-release
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"id":"Room1","type":"Room"}`)
+			}))
+	defer ts.Close()
+	defer close(release)
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cli.RetrieveEntityWithContext(ctx, "Room1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded error, got '%v'", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := cli.ListEntitiesWithContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context canceled error, got '%v'", err)
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/admin/log" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if r.Header.Get("Fiware-Service") != "city" {
+					t.Errorf("Expected 'city' as header in 'Fiware-Service', got '%s'", r.Header.Get("Fiware-Service"))
+				}
+				if r.URL.Query().Get("level") != "DEBUG" {
+					t.Errorf("Expected level 'DEBUG', got '%s'", r.URL.Query().Get("level"))
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"level":"DEBUG"}`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	var out struct {
+		Level string `json:"level"`
+	}
+	if err := cli.GetInto("/admin/log", &out,
+		client.GetIntoSetFiwareService("city"),
+		client.GetIntoAddQuery("level", "DEBUG")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if out.Level != "DEBUG" {
+		t.Fatalf("Expected level 'DEBUG', got '%s'", out.Level)
+	}
+
+	if err := cli.GetInto("/admin/unknown", &out); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected not found error, got '%v'", err)
+	}
+}
+
+func TestSetBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if username, password, ok := r.BasicAuth(); !ok || username != "orion" || password != "s3cr3t" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"id":"Room1","type":"Room"}`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL), client.SetBasicAuth("orion", "s3cr3t"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveEntity("Room1"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	cli, err = client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveEntity("Room1"); err == nil {
+		t.Fatal("Expected an error without credentials")
+	}
+
+	if _, err := client.NewNgsiV2Client(client.SetUrl(ts.URL), client.SetBasicAuth("", "s3cr3t")); err == nil {
+		t.Fatal("Expected an error for empty username")
+	}
+}
+
+func TestSetTLSConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				apiResourcesHandler(w, r)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveAPIResources(); err == nil {
+		t.Fatal("Expected an error for the self-signed certificate")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	cli, err = client.NewNgsiV2Client(
+		client.SetUrl(ts.URL),
+		client.SetClientTimeout(5*time.Second),
+		client.SetTLSConfig(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveAPIResources(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if _, err := client.NewNgsiV2Client(client.SetUrl(ts.URL), client.SetTLSConfig(nil)); err == nil {
+		t.Fatal("Expected an error for nil TLS configuration")
+	}
+}
+
+func TestForEachEntity(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if r.URL.Query().Get("options") != "count" {
+					t.Fatalf("Expected options 'count', got '%s'", r.URL.Query().Get("options"))
+				}
+				if r.URL.Query().Get("limit") != "2" {
+					t.Fatalf("Expected limit 2, got '%s'", r.URL.Query().Get("limit"))
+				}
+				offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+				entities := []string{}
+				for i := offset; i < offset+2 && i < 5; i++ {
+					entities = append(entities, fmt.Sprintf(`{"id":"Room%d","type":"Room"}`, i))
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Fiware-Total-Count", "5")
+				fmt.Fprintf(w, "[%s]", strings.Join(entities, ","))
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	ids := []string{}
+	if err := cli.ForEachEntity(func(e *model.Entity) error {
+		ids = append(ids, e.Id)
+		return nil
+	}, client.ListEntitiesSetLimit(2)); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if strings.Join(ids, ",") != "Room0,Room1,Room2,Room3,Room4" {
+		t.Fatalf("Unexpected entities visited: %v", ids)
+	}
+
+	errStop := errors.New("stop")
+	visited := 0
+	if err := cli.ForEachEntity(func(e *model.Entity) error {
+		visited++
+		if e.Id == "Room2" {
+			return errStop
+		}
+		return nil
+	}, client.ListEntitiesSetLimit(2)); err != errStop {
+		t.Fatalf("Expected the callback error, got '%v'", err)
+	}
+	if visited != 3 {
+		t.Fatalf("Expected 3 entities visited, got %d", visited)
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/version" {
+					t.Fatalf("Unexpected path '%s'", r.URL.Path)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"orion":{"version":"2.4.0","uptime":"0 d, 0 h, 2 m, 19 s","git_hash":"0c9863d3fdbc3d4e2a8fc8b1ed9e0e1a8d2c4c1e","compile_time":"Mon Apr 6 10:19:35 UTC 2020","compiled_by":"root","compiled_in":"buildkitsandbox","release_date":"Mon Apr 6 10:19:35 UTC 2020","doc":"https://fiware-orion.rtfd.io/en/2.4.0/"}}`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	v, err := cli.GetVersion()
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if v.Version != "2.4.0" ||
+		v.Uptime != "0 d, 0 h, 2 m, 19 s" ||
+		v.GitHash != "0c9863d3fdbc3d4e2a8fc8b1ed9e0e1a8d2c4c1e" ||
+		v.Doc != "https://fiware-orion.rtfd.io/en/2.4.0/" {
+		t.Fatalf("Invalid version retrieved: %+v", v)
+	}
+}
+
+func TestGetVersionUnavailable(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.GetVersion(); !errors.Is(err, client.ErrVersionUnavailable) {
+		t.Fatalf("Expected version unavailable error, got '%v'", err)
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if b, _ := ioutil.ReadAll(r.Body); string(b) != `{"actionType":"append","entities":[]}` {
+					t.Errorf("Unexpected request body: '%s'", b)
+				}
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"BadRequest","description":"empty entities vector"}`)
+			}))
+	defer ts.Close()
+
+	var logs []string
+	cli, err := client.NewNgsiV2Client(
+		client.SetUrl(ts.URL),
+		client.SetLogger(func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		}))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	err = cli.BatchUpdate(&model.BatchUpdate{ActionType: model.AppendAction, Entities: []*model.Entity{}})
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != "BadRequest" {
+		t.Fatalf("Expected a bad request error, got '%v'", err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d", len(logs))
+	}
+	if !strings.Contains(logs[0], "POST") || !strings.Contains(logs[0], `{"actionType":"append","entities":[]}`) {
+		t.Fatalf("Unexpected request log: '%s'", logs[0])
+	}
+	if !strings.Contains(logs[1], "400") || !strings.Contains(logs[1], "empty entities vector") {
+		t.Fatalf("Unexpected response log: '%s'", logs[1])
+	}
+}
+
+func TestSetRetry(t *testing.T) {
+	var attempts int32
+	var failures int32
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				atomic.AddInt32(&attempts, 1)
+				if b, _ := ioutil.ReadAll(r.Body); strings.Contains(r.URL.Path, "/v2/op/") && string(b) != `{"actionType":"append","entities":[]}` {
+					t.Errorf("Unexpected request body: '%s'", b)
+				}
+				if strings.HasSuffix(r.URL.Path, "/missing") {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if atomic.AddInt32(&failures, -1) >= 0 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/v2/entities") {
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+	defer ts.Close()
+
+	if _, err := client.NewNgsiV2Client(client.SetRetry(0, time.Millisecond)); err == nil {
+		t.Fatal("Expected an error for zero attempts")
+	}
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL), client.SetRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	reset := func(f int32) {
+		atomic.StoreInt32(&attempts, 0)
+		atomic.StoreInt32(&failures, f)
+	}
+
+	reset(2)
+	if err := cli.BatchUpdate(&model.BatchUpdate{ActionType: model.AppendAction, Entities: []*model.Entity{}}); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if a := atomic.LoadInt32(&attempts); a != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", a)
+	}
+
+	reset(5)
+	if err := cli.DeleteSubscription("abcde12345"); client.ErrorCategory(err) != client.CategoryServerError {
+		t.Fatalf("Expected a server error, got '%v'", err)
+	}
+	if a := atomic.LoadInt32(&attempts); a != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", a)
+	}
+
+	reset(0)
+	if err := cli.DeleteSubscription("missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected a not found error, got '%v'", err)
+	}
+	if a := atomic.LoadInt32(&attempts); a != 1 {
+		t.Fatalf("Expected 1 attempt for a client error, got %d", a)
+	}
+
+	reset(1)
+	room, _ := model.NewEntity("Room1", "Room")
+	if _, _, err := cli.CreateEntity(room); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if a := atomic.LoadInt32(&attempts); a != 1 {
+		t.Fatalf("Expected create not to be retried, got %d attempts", a)
+	}
+}
+
+func TestSetRetryContextCancelled(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL), client.SetRetry(10, time.Second))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := cli.DeleteSubscriptionWithContext(ctx, "abcde12345"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline exceeded error, got '%v'", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the retries to stop with the context, took %v", elapsed)
+	}
+}
+
+func TestSetCompression(t *testing.T) {
+	const entities = `[{"id":"Room1","type":"Room","temperature":{"type":"Number","value":21.5,"metadata":{}}}]`
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if r.URL.Path == "/v2/op/update" {
+					if r.Header.Get("Content-Encoding") != "gzip" {
+						t.Errorf("Expected a gzip compressed request")
+					}
+					zr, err := gzip.NewReader(r.Body)
+					if err != nil {
+						t.Errorf("Unexpected error: '%v'", err)
+						return
+					}
+					if b, _ := ioutil.ReadAll(zr); string(b) != `{"actionType":"append","entities":[]}` {
+						t.Errorf("Unexpected request body: '%s'", b)
+					}
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				if r.Header.Get("Accept-Encoding") != "gzip" {
+					t.Errorf("Expected gzip accept encoding, got '%s'", r.Header.Get("Accept-Encoding"))
+				}
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Query().Get("type") {
+				case "Compressed":
+					w.Header().Set("Content-Encoding", "gzip")
+					zw := gzip.NewWriter(w)
+					zw.Write([]byte(entities))
+					zw.Close()
+				case "Mislabeled":
+					w.Header().Set("Content-Encoding", "gzip")
+					fmt.Fprint(w, entities)
+				default:
+					fmt.Fprint(w, entities)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(
+		client.SetUrl(ts.URL),
+		client.SetCompression(true),
+		client.SetRequestCompression(true))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	for _, typ := range []string{"Compressed", "Mislabeled", "Plain"} {
+		res, err := cli.ListEntities(client.ListEntitiesSetType(typ))
+		if err != nil {
+			t.Fatalf("Unexpected error for %s response: '%v'", typ, err)
+		}
+		if len(res) != 1 || res[0].Id != "Room1" {
+			t.Fatalf("Unexpected entities for %s response: %v", typ, res)
+		}
+	}
+
+	if err := cli.BatchUpdate(&model.BatchUpdate{ActionType: model.AppendAction, Entities: []*model.Entity{}}); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+}
+
+func TestBatchUpdateChunked(t *testing.T) {
+	var sizes []int
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				var msg model.BatchUpdate
+				if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+					t.Errorf("Unexpected error: '%v'", err)
+				}
+				if msg.ActionType != model.UpdateAction {
+					t.Errorf("Expected update action, got '%s'", msg.ActionType)
+				}
+				sizes = append(sizes, len(msg.Entities))
+				if msg.Entities[0].Id == "Room3" {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	msg := model.NewBatchUpdate(model.UpdateAction)
+	for i := 0; i < 7; i++ {
+		e, _ := model.NewEntity(fmt.Sprintf("Room%d", i), "Room")
+		msg.AddEntity(e)
+	}
+
+	if err := cli.BatchUpdateChunked(msg, 0); err == nil {
+		t.Fatal("Expected an error for zero chunk size")
+	}
+
+	err = cli.BatchUpdateChunked(msg, 5)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(sizes) != 2 || sizes[0] != 5 || sizes[1] != 2 {
+		t.Fatalf("Expected chunks of 5 and 2 entities, got %v", sizes)
+	}
+
+	sizes = nil
+	err = cli.BatchUpdateChunked(msg, 1)
+	var chunkedErr *client.BatchChunkedError
+	if !errors.As(err, &chunkedErr) {
+		t.Fatalf("Expected a chunked error, got '%v'", err)
+	}
+	if len(sizes) != 7 {
+		t.Fatalf("Expected all the 7 chunks to be sent, got %d", len(sizes))
+	}
+	if len(chunkedErr.Failures) != 1 || chunkedErr.Failures[0].Chunk != 3 || chunkedErr.Failures[0].Offset != 3 {
+		t.Fatalf("Unexpected failures: %+v", chunkedErr.Failures)
+	}
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected the chunk error to be unwrapped, got '%v'", err)
+	}
+}
+
+func TestEntityExists(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if attrs := r.URL.Query().Get("attrs"); attrs != "dateCreated" {
+					t.Errorf("Expected dateCreated attrs, got '%s'", attrs)
+				}
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/Room1"):
+					if typ := r.URL.Query().Get("type"); typ != "Room" {
+						t.Errorf("Expected Room type, got '%s'", typ)
+					}
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprint(w, `{"id":"Room1","type":"Room","dateCreated":"2020-04-01T10:00:00.00Z"}`)
+				case strings.HasSuffix(r.URL.Path, "/Room2"):
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"error":"NotFound","description":"The requested entity has not been found. Check type and id"}`)
+				default:
+					w.WriteHeader(http.StatusConflict)
+					fmt.Fprint(w, `{"error":"TooManyResults","description":"More than one matching entity. Please refine your query"}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if exists, err := cli.EntityExists("Room1", client.RetrieveEntitySetType("Room"), client.RetrieveEntityAddAttribute("temperature")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if !exists {
+		t.Fatal("Expected Room1 to exist")
+	}
+	if exists, err := cli.EntityExists("Room2"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if exists {
+		t.Fatal("Expected Room2 not to exist")
+	}
+	if _, err := cli.EntityExists("Room3"); !errors.Is(err, client.ErrConflict) {
+		t.Fatalf("Expected a conflict error, got '%v'", err)
+	}
+	if _, err := cli.EntityExists(""); err == nil {
+		t.Fatal("Expected an error for empty id")
+	}
+}
+
+func TestBatchDeleteEntities(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if b, _ := ioutil.ReadAll(r.Body); string(b) != `{"actionType":"delete","entities":[{"id":"Room1","type":"Room"},{"id":"Room2","type":"Room"}]}` {
+					t.Errorf("Unexpected request body: '%s'", b)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if err := cli.BatchDeleteEntities([]string{"Room1", "Room2"}, "Room"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.BatchDeleteEntities(nil, "Room"); err == nil {
+		t.Fatal("Expected an error for no ids")
+	}
+	err = cli.BatchDeleteEntities([]string{"Room1", "Room?", "Room#"}, "Room")
+	if err == nil || !strings.Contains(err.Error(), "'Room?'") || !strings.Contains(err.Error(), "'Room#'") {
+		t.Fatalf("Expected an error referencing the invalid ids, got '%v'", err)
+	}
+}
+
+func TestListEntitiesMalformedResponse(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `[{"id":"Room1","type":"Room"},{"id":"Room2",`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.ListEntities(); err == nil || !strings.Contains(err.Error(), "Error reading list entities response") {
+		t.Fatalf("Expected a decoding error, got '%v'", err)
+	}
+}
+
+func TestRetrieveEntityAddBuiltinAttribute(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if attrs := r.URL.Query().Get("attrs"); attrs != "*,dateModified" {
+					t.Errorf("Expected attrs '*,dateModified', got '%s'", attrs)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if strings.HasSuffix(r.URL.Path, "/v2/entities") {
+					fmt.Fprint(w, `[{"id":"Room1","type":"Room","dateModified":{"type":"DateTime","value":"2020-04-01T10:00:00.00Z","metadata":{}}}]`)
+					return
+				}
+				fmt.Fprint(w, `{"id":"Room1","type":"Room","dateModified":{"type":"DateTime","value":"2020-04-01T10:00:00.00Z","metadata":{}}}`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	e, err := cli.RetrieveEntity("Room1",
+		client.RetrieveEntityAddAttribute(model.AllAttributesName),
+		client.RetrieveEntityAddBuiltinAttribute(model.DateModifiedAttributeName))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := e.GetDateModified(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if _, err := cli.ListEntities(
+		client.ListEntitiesAddAttribute(model.AllAttributesName),
+		client.ListEntitiesAddBuiltinAttribute(model.DateModifiedAttributeName)); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if _, err := cli.RetrieveEntity("Room1", client.RetrieveEntityAddBuiltinAttribute("temperature")); err == nil {
+		t.Fatal("Expected an error for a non builtin attribute")
+	}
+}
+
+func TestListEntitiesSetPolygonCoords(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if g := r.URL.Query().Get("geometry"); g != "polygon" {
+					t.Errorf("Expected polygon geometry, got '%s'", g)
+				}
+				if c := r.URL.Query().Get("coords"); c != "43.7,11.2;43.8,11.2;43.8,11.3;43.7,11.2" {
+					t.Errorf("Unexpected coords '%s'", c)
+				}
+				if g := r.URL.Query().Get("georel"); g != "coveredBy" {
+					t.Errorf("Expected coveredBy georel, got '%s'", g)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `[]`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	ring := []*model.GeoPoint{
+		model.NewGeoPoint(43.7, 11.2),
+		model.NewGeoPoint(43.8, 11.2),
+		model.NewGeoPoint(43.8, 11.3),
+		model.NewGeoPoint(43.7, 11.2),
+	}
+	if _, err := cli.ListEntities(client.ListEntitiesSetPolygonCoords(ring), client.ListEntitiesSetGeoRel(model.GeorelCoveredBy)); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	open := []*model.GeoPoint{ring[0], ring[1], ring[2], model.NewGeoPoint(43.7, 11.3)}
+	if _, err := cli.ListEntities(client.ListEntitiesSetPolygonCoords(open)); err == nil || !strings.Contains(err.Error(), "not closed") {
+		t.Fatalf("Expected an error for an open ring, got '%v'", err)
+	}
+	if _, err := cli.ListEntities(client.ListEntitiesSetPolygonCoords(ring[:2])); err == nil {
+		t.Fatal("Expected an error for too few points")
+	}
+	invalid := []*model.GeoPoint{ring[0], ring[1], model.NewGeoPoint(95, 11.3), ring[0]}
+	if _, err := cli.ListEntities(client.ListEntitiesSetPolygonCoords(invalid)); err == nil {
+		t.Fatal("Expected an error for an invalid point")
+	}
+}
+
+func TestBatchFiwareHeaders(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if s := r.Header.Get("Fiware-Service"); s != "tenantA" {
+					t.Errorf("Expected Fiware-Service 'tenantA', got '%s'", s)
+				}
+				if sp := r.Header.Get("Fiware-ServicePath"); sp != "/building1" {
+					t.Errorf("Expected Fiware-ServicePath '/building1', got '%s'", sp)
+				}
+				if strings.HasSuffix(r.URL.Path, "/v2/op/query") {
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprint(w, `[]`)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if err := cli.BatchUpdate(
+		&model.BatchUpdate{ActionType: model.AppendAction, Entities: []*model.Entity{}},
+		client.BatchUpdateSetFiwareService("tenantA"),
+		client.BatchUpdateSetFiwareServicePath("/building1")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.BatchDeleteEntities([]string{"Room1"}, "Room",
+		client.BatchUpdateSetFiwareService("tenantA"),
+		client.BatchUpdateSetFiwareServicePath("/building1")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.BatchQuery(
+		&model.BatchQuery{Entities: []*model.EntityMatcher{model.NewEntityMatcher().ByIdPattern(".*")}},
+		client.BatchQuerySetFiwareService("tenantA"),
+		client.BatchQuerySetFiwareServicePath("/building1")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+}
+
+func TestEntityPathEscaping(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				switch r.URL.EscapedPath() {
+				case "/v2/entities/urn:ngsi-ld:Room:1%2F2":
+					if r.URL.Path != "/v2/entities/urn:ngsi-ld:Room:1/2" {
+						t.Errorf("Unexpected decoded path '%s'", r.URL.Path)
+					}
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprint(w, `{"id":"urn:ngsi-ld:Room:1/2","type":"Room"}`)
+				case "/v2/entities/urn:ngsi-ld:Room:1%2F2/attrs/temperature":
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprint(w, `{"type":"Number","value":21,"metadata":{}}`)
+				default:
+					t.Errorf("Unexpected path '%s'", r.URL.EscapedPath())
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	e, err := cli.RetrieveEntity("urn:ngsi-ld:Room:1/2")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if e.Id != "urn:ngsi-ld:Room:1/2" {
+		t.Fatalf("Unexpected entity id '%s'", e.Id)
+	}
+	if _, err := cli.GetEntityAttribute("urn:ngsi-ld:Room:1/2", "temperature"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+}
+
+func TestSetFiwareServicePaths(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if sp := r.Header.Get("Fiware-ServicePath"); sp != "/Madrid/Gardens,/Madrid/Parks" {
+					t.Errorf("Unexpected Fiware-ServicePath '%s'", sp)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Fiware-Total-Count", "0")
+				fmt.Fprint(w, `[]`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	paths := []string{"/Madrid/Gardens", "/Madrid/Parks"}
+	if _, err := cli.ListEntities(client.ListEntitiesSetFiwareServicePaths(paths)); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.CountEntities(client.ListEntitiesSetFiwareServicePaths(paths)); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.BatchQuery(
+		&model.BatchQuery{Entities: []*model.EntityMatcher{model.NewEntityMatcher().ByIdPattern(".*")}},
+		client.BatchQuerySetFiwareServicePaths(paths)); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	tests := []struct {
+		name  string
+		paths []string
+	}{
+		{"no paths", nil},
+		{"relative path", []string{"/Madrid/Gardens", "Madrid/Parks"}},
+		{"comma in path", []string{"/Madrid/Gardens,/Madrid/Parks"}},
+		{"too many paths", []string{"/1", "/2", "/3", "/4", "/5", "/6", "/7", "/8", "/9", "/10", "/11"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := cli.ListEntities(client.ListEntitiesSetFiwareServicePaths(tt.paths)); err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+}
+
+func TestListEntitiesWithCount(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if o := r.URL.Query().Get("options"); o != "count" {
+					t.Errorf("Expected count options, got '%s'", o)
+				}
+				if l := r.URL.Query().Get("limit"); l != "2" {
+					t.Errorf("Expected limit 2, got '%s'", l)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if r.URL.Query().Get("type") != "Missing" {
+					w.Header().Set("Fiware-Total-Count", "5")
+				}
+				fmt.Fprint(w, `[{"id":"Room1","type":"Room"},{"id":"Room2","type":"Room"}]`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	entities, count, err := cli.ListEntitiesWithCount(client.ListEntitiesSetLimit(2))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(entities) != 2 || entities[1].Id != "Room2" {
+		t.Fatalf("Unexpected entities: %v", entities)
+	}
+	if count != 5 {
+		t.Fatalf("Expected a count of 5, got %d", count)
+	}
+
+	if _, _, err := cli.ListEntitiesWithCount(client.ListEntitiesSetLimit(2), client.ListEntitiesSetType("Missing")); err == nil {
+		t.Fatal("Expected an error for missing Fiware-Total-Count")
+	}
+}
+
+func TestListEntitiesOrderByDistance(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				expected := "coords=43.77%2C11.25&geometry=point&georel=near%3BmaxDistance%3A1000&orderBy=geo%3Adistance"
+				if r.URL.RawQuery != expected {
+					t.Errorf("Expected query '%s', got '%s'", expected, r.URL.RawQuery)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `[]`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if _, err := cli.ListEntities(
+		client.ListEntitiesSetGeoRel(model.GeorelNear, model.GeorelModifierMaxDistance(1000)),
+		client.ListEntitiesSetGeometry(model.SLFPoint),
+		client.ListEntitiesAddCoord(43.77, 11.25),
+		client.ListEntitiesOrderByDistance(true)); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if _, err := cli.ListEntities(client.ListEntitiesOrderByDistance(false)); err == nil {
+		t.Fatal("Expected an error ordering by distance without a near georel")
+	}
+}
+
+func TestSetObserver(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				if r.Method == "POST" {
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error":"NotFound","description":"The requested entity has not been found. Check type and id"}`)
+			}))
+
+	type observation struct {
+		op         string
+		statusCode int
+		err        error
+	}
+	var observed []observation
+	cli, err := client.NewNgsiV2Client(
+		client.SetUrl(ts.URL),
+		client.SetObserver(func(op string, statusCode int, duration time.Duration, err error) {
+			if duration <= 0 {
+				t.Errorf("Expected a positive duration for %s, got %v", op, duration)
+			}
+			observed = append(observed, observation{op, statusCode, err})
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	e, _ := model.NewEntity("Room1", "Room")
+	if _, _, err := cli.CreateEntity(e); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveEntity("Room2"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected a not found error, got '%v'", err)
+	}
+	ts.Close()
+	if _, err := cli.RetrieveEntity("Room1"); err == nil {
+		t.Fatal("Expected an error with the server closed")
+	}
+
+	expected := []observation{
+		{"RetrieveAPIResources", http.StatusOK, nil},
+		{"CreateEntity", http.StatusCreated, nil},
+		{"RetrieveEntity", http.StatusNotFound, nil},
+	}
+	if len(observed) != 4 {
+		t.Fatalf("Expected 4 observations, got %v", observed)
+	}
+	for i, o := range expected {
+		if observed[i] != o {
+			t.Fatalf("Expected observation %v, got %v", o, observed[i])
+		}
+	}
+	if last := observed[3]; last.op != "RetrieveEntity" || last.statusCode != 0 || last.err == nil {
+		t.Fatalf("Unexpected observation for a network error: %v", last)
+	}
+}
+
+func TestUpdateEntitySetOptionsForcedUpdate(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.UpdateEntityAttribute("Bcn-Welt", "temperature", model.NewAttribute(model.FloatType, 25.5), client.UpdateEntitySetType("Room"), client.UpdateEntitySetOptionsForcedUpdate()); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.UpdateEntityAttributeValue("Bcn-Welt", "temperature", 25.5, client.UpdateEntitySetOptionsForcedUpdate()); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	expected := []string{
+		"/v2/entities/Bcn-Welt/attrs/temperature?options=forcedUpdate&type=Room",
+		"/v2/entities/Bcn-Welt/attrs/temperature/value?options=forcedUpdate",
+	}
+	if strings.Join(requests, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected requests %v, got %v", expected, requests)
+	}
+
+	attrs := map[string]*model.Attribute{"temperature": model.NewAttribute(model.FloatType, 21.7)}
+	if err := cli.AppendEntityAttributes("Bcn-Welt", attrs, true, client.UpdateEntitySetOptionsOverwrite()); err == nil {
+		t.Fatal("Expected an error for overwrite in strict mode")
+	}
+	if err := cli.UpdateEntityAttributeValue("Bcn-Welt", "temperature", 25.5, client.UpdateEntitySetOptionsOverwrite()); err == nil {
+		t.Fatal("Expected an error for an unsupported option")
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected no more requests, got %v", requests[2:])
+	}
+}
+
+func TestSkipForwarding(t *testing.T) {
+	var options []string
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				options = append(options, r.URL.Query().Get("options"))
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Fiware-Total-Count", "1")
+				w.WriteHeader(http.StatusOK)
+				if strings.HasSuffix(r.URL.Path, "/v2/entities") {
+					fmt.Fprint(w, `[{"id":"r1","type":"Room"}]`)
+				} else {
+					fmt.Fprint(w, `{"id":"r1","type":"Room"}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveEntity("r1", client.RetrieveEntitySetSkipForwarding()); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.EntityExists("r1", client.RetrieveEntitySetSkipForwarding()); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.ListEntities(client.ListEntitiesSetSkipForwarding()); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, _, err := cli.ListEntitiesWithCount(client.ListEntitiesSetSkipForwarding()); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.CountEntities(client.ListEntitiesSetSkipForwarding()); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.CountEntities(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	expected := []string{
+		"skipForwarding",
+		"keyValues,skipForwarding",
+		"skipForwarding",
+		"count,skipForwarding",
+		"count,skipForwarding",
+		"count",
+	}
+	if strings.Join(options, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected options %v, got %v", expected, options)
+	}
+}
+
+func TestParseEntityLocation(t *testing.T) {
+	tests := []struct {
+		name       string
+		loc        string
+		id         string
+		entityType string
+		fails      bool
+	}{
+		{"with type", "/v2/entities/Bcn-Welt?type=Room", "Bcn-Welt", "Room", false},
+		{"without type", "/v2/entities/Bcn-Welt", "Bcn-Welt", "", false},
+		{"absolute", "http://orion:1026/v2/entities/urn:ngsi-ld:Room:1?type=Room", "urn:ngsi-ld:Room:1", "Room", false},
+		{"escaped", "/v2/entities/Room%231?type=Room", "Room#1", "Room", false},
+		{"empty", "", "", "", true},
+		{"subscription", "/v2/subscriptions/abcdef", "", "", true},
+		{"missing id", "/v2/entities/?type=Room", "", "", true},
+		{"attribute", "/v2/entities/Bcn-Welt/attrs", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, entityType, err := client.ParseEntityLocation(tt.loc)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			if id != tt.id || entityType != tt.entityType {
+				t.Fatalf("Expected '%s' and '%s', got '%s' and '%s'", tt.id, tt.entityType, id, entityType)
+			}
+		})
+	}
+}
+
+func TestSetRequestInterceptor(t *testing.T) {
+	var captured []*http.Request
+	var bodies []string
+	cli, err := client.NewNgsiV2Client(
+		client.SetUrl("http://orion.invalid:1026"),
+		client.SetRequestInterceptor(func(req *http.Request) error {
+			captured = append(captured, req)
+			body := ""
+			if req.GetBody != nil {
+				rc, _ := req.GetBody()
+				b, _ := ioutil.ReadAll(rc)
+				body = string(b)
+			}
+			bodies = append(bodies, body)
+			return client.ErrDryRun
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	q, _ := model.NewBinarySimpleQueryStatement("temperature", model.SQGreaterThan, "20")
+	if _, err := cli.ListEntities(
+		client.ListEntitiesSetType("Room"),
+		client.ListEntitiesAddQueryStatement(q),
+		client.ListEntitiesSetFiwareService("smartcity"),
+	); !errors.Is(err, client.ErrDryRun) {
+		t.Fatalf("Expected a dry run error, got '%v'", err)
+	}
+	e, _ := model.NewEntity("Room1", "Room")
+	e.SetAttributeAsFloat("temperature", 21.5)
+	if _, _, err := cli.CreateEntity(e); !errors.Is(err, client.ErrDryRun) {
+		t.Fatalf("Expected a dry run error, got '%v'", err)
+	}
+
+	// the API resources are assumed, not requested
+	if len(captured) != 2 {
+		t.Fatalf("Expected 2 captured requests, got %d", len(captured))
+	}
+	list := captured[0]
+	if list.Method != "GET" || list.URL.Path != "/v2/entities" || list.URL.Query().Get("type") != "Room" || list.URL.Query().Get("q") != "temperature>20" {
+		t.Fatalf("Unexpected list request: %s %s", list.Method, list.URL)
+	}
+	if list.Header.Get("Fiware-Service") != "smartcity" {
+		t.Fatalf("Expected 'smartcity' Fiware-Service, got '%s'", list.Header.Get("Fiware-Service"))
+	}
+	create := captured[1]
+	if create.Method != "POST" || create.URL.String() != "http://orion.invalid:1026/v2/entities" {
+		t.Fatalf("Unexpected create request: %s %s", create.Method, create.URL)
+	}
+	if expected := `{"id":"Room1","temperature":{"type":"Float","value":21.5},"type":"Room"}`; bodies[1] != expected {
+		t.Fatalf("Expected body '%s', got '%s'", expected, bodies[1])
+	}
+
+	// other errors fail the requests as well, while nil lets them through
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Trace-Id") != "abc" {
+					t.Errorf("Expected 'abc' trace id, got '%s'", r.Header.Get("X-Trace-Id"))
+				}
+				apiResourcesHandler(w, r)
+			}))
+	defer ts.Close()
+	failure := errors.New("forbidden by policy")
+	fail := false
+	cli, err = client.NewNgsiV2Client(
+		client.SetUrl(ts.URL),
+		client.SetRequestInterceptor(func(req *http.Request) error {
+			if fail {
+				return failure
+			}
+			req.Header.Set("X-Trace-Id", "abc")
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveAPIResources(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	fail = true
+	if _, err := cli.RetrieveAPIResources(); !errors.Is(err, failure) {
+		t.Fatalf("Expected the interceptor error, got '%v'", err)
+	}
+}
+
+func TestRetrieveSubscriptionStatus(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/v2/subscriptions/abcdef"):
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `{"id":"abcdef","status":"active","subject":{"entities":[{"idPattern":".*","type":"Room"}]},"notification":{"http":{"url":"http://localhost:1234"},"timesSent":12,"lastNotification":"2020-03-11T10:15:00.00Z","lastFailure":"2020-03-11T10:15:00.00Z","lastSuccess":"2020-03-11T10:00:00.00Z","lastSuccessCode":200}}`)
+				case strings.HasSuffix(r.URL.Path, "/v2/subscriptions/recovered"):
+					w.WriteHeader(http.StatusOK)
+					fmt.Fprint(w, `{"id":"recovered","status":"active","subject":{"entities":[{"idPattern":".*","type":"Room"}]},"notification":{"http":{"url":"http://localhost:1234"},"timesSent":13,"lastFailure":"2020-03-11T10:15:00.00Z","lastSuccess":"2020-03-11T10:20:00.00Z","lastSuccessCode":204}}`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"error":"NotFound","description":"The requested subscription has not been found. Check id"}`)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	n, err := cli.RetrieveSubscriptionStatus("abcdef")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if n.TimesSent != 12 || n.LastSuccessCode == nil || *n.LastSuccessCode != 200 || n.LastFailure == nil {
+		t.Fatalf("Unexpected notification status: %+v", n)
+	}
+	if n.IsHealthy() {
+		t.Fatal("Expected an unhealthy subscription, the last failure is after the last success")
+	}
+	if n, err := cli.RetrieveSubscriptionStatus("recovered"); err != nil || !n.IsHealthy() {
+		t.Fatalf("Expected a healthy subscription, got %+v (%v)", n, err)
+	}
+	if _, err := cli.RetrieveSubscriptionStatus("missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected a not found error, got '%v'", err)
+	}
+}
+
+func TestLastResponseHeaders(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				w.Header().Set("X-Correlation-Id", r.URL.Query().Get("type"))
+				w.Header().Set("Fiware-Total-Count", "0")
+				fmt.Fprint(w, "[]")
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if h := cli.LastResponseHeaders(); h != nil {
+		t.Fatalf("Expected no headers before any request, got %v", h)
+	}
+
+	if _, err := cli.ListEntities(client.ListEntitiesSetType("Room")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	h := cli.LastResponseHeaders()
+	if id := h.Get("X-Correlation-Id"); id != "Room" {
+		t.Fatalf("Expected correlation id 'Room', got '%s'", id)
+	}
+
+	// the returned headers are a copy
+	h.Set("X-Correlation-Id", "changed")
+	if id := cli.LastResponseHeaders().Get("X-Correlation-Id"); id != "Room" {
+		t.Fatalf("Expected correlation id 'Room', got '%s'", id)
+	}
+
+	if _, err := cli.ListEntities(client.ListEntitiesSetType("Car")); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if id := cli.LastResponseHeaders().Get("X-Correlation-Id"); id != "Car" {
+		t.Fatalf("Expected correlation id 'Car', got '%s'", id)
+	}
+}
+
+func TestConcurrentRetrieveEntity(t *testing.T) {
+	var apiResRequests int32
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					atomic.AddInt32(&apiResRequests, 1)
+					apiResourcesHandler(w, r)
+					return
+				}
+				fmt.Fprintf(w, `{"id":"%s","type":"Room","temperature":{"type":"Float","value":21.5}}`, strings.TrimPrefix(r.URL.Path, "/v2/entities/"))
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	const goroutines = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			e, err := cli.RetrieveEntity(id)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if e.Id != id {
+				errs <- fmt.Errorf("Expected entity '%s', got '%s'", id, e.Id)
+				return
+			}
+			cli.LastResponseHeaders()
+		}(fmt.Sprintf("Room%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if n := atomic.LoadInt32(&apiResRequests); n < 1 || n > goroutines {
+		t.Fatalf("Expected between 1 and %d API resources requests, got %d", goroutines, n)
+	}
+	// once retrieved, the API resources are cached
+	before := atomic.LoadInt32(&apiResRequests)
+	if _, err := cli.RetrieveEntity("Room1"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if n := atomic.LoadInt32(&apiResRequests); n != before {
+		t.Fatalf("Expected API resources to be cached, got %d requests", n)
+	}
+}
+
+func TestSetBasePath(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.Method+" "+r.URL.Path)
+				switch {
+				case r.URL.Path == "/orion/v2":
+					apiResourcesHandler(w, r)
+				case r.URL.Path == "/orion/v2/entities/Room1":
+					fmt.Fprint(w, `{"id":"Room1","type":"Room"}`)
+				case r.URL.Path == "/orion/v2/op/update":
+					w.WriteHeader(http.StatusNoContent)
+				case r.URL.Path == "/orion/v2/subscriptions":
+					// the context broker is unaware of the proxy prefix
+					w.Header().Set("Location", "/v2/subscriptions/abcdef")
+					w.WriteHeader(http.StatusCreated)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL), client.SetBasePath("/orion/v2/"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveEntity("Room1"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	batch := model.NewUpdateBatch()
+	batch.AddEntityRef("Room1", "Room")
+	if err := cli.BatchUpdate(batch); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	sub := &model.Subscription{
+		Subject: &model.SubscriptionSubject{Entities: []*model.SubscriptionSubjectEntity{model.NewEntityMatcher().ById("Room1")}},
+		Notification: &model.SubscriptionNotification{
+			Http: &model.SubscriptionNotificationHttp{Url: "http://localhost:1234"},
+		},
+	}
+	if subId, err := cli.CreateSubscription(sub); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if subId != "abcdef" {
+		t.Fatalf("Expected subscription id 'abcdef', got '%s'", subId)
+	}
+
+	expected := "GET /orion/v2,GET /orion/v2/entities/Room1,POST /orion/v2/op/update,POST /orion/v2/subscriptions"
+	if got := strings.Join(paths, ","); got != expected {
+		t.Fatalf("Expected requests '%s', got '%s'", expected, got)
+	}
+
+	for _, path := range []string{"", "/", "orion/v2"} {
+		if _, err := client.NewNgsiV2Client(client.SetBasePath(path)); err == nil {
+			t.Fatalf("Expected error for base path '%s'", path)
+		}
+	}
+}
+
+func TestPreloadAndRefreshAPIResources(t *testing.T) {
+	var apiResRequests int32
+	var unavailable int32 = 1
+	entitiesUrl := "/v2/entities"
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2" {
+					atomic.AddInt32(&apiResRequests, 1)
+					if atomic.LoadInt32(&unavailable) == 1 {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					fmt.Fprintf(w, `{"entities_url":"%s","types_url":"/v2/types","subscriptions_url":"/v2/subscriptions","registrations_url":"/v2/registrations"}`, entitiesUrl)
+					return
+				}
+				if r.URL.Path != entitiesUrl+"/Room1" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				fmt.Fprint(w, `{"id":"Room1","type":"Room"}`)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	// failures are not cached
+	if err := cli.PreloadAPIResources(); err == nil {
+		t.Fatal("Expected error with the context broker unavailable")
+	}
+	atomic.StoreInt32(&unavailable, 0)
+	if err := cli.PreloadAPIResources(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := cli.PreloadAPIResources(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveEntity("Room1"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if n := atomic.LoadInt32(&apiResRequests); n != 2 {
+		t.Fatalf("Expected 2 API resources requests, got %d", n)
+	}
+
+	// the refreshed resources replace the cached ones, unless refreshing fails
+	entitiesUrl = "/v2/things"
+	atomic.StoreInt32(&unavailable, 1)
+	if err := cli.RefreshAPIResources(); err == nil {
+		t.Fatal("Expected error with the context broker unavailable")
+	}
+	if _, err := cli.RetrieveEntity("Room1"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected a not found error, got '%v'", err)
+	}
+	atomic.StoreInt32(&unavailable, 0)
+	if err := cli.RefreshAPIResources(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveEntity("Room1"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if n := atomic.LoadInt32(&apiResRequests); n != 4 {
+		t.Fatalf("Expected 4 API resources requests, got %d", n)
+	}
+}
+
+func TestSetLoggerLargeResponse(t *testing.T) {
+	const count = 500
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/v2") {
+					apiResourcesHandler(w, r)
+					return
+				}
+				entities := make([]string, count)
+				for i := range entities {
+					entities[i] = fmt.Sprintf(`{"id":"Room%d","type":"Room","temperature":{"type":"Float","value":21.5}}`, i)
+				}
+				fmt.Fprintf(w, "[%s]", strings.Join(entities, ","))
+			}))
+	defer ts.Close()
+
+	var logs []string
+	cli, err := client.NewNgsiV2Client(
+		client.SetUrl(ts.URL),
+		client.SetLogger(func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		}))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	entities, err := cli.ListEntities()
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(entities) != count || entities[count-1].Id != fmt.Sprintf("Room%d", count-1) {
+		t.Fatalf("Expected %d entities, got %d", count, len(entities))
+	}
+	last := logs[len(logs)-1]
+	if !strings.HasSuffix(last, "... (truncated)") || len(last) > 9*1024 {
+		t.Fatalf("Expected a truncated response log, got %d bytes", len(last))
+	}
+}
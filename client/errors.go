@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Sentinel errors matched by APIError through errors.Is.
+var (
+	ErrNotFound   = errors.New("resource not found")
+	ErrConflict   = errors.New("conflict")
+	ErrBadRequest = errors.New("bad request")
+)
+
+// ErrVersionUnavailable is returned by GetVersion when the broker does not
+// expose the Orion version endpoint, e.g. because it is not an Orion broker.
+var ErrVersionUnavailable = errors.New("version information not available")
+
+// ErrDryRun is meant to be returned by a request interceptor for not sending
+// the request; the client method then fails with it.
+var ErrDryRun = errors.New("dry run, request not sent")
+
+// APIError is returned when the context broker answers with an unexpected status code.
+// Use errors.Is with ErrNotFound, ErrConflict or ErrBadRequest to check for the most
+// common cases, or errors.As to inspect the status code and the Orion error.
+type APIError struct {
+	StatusCode int
+	// Code and Description are parsed from the Orion error payload,
+	// e.g. {"error":"NotFound","description":"The requested entity has not been found. Check type and id"}.
+	// They are empty when the body is not an Orion error.
+	Code        string
+	Description string
+	// Raw is the response body
+	Raw []byte
+}
+
+// OrionError is another name of APIError, after the error payload of Orion,
+// kept for the code matching Orion errors by that name. Being an alias, errors.As
+// with either a *OrionError or an *APIError target matches the same errors.
+type OrionError = APIError
+
+func newAPIError(statusCode int, body []byte) *APIError {
+	e := &APIError{StatusCode: statusCode, Raw: body}
+	var payload struct {
+		Error       string `json:"error"`
+		Description string `json:"description"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		e.Code = payload.Error
+		e.Description = payload.Description
+	}
+	return e
+}
+
+// APIError satisfies the error interface
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("Unexpected status code: '%d' (%s): %s", e.StatusCode, e.Code, e.Description)
+	}
+	return fmt.Sprintf("Unexpected status code: '%d'\nResponse body: %s", e.StatusCode, e.Raw)
+}
+
+// Is reports whether the error matches one of the sentinel errors.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	}
+	return false
+}
+
+// BatchChunkFailure is a chunk of a BatchUpdateChunked that could not be sent.
+type BatchChunkFailure struct {
+	// Chunk is the index of the chunk, Offset and Size locate its entities in the batch
+	Chunk  int
+	Offset int
+	Size   int
+	Err    error
+}
+
+// BatchChunkedError is returned by BatchUpdateChunked when some chunks failed.
+// It unwraps to the error of the first failed chunk.
+type BatchChunkedError struct {
+	Failures []BatchChunkFailure
+}
+
+func (e *BatchChunkedError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d batch update chunks failed", len(e.Failures))
+	for _, f := range e.Failures {
+		fmt.Fprintf(&b, "\nchunk %d (entities %d-%d): %v", f.Chunk, f.Offset, f.Offset+f.Size-1, f.Err)
+	}
+	return b.String()
+}
+
+func (e *BatchChunkedError) Unwrap() error {
+	if len(e.Failures) == 0 {
+		return nil
+	}
+	return e.Failures[0].Err
+}
+
+// Error categories, suitable e.g. as labels for error metrics.
+const (
+	CategoryClientError = "client_error"
+	CategoryServerError = "server_error"
+	CategoryNotFound    = "not_found"
+	CategoryConflict    = "conflict"
+	CategoryTimeout     = "timeout"
+	CategoryNetwork     = "network"
+)
+
+// Category buckets the error by its status code. An APIError without status code
+// means that no response has been received and is categorized as a network error.
+func (e *APIError) Category() string {
+	switch {
+	case e.StatusCode == 0:
+		return CategoryNetwork
+	case e.StatusCode == http.StatusNotFound:
+		return CategoryNotFound
+	case e.StatusCode == http.StatusConflict:
+		return CategoryConflict
+	case e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusGatewayTimeout:
+		return CategoryTimeout
+	case e.StatusCode >= 400 && e.StatusCode < 500:
+		return CategoryClientError
+	default:
+		return CategoryServerError
+	}
+}
+
+// ErrorCategory returns the category of any error returned by the client.
+// Errors not coming from the context broker are categorized as timeout or network
+// errors when the request could not be performed, as client errors otherwise
+// (e.g. invalid parameters). It returns an empty string for a nil error.
+func ErrorCategory(err error) string {
+	if err == nil {
+		return ""
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Category()
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return CategoryTimeout
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) {
+		return CategoryNetwork
+	}
+	return CategoryClientError
+}
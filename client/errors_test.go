@@ -0,0 +1,153 @@
+package client_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/phoops/ngsiv2/client"
+)
+
+func TestAPIErrorIs(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		target     error
+		want       bool
+	}{
+		{"not found", http.StatusNotFound, client.ErrNotFound, true},
+		{"conflict", http.StatusConflict, client.ErrConflict, true},
+		{"bad request", http.StatusBadRequest, client.ErrBadRequest, true},
+		{"not found is not a conflict", http.StatusNotFound, client.ErrConflict, false},
+		{"server error is not a bad request", http.StatusInternalServerError, client.ErrBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error = &client.APIError{StatusCode: tt.statusCode}
+			if got := errors.Is(err, tt.target); got != tt.want {
+				t.Fatalf("expected %v but got %v", tt.want, got)
+			}
+			var apiErr *client.APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.statusCode {
+				t.Fatalf("expected an APIError with status code %d", tt.statusCode)
+			}
+		})
+	}
+}
+
+func TestAPIErrorCategory(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		want       string
+	}{
+		{0, client.CategoryNetwork},
+		{http.StatusBadRequest, client.CategoryClientError},
+		{http.StatusUnprocessableEntity, client.CategoryClientError},
+		{http.StatusNotFound, client.CategoryNotFound},
+		{http.StatusConflict, client.CategoryConflict},
+		{http.StatusRequestTimeout, client.CategoryTimeout},
+		{http.StatusGatewayTimeout, client.CategoryTimeout},
+		{http.StatusInternalServerError, client.CategoryServerError},
+		{http.StatusServiceUnavailable, client.CategoryServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("status %d", tt.statusCode), func(t *testing.T) {
+			err := &client.APIError{StatusCode: tt.statusCode}
+			if got := err.Category(); got != tt.want {
+				t.Fatalf("expected %s but got %s", tt.want, got)
+			}
+			if got := client.ErrorCategory(fmt.Errorf("wrapped: %w", err)); got != tt.want {
+				t.Fatalf("expected %s but got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestErrorCategoryTransport(t *testing.T) {
+	if got := client.ErrorCategory(nil); got != "" {
+		t.Fatalf("expected no category for nil error, got %s", got)
+	}
+	if got := client.ErrorCategory(errors.New("invalid parameter")); got != client.CategoryClientError {
+		t.Fatalf("expected %s but got %s", client.CategoryClientError, got)
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(100 * time.Millisecond)
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL), client.SetClientTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := cli.RetrieveAPIResources(); client.ErrorCategory(err) != client.CategoryTimeout {
+		t.Fatalf("expected %s but got %s (%v)", client.CategoryTimeout, client.ErrorCategory(err), err)
+	}
+
+	closed, err := client.NewNgsiV2Client(client.SetUrl("http://127.0.0.1:1"))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, err := closed.RetrieveAPIResources(); client.ErrorCategory(err) != client.CategoryNetwork {
+		t.Fatalf("expected %s but got %s (%v)", client.CategoryNetwork, client.ErrorCategory(err), err)
+	}
+}
+
+func TestOrionError(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2" {
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprint(w, `{"entities_url":"/v2/entities","types_url":"/v2/types","subscriptions_url":"/v2/subscriptions","registrations_url":"/v2/registrations"}`)
+					return
+				}
+				if r.URL.Path == "/v2/entities/Room1" {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"error":"NotFound","description":"The requested entity has not been found. Check type and id"}`)
+					return
+				}
+				w.WriteHeader(http.StatusBadGateway)
+				fmt.Fprint(w, "<html>Bad Gateway</html>")
+			}))
+	defer ts.Close()
+
+	cli, err := client.NewNgsiV2Client(client.SetUrl(ts.URL))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	_, err = cli.RetrieveEntity("Room1")
+	var orionErr *client.OrionError
+	if !errors.As(err, &orionErr) {
+		t.Fatalf("Expected an OrionError, got '%v'", err)
+	}
+	if orionErr.StatusCode != http.StatusNotFound ||
+		orionErr.Code != "NotFound" ||
+		orionErr.Description != "The requested entity has not been found. Check type and id" ||
+		len(orionErr.Raw) == 0 {
+		t.Fatalf("Invalid Orion error: '%+v'", orionErr)
+	}
+	if orionErr.Error() != "Unexpected status code: '404' (NotFound): The requested entity has not been found. Check type and id" {
+		t.Fatalf("Unexpected error message: '%s'", orionErr.Error())
+	}
+
+	_, err = cli.RetrieveEntity("Room2")
+	if !errors.As(err, &orionErr) {
+		t.Fatalf("Expected an OrionError, got '%v'", err)
+	}
+	if orionErr.StatusCode != http.StatusBadGateway || orionErr.Code != "" || string(orionErr.Raw) != "<html>Bad Gateway</html>" {
+		t.Fatalf("Invalid Orion error: '%+v'", orionErr)
+	}
+	if orionErr.Error() != "Unexpected status code: '502'\nResponse body: <html>Bad Gateway</html>" {
+		t.Fatalf("Unexpected error message: '%s'", orionErr.Error())
+	}
+}
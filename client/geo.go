@@ -0,0 +1,52 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/phoops/ngsiv2/model"
+)
+
+// earthRadiusMeters is the mean Earth radius, used for geodesic computations.
+const earthRadiusMeters = 6371008.8
+
+// CircleToPolygonCoords approximates the circle with the given center and radius as a
+// polygon with the given number of segments. It returns the geometry and the coords
+// to be used in a geographical query, e.g. with georel=intersects or coveredBy.
+func CircleToPolygonCoords(center model.GeoPoint, radiusMeters float64, segments int) (model.SimpleLocationFormatGeometry, string, error) {
+	if radiusMeters <= 0 {
+		return "", "", fmt.Errorf("radius must be greater than 0")
+	}
+	if segments < 3 {
+		return "", "", fmt.Errorf("at least 3 segments are needed to build a polygon")
+	}
+	if center.Latitude < -90 || center.Latitude > 90 || center.Longitude < -180 || center.Longitude > 180 {
+		return "", "", fmt.Errorf("invalid center coordinates: '%v, %v'", center.Latitude, center.Longitude)
+	}
+
+	lat := center.Latitude * math.Pi / 180
+	lon := center.Longitude * math.Pi / 180
+	angularDistance := radiusMeters / earthRadiusMeters
+
+	coords := make([]string, 0, segments+1)
+	for i := 0; i < segments; i++ {
+		bearing := 2 * math.Pi * float64(i) / float64(segments)
+		pLat := math.Asin(math.Sin(lat)*math.Cos(angularDistance) +
+			math.Cos(lat)*math.Sin(angularDistance)*math.Cos(bearing))
+		pLon := lon + math.Atan2(math.Sin(bearing)*math.Sin(angularDistance)*math.Cos(lat),
+			math.Cos(angularDistance)-math.Sin(lat)*math.Sin(pLat))
+		// normalize the longitude in [-180, 180]
+		pLon = math.Mod(pLon+3*math.Pi, 2*math.Pi) - math.Pi
+		coords = append(coords, fmt.Sprintf("%v,%v", roundCoord(pLat*180/math.Pi), roundCoord(pLon*180/math.Pi)))
+	}
+	// the polygon ring must be closed
+	coords = append(coords, coords[0])
+
+	return model.SLFPolygon, strings.Join(coords, ";"), nil
+}
+
+// roundCoord rounds a coordinate to 7 decimal digits, about 1 cm.
+func roundCoord(v float64) float64 {
+	return math.Round(v*1e7) / 1e7
+}
@@ -0,0 +1,47 @@
+package client_test
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/phoops/ngsiv2/client"
+	"github.com/phoops/ngsiv2/model"
+)
+
+func TestCircleToPolygonCoords(t *testing.T) {
+	center := model.GeoPoint{Latitude: 43.7696, Longitude: 11.2558}
+	geometry, coords, err := client.CircleToPolygonCoords(center, 1000, 16)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if geometry != model.SLFPolygon {
+		t.Fatalf("Expected '%s' geometry, got '%s'", model.SLFPolygon, geometry)
+	}
+	points := strings.Split(coords, ";")
+	if len(points) != 17 {
+		t.Fatalf("Expected 17 points, got %d", len(points))
+	}
+	if points[0] != points[len(points)-1] {
+		t.Fatal("Expected a closed ring")
+	}
+	for _, p := range points {
+		latLon := strings.Split(p, ",")
+		lat, _ := strconv.ParseFloat(latLon[0], 64)
+		lon, _ := strconv.ParseFloat(latLon[1], 64)
+		// equirectangular approximation is fine at this scale
+		x := (lon - center.Longitude) * math.Pi / 180 * math.Cos(center.Latitude*math.Pi/180)
+		y := (lat - center.Latitude) * math.Pi / 180
+		if d := math.Sqrt(x*x+y*y) * 6371008.8; math.Abs(d-1000) > 1 {
+			t.Fatalf("Expected point '%s' at 1000m from center, got %vm", p, d)
+		}
+	}
+
+	if _, _, err := client.CircleToPolygonCoords(center, 0, 16); err == nil {
+		t.Fatal("Expected an error for a zero radius")
+	}
+	if _, _, err := client.CircleToPolygonCoords(center, 1000, 2); err == nil {
+		t.Fatal("Expected an error for less than 3 segments")
+	}
+}
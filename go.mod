@@ -1,6 +1,6 @@
 module github.com/phoops/ngsiv2
 
-go 1.13
+go 1.18
 
 require (
 	github.com/mitchellh/mapstructure v1.4.2
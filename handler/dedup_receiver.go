@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/phoops/ngsiv2/model"
+)
+
+// DedupReceiver is a NotificationReceiver that drops the notifications
+// already received within a time window, forwarding the others to the inner receiver.
+// Orion may send a notification again after a transient failure, so it
+// protects receivers that are not idempotent.
+type DedupReceiver struct {
+	inner NotificationReceiver
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewDedupReceiver wraps the inner receiver with a deduplication layer.
+// A notification is a duplicate when it has the same subscription id,
+// entity ids and dateModified values of one received less than ttl ago.
+// Entities without dateModified are identified by their whole content.
+func NewDedupReceiver(inner NotificationReceiver, ttl time.Duration) *DedupReceiver {
+	return &DedupReceiver{
+		inner: inner,
+		ttl:   ttl,
+		seen:  make(map[string]time.Time),
+	}
+}
+
+// Receive forwards the notification to the inner receiver unless it is a duplicate.
+func (d *DedupReceiver) Receive(subscritionId string, entities []*model.Entity) {
+	d.ReceiveWithContext(NotificationContext{SubscriptionId: subscritionId}, entities)
+}
+
+// ReceiveWithContext is like Receive, but notifications of different
+// tenants or service paths are never duplicates of each other.
+// The context is forwarded to inner receivers implementing NotificationReceiverWithContext.
+func (d *DedupReceiver) ReceiveWithContext(nc NotificationContext, entities []*model.Entity) {
+	key := notificationKey(nc, entities)
+	now := time.Now()
+
+	d.mu.Lock()
+	for k, expiration := range d.seen {
+		if !now.Before(expiration) {
+			delete(d.seen, k)
+		}
+	}
+	_, duplicate := d.seen[key]
+	if !duplicate {
+		d.seen[key] = now.Add(d.ttl)
+	}
+	d.mu.Unlock()
+
+	if duplicate {
+		return
+	}
+	if rc, ok := d.inner.(NotificationReceiverWithContext); ok {
+		rc.ReceiveWithContext(nc, entities)
+	} else {
+		d.inner.Receive(nc.SubscriptionId, entities)
+	}
+}
+
+func notificationKey(nc NotificationContext, entities []*model.Entity) string {
+	h := sha256.New()
+	h.Write([]byte(nc.Service))
+	h.Write([]byte{0})
+	h.Write([]byte(nc.ServicePath))
+	h.Write([]byte{0})
+	h.Write([]byte(nc.SubscriptionId))
+	for _, e := range entities {
+		h.Write([]byte{0})
+		if e == nil {
+			continue
+		}
+		if modified, err := e.GetDateModified(); err == nil {
+			h.Write([]byte(e.Id))
+			h.Write([]byte{0})
+			h.Write([]byte(e.Type))
+			h.Write([]byte{0})
+			h.Write([]byte(modified.UTC().Format(time.RFC3339Nano)))
+		} else if b, err := json.Marshal(e); err == nil {
+			h.Write(b)
+		} else {
+			h.Write([]byte(e.Id))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
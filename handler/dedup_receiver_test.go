@@ -0,0 +1,76 @@
+package handler_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phoops/ngsiv2/handler"
+	"github.com/phoops/ngsiv2/model"
+)
+
+func TestDedupReceiver(t *testing.T) {
+	receiver := newTestReceiver()
+	dedup := handler.NewDedupReceiver(receiver, 50*time.Millisecond)
+
+	modified := time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC)
+	room, _ := model.NewEntity("Room1", "Room")
+	room.Attributes[model.DateModifiedAttributeName] = model.NewAttribute(model.DateTimeType, modified)
+	room.SetAttributeAsNumber("temperature", 21)
+
+	dedup.Receive("sub1", []*model.Entity{room})
+	dedup.Receive("sub1", []*model.Entity{room})
+	if len(receiver.notifications["sub1"]) != 1 {
+		t.Fatalf("Expected 1 entity received, got %d", len(receiver.notifications["sub1"]))
+	}
+
+	// same entity on another subscription
+	dedup.Receive("sub2", []*model.Entity{room})
+	if len(receiver.notifications["sub2"]) != 1 {
+		t.Fatalf("Expected 1 entity received, got %d", len(receiver.notifications["sub2"]))
+	}
+
+	// a new modification is not a duplicate
+	room.Attributes[model.DateModifiedAttributeName] = model.NewAttribute(model.DateTimeType, modified.Add(time.Second))
+	dedup.Receive("sub1", []*model.Entity{room})
+	if len(receiver.notifications["sub1"]) != 2 {
+		t.Fatalf("Expected 2 entities received, got %d", len(receiver.notifications["sub1"]))
+	}
+
+	// without dateModified the content is used
+	car, _ := model.NewEntity("Car1", "Car")
+	car.SetAttributeAsNumber("speed", 50)
+	dedup.Receive("sub3", []*model.Entity{car})
+	dedup.Receive("sub3", []*model.Entity{car})
+	car.SetAttributeAsNumber("speed", 60)
+	dedup.Receive("sub3", []*model.Entity{car})
+	if len(receiver.notifications["sub3"]) != 2 {
+		t.Fatalf("Expected 2 entities received, got %d", len(receiver.notifications["sub3"]))
+	}
+
+	// after the ttl the notification is forwarded again
+	time.Sleep(60 * time.Millisecond)
+	dedup.Receive("sub3", []*model.Entity{car})
+	if len(receiver.notifications["sub3"]) != 3 {
+		t.Fatalf("Expected 3 entities received, got %d", len(receiver.notifications["sub3"]))
+	}
+}
+
+func TestDedupReceiverWithContext(t *testing.T) {
+	receiver := &testContextReceiver{testReceiver: *newTestReceiver()}
+	dedup := handler.NewDedupReceiver(receiver, time.Minute)
+
+	room, _ := model.NewEntity("Room1", "Room")
+	room.SetAttributeAsNumber("temperature", 21)
+
+	dedup.ReceiveWithContext(handler.NotificationContext{SubscriptionId: "sub1", Service: "tenant1"}, []*model.Entity{room})
+	dedup.ReceiveWithContext(handler.NotificationContext{SubscriptionId: "sub1", Service: "tenant1"}, []*model.Entity{room})
+	// same notification for another tenant
+	dedup.ReceiveWithContext(handler.NotificationContext{SubscriptionId: "sub1", Service: "tenant2"}, []*model.Entity{room})
+
+	if len(receiver.contexts) != 2 {
+		t.Fatalf("Expected 2 notifications forwarded, got %d", len(receiver.contexts))
+	}
+	if receiver.contexts[1].Service != "tenant2" {
+		t.Fatalf("Expected the context to be forwarded, got %+v", receiver.contexts[1])
+	}
+}
@@ -4,8 +4,11 @@
 package handler
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
@@ -39,6 +42,29 @@ type NotificationReceiver interface {
 	Receive(subscritionId string, entities []*model.Entity)
 }
 
+// NotificationContext carries the details of a notification request.
+type NotificationContext struct {
+	SubscriptionId string
+	// Service is the tenant, from the Fiware-Service header
+	Service string
+	// ServicePath is the entities service path, from the Fiware-ServicePath header
+	ServicePath string
+	// Context is the context of the notification request, done when the context
+	// broker disconnects or the server shuts down, for aborting long-running work.
+	// It is how receivers get the request context, since NotificationReceiver
+	// predates contexts; it is nil when the notification was not received through
+	// the handler, e.g. when ReceiveWithContext is called directly.
+	Context context.Context
+}
+
+// NotificationReceiverWithContext is a NotificationReceiver that also wants the
+// notification context, including the request context. The handler calls
+// ReceiveWithContext instead of Receive on the receivers implementing it.
+type NotificationReceiverWithContext interface {
+	NotificationReceiver
+	ReceiveWithContext(nc NotificationContext, entities []*model.Entity)
+}
+
 // Handler struct for managing errors and notification receivers
 type Handler struct {
 	Receivers []NotificationReceiver
@@ -65,10 +91,129 @@ func NewNgsiV2SubscriptionHandler(receivers ...NotificationReceiver) Handler {
 	return Handler{receivers, NgsiV2SubscriptionHandler}
 }
 
+// handlerConfig is the configuration of a subscription handler.
+type handlerConfig struct {
+	successStatus   int
+	asyncReceivers  bool
+	expectedHeaders map[string]string
+	skipEmpty       bool
+	// keyValues is the format of the notified entities, detected when nil
+	keyValues *bool
+}
+
+func defaultHandlerConfig() *handlerConfig {
+	return &handlerConfig{
+		successStatus: http.StatusOK,
+	}
+}
+
+// HandlerOptionFunc is a function that configures a subscription handler.
+type HandlerOptionFunc func(*handlerConfig) error
+
+// WithSuccessStatus sets the status code answered to the context broker when the
+// notification has been handled, 200 by default; e.g. 204 for an empty response.
+// It must be a 2xx status code, since Orion considers the others as failures.
+func WithSuccessStatus(code int) HandlerOptionFunc {
+	return func(cfg *handlerConfig) error {
+		if code < 200 || code > 299 {
+			return fmt.Errorf("Success status must be a 2xx status code, got %d", code)
+		}
+		cfg.successStatus = code
+		return nil
+	}
+}
+
+// WithAsyncReceivers makes the handler invoke each receiver in its own goroutine,
+// answering the context broker right away instead of waiting for the receivers,
+// so that slow receivers do not make Orion time out and mark the subscription as failed.
+// Delivery becomes at-most-once: Orion considers the notification delivered as soon as
+// it gets the response, so the notifications being received are lost if the process
+// stops, and the failures of the receivers go unnoticed.
+// The receivers get the same entities concurrently, so they must not modify them,
+// and a NotificationContext with a background Context, since the request one
+// is done once the response is sent.
+func WithAsyncReceivers() HandlerOptionFunc {
+	return func(cfg *handlerConfig) error {
+		cfg.asyncReceivers = true
+		return nil
+	}
+}
+
+// WithExpectedHeader makes the handler reject with 403 Forbidden the notifications
+// whose name header is not value, before reading them, e.g. for checking a shared
+// secret set in the httpCustom headers of the subscription.
+// It can be used more than once, for requiring several headers.
+func WithExpectedHeader(name, value string) HandlerOptionFunc {
+	return func(cfg *handlerConfig) error {
+		if name == "" {
+			return errors.New("Expected header name cannot be empty")
+		}
+		if cfg.expectedHeaders == nil {
+			cfg.expectedHeaders = make(map[string]string)
+		}
+		cfg.expectedHeaders[http.CanonicalHeaderKey(name)] = value
+		return nil
+	}
+}
+
+// checkHeaders verifies the expected headers, comparing them in constant time
+// so as not to leak secrets through timing.
+func (cfg *handlerConfig) checkHeaders(r *http.Request) error {
+	for name, value := range cfg.expectedHeaders {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(name)), []byte(value)) != 1 {
+			return StatusError{http.StatusForbidden, fmt.Errorf("Missing or invalid %s header", name)}
+		}
+	}
+	return nil
+}
+
+// WithSkipEmptyNotifications makes the handler acknowledge the notifications without
+// entities, e.g. {"data":[],"subscriptionId":"..."}, without invoking the receivers.
+// By default the receivers get them, with an empty entities slice.
+func WithSkipEmptyNotifications() HandlerOptionFunc {
+	return func(cfg *handlerConfig) error {
+		cfg.skipEmpty = true
+		return nil
+	}
+}
+
+// AcceptKeyValues sets the format of the notified entities, matching the attrsFormat
+// of the subscriptions: keyValues when accept is true, normalized otherwise.
+// By default the format is detected for each entity, which is ambiguous when all its
+// attributes are objects with a type and a value, like a keyValues StructuredValue
+// {"type": "PostalAddress", "value": "..."}, and then taken as normalized.
+func AcceptKeyValues(accept bool) HandlerOptionFunc {
+	return func(cfg *handlerConfig) error {
+		cfg.keyValues = &accept
+		return nil
+	}
+}
+
+// NewNgsiV2SubscriptionHandlerWithOptions is like NewNgsiV2SubscriptionHandler,
+// configuring the handler with the given options.
+func NewNgsiV2SubscriptionHandlerWithOptions(receivers []NotificationReceiver, options ...HandlerOptionFunc) (Handler, error) {
+	cfg := defaultHandlerConfig()
+
+	// apply the options
+	for _, option := range options {
+		if err := option(cfg); err != nil {
+			return Handler{}, err
+		}
+	}
+	return Handler{receivers, cfg.handle}, nil
+}
+
 func NgsiV2SubscriptionHandler(receivers []NotificationReceiver, w http.ResponseWriter, r *http.Request) error {
+	return defaultHandlerConfig().handle(receivers, w, r)
+}
+
+func (cfg *handlerConfig) handle(receivers []NotificationReceiver, w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "POST" {
 		return StatusError{http.StatusMethodNotAllowed, errors.New("Expected a POST")}
 	}
+	if err := cfg.checkHeaders(r); err != nil {
+		return err
+	}
 
 	if ct := r.Header.Get("Content-Type"); ct != "" {
 		if !strings.HasPrefix(ct, "application/json") {
@@ -81,8 +226,8 @@ func NgsiV2SubscriptionHandler(receivers []NotificationReceiver, w http.Response
 
 	decoder := json.NewDecoder(r.Body)
 
-	var n model.Notification
-	err := decoder.Decode(&n)
+	var raw rawNotification
+	err := decoder.Decode(&raw)
 	if err != nil {
 		// unfortunately, it is not defined yet
 		if err.Error() == "http: request body too large" {
@@ -91,9 +236,111 @@ func NgsiV2SubscriptionHandler(receivers []NotificationReceiver, w http.Response
 			return StatusError{http.StatusBadRequest, err}
 		}
 	}
+	n, err := raw.decode(cfg.keyValues)
+	if err != nil {
+		return StatusError{http.StatusBadRequest, err}
+	}
+
+	if cfg.skipEmpty && len(n.Data) == 0 {
+		w.WriteHeader(cfg.successStatus)
+		return nil
+	}
 
-	for _, r := range receivers {
-		r.Receive(n.SubscriptionId, n.Data)
+	nc := NotificationContext{
+		SubscriptionId: n.SubscriptionId,
+		Service:        r.Header.Get("Fiware-Service"),
+		ServicePath:    r.Header.Get("Fiware-ServicePath"),
+		Context:        r.Context(),
 	}
+	if cfg.asyncReceivers {
+		nc.Context = context.Background()
+		for _, r := range receivers {
+			go dispatch(r, nc, n.Data)
+		}
+	} else {
+		for _, r := range receivers {
+			dispatch(r, nc, n.Data)
+		}
+	}
+	w.WriteHeader(cfg.successStatus)
 	return nil
 }
+
+// dispatch hands the notification to the receiver, along with its context if wanted.
+func dispatch(r NotificationReceiver, nc NotificationContext, entities []*model.Entity) {
+	if rc, ok := r.(NotificationReceiverWithContext); ok {
+		rc.ReceiveWithContext(nc, entities)
+	} else {
+		r.Receive(nc.SubscriptionId, entities)
+	}
+}
+
+// rawNotification is a notification whose entities are not decoded yet,
+// since they can be either in normalized or keyValues format.
+type rawNotification struct {
+	Data           []json.RawMessage `json:"data"`
+	SubscriptionId string            `json:"subscriptionId"`
+}
+
+// decode decodes the entities in keyValues format if keyValues is true,
+// in normalized format if false, detecting their format if nil.
+func (raw *rawNotification) decode(keyValues *bool) (*model.Notification, error) {
+	n := &model.Notification{SubscriptionId: raw.SubscriptionId}
+	if raw.Data == nil {
+		return n, nil
+	}
+	n.Data = make([]*model.Entity, 0, len(raw.Data))
+	for _, data := range raw.Data {
+		var e *model.Entity
+		if (keyValues == nil && isKeyValues(data)) || (keyValues != nil && *keyValues) {
+			var err error
+			if e, err = model.UnmarshalKeyValuesEntity(data); err != nil {
+				return nil, err
+			}
+		} else {
+			e = new(model.Entity)
+			if err := json.Unmarshal(data, e); err != nil {
+				return nil, err
+			}
+		}
+		n.Data = append(n.Data, e)
+	}
+	return n, nil
+}
+
+// isKeyValues tells whether the entity is in the keyValues format, i.e. some of
+// its attributes are not {"type": ..., "value": ..., "metadata": ...} objects,
+// metadata being optional.
+func isKeyValues(data []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	for name, value := range fields {
+		if name == "id" || name == "type" {
+			continue
+		}
+		var attr map[string]json.RawMessage
+		if err := json.Unmarshal(value, &attr); err != nil {
+			return true
+		}
+		if !isNormalizedAttribute(attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNormalizedAttribute(attr map[string]json.RawMessage) bool {
+	_, hasType := attr["type"]
+	_, hasValue := attr["value"]
+	if !hasType || !hasValue {
+		return false
+	}
+	for key := range attr {
+		if key != "type" && key != "value" && key != "metadata" {
+			return false
+		}
+	}
+	return true
+}
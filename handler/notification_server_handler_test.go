@@ -1,10 +1,12 @@
 package handler_test
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/phoops/ngsiv2/handler"
 	"github.com/phoops/ngsiv2/model"
@@ -118,3 +120,411 @@ func TestSubscriptionHandlerNotificationOneData(t *testing.T) {
 		}
 	}
 }
+
+type testContextReceiver struct {
+	testReceiver
+	contexts []handler.NotificationContext
+}
+
+func (tr *testContextReceiver) ReceiveWithContext(nc handler.NotificationContext, entities []*model.Entity) {
+	tr.contexts = append(tr.contexts, nc)
+	tr.notifications[nc.SubscriptionId] = append(tr.notifications[nc.SubscriptionId], entities...)
+}
+
+func TestSubscriptionHandlerNotificationContext(t *testing.T) {
+	receiver := newTestReceiver()
+	ctxReceiver := &testContextReceiver{testReceiver: *newTestReceiver()}
+	req, _ := http.NewRequest("POST", "/test", strings.NewReader(`
+{
+    "data": [
+        {
+            "id": "Room1",
+            "temperature": {
+                "metadata": {},
+                "type": "Float",
+                "value": 28.5
+            },
+            "type": "Room"
+        }
+    ],
+    "subscriptionId": "57458eb60962ef754e7c0998"
+}`))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Fiware-Service", "tenant1")
+	req.Header.Add("Fiware-ServicePath", "/building1")
+	rr := httptest.NewRecorder()
+	h := handler.NewNgsiV2SubscriptionHandler(receiver, ctxReceiver)
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("wrong status code: expected %v, got %v", http.StatusOK, status)
+	}
+	if ne := len(receiver.notifications["57458eb60962ef754e7c0998"]); ne != 1 {
+		t.Errorf("expected 1 notification for the plain receiver, got %d", ne)
+	}
+	if nc := len(ctxReceiver.contexts); nc != 1 {
+		t.Fatalf("expected 1 notification context, got %d", nc)
+	}
+	expected := handler.NotificationContext{
+		SubscriptionId: "57458eb60962ef754e7c0998",
+		Service:        "tenant1",
+		ServicePath:    "/building1",
+		Context:        req.Context(),
+	}
+	if ctxReceiver.contexts[0] != expected {
+		t.Errorf("expected notification context %+v, got %+v", expected, ctxReceiver.contexts[0])
+	}
+	if ne := len(ctxReceiver.notifications["57458eb60962ef754e7c0998"]); ne != 1 {
+		t.Errorf("expected 1 notification for the context receiver, got %d", ne)
+	}
+}
+
+func TestSubscriptionHandlerNotificationKeyValues(t *testing.T) {
+	receiver := newTestReceiver()
+	req, _ := http.NewRequest("POST", "/test", strings.NewReader(`
+{
+    "data": [
+        {
+            "id": "Room1",
+            "type": "Room",
+            "temperature": 28.5,
+            "name": "Kitchen",
+            "address": {"city": "Florence"}
+        }
+    ],
+    "subscriptionId": "57458eb60962ef754e7c0998"
+}`))
+	req.Header.Add("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h := handler.NewNgsiV2SubscriptionHandler(receiver)
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("wrong status code: expected %v, got %v", http.StatusOK, status)
+	}
+	entities := receiver.notifications["57458eb60962ef754e7c0998"]
+	if ne := len(entities); ne != 1 {
+		t.Fatalf("expected 1 notification, got %d", ne)
+	}
+	e := entities[0]
+	if e.Id != "Room1" || e.Type != "Room" {
+		t.Errorf("Unexpected entity '%s' of type '%s'", e.Id, e.Type)
+	}
+	temp, err := e.GetAttribute("temperature")
+	if err != nil {
+		t.Fatalf("Error getting temperature attribute: %v", err)
+	}
+	if temp.Type != model.NumberType {
+		t.Errorf("Expected temperature of type '%s', got '%s'", model.NumberType, temp.Type)
+	}
+	if tempFloat, err := temp.GetAsFloat(); err != nil {
+		t.Errorf("Error getting temperature value as float: %v", err)
+	} else if tempFloat != 28.5 {
+		t.Errorf("Expecting temperature attribute with value %2.1f, got %2.1f", 28.5, tempFloat)
+	}
+	if name, err := e.GetAttribute("name"); err != nil || name.Type != model.TextType {
+		t.Errorf("Expected name attribute of type '%s', got %+v (%v)", model.TextType, name, err)
+	}
+	if address, err := e.GetAttribute("address"); err != nil || address.Type != model.StructuredValueType {
+		t.Errorf("Expected address attribute of type '%s', got %+v (%v)", model.StructuredValueType, address, err)
+	}
+}
+
+func TestSubscriptionHandlerNotificationKeyValuesTypedObject(t *testing.T) {
+	receiver := newTestReceiver()
+	req, _ := http.NewRequest("POST", "/test", strings.NewReader(`{"data":[{"id":"X","type":"T","address":{"type":"PostalAddress","streetAddress":"Via Roma 1"}}],"subscriptionId":"sub1"}`))
+	req.Header.Add("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h := handler.NewNgsiV2SubscriptionHandler(receiver)
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("wrong status code: expected %v, got %v", http.StatusOK, status)
+	}
+	entities := receiver.notifications["sub1"]
+	if ne := len(entities); ne != 1 {
+		t.Fatalf("expected 1 notification, got %d", ne)
+	}
+	address, err := entities[0].GetAttribute("address")
+	if err != nil {
+		t.Fatalf("Error getting address attribute: %v", err)
+	}
+	if address.Type != model.StructuredValueType {
+		t.Fatalf("Expected address attribute of type '%s', got '%s'", model.StructuredValueType, address.Type)
+	}
+	value, ok := address.Value.(map[string]interface{})
+	if !ok || value["type"] != "PostalAddress" || value["streetAddress"] != "Via Roma 1" {
+		t.Errorf("Unexpected address value %v", address.Value)
+	}
+}
+
+func TestSubscriptionHandlerAcceptKeyValues(t *testing.T) {
+	// an entity whose attributes look normalized, notified in either format
+	payload := `{"data":[{"id":"X","type":"T","address":{"type":"PostalAddress","value":"Via Roma 1"}}],"subscriptionId":"sub1"}`
+	tests := []struct {
+		name         string
+		options      []handler.HandlerOptionFunc
+		expectedType model.AttributeType
+	}{
+		{"detected", nil, "PostalAddress"},
+		{"normalized", []handler.HandlerOptionFunc{handler.AcceptKeyValues(false)}, "PostalAddress"},
+		{"keyValues", []handler.HandlerOptionFunc{handler.AcceptKeyValues(true)}, model.StructuredValueType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newTestReceiver()
+			h, err := handler.NewNgsiV2SubscriptionHandlerWithOptions([]handler.NotificationReceiver{receiver}, tt.options...)
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			req, _ := http.NewRequest("POST", "/test", strings.NewReader(payload))
+			req.Header.Add("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusOK {
+				t.Fatalf("wrong status code: expected %v, got %v", http.StatusOK, status)
+			}
+			entities := receiver.notifications["sub1"]
+			if ne := len(entities); ne != 1 {
+				t.Fatalf("expected 1 notification, got %d", ne)
+			}
+			address, err := entities[0].GetAttribute("address")
+			if err != nil {
+				t.Fatalf("Error getting address attribute: %v", err)
+			}
+			if address.Type != tt.expectedType {
+				t.Errorf("Expected address attribute of type '%s', got '%s'", tt.expectedType, address.Type)
+			}
+		})
+	}
+}
+
+type testCtxReceiver struct {
+	errs []error
+	ids  []string
+}
+
+func (tr *testCtxReceiver) Receive(subscriptionId string, entities []*model.Entity) {
+	tr.ReceiveWithContext(handler.NotificationContext{SubscriptionId: subscriptionId}, entities)
+}
+
+func (tr *testCtxReceiver) ReceiveWithContext(nc handler.NotificationContext, entities []*model.Entity) {
+	var err error
+	if nc.Context != nil {
+		err = nc.Context.Err()
+	}
+	tr.errs = append(tr.errs, err)
+	tr.ids = append(tr.ids, nc.SubscriptionId)
+}
+
+func TestSubscriptionHandlerRequestContext(t *testing.T) {
+	receiver := &testCtxReceiver{}
+	h := handler.NewNgsiV2SubscriptionHandler(receiver, handler.NewDedupReceiver(receiver, time.Minute))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", "/test", strings.NewReader(`{"data":[{"id":"Room1","type":"Room","temperature":{"type":"Float","value":28.5}}],"subscriptionId":"sub1"}`))
+	req.Header.Add("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("wrong status code: expected %v, got %v", http.StatusOK, status)
+	}
+	if len(receiver.errs) != 2 {
+		t.Fatalf("expected 2 notifications, got %d", len(receiver.errs))
+	}
+	for i, err := range receiver.errs {
+		if err != context.Canceled || receiver.ids[i] != "sub1" {
+			t.Errorf("expected the cancelled request context for sub1, got '%v' for %s", err, receiver.ids[i])
+		}
+	}
+}
+
+func TestSubscriptionHandlerWithSuccessStatus(t *testing.T) {
+	if _, err := handler.NewNgsiV2SubscriptionHandlerWithOptions(nil, handler.WithSuccessStatus(http.StatusFound)); err == nil {
+		t.Fatal("expected an error for a non 2xx success status")
+	}
+
+	receiver := newTestReceiver()
+	h, err := handler.NewNgsiV2SubscriptionHandlerWithOptions([]handler.NotificationReceiver{receiver}, handler.WithSuccessStatus(http.StatusNoContent))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	req, _ := http.NewRequest("POST", "/test", strings.NewReader(`{"data":[{"id":"Room1","type":"Room","temperature":{"type":"Float","value":28.5}}],"subscriptionId":"sub1"}`))
+	req.Header.Add("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("wrong status code: expected %v, got %v", http.StatusNoContent, status)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("expected an empty body, got '%s'", rr.Body.String())
+	}
+	if ne := len(receiver.notifications["sub1"]); ne != 1 {
+		t.Errorf("expected 1 notification, got %d", ne)
+	}
+
+	// errors keep their status code
+	req, _ = http.NewRequest("GET", "/test", nil)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
+		t.Errorf("wrong status code: expected %v, got %v", http.StatusMethodNotAllowed, status)
+	}
+}
+
+type blockingReceiver struct {
+	release  chan struct{}
+	received chan string
+}
+
+func (br *blockingReceiver) Receive(subscriptionId string, entities []*model.Entity) {
+	<-br.release
+	br.received <- subscriptionId
+}
+
+func TestSubscriptionHandlerWithAsyncReceivers(t *testing.T) {
+	slow := &blockingReceiver{release: make(chan struct{}), received: make(chan string, 1)}
+	ctxReceiver := &testCtxReceiver{}
+	done := make(chan struct{})
+	h, err := handler.NewNgsiV2SubscriptionHandlerWithOptions(
+		[]handler.NotificationReceiver{slow, receiverFunc(func(nc handler.NotificationContext, entities []*model.Entity) {
+			ctxReceiver.ReceiveWithContext(nc, entities)
+			close(done)
+		})},
+		handler.WithAsyncReceivers(),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "POST", "/test", strings.NewReader(`{"data":[{"id":"Room1","type":"Room","temperature":{"type":"Float","value":28.5}}],"subscriptionId":"sub1"}`))
+	req.Header.Add("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	// the response is sent while the slow receiver is still blocked
+	h.ServeHTTP(rr, req)
+	cancel()
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("wrong status code: expected %v, got %v", http.StatusOK, status)
+	}
+	close(slow.release)
+	select {
+	case id := <-slow.received:
+		if id != "sub1" {
+			t.Errorf("expected sub1, got %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the slow receiver did not get the notification")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the context receiver did not get the notification")
+	}
+	if err := ctxReceiver.errs[0]; err != nil {
+		t.Errorf("expected a context not cancelled with the request, got '%v'", err)
+	}
+}
+
+type receiverFunc func(nc handler.NotificationContext, entities []*model.Entity)
+
+func (f receiverFunc) Receive(subscriptionId string, entities []*model.Entity) {
+	f(handler.NotificationContext{SubscriptionId: subscriptionId}, entities)
+}
+
+func (f receiverFunc) ReceiveWithContext(nc handler.NotificationContext, entities []*model.Entity) {
+	f(nc, entities)
+}
+
+func TestSubscriptionHandlerWithExpectedHeader(t *testing.T) {
+	if _, err := handler.NewNgsiV2SubscriptionHandlerWithOptions(nil, handler.WithExpectedHeader("", "secret")); err == nil {
+		t.Fatal("expected an error for an empty header name")
+	}
+
+	receiver := newTestReceiver()
+	h, err := handler.NewNgsiV2SubscriptionHandlerWithOptions(
+		[]handler.NotificationReceiver{receiver},
+		handler.WithExpectedHeader("x-notification-secret", "s3cr3t"),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		status int
+	}{
+		{"missing secret", "", `{"data":[],"subscriptionId":"sub1"}`, http.StatusForbidden},
+		{"wrong secret", "secret", `{"data":[],"subscriptionId":"sub1"}`, http.StatusForbidden},
+		{"wrong secret and invalid body", "secret", `{`, http.StatusForbidden},
+		{"right secret", "s3cr3t", `{"data":[{"id":"Room1","type":"Room","temperature":{"type":"Float","value":28.5}}],"subscriptionId":"sub1"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/test", strings.NewReader(tt.body))
+			req.Header.Add("Content-Type", "application/json")
+			if tt.secret != "" {
+				req.Header.Add("X-Notification-Secret", tt.secret)
+			}
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("wrong status code: expected %v, got %v", tt.status, status)
+			}
+		})
+	}
+	if ne := len(receiver.notifications["sub1"]); ne != 1 {
+		t.Errorf("expected only the authenticated notification, got %d", ne)
+	}
+}
+
+func TestSubscriptionHandlerEmptyNotification(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []handler.HandlerOptionFunc
+		received bool
+	}{
+		{"default", nil, true},
+		{"skip empty", []handler.HandlerOptionFunc{handler.WithSkipEmptyNotifications()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newTestReceiver()
+			h, err := handler.NewNgsiV2SubscriptionHandlerWithOptions([]handler.NotificationReceiver{receiver}, tt.options...)
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			req, _ := http.NewRequest("POST", "/test", strings.NewReader(`{"data":[],"subscriptionId":"x"}`))
+			req.Header.Add("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusOK {
+				t.Errorf("wrong status code: expected %v, got %v", http.StatusOK, status)
+			}
+			entities, received := receiver.notifications["x"]
+			if received != tt.received {
+				t.Fatalf("expected received to be %v", tt.received)
+			}
+			if len(entities) != 0 {
+				t.Errorf("expected no entities, got %d", len(entities))
+			}
+		})
+	}
+}
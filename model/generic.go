@@ -0,0 +1,54 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// GetAttributeAs returns the value of the named attribute as T, using the typed getter
+// matching T: string, int, float64, bool, time.Time, *GeoPoint, []*GeoPoint (for both
+// geo:line and geo:polygon attributes), *geojson.Geometry, or []string and []float64
+// for StructuredValue arrays.
+func GetAttributeAs[T any](e *Entity, name string) (T, error) {
+	var zero T
+	a, err := e.GetAttribute(name)
+	if err != nil {
+		return zero, err
+	}
+
+	var v interface{}
+	switch any(zero).(type) {
+	case string:
+		v, err = a.GetAsString()
+	case int:
+		v, err = a.GetAsInteger()
+	case float64:
+		v, err = a.GetAsFloat()
+	case bool:
+		v, err = a.GetAsBoolean()
+	case time.Time:
+		v, err = a.GetAsDateTime()
+	case *GeoPoint:
+		v, err = a.GetAsGeoPoint()
+	case []*GeoPoint:
+		if a.Type == GeoPolygonType {
+			v, err = a.GetAsGeoPolygon()
+		} else {
+			v, err = a.GetAsGeoLine()
+		}
+	case *geojson.Geometry:
+		v, err = a.GetAsGeoJSON()
+	case []string:
+		v, err = a.GetAsStringSlice()
+	case []float64:
+		v, err = a.GetAsFloatSlice()
+	default:
+		return zero, fmt.Errorf("Unsupported type %T for attribute '%s'", zero, name)
+	}
+	if err != nil {
+		return zero, err
+	}
+	return v.(T), nil
+}
@@ -0,0 +1,52 @@
+package model_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phoops/ngsiv2/model"
+)
+
+func TestGetAttributeAs(t *testing.T) {
+	e, _ := model.NewEntity("Room1", "Room")
+	lastSeen := time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC)
+	e.SetAttributeAsText("name", "Kitchen")
+	e.SetAttributeAsInteger("floor", 2)
+	e.SetAttributeAsFloat("temperature", 21.5)
+	e.SetAttributeAsBoolean("occupied", true)
+	e.SetAttributeAsDateTime("lastSeen", lastSeen)
+	e.SetAttributeAsGeoPoint("location", model.NewGeoPoint(43.77, 11.25))
+	e.SetAttributeAsGeoLine("path", []*model.GeoPoint{model.NewGeoPoint(43.77, 11.25), model.NewGeoPoint(43.78, 11.26)})
+
+	if v, err := model.GetAttributeAs[string](e, "name"); err != nil || v != "Kitchen" {
+		t.Fatalf("Unexpected name: '%v', '%v'", v, err)
+	}
+	if v, err := model.GetAttributeAs[int](e, "floor"); err != nil || v != 2 {
+		t.Fatalf("Unexpected floor: '%v', '%v'", v, err)
+	}
+	if v, err := model.GetAttributeAs[float64](e, "temperature"); err != nil || v != 21.5 {
+		t.Fatalf("Unexpected temperature: '%v', '%v'", v, err)
+	}
+	if v, err := model.GetAttributeAs[bool](e, "occupied"); err != nil || !v {
+		t.Fatalf("Unexpected occupied: '%v', '%v'", v, err)
+	}
+	if v, err := model.GetAttributeAs[time.Time](e, "lastSeen"); err != nil || !v.Equal(lastSeen) {
+		t.Fatalf("Unexpected lastSeen: '%v', '%v'", v, err)
+	}
+	if v, err := model.GetAttributeAs[*model.GeoPoint](e, "location"); err != nil || v.Latitude != 43.77 {
+		t.Fatalf("Unexpected location: '%v', '%v'", v, err)
+	}
+	if v, err := model.GetAttributeAs[[]*model.GeoPoint](e, "path"); err != nil || len(v) != 2 {
+		t.Fatalf("Unexpected path: '%v', '%v'", v, err)
+	}
+
+	if _, err := model.GetAttributeAs[bool](e, "name"); err == nil {
+		t.Fatal("Expected an error reading a Text attribute as bool")
+	}
+	if _, err := model.GetAttributeAs[string](e, "missing"); err == nil {
+		t.Fatal("Expected an error for a missing attribute")
+	}
+	if _, err := model.GetAttributeAs[uint](e, "floor"); err == nil {
+		t.Fatal("Expected an error for an unsupported type")
+	}
+}
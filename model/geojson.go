@@ -0,0 +1,98 @@
+package model
+
+import (
+	"fmt"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// EntitiesToGeoJSON builds a GeoJSON FeatureCollection out of entities, e.g. to render
+// them on a map. The geometry of each feature is the value of the geoAttr attribute,
+// which can be a geo:point, geo:line, geo:polygon or geo:json one; its id is the entity id,
+// and its properties are the entity type, as "type", and the values of the other attributes.
+// Nil entities and entities lacking geoAttr are skipped; see EntitiesToGeoJSONStrict
+// to fail on them instead.
+func EntitiesToGeoJSON(entities []*Entity, geoAttr string) (*geojson.FeatureCollection, error) {
+	return entitiesToGeoJSON(entities, geoAttr, false)
+}
+
+// EntitiesToGeoJSONStrict is like EntitiesToGeoJSON, but fails if an entity is nil or lacks geoAttr.
+func EntitiesToGeoJSONStrict(entities []*Entity, geoAttr string) (*geojson.FeatureCollection, error) {
+	return entitiesToGeoJSON(entities, geoAttr, true)
+}
+
+func entitiesToGeoJSON(entities []*Entity, geoAttr string, strict bool) (*geojson.FeatureCollection, error) {
+	fc := geojson.NewFeatureCollection()
+	for i, e := range entities {
+		if e == nil {
+			if strict {
+				return nil, fmt.Errorf("Entity %d is nil", i)
+			}
+			continue
+		}
+		a, ok := e.Attributes[geoAttr]
+		if !ok || a == nil {
+			if strict {
+				return nil, fmt.Errorf("Entity '%s' has no attribute '%s'", e.Id, geoAttr)
+			}
+			continue
+		}
+		g, err := a.asGeometry()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid location of entity '%s': %w", e.Id, err)
+		}
+		f := geojson.NewFeature(g)
+		f.ID = e.Id
+		if e.Type != "" {
+			f.SetProperty("type", e.Type)
+		}
+		for name, attr := range e.Attributes {
+			if name != geoAttr && attr != nil {
+				f.SetProperty(name, attr.Value)
+			}
+		}
+		fc.AddFeature(f)
+	}
+	return fc, nil
+}
+
+// asGeometry returns the value of a geo attribute as a GeoJSON geometry.
+func (a *Attribute) asGeometry() (*geojson.Geometry, error) {
+	switch a.Type {
+	case GeoPointType:
+		p, err := a.GetAsGeoPoint()
+		if err != nil {
+			return nil, err
+		}
+		return geojson.NewPointGeometry(p.position()), nil
+	case GeoLineType:
+		points, err := a.GetAsGeoLine()
+		if err != nil {
+			return nil, err
+		}
+		return geojson.NewLineStringGeometry(geoPointsPositions(points)), nil
+	case GeoPolygonType:
+		ring, err := a.GetAsGeoPolygon()
+		if err != nil {
+			return nil, err
+		}
+		return geojson.NewPolygonGeometry([][][]float64{geoPointsPositions(ring)}), nil
+	case GeoJSONType:
+		return a.GetAsGeoJSON()
+	default:
+		return nil, fmt.Errorf("Attribute type '%s' is not a geo type", a.Type)
+	}
+}
+
+// position returns the point as a GeoJSON position, i.e. longitude first.
+func (p *GeoPoint) position() []float64 {
+	return []float64{p.Longitude, p.Latitude}
+}
+
+func geoPointsPositions(points []*GeoPoint) [][]float64 {
+	positions := make([][]float64, len(points))
+	for i, p := range points {
+		positions[i] = p.position()
+	}
+	return positions
+}
@@ -0,0 +1,72 @@
+package model_test
+
+import (
+	"testing"
+
+	"github.com/phoops/ngsiv2/model"
+)
+
+func TestEntitiesToGeoJSON(t *testing.T) {
+	room1, _ := model.NewEntity("Room1", "Room")
+	room1.SetAttributeAsGeoPoint("location", &model.GeoPoint{Latitude: 43.77, Longitude: 11.25})
+	room1.SetAttributeAsFloat("temperature", 21.5)
+	room2, _ := model.NewEntity("Room2", "Room")
+	room2.SetAttributeAsGeoPolygon("location", []*model.GeoPoint{
+		{Latitude: 0, Longitude: 0},
+		{Latitude: 0, Longitude: 1},
+		{Latitude: 1, Longitude: 1},
+		{Latitude: 0, Longitude: 0},
+	})
+	nowhere, _ := model.NewEntity("Room3", "Room")
+	nowhere.SetAttributeAsFloat("temperature", 19)
+	entities := []*model.Entity{room1, room2, nowhere}
+
+	fc, err := model.EntitiesToGeoJSON(entities, "location")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(fc.Features) != 2 {
+		t.Fatalf("Expected 2 features, got %d", len(fc.Features))
+	}
+	f := fc.Features[0]
+	if f.ID != "Room1" || !f.Geometry.IsPoint() || f.Geometry.Point[0] != 11.25 || f.Geometry.Point[1] != 43.77 {
+		t.Fatalf("Unexpected feature %+v", f)
+	}
+	if f.Properties["type"] != "Room" || f.Properties["temperature"] != 21.5 {
+		t.Fatalf("Unexpected properties %v", f.Properties)
+	}
+	if _, ok := f.Properties["location"]; ok {
+		t.Fatal("Expected the location not to be among the properties")
+	}
+	if g := fc.Features[1].Geometry; !g.IsPolygon() || len(g.Polygon[0]) != 4 || g.Polygon[0][1][0] != 1 {
+		t.Fatalf("Unexpected polygon %+v", g)
+	}
+	if _, err := fc.MarshalJSON(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	if _, err := model.EntitiesToGeoJSONStrict(entities, "location"); err == nil {
+		t.Fatal("Expected an error for entity without location")
+	}
+	if _, err := model.EntitiesToGeoJSON(entities, "temperature"); err == nil {
+		t.Fatal("Expected an error for non geo attribute")
+	}
+}
+
+func TestEntitiesToGeoJSONNilEntity(t *testing.T) {
+	room1, _ := model.NewEntity("Room1", "Room")
+	room1.SetAttributeAsGeoPoint("location", &model.GeoPoint{Latitude: 43.77, Longitude: 11.25})
+	entities := []*model.Entity{nil, room1, nil}
+
+	fc, err := model.EntitiesToGeoJSON(entities, "location")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(fc.Features) != 1 || fc.Features[0].ID != "Room1" {
+		t.Fatalf("Expected only the Room1 feature, got %+v", fc.Features)
+	}
+
+	if _, err := model.EntitiesToGeoJSONStrict(entities, "location"); err == nil {
+		t.Fatal("Expected an error for a nil entity")
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +19,9 @@ import (
 
 var ErrInvalidCastingAttributeEntity = errors.New("could not cast the attribute of the entity")
 
+// ErrMetadataNotFound is returned when looking up a metadata the attribute does not have.
+var ErrMetadataNotFound = errors.New("metadata not found")
+
 // Entity is a context entity, i.e. a thing in the NGSI model.
 type Entity struct {
 	Id         string                `json:"id"`
@@ -68,6 +74,7 @@ const (
 	GeoJSONType         AttributeType = "geo:json"
 	StructuredValueType AttributeType = "StructuredValue"
 	RelationshipType    AttributeType = "Relationship"
+	NoneType            AttributeType = "None"
 )
 
 const (
@@ -76,6 +83,12 @@ const (
 	DateExpiresAttributeName  string = "dateExpires"
 )
 
+const (
+	PreviousValueMetadataName string = "previousValue"
+	TimeInstantMetadataName   string = "TimeInstant"
+	UnitCodeMetadataName      string = "unitCode"
+)
+
 type ActionType string
 
 const (
@@ -98,6 +111,31 @@ type APIResources struct {
 	RegistrationsUrl string `json:"registrations_url"`
 }
 
+// OrionVersion holds the version information of an Orion context broker.
+type OrionVersion struct {
+	Version     string `json:"version"`
+	Uptime      string `json:"uptime"`
+	GitHash     string `json:"git_hash"`
+	CompileTime string `json:"compile_time,omitempty"`
+	CompiledBy  string `json:"compiled_by,omitempty"`
+	CompiledIn  string `json:"compiled_in,omitempty"`
+	ReleaseDate string `json:"release_date,omitempty"`
+	Doc         string `json:"doc,omitempty"`
+}
+
+// EntityType is an entity type with its attributes, as returned by the types endpoint.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/types
+type EntityType struct {
+	Type  string                    `json:"type"`
+	Attrs map[string]EntityTypeAttr `json:"attrs,omitempty"`
+	Count int                       `json:"count"`
+}
+
+// EntityTypeAttr lists the types an attribute takes among the entities of an entity type.
+type EntityTypeAttr struct {
+	Types []string `json:"types"`
+}
+
 type BatchUpdate struct {
 	ActionType ActionType `json:"actionType"`
 	Entities   []*Entity  `json:"entities"`
@@ -112,14 +150,8 @@ type BatchQuery struct {
 
 func (batchQuery *BatchQuery) Match(matchers ...*EntityMatcher) error {
 	for _, matcher := range matchers {
-		if matcher.Id == "" && matcher.IdPattern == "" {
-			return fmt.Errorf("id or idPattern must be present")
-		}
-		if matcher.Id != "" && matcher.IdPattern != "" {
-			return fmt.Errorf("id and idPattern cannot be used at the same time")
-		}
-		if matcher.Type != "" && matcher.TypePattern != "" {
-			return fmt.Errorf("type and typePattern cannot be used at the same time")
+		if err := matcher.validate(); err != nil {
+			return err
 		}
 		batchQuery.Entities = append(batchQuery.Entities, matcher)
 	}
@@ -134,6 +166,19 @@ type EntityMatcher struct {
 	TypePattern string `json:"typePattern,omitempty"`
 }
 
+func (entityMatcher *EntityMatcher) validate() error {
+	if entityMatcher.Id == "" && entityMatcher.IdPattern == "" {
+		return fmt.Errorf("id or idPattern must be present")
+	}
+	if entityMatcher.Id != "" && entityMatcher.IdPattern != "" {
+		return fmt.Errorf("id and idPattern cannot be used at the same time")
+	}
+	if entityMatcher.Type != "" && entityMatcher.TypePattern != "" {
+		return fmt.Errorf("type and typePattern cannot be used at the same time")
+	}
+	return nil
+}
+
 func NewEntityMatcher() *EntityMatcher {
 	return &EntityMatcher{}
 }
@@ -190,12 +235,28 @@ type SubscriptionNotificationHttpCustom struct {
 	Payload string            `json:"payload,omitempty"`
 }
 
+// SubscriptionNotificationMqtt sends notifications to an MQTT broker.
+type SubscriptionNotificationMqtt struct {
+	Url   string `json:"url"`
+	Topic string `json:"topic"`
+	Qos   uint   `json:"qos,omitempty"`
+}
+
+type SubscriptionNotificationMqttCustom struct {
+	Url     string `json:"url"`
+	Topic   string `json:"topic"`
+	Qos     uint   `json:"qos,omitempty"`
+	Payload string `json:"payload,omitempty"`
+}
+
 type SubscriptionNotification struct {
 	Attrs            []string                            `json:"attrs,omitempty"`
 	ExceptAttrs      []string                            `json:"exceptAttrs,omitempty"`
 	Http             *SubscriptionNotificationHttp       `json:"http,omitempty"`
 	HttpCustom       *SubscriptionNotificationHttpCustom `json:"httpCustom,omitempty"`
-	AttrsFormat      string                              `json:"attrsFormat,omitempty"`
+	Mqtt             *SubscriptionNotificationMqtt       `json:"mqtt,omitempty"`
+	MqttCustom       *SubscriptionNotificationMqttCustom `json:"mqttCustom,omitempty"`
+	AttrsFormat      AttrsFormat                         `json:"attrsFormat,omitempty"`
 	Metadata         []string                            `json:"metadata,omitempty"`
 	TimesSent        uint                                `json:"timesSent,omitempty"`
 	LastNotification *time.Time                          `json:"lastNotification,omitempty"`
@@ -232,6 +293,68 @@ type Subscription struct {
 	Throttling   uint                      `json:"throttling,omitempty"`
 }
 
+// Validate checks that the subscription has a subject with at least one entity
+// and a notification with exactly one endpoint.
+func (s *Subscription) Validate() error {
+	if s.Subject == nil {
+		return fmt.Errorf("Subscription subject is required")
+	}
+	if err := s.Subject.Validate(); err != nil {
+		return err
+	}
+	if s.Notification == nil {
+		return fmt.Errorf("Subscription notification is required")
+	}
+	return s.Notification.Validate()
+}
+
+// Validate checks that the subject has at least one valid entity.
+func (s *SubscriptionSubject) Validate() error {
+	if len(s.Entities) == 0 {
+		return fmt.Errorf("Subscription subject requires at least one entity")
+	}
+	for _, e := range s.Entities {
+		if e == nil {
+			return fmt.Errorf("Subscription subject entity cannot be nil")
+		}
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("Invalid subscription subject entity: %w", err)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the notification has exactly one endpoint
+// and a supported attrsFormat.
+func (n *SubscriptionNotification) Validate() error {
+	endpoints := 0
+	for _, set := range []bool{n.Http != nil, n.HttpCustom != nil, n.Mqtt != nil, n.MqttCustom != nil} {
+		if set {
+			endpoints++
+		}
+	}
+	if endpoints != 1 {
+		return fmt.Errorf("Subscription notification requires exactly one endpoint (http, httpCustom, mqtt or mqttCustom), got %d", endpoints)
+	}
+	if n.AttrsFormat != "" && !n.AttrsFormat.IsValid() {
+		return fmt.Errorf("Invalid notification attrsFormat '%s'", n.AttrsFormat)
+	}
+	if len(n.Attrs) > 0 && len(n.ExceptAttrs) > 0 {
+		return fmt.Errorf("Notification attrs and exceptAttrs cannot be used at the same time")
+	}
+	return nil
+}
+
+// IsHealthy tells whether the last notification attempt did not fail, i.e. there is
+// no failure or the last success is more recent than the last failure.
+// It is also true when no notification has been sent yet.
+func (n *SubscriptionNotification) IsHealthy() bool {
+	if n.LastFailure == nil {
+		return true
+	}
+	return n.LastSuccess != nil && !n.LastFailure.After(*n.LastSuccess)
+}
+
 type SubscriptionStatus string
 
 const (
@@ -241,13 +364,125 @@ const (
 	SubscriptionFailed   SubscriptionStatus = "failed"
 )
 
+// Registration is a context provider registration.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/registrations
+type Registration struct {
+	Id                    string                             `json:"id,omitempty"`
+	Description           string                             `json:"description,omitempty"`
+	DataProvided          *RegistrationDataProvided          `json:"dataProvided,omitempty"`
+	Provider              *RegistrationProvider              `json:"provider,omitempty"`
+	Expires               *OrionTime                         `json:"expires,omitempty"`
+	Status                RegistrationStatus                 `json:"status,omitempty"`
+	ForwardingInformation *RegistrationForwardingInformation `json:"forwardingInformation,omitempty"`
+}
+
+type RegistrationDataProvided struct {
+	Entities   []*EntityMatcher `json:"entities,omitempty"`
+	Attrs      []string         `json:"attrs,omitempty"`
+	Expression *QueryExpression `json:"expression,omitempty"`
+}
+
+type RegistrationProviderHttp struct {
+	Url string `json:"url"`
+}
+
+type RegistrationProvider struct {
+	Http                    *RegistrationProviderHttp `json:"http,omitempty"`
+	SupportedForwardingMode string                    `json:"supportedForwardingMode,omitempty"`
+	LegacyForwarding        bool                      `json:"legacyForwarding,omitempty"`
+}
+
+// RegistrationForwardingInformation holds the forwarding statistics, set by the context broker.
+type RegistrationForwardingInformation struct {
+	TimesSent      uint       `json:"timesSent,omitempty"`
+	LastForwarding *time.Time `json:"lastForwarding,omitempty"`
+	LastFailure    *time.Time `json:"lastFailure,omitempty"`
+	LastSuccess    *time.Time `json:"lastSuccess,omitempty"`
+}
+
+type RegistrationStatus string
+
+const (
+	RegistrationActive   RegistrationStatus = "active"
+	RegistrationInactive RegistrationStatus = "inactive"
+)
+
+// SubscriptionHealth is a verdict about the notifications delivery of a subscription.
+type SubscriptionHealth string
+
+const (
+	// SubscriptionHealthy means the last notification was delivered successfully.
+	SubscriptionHealthy SubscriptionHealth = "healthy"
+	// SubscriptionFailing means the subscription failed or the last notification was not delivered.
+	SubscriptionFailing SubscriptionHealth = "failing"
+	// SubscriptionIdle means no notification has been sent yet.
+	SubscriptionIdle SubscriptionHealth = "idle"
+)
+
+// SubscriptionDiagnostics packages the notification statistics of a subscription
+// along with a verdict about its health.
+type SubscriptionDiagnostics struct {
+	Id               string
+	Status           SubscriptionStatus
+	TimesSent        uint
+	LastNotification *time.Time
+	LastFailure      *time.Time
+	LastSuccess      *time.Time
+	LastSuccessCode  *uint
+	Health           SubscriptionHealth
+}
+
+// NewSubscriptionDiagnostics computes the diagnostics of the given subscription.
+func NewSubscriptionDiagnostics(s *Subscription) *SubscriptionDiagnostics {
+	d := &SubscriptionDiagnostics{Id: s.Id, Status: s.Status}
+	if n := s.Notification; n != nil {
+		d.TimesSent = n.TimesSent
+		d.LastNotification = n.LastNotification
+		d.LastFailure = n.LastFailure
+		d.LastSuccess = n.LastSuccess
+		d.LastSuccessCode = n.LastSuccessCode
+	}
+	switch {
+	case s.Status == SubscriptionFailed:
+		d.Health = SubscriptionFailing
+	case s.Notification != nil && !s.Notification.IsHealthy():
+		d.Health = SubscriptionFailing
+	case d.LastSuccess == nil && d.TimesSent == 0:
+		d.Health = SubscriptionIdle
+	default:
+		d.Health = SubscriptionHealthy
+	}
+	return d
+}
+
 const (
 	InvalidChars      string = `<>"'=;()`
 	InvalidFieldChars string = `&?/#` // plus control characters and whitespaces
 )
 
+// ReservedAttrNames can't be used as attribute names. The dateCreated and dateModified
+// builtin attributes are reserved since the context broker maintains them, while
+// dateExpires is not, since clients set it to create transient entities.
 var ReservedAttrNames = [...]string{"id", "type", "geo:distance", "dateCreated", "dateModified"}
 
+// AllAttributesName selects all the regular attributes in the attrs parameter,
+// e.g. for requesting them along with some builtin ones.
+const AllAttributesName string = "*"
+
+// BuiltinAttributeNames are the attributes set by the context broker,
+// only returned when explicitly requested.
+var BuiltinAttributeNames = [...]string{DateCreatedAttributeName, DateModifiedAttributeName, DateExpiresAttributeName}
+
+// IsBuiltinAttributeName tells whether name is one of BuiltinAttributeNames.
+func IsBuiltinAttributeName(name string) bool {
+	for _, builtin := range BuiltinAttributeNames {
+		if name == builtin {
+			return true
+		}
+	}
+	return false
+}
+
 // SimplifiedEntityRepresentation are representation modes to generate simplified
 // representations of entitites.
 // See: https://orioncontextbroker.docs.apiary.io/#introduction/specification/simplified-entity-representation
@@ -260,6 +495,29 @@ const (
 	CountRepresentation     SimplifiedEntityRepresentation = "count"
 )
 
+// AttrsFormat is the format of the entities sent in notifications.
+// See: https://orioncontextbroker.docs.apiary.io/#reference/subscriptions
+type AttrsFormat string
+
+const (
+	AttrsFormatNormalized           AttrsFormat = "normalized"
+	AttrsFormatKeyValues            AttrsFormat = "keyValues"
+	AttrsFormatValues               AttrsFormat = "values"
+	AttrsFormatLegacy               AttrsFormat = "legacy"
+	AttrsFormatSimplifiedNormalized AttrsFormat = "simplifiedNormalized"
+	AttrsFormatSimplifiedKeyValues  AttrsFormat = "simplifiedKeyValues"
+)
+
+// IsValid tells whether f is one of the formats supported by the context broker.
+func (f AttrsFormat) IsValid() bool {
+	switch f {
+	case AttrsFormatNormalized, AttrsFormatKeyValues, AttrsFormatValues, AttrsFormatLegacy,
+		AttrsFormatSimplifiedNormalized, AttrsFormatSimplifiedKeyValues:
+		return true
+	}
+	return false
+}
+
 type SimpleLocationFormatGeometry string
 
 const (
@@ -303,15 +561,46 @@ const (
 
 type SimpleQueryStatement string
 
+// NewBinarySimpleQueryStatement creates the statement comparing attr with value.
+// attr can also be a dotted path into a structured value, e.g. address.city;
+// see NewNestedQueryStatement for paths whose segments contain dots.
 func NewBinarySimpleQueryStatement(attr string, operator SimpleQueryOperator, value string) (SimpleQueryStatement, error) {
 	if !IsValidAttributeName(attr) {
 		return "", fmt.Errorf("'%s' is not a valid attribute name", attr)
 	}
+	return binarySimpleQueryStatement(attr, operator, value), nil
+}
+
+// NewNestedQueryStatement creates the statement comparing with value the field of
+// a structured value found following path, starting from the attribute name,
+// e.g. address.city==Madrid for the []string{"address", "city"} path.
+// Segments containing dots are quoted, as in 'address.v2'.city.
+func NewNestedQueryStatement(path []string, operator SimpleQueryOperator, value string) (SimpleQueryStatement, error) {
+	if len(path) == 0 {
+		return "", fmt.Errorf("Cannot create nested query statement with empty path")
+	}
+	if !IsValidAttributeName(path[0]) {
+		return "", fmt.Errorf("'%s' is not a valid attribute name", path[0])
+	}
+	segments := make([]string, len(path))
+	for i, segment := range path {
+		if !IsValidFieldSyntax(segment) || strings.Contains(segment, "'") {
+			return "", fmt.Errorf("'%s' is not a valid path segment", segment)
+		}
+		if strings.Contains(segment, ".") {
+			segment = "'" + segment + "'"
+		}
+		segments[i] = segment
+	}
+	return binarySimpleQueryStatement(strings.Join(segments, "."), operator, value), nil
+}
+
+func binarySimpleQueryStatement(lhs string, operator SimpleQueryOperator, value string) SimpleQueryStatement {
 	quotedValue := value
 	if operator == SQEqual || operator == SQUnequal {
 		quotedValue = quoteIfComma(value)
 	}
-	return SimpleQueryStatement(fmt.Sprintf("%s%s%s", attr, operator, quotedValue)), nil
+	return SimpleQueryStatement(fmt.Sprintf("%s%s%s", lhs, operator, quotedValue))
 }
 
 func NewBinarySimpleQueryStatementMultipleValues(attr string, operator SimpleQueryOperator, values ...string) (SimpleQueryStatement, error) {
@@ -341,6 +630,43 @@ func NewBinarySimpleQueryStatementRange(attr string, operator SimpleQueryOperato
 	return SimpleQueryStatement(fmt.Sprintf("%s%s%s..%s", attr, operator, quoteIfComma(minimum), quoteIfComma(maximum))), nil
 }
 
+// NewUnarySimpleQueryStatement creates the statement matching the entities
+// having attr, e.g. temperature, or lacking it if exists is false, e.g. !temperature.
+func NewUnarySimpleQueryStatement(attr string, exists bool) (SimpleQueryStatement, error) {
+	if !IsValidAttributeName(attr) {
+		return "", fmt.Errorf("'%s' is not a valid attribute name", attr)
+	}
+	if !exists {
+		return SimpleQueryStatement("!" + attr), nil
+	}
+	return SimpleQueryStatement(attr), nil
+}
+
+// NewMatchPatternQueryStatement creates the statement matching the entities whose attr
+// is a string matching the regular expression pattern, e.g. name~=^Room.
+// The pattern is checked to compile before building the statement.
+func NewMatchPatternQueryStatement(attr, pattern string) (SimpleQueryStatement, error) {
+	if !IsValidAttributeName(attr) {
+		return "", fmt.Errorf("'%s' is not a valid attribute name", attr)
+	}
+	if pattern == "" {
+		return "", fmt.Errorf("Cannot create match pattern query statement with empty pattern")
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return "", fmt.Errorf("Invalid pattern '%s': %w", pattern, err)
+	}
+	return SimpleQueryStatement(fmt.Sprintf("%s%s%s", attr, SQMatchPattern, pattern)), nil
+}
+
+// NewDateTimeRangeQueryStatement creates the statement matching the entities
+// whose attr is a date between from and to, e.g. dateObserved==2020-01-01T00:00:00Z..2020-01-02T00:00:00Z.
+func NewDateTimeRangeQueryStatement(attr string, from, to time.Time) (SimpleQueryStatement, error) {
+	if !from.Before(to) {
+		return "", fmt.Errorf("Range start '%s' is not before range end '%s'", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	return NewBinarySimpleQueryStatementRange(attr, SQEqual, from.Format(time.RFC3339), to.Format(time.RFC3339))
+}
+
 func quoteIfComma(str string) string {
 	if strings.Contains(str, ",") {
 		return "'" + str + "'"
@@ -355,6 +681,8 @@ func NewEntity(id string, entityType string) (*Entity, error) {
 		return nil, err
 	} else if err := validateFieldSyntax(entityType); err != nil {
 		return nil, err
+	} else if err := validateIdConvention(id, entityType); err != nil {
+		return nil, err
 	}
 	e := &Entity{}
 	e.Id = id
@@ -363,6 +691,119 @@ func NewEntity(id string, entityType string) (*Entity, error) {
 	return e, nil
 }
 
+// Clone returns a deep copy of the entity: attributes, metadata and their
+// values are copied, so changing the clone never affects the original.
+func (e *Entity) Clone() *Entity {
+	if e == nil {
+		return nil
+	}
+	c := &Entity{Id: e.Id, Type: e.Type}
+	if e.Attributes != nil {
+		c.Attributes = make(map[string]*Attribute, len(e.Attributes))
+		for name, a := range e.Attributes {
+			c.Attributes[name] = a.Clone()
+		}
+	}
+	return c
+}
+
+// Clone returns a deep copy of the attribute, metadata included.
+func (a *Attribute) Clone() *Attribute {
+	if a == nil {
+		return nil
+	}
+	c := &Attribute{typeValue: typeValue{Type: a.Type, Value: cloneValue(a.Value)}}
+	if a.Metadata != nil {
+		c.Metadata = make(map[string]*Metadata, len(a.Metadata))
+		for name, m := range a.Metadata {
+			if m == nil {
+				c.Metadata[name] = nil
+				continue
+			}
+			c.Metadata[name] = &Metadata{typeValue{Type: m.Type, Value: cloneValue(m.Value)}}
+		}
+	}
+	return c
+}
+
+// cloneValue deep copies the values held by attributes and metadata.
+// Values of types unknown to the model are copied as they are.
+func cloneValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case *GeoPoint:
+		if val == nil {
+			return val
+		}
+		g := *val
+		return &g
+	case []*GeoPoint:
+		if val == nil {
+			return val
+		}
+		points := make([]*GeoPoint, len(val))
+		for i, p := range val {
+			points[i], _ = cloneValue(p).(*GeoPoint)
+		}
+		return points
+	case *geojson.Geometry:
+		if val == nil {
+			return val
+		}
+		b, err := val.MarshalJSON()
+		if err != nil {
+			return val
+		}
+		g, err := geojson.UnmarshalGeometry(b)
+		if err != nil {
+			return val
+		}
+		return g
+	case map[string]interface{}:
+		if val == nil {
+			return val
+		}
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			m[k] = cloneValue(item)
+		}
+		return m
+	case []interface{}:
+		if val == nil {
+			return val
+		}
+		items := make([]interface{}, len(val))
+		for i, item := range val {
+			items[i] = cloneValue(item)
+		}
+		return items
+	case []string:
+		if val == nil {
+			return val
+		}
+		return append([]string(nil), val...)
+	case []float64:
+		if val == nil {
+			return val
+		}
+		return append([]float64(nil), val...)
+	default:
+		// strings, numbers, booleans and times are values already
+		return v
+	}
+}
+
+// SetId sets the id of the entity, checking the field syntax and the id convention in use.
+func (e *Entity) SetId(id string) error {
+	if err := validateFieldSyntax(id); err != nil {
+		return err
+	}
+	if err := validateIdConvention(id, e.Type); err != nil {
+		return err
+	}
+	e.Id = id
+	return nil
+}
+
 type _entity Entity
 
 func (e *Entity) UnmarshalJSON(b []byte) error {
@@ -391,47 +832,11 @@ func (e *Entity) UnmarshalJSON(b []byte) error {
 
 	t_.Attributes = make(map[string]*Attribute, len(jsonValues))
 	for attr, aJson := range jsonValues {
-		if !IsValidFieldSyntax(attr) {
-			fmt.Printf("[Warning] Attribute %v has wrong field syntax\n", attr)
-		}
 		var a Attribute
 
 		if err := json.Unmarshal(aJson, &a); err != nil {
 			return err
 		}
-		switch a.Type {
-		case DateTimeType:
-			val, ok := a.Value.(string)
-			if !ok {
-				return fmt.Errorf("Invalid DateTimeType value: '%v'", a.Value)
-			}
-			if v, err := time.Parse(time.RFC3339, val); err == nil {
-				a.Value = v
-			}
-		case GeoPointType:
-			g := new(GeoPoint)
-			val, ok := a.Value.(string)
-			if !ok {
-				return fmt.Errorf("Invalid geo:point value: '%v'", a.Value)
-			}
-			if err := g.UnmarshalJSON([]byte(val)); err == nil {
-				a.Value = g
-			}
-		case GeoJSONType:
-			var ma map[string]json.RawMessage
-			if err := json.Unmarshal(aJson, &ma); err != nil {
-				return err
-			}
-			gJSON, ok := ma["value"]
-			if !ok {
-				return fmt.Errorf("Invalid geo:json value: '%v'", a)
-			}
-			g := new(geojson.Geometry)
-			if err := g.UnmarshalJSON(gJSON); err != nil {
-				return err
-			}
-			a.Value = g
-		}
 		t_.Attributes[attr] = &a
 	}
 
@@ -440,6 +845,113 @@ func (e *Entity) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// decodeTypedValue converts the value decoded from JSON into the Go type matching
+// the NGSI type, e.g. a DateTime string into a time.Time.
+// b is the raw JSON object holding type and value.
+func (tv *typeValue) decodeTypedValue(b []byte) error {
+	switch tv.Type {
+	case DateTimeType:
+		val, ok := tv.Value.(string)
+		if !ok {
+			return fmt.Errorf("Invalid DateTimeType value: '%v'", tv.Value)
+		}
+		if v, err := time.Parse(time.RFC3339, val); err == nil {
+			tv.Value = v
+		}
+	case GeoPointType:
+		g := new(GeoPoint)
+		val, ok := tv.Value.(string)
+		if !ok {
+			return fmt.Errorf("Invalid geo:point value: '%v'", tv.Value)
+		}
+		if err := g.UnmarshalJSON([]byte(val)); err == nil {
+			tv.Value = g
+		}
+	case GeoLineType, GeoPolygonType:
+		if points, ok := decodeGeoPoints(tv.Value); ok {
+			tv.Value = points
+		}
+	case GeoJSONType:
+		var ma map[string]json.RawMessage
+		if err := json.Unmarshal(b, &ma); err != nil {
+			return err
+		}
+		gJSON, ok := ma["value"]
+		if !ok {
+			return fmt.Errorf("Invalid geo:json value: '%v'", *tv)
+		}
+		g := new(geojson.Geometry)
+		if err := g.UnmarshalJSON(gJSON); err != nil {
+			return err
+		}
+		tv.Value = g
+	}
+	return nil
+}
+
+// decodeGeoPoints decodes a list of coordinates in the "lat, lon" format.
+func decodeGeoPoints(v interface{}) ([]*GeoPoint, bool) {
+	coords, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	points := make([]*GeoPoint, 0, len(coords))
+	for _, c := range coords {
+		str, ok := c.(string)
+		if !ok {
+			return nil, false
+		}
+		g := new(GeoPoint)
+		if err := g.UnmarshalJSON([]byte(str)); err != nil {
+			return nil, false
+		}
+		points = append(points, g)
+	}
+	return points, true
+}
+
+type _attribute Attribute
+
+// UnmarshalJSON decodes the attribute converting its value according to its type,
+// e.g. DateTime values into time.Time and geo:point values into *GeoPoint.
+func (a *Attribute) UnmarshalJSON(b []byte) error {
+	t_ := _attribute{}
+	if err := json.Unmarshal(b, &t_); err != nil {
+		return err
+	}
+	if err := t_.decodeTypedValue(b); err != nil {
+		return err
+	}
+	*a = Attribute(t_)
+	return nil
+}
+
+// UnmarshalJSON decodes the metadata applying the same type conversions used for attributes.
+func (m *Metadata) UnmarshalJSON(b []byte) error {
+	var tv typeValue
+	if err := json.Unmarshal(b, &tv); err != nil {
+		return err
+	}
+	if err := tv.decodeTypedValue(b); err != nil {
+		return err
+	}
+	m.typeValue = tv
+	return nil
+}
+
+// AttributeNames returns the names of the entity attributes, sorted.
+func (e *Entity) AttributeNames() []string {
+	names := make([]string, 0, len(e.Attributes))
+	for name := range e.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MarshalJSON encodes the entity as a JSON object whose keys, i.e. id, type and
+// the attribute names, are sorted, so that the output is deterministic.
+// An empty type is omitted, as Orion rejects empty types.
 func (e *Entity) MarshalJSON() ([]byte, error) {
 	data := make(map[string]interface{})
 
@@ -453,63 +965,583 @@ func (e *Entity) MarshalJSON() ([]byte, error) {
 	for i := 0; i < typ.NumField(); i++ {
 		field := typ.Field(i)
 		fieldv := val.Field(i)
-		jsonTag := strings.Split(field.Tag.Get("json"), ",")[0]
-		if jsonTag != "" && jsonTag != "-" {
-			data[jsonTag] = fieldv.Interface()
+		tagParts := strings.Split(field.Tag.Get("json"), ",")
+		jsonTag := tagParts[0]
+		if jsonTag == "" || jsonTag == "-" {
+			continue
 		}
+		if fieldv.IsZero() && containsString(tagParts[1:], "omitempty") {
+			continue
+		}
+		data[jsonTag] = fieldv.Interface()
 	}
 
 	return json.Marshal(data)
 }
 
-func (e *Entity) String() string {
-	b, _ := e.MarshalJSON()
-	return string(b)
-}
-
-func NewGeoPoint(latitude float64, longitude float64) *GeoPoint {
-	return &GeoPoint{latitude, longitude}
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
-func (p *GeoPoint) UnmarshalJSON(b []byte) error {
-	tokens := strings.Split(string(b), ",")
-	if len(tokens) != 2 {
-		return fmt.Errorf("Invalid geo:point value: '%s'", string(b))
+// AssertRoundTrip marshals the entity and unmarshals it back, checking that its id,
+// its type and every attribute, as compared by Attribute.Equal, survived.
+// It is meant for tests, and returns an error describing the first divergence found.
+func AssertRoundTrip(e *Entity) error {
+	if e == nil {
+		return errors.New("Cannot round trip a nil entity")
 	}
-	lat, err := strconv.ParseFloat(strings.TrimSpace(tokens[0]), 64)
+	b, err := json.Marshal(e)
 	if err != nil {
-		return fmt.Errorf("Invalid latitude value: '%s'", tokens[0])
+		return fmt.Errorf("Could not marshal entity '%s': %w", e.Id, err)
 	}
-	lon, err := strconv.ParseFloat(strings.TrimSpace(tokens[1]), 64)
-	if err != nil {
-		return fmt.Errorf("Invalid longitude value: '%s'", tokens[1])
+	decoded := new(Entity)
+	if err := json.Unmarshal(b, decoded); err != nil {
+		return fmt.Errorf("Could not unmarshal entity '%s': %w", e.Id, err)
+	}
+	if decoded.Id != e.Id {
+		return fmt.Errorf("Entity id changed from '%s' to '%s'", e.Id, decoded.Id)
+	}
+	if decoded.Type != e.Type {
+		return fmt.Errorf("Entity type changed from '%s' to '%s'", e.Type, decoded.Type)
+	}
+
+	for _, name := range e.AttributeNames() {
+		a := e.Attributes[name]
+		d, ok := decoded.Attributes[name]
+		if !ok {
+			return fmt.Errorf("Attribute '%s' lost in round trip", name)
+		}
+		if a.Equal(d) {
+			continue
+		}
+		switch {
+		case a.Type != d.Type:
+			return fmt.Errorf("Attribute '%s' type changed from '%s' to '%s'", name, a.Type, d.Type)
+		case !valuesEqual(a.Value, d.Value):
+			return fmt.Errorf("Attribute '%s' value changed from '%v' to '%v'", name, a.Value, d.Value)
+		default:
+			return fmt.Errorf("Attribute '%s' metadata changed in round trip", name)
+		}
 	}
-	*p = GeoPoint{lat, lon}
 	return nil
 }
 
-func (p *GeoPoint) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf(`"%v, %v"`, p.Latitude, p.Longitude)), nil
+// Diff compares the attributes of the entity with the ones of other, by type and value.
+// It returns the attributes of other that are new or changed, suitable for an update,
+// and the sorted names of the attributes missing in other.
+// Values are compared by what they represent, e.g. geo:point values by their coordinates
+// and structured values deeply; metadata are not compared.
+// A nil entity has no attributes, so diffing against nil reports all of them as removed.
+func (e *Entity) Diff(other *Entity) (map[string]*Attribute, []string) {
+	var attrs, otherAttrs map[string]*Attribute
+	if e != nil {
+		attrs = e.Attributes
+	}
+	if other != nil {
+		otherAttrs = other.Attributes
+	}
+	changed := make(map[string]*Attribute)
+	var removed []string
+	for name, otherAttr := range otherAttrs {
+		attr, ok := attrs[name]
+		if !ok || attr == nil || otherAttr == nil {
+			if attr != otherAttr {
+				changed[name] = otherAttr
+			}
+			continue
+		}
+		if !attr.typeValue.equal(&otherAttr.typeValue) {
+			changed[name] = otherAttr
+		}
+	}
+	for name := range attrs {
+		if _, ok := otherAttrs[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	return changed, removed
 }
 
-func (e *Entity) GetAttribute(name string) (*Attribute, error) {
-	if attr, ok := e.Attributes[name]; ok {
-		return attr, nil
-	} else {
-		return nil, fmt.Errorf("Entity has no attribute '%s'", name)
+// Equal tells whether the attributes have the same type, value and metadata.
+// Values are compared by what they represent, as in Entity.Diff, so e.g. two
+// *GeoPoint values are equal when they have the same coordinates, and structured
+// values are compared deeply.
+func (a *Attribute) Equal(other *Attribute) bool {
+	if a == nil || other == nil {
+		return a == other
+	}
+	if !a.typeValue.equal(&other.typeValue) || len(a.Metadata) != len(other.Metadata) {
+		return false
+	}
+	for name, m := range a.Metadata {
+		om, ok := other.Metadata[name]
+		if !ok {
+			return false
+		}
+		if m == nil || om == nil {
+			if m != om {
+				return false
+			}
+			continue
+		}
+		if !m.typeValue.equal(&om.typeValue) {
+			return false
+		}
 	}
+	return true
 }
 
-// IsValidString checks whether the string is valid or contains any forbidden character.
-// See: https://github.com/telefonicaid/fiware-orion/blob/master/doc/manuals/user/forbidden_characters.md
-func IsValidString(str string) bool {
-	return !strings.ContainsAny(str, InvalidChars)
+func (tv *typeValue) equal(other *typeValue) bool {
+	return tv.Type == other.Type && valuesEqual(tv.Value, other.Value)
 }
 
-// SanitizeString removes any forbidden character from a string.
-func SanitizeString(str string) string {
+// valuesEqual compares two attribute or metadata values: time and geo:point values
+// are compared by what they represent, the others as they are encoded in JSON,
+// so that e.g. an int and a float64 holding the same number are equal.
+func valuesEqual(a, b interface{}) bool {
+	if at, ok := asTime(a); ok {
+		bt, ok := asTime(b)
+		return ok && at.Equal(bt)
+	}
+	if ap, ok := asGeoPoint(a); ok {
+		bp, ok := asGeoPoint(b)
+		return ok && ap == bp
+	}
+	aj, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bj, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	var av, bv interface{}
+	if err := json.Unmarshal(aj, &av); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(bj, &bv); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+func asTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case OrionTime:
+		return t.Time, true
+	case *OrionTime:
+		if t != nil {
+			return t.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func asGeoPoint(v interface{}) (GeoPoint, bool) {
+	switch p := v.(type) {
+	case GeoPoint:
+		return p, true
+	case *GeoPoint:
+		if p != nil {
+			return *p, true
+		}
+	}
+	return GeoPoint{}, false
+}
+
+func (e *Entity) String() string {
+	b, _ := e.MarshalJSON()
+	return string(b)
+}
+
+// ToKeyValuesEntity returns a copy of the entity in the simplified keyValues form:
+// attributes only carry their values, while types and metadata are erased.
+func (e *Entity) ToKeyValuesEntity() *Entity {
+	kv := &Entity{Id: e.Id, Type: e.Type}
+	kv.Attributes = make(map[string]*Attribute, len(e.Attributes))
+	for name, a := range e.Attributes {
+		kv.Attributes[name] = NewAttribute("", a.Value)
+	}
+	return kv
+}
+
+// KeyValuesToNormalized returns a normalized copy of an entity in keyValues form.
+// typeHints sets the type of the named attributes, converting their values when needed
+// (e.g. a DateTime string into a time.Time); the type of the other attributes is
+// inferred from their values.
+func KeyValuesToNormalized(kv *Entity, typeHints map[string]AttributeType) *Entity {
+	e := &Entity{Id: kv.Id, Type: kv.Type}
+	e.Attributes = make(map[string]*Attribute, len(kv.Attributes))
+	for name, a := range kv.Attributes {
+		typ, ok := typeHints[name]
+		if !ok {
+			typ = inferAttributeType(a.Value)
+		}
+		e.Attributes[name] = NewAttribute(typ, convertValue(typ, a.Value))
+	}
+	return e
+}
+
+// UnmarshalKeyValuesEntity decodes an entity in the simplified keyValues form,
+// where attributes are bare JSON values, into its normalized form.
+// The types of the attributes are inferred from their values, as in KeyValuesToNormalized.
+func UnmarshalKeyValuesEntity(b []byte) (*Entity, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	kv := &Entity{Attributes: make(map[string]*Attribute, len(data))}
+	for name, v := range data {
+		switch name {
+		case "id":
+			id, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid entity id: '%v'", v)
+			}
+			kv.Id = id
+		case "type":
+			typ, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid entity type: '%v'", v)
+			}
+			kv.Type = typ
+		default:
+			kv.Attributes[name] = NewAttribute("", v)
+		}
+	}
+	return KeyValuesToNormalized(kv, nil), nil
+}
+
+// inferAttributeType guesses the NGSI type of a value.
+func inferAttributeType(v interface{}) AttributeType {
+	switch v.(type) {
+	case string:
+		return TextType
+	case float64, float32:
+		return NumberType
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return IntegerType
+	case bool:
+		return BooleanType
+	case time.Time, OrionTime:
+		return DateTimeType
+	case *GeoPoint:
+		return GeoPointType
+	case *geojson.Geometry:
+		return GeoJSONType
+	case nil:
+		return NoneType
+	default:
+		return StructuredValueType
+	}
+}
+
+// convertValue converts a raw value into the Go type used for the NGSI type, if needed.
+// The value is returned unchanged if it cannot be converted.
+func convertValue(typ AttributeType, v interface{}) interface{} {
+	switch typ {
+	case DateTimeType:
+		if s, ok := v.(string); ok {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				return t
+			}
+		}
+	case GeoPointType:
+		if s, ok := v.(string); ok {
+			g := new(GeoPoint)
+			if err := g.UnmarshalJSON([]byte(s)); err == nil {
+				return g
+			}
+		}
+	case GeoJSONType:
+		if m, ok := v.(map[string]interface{}); ok {
+			if b, err := json.Marshal(m); err == nil {
+				if g, err := geojson.UnmarshalGeometry(b); err == nil {
+					return g
+				}
+			}
+		}
+	}
+	return v
+}
+
+// coerceDateTimeLayouts are the layouts tried, in order, when coercing a string to DateTime.
+var coerceDateTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// CoerceValue converts a loosely typed raw value into the Go type used for the given
+// NGSI type, e.g. a numeric string into a float64 for Number or into an int for Integer,
+// or a date string into a time.Time for DateTime.
+// An error is returned when the value cannot be converted.
+// Values of types without a specific Go representation are returned unchanged.
+func CoerceValue(typ AttributeType, raw interface{}) (interface{}, error) {
+	switch typ {
+	case StringType, TextType, RelationshipType:
+		switch v := raw.(type) {
+		case string:
+			return v, nil
+		case bool, int, int32, int64, float32, float64, json.Number:
+			return fmt.Sprint(v), nil
+		}
+	case NumberType, FloatType, PercentageType:
+		switch v := raw.(type) {
+		case float64:
+			return v, nil
+		case float32:
+			return float64(v), nil
+		case int:
+			return float64(v), nil
+		case int32:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case json.Number:
+			return v.Float64()
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot coerce '%s' to %s: %w", v, typ, err)
+			}
+			return f, nil
+		}
+	case IntegerType:
+		switch v := raw.(type) {
+		case int:
+			return v, nil
+		case int32:
+			return int(v), nil
+		case int64:
+			return int(v), nil
+		case float32:
+			return integerFromFloat(typ, float64(v))
+		case float64:
+			return integerFromFloat(typ, v)
+		case json.Number:
+			i, err := strconv.Atoi(v.String())
+			if err != nil {
+				return nil, fmt.Errorf("Cannot coerce '%s' to %s: %w", v, typ, err)
+			}
+			return i, nil
+		case string:
+			i, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("Cannot coerce '%s' to %s: %w", v, typ, err)
+			}
+			return i, nil
+		}
+	case BooleanType:
+		switch v := raw.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("Cannot coerce '%s' to %s: %w", v, typ, err)
+			}
+			return b, nil
+		}
+	case DateTimeType:
+		switch v := raw.(type) {
+		case time.Time:
+			return v, nil
+		case OrionTime:
+			return v.Time, nil
+		case string:
+			for _, layout := range coerceDateTimeLayouts {
+				if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+					return t, nil
+				}
+			}
+			return nil, fmt.Errorf("Cannot coerce '%s' to %s: unknown date format", v, typ)
+		}
+	case GeoPointType:
+		switch v := raw.(type) {
+		case *GeoPoint:
+			return v, nil
+		case GeoPoint:
+			return &v, nil
+		case string:
+			g := new(GeoPoint)
+			if err := g.UnmarshalJSON([]byte(v)); err != nil {
+				return nil, fmt.Errorf("Cannot coerce '%s' to %s: %w", v, typ, err)
+			}
+			return g, nil
+		}
+	case GeoJSONType:
+		switch v := raw.(type) {
+		case *geojson.Geometry:
+			return v, nil
+		case string:
+			g, err := geojson.UnmarshalGeometry([]byte(v))
+			if err != nil {
+				return nil, fmt.Errorf("Cannot coerce '%s' to %s: %w", v, typ, err)
+			}
+			return g, nil
+		case map[string]interface{}:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot coerce value to %s: %w", typ, err)
+			}
+			g, err := geojson.UnmarshalGeometry(b)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot coerce value to %s: %w", typ, err)
+			}
+			return g, nil
+		}
+	default:
+		return raw, nil
+	}
+	return nil, fmt.Errorf("Cannot coerce value of type %T to %s", raw, typ)
+}
+
+func integerFromFloat(typ AttributeType, f float64) (int, error) {
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("Cannot coerce '%v' to %s: not an integer", f, typ)
+	}
+	return int(f), nil
+}
+
+func NewGeoPoint(latitude float64, longitude float64) *GeoPoint {
+	return &GeoPoint{latitude, longitude}
+}
+
+func (p *GeoPoint) UnmarshalJSON(b []byte) error {
+	tokens := strings.Split(string(b), ",")
+	if len(tokens) != 2 {
+		return fmt.Errorf("Invalid geo:point value: '%s'", string(b))
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(tokens[0]), 64)
+	if err != nil {
+		return fmt.Errorf("Invalid latitude value: '%s'", tokens[0])
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(tokens[1]), 64)
+	if err != nil {
+		return fmt.Errorf("Invalid longitude value: '%s'", tokens[1])
+	}
+	g := GeoPoint{lat, lon}
+	if err := g.Validate(); err != nil {
+		return err
+	}
+	*p = g
+	return nil
+}
+
+// Validate checks that latitude is in [-90, 90] and longitude in [-180, 180].
+func (p *GeoPoint) Validate() error {
+	if p.Latitude < -90 || p.Latitude > 90 || math.IsNaN(p.Latitude) {
+		return fmt.Errorf("Latitude %v out of range [-90, 90]", p.Latitude)
+	}
+	if p.Longitude < -180 || p.Longitude > 180 || math.IsNaN(p.Longitude) {
+		return fmt.Errorf("Longitude %v out of range [-180, 180]", p.Longitude)
+	}
+	return nil
+}
+
+func (p *GeoPoint) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%v, %v"`, p.Latitude, p.Longitude)), nil
+}
+
+func (e *Entity) GetAttribute(name string) (*Attribute, error) {
+	if attr, ok := e.Attributes[name]; ok {
+		return attr, nil
+	} else {
+		return nil, fmt.Errorf("Entity has no attribute '%s'", name)
+	}
+}
+
+// HasAttribute tells whether the entity has an attribute named name.
+func (e *Entity) HasAttribute(name string) bool {
+	_, ok := e.Attributes[name]
+	return ok
+}
+
+// RemoveAttribute removes the attribute named name from the entity, if present.
+// It only affects the local entity, not the one stored in the context broker.
+func (e *Entity) RemoveAttribute(name string) {
+	delete(e.Attributes, name)
+}
+
+// ValidationProfile selects the rule set used to validate strings, field syntax and
+// attribute names, so that validation matches the target context broker.
+type ValidationProfile int
+
+const (
+	// OrionStable follows the restrictions of the Orion context broker. It is the default.
+	OrionStable ValidationProfile = iota
+	// OrionLD follows the restrictions of Orion-LD, where attribute names can be
+	// expanded URIs, so slashes and hashes are allowed in fields.
+	OrionLD
+	// Lenient only rejects empty fields and control characters.
+	Lenient
+)
+
+type validationRules struct {
+	maxFieldLength    int
+	invalidChars      string
+	invalidFieldChars string
+	allowSpaces       bool
+	reservedAttrNames []string
+}
+
+var validationProfiles = map[ValidationProfile]validationRules{
+	OrionStable: {
+		maxFieldLength:    256,
+		invalidChars:      InvalidChars,
+		invalidFieldChars: InvalidFieldChars,
+		reservedAttrNames: ReservedAttrNames[:],
+	},
+	OrionLD: {
+		maxFieldLength:    256,
+		invalidChars:      InvalidChars,
+		invalidFieldChars: `&?`,
+		reservedAttrNames: []string{"id", "type", "@context", "createdAt", "modifiedAt", "observedAt"},
+	},
+	Lenient: {
+		maxFieldLength:    1024,
+		allowSpaces:       true,
+		reservedAttrNames: []string{"id", "type"},
+	},
+}
+
+var validation = validationProfiles[OrionStable]
+
+// SetValidationProfile sets the rule set used by IsValidString, SanitizeString,
+// IsValidFieldSyntax and IsValidAttributeName.
+// It is meant to be called once, at initialization time.
+func SetValidationProfile(profile ValidationProfile) error {
+	rules, ok := validationProfiles[profile]
+	if !ok {
+		return fmt.Errorf("unknown validation profile: %d", profile)
+	}
+	validation = rules
+	return nil
+}
+
+// IsValidString checks whether the string is valid or contains any forbidden character.
+// See: https://github.com/telefonicaid/fiware-orion/blob/master/doc/manuals/user/forbidden_characters.md
+func IsValidString(str string) bool {
+	return !strings.ContainsAny(str, validation.invalidChars)
+}
+
+// SanitizeString removes any forbidden character from a string.
+func SanitizeString(str string) string {
 	return strings.Map(func(r rune) rune {
-		if strings.IndexRune(InvalidChars, r) < 0 {
+		if strings.IndexRune(validation.invalidChars, r) < 0 {
 			return r
 		}
 		return -1
@@ -519,13 +1551,13 @@ func SanitizeString(str string) string {
 // IsValidFieldSyntax checks whether the field syntax is valid or violates restrictions.
 // See: https://orioncontextbroker.docs.apiary.io/#introduction/specification/field-syntax-restrictions
 func IsValidFieldSyntax(str string) bool {
-	if len(str) < 1 || len(str) > 256 {
+	if len(str) < 1 || len(str) > validation.maxFieldLength {
 		return false
 	}
 	for _, r := range str {
 		if unicode.IsControl(r) ||
-			unicode.IsSpace(r) ||
-			strings.ContainsRune(InvalidFieldChars, r) {
+			(!validation.allowSpaces && unicode.IsSpace(r)) ||
+			strings.ContainsRune(validation.invalidFieldChars, r) {
 			return false
 		}
 	}
@@ -540,13 +1572,53 @@ func validateFieldSyntax(str string) error {
 	}
 }
 
+// IdConvention is a naming convention enforced on entity ids.
+type IdConvention int
+
+const (
+	// AnyId only requires ids to respect the field syntax restrictions. It is the default.
+	AnyId IdConvention = iota
+	// RequireURN requires ids in the urn:ngsi-ld:<Type>:<localid> form, as recommended
+	// by the Smart Data Models.
+	RequireURN
+)
+
+var idConvention = AnyId
+
+var urnIdRegexp = regexp.MustCompile(`^urn:ngsi-ld:([^:]+):(.+)$`)
+
+// SetIdConvention sets the convention enforced on ids by NewEntity and Entity.SetId.
+// It is meant to be called once, at initialization time.
+func SetIdConvention(convention IdConvention) {
+	idConvention = convention
+}
+
+// IsValidURNId checks whether the id follows the urn:ngsi-ld:<Type>:<localid> convention.
+func IsValidURNId(id string) bool {
+	return IsValidFieldSyntax(id) && urnIdRegexp.MatchString(id)
+}
+
+func validateIdConvention(id string, entityType string) error {
+	if idConvention != RequireURN {
+		return nil
+	}
+	m := urnIdRegexp.FindStringSubmatch(id)
+	if m == nil {
+		return fmt.Errorf("'%s' is not a valid id: expected 'urn:ngsi-ld:<Type>:<localid>'", id)
+	}
+	if entityType != "" && m[1] != entityType {
+		return fmt.Errorf("'%s' is not a valid id: expected type '%s' in urn, got '%s'", id, entityType, m[1])
+	}
+	return nil
+}
+
 // IsValidAttributeName checks whether the attribute name is valid or is forbidden.
 // See: https://orioncontextbroker.docs.apiary.io/#introduction/specification/attribute-names-restrictions
 func IsValidAttributeName(name string) bool {
 	if !IsValidFieldSyntax(name) {
 		return false
 	}
-	for _, reserved := range ReservedAttrNames {
+	for _, reserved := range validation.reservedAttrNames {
 		if name == reserved {
 			return false
 		}
@@ -562,10 +1634,19 @@ func validateAttributeName(name string) error {
 	}
 }
 
+// initAttributes creates the attributes map of entities not built by NewEntity,
+// e.g. &Entity{}, so that setters don't panic on a nil map.
+func (e *Entity) initAttributes() {
+	if e.Attributes == nil {
+		e.Attributes = make(map[string]*Attribute)
+	}
+}
+
 func (e *Entity) SetAttribute(name string, typ AttributeType, value interface{}) error {
 	if err := validateAttributeName(name); err != nil {
 		return err
 	}
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  typ,
@@ -584,6 +1665,7 @@ func (e *Entity) SetAttributeAsString(name string, value string) error {
 		return fmt.Errorf("Invalid string value for attribute %s, contains invalid chars", name)
 	}
 
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  StringType,
@@ -602,6 +1684,7 @@ func (e *Entity) SetAttributeAsText(name string, value string) error {
 		return fmt.Errorf("Invalid string value for attribute %s, contains invalid chars", name)
 	}
 
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  TextType,
@@ -615,6 +1698,7 @@ func (e *Entity) SetAttributeAsNumber(name string, value float64) error {
 	if err := validateAttributeName(name); err != nil {
 		return err
 	}
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  NumberType,
@@ -628,6 +1712,7 @@ func (e *Entity) SetAttributeAsInteger(name string, value int) error {
 	if err := validateAttributeName(name); err != nil {
 		return err
 	}
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  IntegerType,
@@ -641,6 +1726,7 @@ func (e *Entity) SetAttributeAsFloat(name string, value float64) error {
 	if err := validateAttributeName(name); err != nil {
 		return err
 	}
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  FloatType,
@@ -650,10 +1736,36 @@ func (e *Entity) SetAttributeAsFloat(name string, value float64) error {
 	return nil
 }
 
+// SetAttributeAsPercentage sets a Percentage attribute, whose value must be between 0 and 100.
+func (e *Entity) SetAttributeAsPercentage(name string, value float64) error {
+	if err := validateAttributeName(name); err != nil {
+		return err
+	}
+	if err := validatePercentage(value); err != nil {
+		return err
+	}
+	e.initAttributes()
+	e.Attributes[name] = &Attribute{
+		typeValue: typeValue{
+			Type:  PercentageType,
+			Value: value,
+		},
+	}
+	return nil
+}
+
+func validatePercentage(value float64) error {
+	if value < 0 || value > 100 || math.IsNaN(value) {
+		return fmt.Errorf("Percentage value must be between 0 and 100, got %v", value)
+	}
+	return nil
+}
+
 func (e *Entity) SetAttributeAsBoolean(name string, value bool) error {
 	if err := validateAttributeName(name); err != nil {
 		return err
 	}
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  BooleanType,
@@ -667,6 +1779,7 @@ func (e *Entity) SetAttributeAsDateTime(name string, value time.Time) error {
 	if err := validateAttributeName(name); err != nil {
 		return err
 	}
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  DateTimeType,
@@ -676,7 +1789,23 @@ func (e *Entity) SetAttributeAsDateTime(name string, value time.Time) error {
 	return nil
 }
 
-func (e *Entity) SetDateExpires(value time.Time) {
+// SetDateExpires sets the dateExpires builtin attribute, making the entity a transient one
+// that the context broker deletes once value is reached.
+// Unlike dateCreated and dateModified, which are reserved since the context broker maintains
+// them, dateExpires is set by clients, so it is not checked against the reserved names.
+// It fails if value is in the past; see SetDateExpiresAllowPast for allowing it.
+func (e *Entity) SetDateExpires(value time.Time) error {
+	if value.Before(time.Now()) {
+		return fmt.Errorf("Invalid dateExpires '%s': it is in the past", value.Format(time.RFC3339))
+	}
+	e.SetDateExpiresAllowPast(value)
+	return nil
+}
+
+// SetDateExpiresAllowPast is like SetDateExpires, but accepts times in the past,
+// which make the context broker delete the entity at its next expiration check.
+func (e *Entity) SetDateExpiresAllowPast(value time.Time) {
+	e.initAttributes()
 	e.Attributes[DateExpiresAttributeName] = &Attribute{
 		typeValue: typeValue{
 			Type:  DateTimeType,
@@ -685,10 +1814,24 @@ func (e *Entity) SetDateExpires(value time.Time) {
 	}
 }
 
+// ClearDateExpires removes the dateExpires builtin attribute from the entity, if present.
+// As for RemoveAttribute, this only affects the local entity: to make a stored entity
+// permanent again its dateExpires attribute has to be deleted from the context broker.
+func (e *Entity) ClearDateExpires() {
+	e.RemoveAttribute(DateExpiresAttributeName)
+}
+
 func (e *Entity) SetAttributeAsGeoPoint(name string, value *GeoPoint) error {
 	if err := validateAttributeName(name); err != nil {
 		return err
 	}
+	if value == nil {
+		return fmt.Errorf("geo:point value cannot be nil")
+	}
+	if err := value.Validate(); err != nil {
+		return err
+	}
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  GeoPointType,
@@ -698,10 +1841,64 @@ func (e *Entity) SetAttributeAsGeoPoint(name string, value *GeoPoint) error {
 	return nil
 }
 
+// SetAttributeAsGeoLine sets a geo:line attribute, made of at least two points.
+func (e *Entity) SetAttributeAsGeoLine(name string, points []*GeoPoint) error {
+	if err := validateAttributeName(name); err != nil {
+		return err
+	}
+	if len(points) < 2 {
+		return fmt.Errorf("A geo:line needs at least 2 points, got %d", len(points))
+	}
+	for i, p := range points {
+		if p == nil {
+			return fmt.Errorf("Point %d of geo:line is nil", i)
+		}
+	}
+	e.initAttributes()
+	e.Attributes[name] = &Attribute{
+		typeValue: typeValue{
+			Type:  GeoLineType,
+			Value: points,
+		},
+	}
+	return nil
+}
+
+// SetAttributeAsGeoPolygon sets a geo:polygon attribute.
+// The ring is closed automatically when its last point differs from the first one,
+// and it must have at least 4 points once closed.
+func (e *Entity) SetAttributeAsGeoPolygon(name string, ring []*GeoPoint) error {
+	if err := validateAttributeName(name); err != nil {
+		return err
+	}
+	for i, p := range ring {
+		if p == nil {
+			return fmt.Errorf("Point %d of geo:polygon is nil", i)
+		}
+	}
+	if len(ring) > 0 && *ring[0] != *ring[len(ring)-1] {
+		closed := make([]*GeoPoint, len(ring), len(ring)+1)
+		copy(closed, ring)
+		ring = append(closed, ring[0])
+	}
+	if len(ring) < 4 {
+		return fmt.Errorf("A geo:polygon needs at least 4 points with the first and last one coinciding, got %d", len(ring))
+	}
+	e.initAttributes()
+	e.Attributes[name] = &Attribute{
+		typeValue: typeValue{
+			Type:  GeoPolygonType,
+			Value: ring,
+		},
+	}
+	return nil
+}
+
 func (e *Entity) SetAttributeAsGeoJSON(name string, value *geojson.Geometry) error {
 	if err := validateAttributeName(name); err != nil {
 		return err
 	}
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  GeoJSONType,
@@ -715,6 +1912,7 @@ func (e *Entity) SetAttributeAsStructuredValue(name string, value interface{}) e
 	if err := validateAttributeName(name); err != nil {
 		return err
 	}
+	e.initAttributes()
 	e.Attributes[name] = &Attribute{
 		typeValue: typeValue{
 			Type:  StructuredValueType,
@@ -724,9 +1922,152 @@ func (e *Entity) SetAttributeAsStructuredValue(name string, value interface{}) e
 	return nil
 }
 
-func (a *Attribute) GetAsString() (string, error) {
+// SetAttributeWithPrevious sets the attribute named name and attaches to it a
+// previousValue metadata of the same type, holding the previous value.
+// This is the convention used by time-series backends such as STH or QuantumLeap.
+func (e *Entity) SetAttributeWithPrevious(name string, typ AttributeType, value, previous interface{}) error {
+	if err := validateAttributeName(name); err != nil {
+		return err
+	}
+	e.initAttributes()
+	e.Attributes[name] = &Attribute{
+		typeValue: typeValue{
+			Type:  typ,
+			Value: value,
+		},
+		Metadata: map[string]*Metadata{
+			PreviousValueMetadataName: {
+				typeValue: typeValue{
+					Type:  typ,
+					Value: previous,
+				},
+			},
+		},
+	}
+	return nil
+}
+
+// GetMetadata returns the metadata named name, or ErrMetadataNotFound.
+func (a *Attribute) GetMetadata(name string) (*Metadata, error) {
+	if m, ok := a.Metadata[name]; ok && m != nil {
+		return m, nil
+	}
+	return nil, fmt.Errorf("Attribute has no metadata '%s': %w", name, ErrMetadataNotFound)
+}
+
+// SetMetadata sets the metadata named name, replacing any previous one.
+func (a *Attribute) SetMetadata(name string, typ AttributeType, value interface{}) {
+	if a.Metadata == nil {
+		a.Metadata = make(map[string]*Metadata)
+	}
+	a.Metadata[name] = &Metadata{
+		typeValue: typeValue{
+			Type:  typ,
+			Value: value,
+		},
+	}
+}
+
+// metadataAsAttribute looks up a metadata, wrapping it in an attribute to reuse its typed getters.
+func (a *Attribute) metadataAsAttribute(name string) (*Attribute, error) {
+	m, err := a.GetMetadata(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Attribute{typeValue: m.typeValue}, nil
+}
+
+func (a *Attribute) GetMetadataAsString(name string) (string, error) {
+	if m, err := a.metadataAsAttribute(name); err != nil {
+		return "", err
+	} else {
+		return m.GetAsString()
+	}
+}
+
+func (a *Attribute) GetMetadataAsFloat(name string) (float64, error) {
+	if m, err := a.metadataAsAttribute(name); err != nil {
+		return 0, err
+	} else {
+		return m.GetAsFloat()
+	}
+}
+
+func (a *Attribute) GetMetadataAsInteger(name string) (int, error) {
+	if m, err := a.metadataAsAttribute(name); err != nil {
+		return 0, err
+	} else {
+		return m.GetAsInteger()
+	}
+}
+
+func (a *Attribute) GetMetadataAsBoolean(name string) (bool, error) {
+	if m, err := a.metadataAsAttribute(name); err != nil {
+		return false, err
+	} else {
+		return m.GetAsBoolean()
+	}
+}
+
+func (a *Attribute) GetMetadataAsDateTime(name string) (time.Time, error) {
+	if m, err := a.metadataAsAttribute(name); err != nil {
+		return time.Time{}, err
+	} else {
+		return m.GetAsDateTime()
+	}
+}
+
+// GetTimeInstant returns the observation time recorded in the TimeInstant metadata,
+// as per the FIWARE conventions. The value is accepted as a DateTime or as an RFC3339 string,
+// e.g. when the metadata type is ISO8601. It returns ErrMetadataNotFound if the metadata is missing.
+func (a *Attribute) GetTimeInstant() (time.Time, error) {
+	m, err := a.GetMetadata(TimeInstantMetadataName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t, ok := asTime(m.Value); ok {
+		return t, nil
+	}
+	if str, ok := m.Value.(string); ok {
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid %s metadata value: %w", TimeInstantMetadataName, err)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid %s metadata value: '%v'", TimeInstantMetadataName, m.Value)
+}
+
+// SetUnitCode sets the unitCode metadata, holding the UN/CEFACT code of the unit
+// of measurement of the attribute value, e.g. "CEL" for degrees Celsius.
+func (a *Attribute) SetUnitCode(code string) {
+	a.SetMetadata(UnitCodeMetadataName, StringType, code)
+}
+
+// GetUnitCode returns the value of the unitCode metadata, and whether the attribute has it.
+func (a *Attribute) GetUnitCode() (string, bool) {
+	code, err := a.GetMetadataAsString(UnitCodeMetadataName)
+	return code, err == nil
+}
+
+// errWrongAttributeType is returned by the conversion helpers when the attribute type
+// doesn't match; the GetAs* methods replace it with an error naming the type.
+// The helpers only return preallocated errors, so that failures don't allocate.
+var errWrongAttributeType = errors.New("wrong attribute type")
+
+var errIntegerOutOfRange = errors.New("integer out of range")
+
+// typeError turns the errors of the conversion helpers into the ones of the GetAs* methods.
+func (a *Attribute) typeError(err error, expected string) error {
+	if err == errWrongAttributeType {
+		return fmt.Errorf("Attribute is %s, but %s", expected, a.Type)
+	}
+	return err
+}
+
+func (a *Attribute) stringValue() (string, error) {
 	if a.Type != StringType && a.Type != TextType && a.Type != RelationshipType {
-		return "", fmt.Errorf("Attribute is nor String, Text or Relationship, but %s", a.Type)
+		return "", errWrongAttributeType
 	}
 	rawString, ok := a.Value.(string)
 	if !ok {
@@ -735,37 +2076,165 @@ func (a *Attribute) GetAsString() (string, error) {
 	return rawString, nil
 }
 
-func (a *Attribute) GetAsInteger() (int, error) {
+func (a *Attribute) GetAsString() (string, error) {
+	v, err := a.stringValue()
+	if err != nil {
+		return "", a.typeError(err, "nor String, Text or Relationship")
+	}
+	return v, nil
+}
+
+func (a *Attribute) integerValue() (int, error) {
 	if a.Type != IntegerType {
-		return 0, fmt.Errorf("Attribute is not Integer, but %s", a.Type)
+		return 0, errWrongAttributeType
 	}
 	// when we read from JSON, an int is a float64, when we fill with this library, an int is... an int!
-	f, ok := a.Value.(float64)
-	if !ok {
-		return a.Value.(int), nil
+	// Orion may also encode it as a string.
+	var f float64
+	switch v := a.Value.(type) {
+	case int:
+		return v, nil
+	case float64:
+		f = v
+	case string:
+		v = strings.TrimSpace(v)
+		number, integral := isDecimalNumber(v)
+		if !number {
+			return 0, ErrInvalidCastingAttributeEntity
+		}
+		if integral {
+			if i, err := strconv.Atoi(v); err == nil {
+				return i, nil
+			}
+		}
+		// e.g. "720.0" or "7.2e2", which must be whole numbers
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || parsed != math.Trunc(parsed) || !isIntRange(parsed) {
+			return 0, ErrInvalidCastingAttributeEntity
+		}
+		return int(parsed), nil
+	default:
+		return 0, ErrInvalidCastingAttributeEntity
 	}
 
-	if f > 0 && int(f) < 0 {
-		return 0, errors.New("integer out of range")
+	if !isIntRange(f) {
+		return 0, errIntegerOutOfRange
 	}
 
 	return int(f), nil
 }
 
-func (a *Attribute) GetAsFloat() (float64, error) {
+// isIntRange tells whether f, once truncated, fits an int; NaN and infinities don't.
+func isIntRange(f float64) bool {
+	// float64(math.MaxInt) rounds up to a power of two, which is out of range
+	return f >= float64(math.MinInt) && f < float64(math.MaxInt)
+}
+
+// isDecimalNumber tells whether s is a decimal number, like -12, 3.5 or 1e3, and
+// whether it is written as an integer. It spares the strconv errors, which allocate,
+// for the strings that are not numbers at all.
+func isDecimalNumber(s string) (number bool, integral bool) {
+	i := 0
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	digits := 0
+	for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+		digits++
+	}
+	integral = true
+	if i < len(s) && s[i] == '.' {
+		integral = false
+		for i++; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+			digits++
+		}
+	}
+	if digits == 0 {
+		return false, false
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		integral = false
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		expDigits := 0
+		for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+			expDigits++
+		}
+		if expDigits == 0 {
+			return false, false
+		}
+	}
+	return i == len(s), integral
+}
+
+func (a *Attribute) GetAsInteger() (int, error) {
+	v, err := a.integerValue()
+	if err == ErrInvalidCastingAttributeEntity {
+		if s, ok := a.Value.(string); ok {
+			return 0, fmt.Errorf("Invalid Integer value '%s': %w", s, err)
+		}
+	}
+	if err != nil {
+		return 0, a.typeError(err, "not Integer")
+	}
+	return v, nil
+}
+
+func (a *Attribute) floatValue() (float64, error) {
 	if a.Type != FloatType && a.Type != NumberType {
-		return 0, fmt.Errorf("Attribute is nor Float or Number, but %s", a.Type)
+		return 0, errWrongAttributeType
+	}
+	switch v := a.Value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		// Orion may encode numbers as strings
+		v = strings.TrimSpace(v)
+		if number, _ := isDecimalNumber(v); !number {
+			return 0, ErrInvalidCastingAttributeEntity
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, ErrInvalidCastingAttributeEntity
+		}
+		return f, nil
+	default:
+		return 0, ErrInvalidCastingAttributeEntity
+	}
+}
+
+func (a *Attribute) GetAsFloat() (float64, error) {
+	v, err := a.floatValue()
+	if err == ErrInvalidCastingAttributeEntity {
+		if s, ok := a.Value.(string); ok {
+			return 0, fmt.Errorf("Invalid %s value '%s': %w", a.Type, s, err)
+		}
+	}
+	if err != nil {
+		return 0, a.typeError(err, "nor Float or Number")
+	}
+	return v, nil
+}
+
+func (a *Attribute) GetAsPercentage() (float64, error) {
+	if a.Type != PercentageType {
+		return 0, fmt.Errorf("Attribute is not Percentage, but %s", a.Type)
 	}
 	rawFloat, ok := a.Value.(float64)
 	if !ok {
 		return 0, ErrInvalidCastingAttributeEntity
 	}
+	if err := validatePercentage(rawFloat); err != nil {
+		return 0, err
+	}
 	return rawFloat, nil
 }
 
-func (a *Attribute) GetAsBoolean() (bool, error) {
+func (a *Attribute) booleanValue() (bool, error) {
 	if a.Type != BooleanType {
-		return false, fmt.Errorf("Attribute is not Boolean, but %s", a.Type)
+		return false, errWrongAttributeType
 	}
 	rawBool, ok := a.Value.(bool)
 	if !ok {
@@ -774,19 +2243,49 @@ func (a *Attribute) GetAsBoolean() (bool, error) {
 	return rawBool, nil
 }
 
-func (a *Attribute) GetAsDateTime() (time.Time, error) {
+func (a *Attribute) GetAsBoolean() (bool, error) {
+	v, err := a.booleanValue()
+	if err != nil {
+		return false, a.typeError(err, "not Boolean")
+	}
+	return v, nil
+}
+
+var errNoTimeValue = errors.New("Attribute with date time type does not contain time value")
+
+func (a *Attribute) dateTimeValue() (time.Time, error) {
 	if a.Type != DateTimeType {
-		return time.Time{}, fmt.Errorf("Attribute is not DateTime, but %s", a.Type)
+		return time.Time{}, errWrongAttributeType
 	}
-	if dt, ok := a.Value.(time.Time); !ok {
-		if dt, ok := a.Value.(OrionTime); !ok {
-			return time.Time{}, fmt.Errorf("Attribute with date time type does not contain time value")
-		} else {
-			return dt.Time, nil
-		}
-	} else {
+	switch dt := a.Value.(type) {
+	case time.Time:
 		return dt, nil
+	case OrionTime:
+		return dt.Time, nil
 	}
+	return time.Time{}, errNoTimeValue
+}
+
+func (a *Attribute) GetAsDateTime() (time.Time, error) {
+	v, err := a.dateTimeValue()
+	if err != nil {
+		return time.Time{}, a.typeError(err, "not DateTime")
+	}
+	return v, nil
+}
+
+// GetAsDateTimeInLocation is like GetAsDateTime, but returns the time in loc.
+// The offset of a DateTime value is kept as it was decoded, but Orion stores
+// dates in UTC, so the original offset is lost once they go through the context broker.
+func (a *Attribute) GetAsDateTimeInLocation(loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		return time.Time{}, fmt.Errorf("Location cannot be nil")
+	}
+	dt, err := a.GetAsDateTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return dt.In(loc), nil
 }
 
 func (a *Attribute) GetAsGeoPoint() (*GeoPoint, error) {
@@ -800,6 +2299,28 @@ func (a *Attribute) GetAsGeoPoint() (*GeoPoint, error) {
 	}
 }
 
+func (a *Attribute) GetAsGeoLine() ([]*GeoPoint, error) {
+	if a.Type != GeoLineType {
+		return nil, fmt.Errorf("Attribute is not GeoLine, but '%s'", a.Type)
+	}
+	if points, ok := a.Value.([]*GeoPoint); !ok {
+		return nil, fmt.Errorf("Attribute with geoline type does not contain geoline value")
+	} else {
+		return points, nil
+	}
+}
+
+func (a *Attribute) GetAsGeoPolygon() ([]*GeoPoint, error) {
+	if a.Type != GeoPolygonType {
+		return nil, fmt.Errorf("Attribute is not GeoPolygon, but '%s'", a.Type)
+	}
+	if ring, ok := a.Value.([]*GeoPoint); !ok {
+		return nil, fmt.Errorf("Attribute with geopolygon type does not contain geopolygon value")
+	} else {
+		return ring, nil
+	}
+}
+
 func (a *Attribute) GetAsGeoJSON() (*geojson.Geometry, error) {
 	if a.Type != GeoJSONType {
 		return nil, fmt.Errorf("Attribute is not geo:json, but '%s'", a.Type)
@@ -813,12 +2334,92 @@ func (a *Attribute) GetAsGeoJSON() (*geojson.Geometry, error) {
 
 // DecodeStructuredValue decodes the attribute into output if attribute type is StructuredValue.
 // output must be a pointer to a map or struct.
+// Numbers, which are float64 once unmarshaled from JSON, can be decoded into integer
+// fields only if they have no fractional part and fit the field, e.g. 25 and 25.0
+// into an int, but neither 25.5 nor -1 into a uint. No other conversion is made,
+// e.g. a string is not decoded into a number field, nor a number into a string one.
 func (a *Attribute) DecodeStructuredValue(output interface{}) error {
 	if a.Type != StructuredValueType {
 		return fmt.Errorf("Attribute is not %s, but '%s'", StructuredValueType, a.Type)
 	}
 
-	return mapstructure.Decode(a.Value, output)
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: integralNumberHook,
+		Result:     output,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(a.Value)
+}
+
+// integralNumberHook is a mapstructure decode hook preventing floating point numbers
+// from being silently truncated when decoded into integers.
+func integralNumberHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.Float64 && from.Kind() != reflect.Float32 {
+		return data, nil
+	}
+	f := reflect.ValueOf(data).Float()
+	switch to.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 || reflect.Zero(to).OverflowInt(int64(f)) {
+			return nil, fmt.Errorf("Cannot decode %v into %s", f, to)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || reflect.Zero(to).OverflowUint(uint64(f)) {
+			return nil, fmt.Errorf("Cannot decode %v into %s", f, to)
+		}
+	}
+	return data, nil
+}
+
+// GetAsStringSlice returns the value of a StructuredValue attribute holding an array of strings.
+func (a *Attribute) GetAsStringSlice() ([]string, error) {
+	if a.Type != StructuredValueType {
+		return nil, fmt.Errorf("Attribute is not %s, but '%s'", StructuredValueType, a.Type)
+	}
+	switch v := a.Value.(type) {
+	case []string:
+		return v, nil
+	case []interface{}:
+		ret := make([]string, len(v))
+		for i, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("Element %d of structured value is not a string, but '%T'", i, item)
+			}
+			ret[i] = str
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("Attribute with %s type does not contain an array value", StructuredValueType)
+	}
+}
+
+// GetAsFloatSlice returns the value of a StructuredValue attribute holding an array of numbers.
+func (a *Attribute) GetAsFloatSlice() ([]float64, error) {
+	if a.Type != StructuredValueType {
+		return nil, fmt.Errorf("Attribute is not %s, but '%s'", StructuredValueType, a.Type)
+	}
+	switch v := a.Value.(type) {
+	case []float64:
+		return v, nil
+	case []interface{}:
+		ret := make([]float64, len(v))
+		for i, item := range v {
+			switch n := item.(type) {
+			case float64:
+				ret[i] = n
+			case int:
+				ret[i] = float64(n)
+			default:
+				return nil, fmt.Errorf("Element %d of structured value is not a number, but '%T'", i, item)
+			}
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("Attribute with %s type does not contain an array value", StructuredValueType)
+	}
 }
 
 func (e *Entity) GetAttributeAsString(attributeName string) (string, error) {
@@ -829,6 +2430,22 @@ func (e *Entity) GetAttributeAsString(attributeName string) (string, error) {
 	}
 }
 
+func (e *Entity) GetAttributeAsStringSlice(attributeName string) ([]string, error) {
+	if a, err := e.GetAttribute(attributeName); err != nil {
+		return nil, err
+	} else {
+		return a.GetAsStringSlice()
+	}
+}
+
+func (e *Entity) GetAttributeAsFloatSlice(attributeName string) ([]float64, error) {
+	if a, err := e.GetAttribute(attributeName); err != nil {
+		return nil, err
+	} else {
+		return a.GetAsFloatSlice()
+	}
+}
+
 func (e *Entity) GetAttributeAsInteger(attributeName string) (int, error) {
 	if a, err := e.GetAttribute(attributeName); err != nil {
 		return 0, err
@@ -845,6 +2462,14 @@ func (e *Entity) GetAttributeAsFloat(attributeName string) (float64, error) {
 	}
 }
 
+func (e *Entity) GetAttributeAsPercentage(attributeName string) (float64, error) {
+	if a, err := e.GetAttribute(attributeName); err != nil {
+		return 0, err
+	} else {
+		return a.GetAsPercentage()
+	}
+}
+
 func (e *Entity) GetAttributeAsBoolean(attributeName string) (bool, error) {
 	if a, err := e.GetAttribute(attributeName); err != nil {
 		return false, err
@@ -861,6 +2486,14 @@ func (e *Entity) GetAttributeAsDateTime(attributeName string) (time.Time, error)
 	}
 }
 
+func (e *Entity) GetAttributeAsDateTimeInLocation(attributeName string, loc *time.Location) (time.Time, error) {
+	if a, err := e.GetAttribute(attributeName); err != nil {
+		return time.Time{}, err
+	} else {
+		return a.GetAsDateTimeInLocation(loc)
+	}
+}
+
 func (e *Entity) GetDateExpires() (time.Time, error) {
 	if a, err := e.GetAttribute(DateExpiresAttributeName); err != nil {
 		return time.Time{}, err
@@ -893,6 +2526,22 @@ func (e *Entity) GetAttributeAsGeoPoint(attributeName string) (*GeoPoint, error)
 	}
 }
 
+func (e *Entity) GetAttributeAsGeoLine(attributeName string) ([]*GeoPoint, error) {
+	if a, err := e.GetAttribute(attributeName); err != nil {
+		return nil, err
+	} else {
+		return a.GetAsGeoLine()
+	}
+}
+
+func (e *Entity) GetAttributeAsGeoPolygon(attributeName string) ([]*GeoPoint, error) {
+	if a, err := e.GetAttribute(attributeName); err != nil {
+		return nil, err
+	} else {
+		return a.GetAsGeoPolygon()
+	}
+}
+
 func (e *Entity) GetAttributeAsGeoJSON(attributeName string) (*geojson.Geometry, error) {
 	a, err := e.GetAttribute(attributeName)
 	if err != nil {
@@ -916,6 +2565,51 @@ func NewBatchUpdate(action ActionType) *BatchUpdate {
 	return b
 }
 
+// NewAppendBatch creates a batch update appending the attributes of its entities,
+// creating the entities that don't exist.
+func NewAppendBatch() *BatchUpdate {
+	return NewBatchUpdate(AppendAction)
+}
+
+// NewUpdateBatch creates a batch update updating the attributes of existing entities.
+func NewUpdateBatch() *BatchUpdate {
+	return NewBatchUpdate(UpdateAction)
+}
+
+// NewDeleteBatch creates a batch update deleting its entities, or the attributes
+// of its entities when they have any.
+func NewDeleteBatch() *BatchUpdate {
+	return NewBatchUpdate(DeleteAction)
+}
+
+// NewReplaceBatch creates a batch update replacing all the attributes of existing entities.
+func NewReplaceBatch() *BatchUpdate {
+	return NewBatchUpdate(ReplaceAction)
+}
+
 func (u *BatchUpdate) AddEntity(entity *Entity) {
 	u.Entities = append(u.Entities, entity)
 }
+
+// AddEntities adds all the entities to the batch update.
+func (u *BatchUpdate) AddEntities(entities ...*Entity) {
+	u.Entities = append(u.Entities, entities...)
+}
+
+// AddEntityRef adds an entity with just id and type, which is all a delete batch
+// needs to delete a whole entity. The type can be empty.
+func (u *BatchUpdate) AddEntityRef(id string, entityType string) error {
+	if err := validateFieldSyntax(id); err != nil {
+		return err
+	}
+	if entityType != "" {
+		if err := validateFieldSyntax(entityType); err != nil {
+			return err
+		}
+	}
+	if err := validateIdConvention(id, entityType); err != nil {
+		return err
+	}
+	u.AddEntity(&Entity{Id: id, Type: entityType, Attributes: make(map[string]*Attribute)})
+	return nil
+}
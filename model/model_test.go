@@ -2,7 +2,10 @@ package model_test
 
 import (
 	"encoding/json"
+	"errors"
 	"math"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -398,6 +401,14 @@ func TestEntityUnmarshal(t *testing.T) {
 	if manufacturersString[2] != "BMW" {
 		t.Fatalf("Expected 'BMW' as third manufacturer, got '%s'", manufacturersString[2])
 	}
+	if manufacturers, err := manufacturersAttr.GetAsStringSlice(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	} else if len(manufacturers) != 3 || manufacturers[1] != "Alfa Romeo" {
+		t.Fatalf("Unexpected manufacturers: %v", manufacturers)
+	}
+	if _, err := manufacturersAttr.GetAsFloatSlice(); err == nil {
+		t.Fatal("Expected a failure on non numbers 'manufacturers'")
+	}
 
 	type Person struct {
 		Name string
@@ -737,6 +748,8 @@ func TestGetAsInteger(t *testing.T) {
 	}{
 		{"cast as integer", model.NewAttribute(model.IntegerType, 42.42), 42, false},
 		{"integer overflow", model.NewAttribute(model.IntegerType, float64(math.MaxInt64+1)), 0, true},
+		{"integer underflow", model.NewAttribute(model.IntegerType, -1e300), 0, true},
+		{"integer NaN", model.NewAttribute(model.IntegerType, math.NaN()), 0, true},
 	}
 
 	for _, tt := range tests {
@@ -869,7 +882,9 @@ func TestDateExpiresMarshal(t *testing.T) {
 		t.Fatalf("Unexpected error: '%v'", err)
 	}
 	timeGoneIn60Seconds := time.Now().Add(60 * time.Second)
-	office.SetDateExpires(timeGoneIn60Seconds)
+	if err := office.SetDateExpires(timeGoneIn60Seconds); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
 
 	bytes, err := json.Marshal(office)
 	if err != nil {
@@ -969,3 +984,1515 @@ func TestIsValidAttributeName(t *testing.T) {
 		t.Fatalf("Attribute name should not be valid")
 	}
 }
+
+func TestSetAttributeWithPrevious(t *testing.T) {
+	room, err := model.NewEntity("Room1", "Room")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := room.SetAttributeWithPrevious("temperature", model.FloatType, 23.5, 21.0); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := room.SetAttributeWithPrevious("dateCreated", model.FloatType, 23.5, 21.0); err == nil {
+		t.Fatal("Expected an error for a reserved attribute name")
+	}
+
+	bytes, err := json.Marshal(room)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	unmarshaled := &model.Entity{}
+	if err = unmarshaled.UnmarshalJSON(bytes); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	temperature, err := unmarshaled.GetAttribute("temperature")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if v, err := temperature.GetAsFloat(); err != nil || v != 23.5 {
+		t.Fatalf("Expected 23.5 for temperature value, got %v (%v)", v, err)
+	}
+	previous, ok := temperature.Metadata[model.PreviousValueMetadataName]
+	if !ok {
+		t.Fatal("Expected previousValue metadata")
+	}
+	if previous.Type != model.FloatType || previous.Value != 21.0 {
+		t.Fatalf("Unexpected previousValue metadata: %+v", previous)
+	}
+}
+
+func TestMetadataUnmarshal(t *testing.T) {
+	roomEntityJson := `
+	{
+		"id": "Room1",
+		"temperature": {
+			"metadata": {
+				"TimeInstant": {
+					"type": "DateTime",
+					"value": "2020-03-11T10:15:00.00Z"
+				},
+				"origin": {
+					"type": "geo:point",
+					"value": "43.8030095, 11.2385831"
+				},
+				"accuracy": {
+					"type": "Number",
+					"value": 0.5
+				}
+			},
+			"type": "Float",
+			"value": 23
+		},
+		"type": "Room"
+	}
+`
+	roomEntity := &model.Entity{}
+	if err := roomEntity.UnmarshalJSON([]byte(roomEntityJson)); err != nil {
+		t.Fatalf("Error unmarshaling entity: %v", err)
+	}
+	temperature, err := roomEntity.GetAttribute("temperature")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	timeInstant, ok := temperature.Metadata["TimeInstant"].Value.(time.Time)
+	if !ok {
+		t.Fatalf("Expected TimeInstant metadata as time.Time, got %T", temperature.Metadata["TimeInstant"].Value)
+	}
+	if !timeInstant.Equal(time.Date(2020, 3, 11, 10, 15, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected TimeInstant metadata value: %v", timeInstant)
+	}
+
+	origin, ok := temperature.Metadata["origin"].Value.(*model.GeoPoint)
+	if !ok {
+		t.Fatalf("Expected origin metadata as *model.GeoPoint, got %T", temperature.Metadata["origin"].Value)
+	}
+	if origin.Latitude != 43.8030095 || origin.Longitude != 11.2385831 {
+		t.Fatalf("Unexpected origin metadata value: %v", origin)
+	}
+
+	if temperature.Metadata["accuracy"].Value != 0.5 {
+		t.Fatalf("Unexpected accuracy metadata value: %v", temperature.Metadata["accuracy"].Value)
+	}
+}
+
+func TestNewSubscriptionDiagnostics(t *testing.T) {
+	earlier := time.Date(2020, 3, 11, 10, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Hour)
+	code := uint(200)
+
+	tests := []struct {
+		name string
+		sub  *model.Subscription
+		want model.SubscriptionHealth
+	}{
+		{"no notification", &model.Subscription{Status: model.SubscriptionActive}, model.SubscriptionIdle},
+		{"failed status", &model.Subscription{Status: model.SubscriptionFailed}, model.SubscriptionFailing},
+		{"last success", &model.Subscription{
+			Status:       model.SubscriptionActive,
+			Notification: &model.SubscriptionNotification{TimesSent: 2, LastSuccess: &later, LastFailure: &earlier, LastSuccessCode: &code},
+		}, model.SubscriptionHealthy},
+		{"last failure", &model.Subscription{
+			Status:       model.SubscriptionActive,
+			Notification: &model.SubscriptionNotification{TimesSent: 2, LastSuccess: &earlier, LastFailure: &later},
+		}, model.SubscriptionFailing},
+		{"only failures", &model.Subscription{
+			Status:       model.SubscriptionActive,
+			Notification: &model.SubscriptionNotification{TimesSent: 1, LastFailure: &earlier},
+		}, model.SubscriptionFailing},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := model.NewSubscriptionDiagnostics(tt.sub)
+			if d.Health != tt.want {
+				t.Fatalf("expected %s but got %s", tt.want, d.Health)
+			}
+			if tt.sub.Notification != nil && d.TimesSent != tt.sub.Notification.TimesSent {
+				t.Fatalf("expected %d times sent but got %d", tt.sub.Notification.TimesSent, d.TimesSent)
+			}
+			if n := tt.sub.Notification; n != nil && n.IsHealthy() != (tt.want == model.SubscriptionHealthy) {
+				t.Fatalf("expected healthy to be %v", tt.want == model.SubscriptionHealthy)
+			}
+		})
+	}
+}
+
+func TestIsValidURNId(t *testing.T) {
+	if !model.IsValidURNId("urn:ngsi-ld:Room:001") {
+		t.Fatal("Id should be a valid urn")
+	}
+	if !model.IsValidURNId("urn:ngsi-ld:Room:floor1:001") {
+		t.Fatal("Id with a composite local id should be a valid urn")
+	}
+	if model.IsValidURNId("Room1") ||
+		model.IsValidURNId("urn:ngsi-ld:Room") ||
+		model.IsValidURNId("urn:ngsi-ld:Room:") ||
+		model.IsValidURNId("urn:ngsi-ld:Room:a b") {
+		t.Fatal("Id should not be a valid urn")
+	}
+}
+
+func TestIdConvention(t *testing.T) {
+	model.SetIdConvention(model.RequireURN)
+	defer model.SetIdConvention(model.AnyId)
+
+	if _, err := model.NewEntity("Room1", "Room"); err == nil {
+		t.Fatal("Expected an error for a non urn id")
+	}
+	if _, err := model.NewEntity("urn:ngsi-ld:Office:1", "Room"); err == nil {
+		t.Fatal("Expected an error for a mismatching type in urn id")
+	}
+	room, err := model.NewEntity("urn:ngsi-ld:Room:1", "Room")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := room.SetId("Room2"); err == nil {
+		t.Fatal("Expected an error for a non urn id")
+	}
+	if err := room.SetId("urn:ngsi-ld:Room:2"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if room.Id != "urn:ngsi-ld:Room:2" {
+		t.Fatalf("Expected 'urn:ngsi-ld:Room:2' as id, got '%s'", room.Id)
+	}
+
+	model.SetIdConvention(model.AnyId)
+	if _, err := model.NewEntity("Room1", "Room"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+}
+
+func TestKeyValuesConversion(t *testing.T) {
+	room, err := model.NewEntity("Room1", "Room")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	room.SetAttributeAsFloat("temperature", 23.5)
+	room.SetAttributeAsText("name", "Meeting room")
+	room.SetAttributeAsBoolean("dirty", false)
+	room.SetAttributeAsGeoPoint("location", model.NewGeoPoint(43.8030095, 11.2385831))
+	room.SetAttributeWithPrevious("pressure", model.IntegerType, 720, 710)
+
+	kv := room.ToKeyValuesEntity()
+	if kv.Id != "Room1" || kv.Type != "Room" || len(kv.Attributes) != 5 {
+		t.Fatalf("Unexpected keyValues entity: %v", kv)
+	}
+	for name, a := range kv.Attributes {
+		if a.Type != "" || a.Metadata != nil {
+			t.Fatalf("Expected type and metadata erased for attribute '%s'", name)
+		}
+	}
+	if kv.Attributes["temperature"].Value != 23.5 {
+		t.Fatalf("Unexpected temperature value: %v", kv.Attributes["temperature"].Value)
+	}
+
+	// simulate a keyValues entity decoded from JSON
+	kv.Attributes["location"].Value = "43.8030095, 11.2385831"
+	kv.Attributes["lastUpdate"] = model.NewAttribute("", "2018-07-24T07:21:24.238Z")
+	kv.Attributes["area"] = model.NewAttribute("", map[string]interface{}{
+		"type":        "Polygon",
+		"coordinates": []interface{}{[]interface{}{[]interface{}{0.0, 0.0}, []interface{}{1.0, 0.0}, []interface{}{1.0, 1.0}, []interface{}{0.0, 0.0}}},
+	})
+
+	normalized := model.KeyValuesToNormalized(kv, map[string]model.AttributeType{
+		"name":       model.StringType,
+		"location":   model.GeoPointType,
+		"lastUpdate": model.DateTimeType,
+		"area":       model.GeoJSONType,
+	})
+	if v, err := normalized.GetAttributeAsFloat("temperature"); err != nil || v != 23.5 {
+		t.Fatalf("Expected 23.5 as temperature, got %v (%v)", v, err)
+	}
+	if normalized.Attributes["name"].Type != model.StringType {
+		t.Fatalf("Expected type hint to be used, got '%s'", normalized.Attributes["name"].Type)
+	}
+	if normalized.Attributes["dirty"].Type != model.BooleanType {
+		t.Fatalf("Expected inferred Boolean type, got '%s'", normalized.Attributes["dirty"].Type)
+	}
+	if v, err := normalized.GetAttributeAsInteger("pressure"); err != nil || v != 720 {
+		t.Fatalf("Expected 720 as pressure, got %v (%v)", v, err)
+	}
+	if p, err := normalized.GetAttributeAsGeoPoint("location"); err != nil || p.Latitude != 43.8030095 {
+		t.Fatalf("Unexpected location: %v (%v)", p, err)
+	}
+	if _, err := normalized.GetAttributeAsDateTime("lastUpdate"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if g, err := normalized.GetAttributeAsGeoJSON("area"); err != nil || !g.IsPolygon() {
+		t.Fatalf("Unexpected area: %v (%v)", g, err)
+	}
+}
+
+func TestValidationProfile(t *testing.T) {
+	defer model.SetValidationProfile(model.OrionStable)
+
+	tests := []struct {
+		profile        model.ValidationProfile
+		uriField       bool
+		spacedField    bool
+		stringWithLt   bool
+		reservedCustom bool
+		dateCreated    bool
+	}{
+		{model.OrionStable, false, false, false, true, false},
+		{model.OrionLD, true, false, false, false, true},
+		{model.Lenient, true, true, true, true, true},
+	}
+
+	for _, tt := range tests {
+		if err := model.SetValidationProfile(tt.profile); err != nil {
+			t.Fatalf("Unexpected error: '%v'", err)
+		}
+		if got := model.IsValidFieldSyntax("https://uri.etsi.org/ngsi-ld/default-context/temperature"); got != tt.uriField {
+			t.Errorf("profile %d: expected %v for uri field syntax, got %v", tt.profile, tt.uriField, got)
+		}
+		if got := model.IsValidFieldSyntax("a b"); got != tt.spacedField {
+			t.Errorf("profile %d: expected %v for field with spaces, got %v", tt.profile, tt.spacedField, got)
+		}
+		if got := model.IsValidString("a < b"); got != tt.stringWithLt {
+			t.Errorf("profile %d: expected %v for string with forbidden chars, got %v", tt.profile, tt.stringWithLt, got)
+		}
+		if got := model.IsValidAttributeName("@context"); got != tt.reservedCustom {
+			t.Errorf("profile %d: expected %v for '@context' attribute name, got %v", tt.profile, tt.reservedCustom, got)
+		}
+		if got := model.IsValidAttributeName("dateCreated"); got != tt.dateCreated {
+			t.Errorf("profile %d: expected %v for 'dateCreated' attribute name, got %v", tt.profile, tt.dateCreated, got)
+		}
+		if model.IsValidAttributeName("id") || model.IsValidFieldSyntax("") || model.IsValidFieldSyntax("a\nb") {
+			t.Errorf("profile %d: id, empty and control chars should never be valid", tt.profile)
+		}
+	}
+
+	if err := model.SetValidationProfile(model.ValidationProfile(42)); err == nil {
+		t.Fatal("Expected an error for an unknown profile")
+	}
+}
+
+func TestCoerceValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      model.AttributeType
+		raw      interface{}
+		expected interface{}
+		fails    bool
+	}{
+		{"number from string", model.NumberType, " 21.5", 21.5, false},
+		{"number from int", model.NumberType, 21, 21.0, false},
+		{"number from invalid string", model.NumberType, "warm", nil, true},
+		{"integer from string", model.IntegerType, "42", 42, false},
+		{"integer from integral float", model.IntegerType, 42.0, 42, false},
+		{"integer from fractional float", model.IntegerType, 42.5, nil, true},
+		{"integer from decimal string", model.IntegerType, "42.5", nil, true},
+		{"boolean from string", model.BooleanType, "true", true, false},
+		{"boolean from number", model.BooleanType, 1, nil, true},
+		{"text from number", model.TextType, 12.5, "12.5", false},
+		{"datetime RFC3339", model.DateTimeType, "2020-04-01T10:00:00Z", time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC), false},
+		{"datetime without zone", model.DateTimeType, "2020-04-01 10:00:00", time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC), false},
+		{"datetime date only", model.DateTimeType, "2020-04-01", time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC), false},
+		{"datetime invalid", model.DateTimeType, "yesterday", nil, true},
+		{"geo:point from string", model.GeoPointType, "43.77, 11.25", model.NewGeoPoint(43.77, 11.25), false},
+		{"geo:point invalid", model.GeoPointType, "43.77", nil, true},
+		{"structured value unchanged", model.StructuredValueType, []int{1, 2}, []int{1, 2}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := model.CoerceValue(tt.typ, tt.raw)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("Expected an error, got value '%v'", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			switch expected := tt.expected.(type) {
+			case time.Time:
+				if tm, ok := v.(time.Time); !ok || !tm.Equal(expected) {
+					t.Fatalf("Expected '%v', got '%v'", expected, v)
+				}
+			case *model.GeoPoint:
+				if g, ok := v.(*model.GeoPoint); !ok || *g != *expected {
+					t.Fatalf("Expected '%v', got '%v'", expected, v)
+				}
+			case []int:
+				if s, ok := v.([]int); !ok || len(s) != len(expected) {
+					t.Fatalf("Expected '%v', got '%v'", expected, v)
+				}
+			default:
+				if v != tt.expected {
+					t.Fatalf("Expected '%v' (%T), got '%v' (%T)", tt.expected, tt.expected, v, v)
+				}
+			}
+		})
+	}
+
+	g, err := model.CoerceValue(model.GeoJSONType, `{"type":"Point","coordinates":[11.25,43.77]}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if geom, ok := g.(*geojson.Geometry); !ok || !geom.IsPoint() {
+		t.Fatalf("Expected a geojson point, got '%v'", g)
+	}
+}
+
+func TestAssertRoundTrip(t *testing.T) {
+	if err := model.AssertRoundTrip(nil); err == nil {
+		t.Fatal("Expected an error for a nil entity")
+	}
+
+	e, _ := model.NewEntity("Room1", "Room")
+	e.SetAttributeAsNumber("temperature", 21.5)
+	e.SetAttributeAsInteger("floor", 2)
+	e.SetAttributeAsText("name", "Kitchen")
+	e.SetAttributeAsBoolean("occupied", true)
+	e.SetAttributeAsDateTime("lastSeen", time.Date(2020, 4, 1, 12, 0, 0, 123000000, time.FixedZone("CEST", 2*3600)))
+	e.SetAttributeAsGeoPoint("location", model.NewGeoPoint(43.77, 11.25))
+	e.SetAttributeAsGeoJSON("area", geojson.NewPolygonGeometry([][][]float64{{{11, 43}, {12, 43}, {12, 44}, {11, 43}}}))
+	e.SetAttributeAsStructuredValue("address", map[string]interface{}{"street": "Via Roma", "number": 1})
+	if err := model.AssertRoundTrip(e); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	// sub-millisecond precision is lost when marshaling DateTime values
+	e.SetAttributeAsDateTime("lastSeen", time.Date(2020, 4, 1, 12, 0, 0, 123456789, time.UTC))
+	if err := model.AssertRoundTrip(e); err == nil {
+		t.Fatal("Expected an error for a DateTime value not surviving the round trip")
+	}
+
+	// a geo:point value that is not a *GeoPoint cannot be decoded
+	e.SetAttributeAsDateTime("lastSeen", time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC))
+	e.Attributes["location"] = model.NewAttribute(model.GeoPointType, []float64{43.77, 11.25})
+	if err := model.AssertRoundTrip(e); err == nil {
+		t.Fatal("Expected an error for an invalid geo:point value")
+	}
+
+	// metadata are compared too
+	e.SetAttributeAsGeoPoint("location", model.NewGeoPoint(43.77, 11.25))
+	e.Attributes["temperature"].SetUnitCode("CEL")
+	if err := model.AssertRoundTrip(e); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	// a DateTime given as a string is decoded as a time, losing its formatting
+	e.Attributes["temperature"].SetMetadata(model.TimeInstantMetadataName, model.DateTimeType, "2020-04-01T12:00:00.000Z")
+	if err := model.AssertRoundTrip(e); err == nil || !strings.Contains(err.Error(), "metadata") {
+		t.Fatalf("Expected an error for a metadata not surviving the round trip, got '%v'", err)
+	}
+}
+
+func TestUnmarshalKeyValuesEntity(t *testing.T) {
+	e, err := model.UnmarshalKeyValuesEntity([]byte(`{"id":"Room1","type":"Room","temperature":23.5,"occupied":true,"name":"Kitchen","tags":["a","b"]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if e.Id != "Room1" || e.Type != "Room" || len(e.Attributes) != 4 {
+		t.Fatalf("Invalid entity decoded: %v", e)
+	}
+	if a := e.Attributes["temperature"]; a.Type != model.NumberType || a.Value != 23.5 {
+		t.Fatalf("Invalid temperature attribute: %v", a)
+	}
+	if a := e.Attributes["occupied"]; a.Type != model.BooleanType || a.Value != true {
+		t.Fatalf("Invalid occupied attribute: %v", a)
+	}
+	if a := e.Attributes["name"]; a.Type != model.TextType || a.Value != "Kitchen" {
+		t.Fatalf("Invalid name attribute: %v", a)
+	}
+	if a := e.Attributes["tags"]; a.Type != model.StructuredValueType {
+		t.Fatalf("Invalid tags attribute: %v", a)
+	}
+
+	if _, err := model.UnmarshalKeyValuesEntity([]byte(`{"id":1}`)); err == nil {
+		t.Fatal("Expected an error for invalid id")
+	}
+}
+
+func TestGeoLine(t *testing.T) {
+	e, _ := model.NewEntity("Road1", "Road")
+	if err := e.SetAttributeAsGeoLine("path", []*model.GeoPoint{model.NewGeoPoint(40.63, -8.60)}); err == nil {
+		t.Fatal("Expected an error for a geo:line with a single point")
+	}
+	if err := e.SetAttributeAsGeoLine("path", []*model.GeoPoint{model.NewGeoPoint(40.63, -8.60), model.NewGeoPoint(40.64, -8.61)}); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	var raw map[string]map[string]interface{}
+	json.Unmarshal(b, &raw)
+	if coords, ok := raw["path"]["value"].([]interface{}); !ok || len(coords) != 2 || coords[0] != "40.63, -8.6" {
+		t.Fatalf("Unexpected geo:line value: %v", raw["path"]["value"])
+	}
+
+	unmarshaled := &model.Entity{}
+	if err := json.Unmarshal(b, unmarshaled); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	line, err := unmarshaled.GetAttributeAsGeoLine("path")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(line) != 2 || *line[0] != *model.NewGeoPoint(40.63, -8.60) || *line[1] != *model.NewGeoPoint(40.64, -8.61) {
+		t.Fatalf("Unexpected geo:line: %v", line)
+	}
+	if _, err := unmarshaled.Attributes["path"].GetAsGeoPoint(); err == nil {
+		t.Fatal("Expected an error reading a geo:line as geo:point")
+	}
+}
+
+func TestGeoPolygon(t *testing.T) {
+	e, _ := model.NewEntity("Park1", "Park")
+	if err := e.SetAttributeAsGeoPolygon("area", []*model.GeoPoint{model.NewGeoPoint(40.63, -8.60), model.NewGeoPoint(40.64, -8.61)}); err == nil {
+		t.Fatal("Expected an error for a geo:polygon with two points")
+	}
+	ring := []*model.GeoPoint{
+		model.NewGeoPoint(40.63, -8.60),
+		model.NewGeoPoint(40.64, -8.61),
+		model.NewGeoPoint(40.65, -8.60),
+	}
+	if err := e.SetAttributeAsGeoPolygon("area", ring); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(ring) != 3 {
+		t.Fatal("The given ring must not be modified")
+	}
+	if closed, _ := e.GetAttributeAsGeoPolygon("area"); len(closed) != 4 || *closed[3] != *closed[0] {
+		t.Fatalf("Expected the ring to be closed, got %v", closed)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	unmarshaled := &model.Entity{}
+	if err := json.Unmarshal(b, unmarshaled); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if unmarshaled.Attributes["area"].Type != model.GeoPolygonType {
+		t.Fatalf("Expected '%s' type, got '%s'", model.GeoPolygonType, unmarshaled.Attributes["area"].Type)
+	}
+	polygon, err := unmarshaled.GetAttributeAsGeoPolygon("area")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(polygon) != 4 {
+		t.Fatalf("Expected 4 points, got %d", len(polygon))
+	}
+	for i, p := range polygon {
+		if *p != *ring[i%3] {
+			t.Fatalf("Unexpected point %d: %v", i, p)
+		}
+	}
+	if err := model.AssertRoundTrip(e); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+}
+
+func TestAttributeMetadata(t *testing.T) {
+	var entity model.Entity
+	if err := json.Unmarshal([]byte(`{"id":"Sensor1","type":"Sensor","temperature":{"type":"Number","value":21.5,"metadata":{"unitCode":{"type":"Text","value":"CEL"},"accuracy":{"type":"Number","value":0.1},"calibrated":{"type":"Boolean","value":true}}}}`), &entity); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	temp := entity.Attributes["temperature"]
+
+	if unit, err := temp.GetMetadataAsString("unitCode"); err != nil || unit != "CEL" {
+		t.Fatalf("Unexpected unitCode: '%v', '%v'", unit, err)
+	}
+	if accuracy, err := temp.GetMetadataAsFloat("accuracy"); err != nil || accuracy != 0.1 {
+		t.Fatalf("Unexpected accuracy: '%v', '%v'", accuracy, err)
+	}
+	if calibrated, err := temp.GetMetadataAsBoolean("calibrated"); err != nil || !calibrated {
+		t.Fatalf("Unexpected calibrated: '%v', '%v'", calibrated, err)
+	}
+	if _, err := temp.GetMetadataAsFloat("unitCode"); err == nil {
+		t.Fatal("Expected an error reading a Text metadata as float")
+	}
+	if _, err := temp.GetMetadata("missing"); !errors.Is(err, model.ErrMetadataNotFound) {
+		t.Fatalf("Expected metadata not found error, got '%v'", err)
+	}
+
+	attr := model.NewAttribute(model.NumberType, 10)
+	attr.SetMetadata("accuracy", model.NumberType, 0.5)
+	attr.SetMetadata("accuracy", model.NumberType, 0.2)
+	if m, err := attr.GetMetadata("accuracy"); err != nil || m.Type != model.NumberType || m.Value != 0.2 {
+		t.Fatalf("Unexpected accuracy metadata: '%v', '%v'", m, err)
+	}
+}
+
+func TestGetTimeInstant(t *testing.T) {
+	var entity model.Entity
+	if err := json.Unmarshal([]byte(`{"id":"Sensor1","type":"Sensor",
+		"temperature":{"type":"Number","value":21.5,"metadata":{"TimeInstant":{"type":"DateTime","value":"2020-04-01T10:00:00.000Z"}}},
+		"humidity":{"type":"Number","value":40,"metadata":{"TimeInstant":{"type":"ISO8601","value":"2020-04-01T12:00:00+02:00"}}},
+		"pressure":{"type":"Number","value":1013,"metadata":{"TimeInstant":{"type":"Text","value":"yesterday"}}},
+		"noise":{"type":"Number","value":30}}`), &entity); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	expected := time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, name := range []string{"temperature", "humidity"} {
+		if ti, err := entity.Attributes[name].GetTimeInstant(); err != nil {
+			t.Fatalf("Unexpected error: '%v'", err)
+		} else if !ti.Equal(expected) {
+			t.Fatalf("Expected '%v' for %s, got '%v'", expected, name, ti)
+		}
+	}
+	if _, err := entity.Attributes["pressure"].GetTimeInstant(); err == nil || errors.Is(err, model.ErrMetadataNotFound) {
+		t.Fatalf("Expected an invalid value error, got '%v'", err)
+	}
+	if _, err := entity.Attributes["noise"].GetTimeInstant(); !errors.Is(err, model.ErrMetadataNotFound) {
+		t.Fatalf("Expected metadata not found error, got '%v'", err)
+	}
+}
+
+func TestPercentage(t *testing.T) {
+	e, _ := model.NewEntity("Battery1", "Battery")
+	if err := e.SetAttributeAsPercentage("charge", 101); err == nil {
+		t.Fatal("Expected an error for a percentage over 100")
+	}
+	if err := e.SetAttributeAsPercentage("charge", -1); err == nil {
+		t.Fatal("Expected an error for a negative percentage")
+	}
+	if err := e.SetAttributeAsPercentage("charge", 87.5); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	b, _ := json.Marshal(e)
+	unmarshaled := &model.Entity{}
+	if err := json.Unmarshal(b, unmarshaled); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if charge, err := unmarshaled.GetAttributeAsPercentage("charge"); err != nil || charge != 87.5 {
+		t.Fatalf("Unexpected charge: '%v', '%v'", charge, err)
+	}
+	if _, err := unmarshaled.GetAttributeAsFloat("charge"); err == nil {
+		t.Fatal("Expected an error reading a Percentage as float")
+	}
+
+	unmarshaled.Attributes["charge"] = model.NewAttribute(model.PercentageType, 120.0)
+	if _, err := unmarshaled.GetAttributeAsPercentage("charge"); err == nil {
+		t.Fatal("Expected an error for an out of range percentage")
+	}
+}
+
+func TestGetAsNumberFromString(t *testing.T) {
+	tests := []struct {
+		name     string
+		attr     *model.Attribute
+		expected float64
+		fails    bool
+	}{
+		{"integer from string", model.NewAttribute(model.IntegerType, "720"), 720, false},
+		{"integer from float string", model.NewAttribute(model.IntegerType, "720.0"), 720, false},
+		{"integer from exponent string", model.NewAttribute(model.IntegerType, "7.2e2"), 720, false},
+		{"integer from fractional string", model.NewAttribute(model.IntegerType, "720.5"), 0, true},
+		{"integer from NaN string", model.NewAttribute(model.IntegerType, "NaN"), 0, true},
+		{"integer from infinite string", model.NewAttribute(model.IntegerType, "-Inf"), 0, true},
+		{"integer from huge string", model.NewAttribute(model.IntegerType, "1e300"), 0, true},
+		{"integer from huge negative string", model.NewAttribute(model.IntegerType, "-1e300"), 0, true},
+		{"integer from invalid string", model.NewAttribute(model.IntegerType, "many"), 0, true},
+		{"integer from boolean", model.NewAttribute(model.IntegerType, true), 0, true},
+		{"float from string", model.NewAttribute(model.FloatType, "23.5"), 23.5, false},
+		{"number from string", model.NewAttribute(model.NumberType, " 23 "), 23, false},
+		{"float from invalid string", model.NewAttribute(model.FloatType, "hot"), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v float64
+			var err error
+			if tt.attr.Type == model.IntegerType {
+				var i int
+				i, err = tt.attr.GetAsInteger()
+				v = float64(i)
+			} else {
+				v, err = tt.attr.GetAsFloat()
+			}
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("Expected an error, got '%v'", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			if v != tt.expected {
+				t.Fatalf("Expected '%v', got '%v'", tt.expected, v)
+			}
+		})
+	}
+}
+
+func TestGeoPointValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		point *model.GeoPoint
+		fails string
+	}{
+		{"valid", model.NewGeoPoint(43.77, 11.25), ""},
+		{"bounds", model.NewGeoPoint(-90, 180), ""},
+		{"latitude out of range", model.NewGeoPoint(91, 11.25), "Latitude"},
+		{"longitude out of range", model.NewGeoPoint(43.77, -181), "Longitude"},
+		{"swapped coordinates", model.NewGeoPoint(181, 43.77), "Latitude"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.point.Validate()
+			if tt.fails == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: '%v'", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.fails) {
+				t.Fatalf("Expected an error about %s, got '%v'", tt.fails, err)
+			}
+			e, _ := model.NewEntity("Room1", "Room")
+			if err := e.SetAttributeAsGeoPoint("location", tt.point); err == nil {
+				t.Fatal("Expected an error setting an invalid geo:point")
+			}
+		})
+	}
+
+	g := new(model.GeoPoint)
+	if err := g.UnmarshalJSON([]byte("11.25, 181")); err == nil {
+		t.Fatal("Expected an error unmarshaling an invalid geo:point")
+	}
+}
+
+func TestSubscriptionMqttNotification(t *testing.T) {
+	sub := &model.Subscription{
+		Description: "MQTT subscription",
+		Notification: &model.SubscriptionNotification{
+			Mqtt: &model.SubscriptionNotificationMqtt{
+				Url:   "mqtt://broker:1883",
+				Topic: "rooms",
+				Qos:   1,
+			},
+		},
+	}
+	b, err := json.Marshal(sub)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	expected := `{"description":"MQTT subscription","notification":{"mqtt":{"url":"mqtt://broker:1883","topic":"rooms","qos":1}}}`
+	if string(b) != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, b)
+	}
+
+	var decoded model.Subscription
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if decoded.Notification.Mqtt == nil || *decoded.Notification.Mqtt != *sub.Notification.Mqtt {
+		t.Fatalf("Expected mqtt notification %+v, got %+v", sub.Notification.Mqtt, decoded.Notification.Mqtt)
+	}
+	if decoded.Notification.Http != nil || decoded.Notification.MqttCustom != nil {
+		t.Fatal("Expected only the mqtt notification to be set")
+	}
+
+	var custom model.Subscription
+	if err := json.Unmarshal([]byte(`{"notification":{"mqttCustom":{"url":"mqtt://broker:1883","topic":"rooms","payload":"${id}"}}}`), &custom); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if custom.Notification.MqttCustom == nil || custom.Notification.MqttCustom.Payload != "${id}" {
+		t.Fatalf("Unexpected mqttCustom notification: %+v", custom.Notification.MqttCustom)
+	}
+
+	httpSub := &model.Subscription{Notification: &model.SubscriptionNotification{Http: &model.SubscriptionNotificationHttp{Url: "http://localhost"}}}
+	b, _ = json.Marshal(httpSub)
+	if strings.Contains(string(b), "mqtt") {
+		t.Fatalf("Expected no mqtt fields in http subscription, got '%s'", b)
+	}
+}
+
+func TestSubscriptionValidate(t *testing.T) {
+	subject := func() *model.SubscriptionSubject {
+		return &model.SubscriptionSubject{Entities: []*model.SubscriptionSubjectEntity{model.NewEntityMatcher().ByIdPattern(".*")}}
+	}
+	httpEndpoint := &model.SubscriptionNotificationHttp{Url: "http://localhost:1234"}
+	tests := []struct {
+		name  string
+		sub   *model.Subscription
+		fails bool
+	}{
+		{
+			"valid",
+			&model.Subscription{Subject: subject(), Notification: &model.SubscriptionNotification{Http: httpEndpoint, AttrsFormat: model.AttrsFormatKeyValues}},
+			false,
+		},
+		{
+			"no subject",
+			&model.Subscription{Notification: &model.SubscriptionNotification{Http: httpEndpoint}},
+			true,
+		},
+		{
+			"no subject entities",
+			&model.Subscription{Subject: &model.SubscriptionSubject{}, Notification: &model.SubscriptionNotification{Http: httpEndpoint}},
+			true,
+		},
+		{
+			"no notification",
+			&model.Subscription{Subject: subject()},
+			true,
+		},
+		{
+			"no endpoint",
+			&model.Subscription{Subject: subject(), Notification: &model.SubscriptionNotification{}},
+			true,
+		},
+		{
+			"two endpoints",
+			&model.Subscription{Subject: subject(), Notification: &model.SubscriptionNotification{
+				Http: httpEndpoint,
+				Mqtt: &model.SubscriptionNotificationMqtt{Url: "mqtt://broker:1883", Topic: "rooms"},
+			}},
+			true,
+		},
+		{
+			"invalid attrsFormat",
+			&model.Subscription{Subject: subject(), Notification: &model.SubscriptionNotification{Http: httpEndpoint, AttrsFormat: "normalised"}},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sub.Validate()
+			if tt.fails && err == nil {
+				t.Fatal("Expected an error")
+			}
+			if !tt.fails && err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+		})
+	}
+}
+
+func TestAttrsFormat(t *testing.T) {
+	for _, f := range []model.AttrsFormat{
+		model.AttrsFormatNormalized,
+		model.AttrsFormatKeyValues,
+		model.AttrsFormatValues,
+		model.AttrsFormatLegacy,
+	} {
+		if !f.IsValid() {
+			t.Fatalf("Expected '%s' to be valid", f)
+		}
+	}
+	if model.AttrsFormat("normalised").IsValid() {
+		t.Fatal("Expected 'normalised' to be invalid")
+	}
+
+	n := &model.SubscriptionNotification{AttrsFormat: model.AttrsFormatKeyValues}
+	b, err := json.Marshal(n)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if string(b) != `{"attrsFormat":"keyValues"}` {
+		t.Fatalf("Unexpected serialization: '%s'", b)
+	}
+	var decoded model.SubscriptionNotification
+	if err := json.Unmarshal([]byte(`{"attrsFormat":"legacy"}`), &decoded); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if decoded.AttrsFormat != model.AttrsFormatLegacy {
+		t.Fatalf("Expected legacy attrsFormat, got '%s'", decoded.AttrsFormat)
+	}
+}
+
+func TestIsBuiltinAttributeName(t *testing.T) {
+	for _, name := range []string{"dateCreated", "dateModified", "dateExpires"} {
+		if !model.IsBuiltinAttributeName(name) {
+			t.Fatalf("Expected '%s' to be a builtin attribute", name)
+		}
+	}
+	for _, name := range []string{"temperature", "*", "id"} {
+		if model.IsBuiltinAttributeName(name) {
+			t.Fatalf("Expected '%s' not to be a builtin attribute", name)
+		}
+	}
+}
+
+func TestNewDateTimeRangeQueryStatement(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		attr     string
+		from     time.Time
+		to       time.Time
+		expected model.SimpleQueryStatement
+		fails    bool
+	}{
+		{"valid range", "dateObserved", from, to, "dateObserved==2020-01-01T00:00:00Z..2020-01-02T00:00:00Z", false},
+		{"offset kept", "dateObserved", from.In(time.FixedZone("CET", 3600)), to, "dateObserved==2020-01-01T01:00:00+01:00..2020-01-02T00:00:00Z", false},
+		{"reversed range", "dateObserved", to, from, "", true},
+		{"empty range", "dateObserved", from, from, "", true},
+		{"invalid attribute", "date Observed", from, to, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := model.NewDateTimeRangeQueryStatement(tt.attr, tt.from, tt.to)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			if st != tt.expected {
+				t.Fatalf("Expected '%s', got '%s'", tt.expected, st)
+			}
+		})
+	}
+}
+
+func TestEntityClone(t *testing.T) {
+	e, _ := model.NewEntity("Room1", "Room")
+	e.SetAttributeAsFloat("temperature", 21.5)
+	e.SetAttributeAsGeoPoint("location", model.NewGeoPoint(43.77, 11.25))
+	e.SetAttributeAsGeoLine("path", []*model.GeoPoint{model.NewGeoPoint(43.77, 11.25), model.NewGeoPoint(43.78, 11.26)})
+	e.SetAttributeAsDateTime("lastSeen", time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC))
+	e.SetAttributeAsGeoJSON("area", geojson.NewPointGeometry([]float64{11.25, 43.77}))
+	e.SetAttributeAsStructuredValue("address", map[string]interface{}{"city": "Florence", "tags": []interface{}{"a"}})
+	temp, _ := e.GetAttribute("temperature")
+	temp.SetMetadata("unitCode", model.TextType, "CEL")
+
+	c := e.Clone()
+	if !reflect.DeepEqual(e, c) {
+		t.Fatalf("Expected the clone to equal the original")
+	}
+
+	ctemp, _ := c.GetAttribute("temperature")
+	if ctemp == temp {
+		t.Fatal("Expected the clone to have its own attributes")
+	}
+	ctemp.Value = 30.0
+	ctemp.SetMetadata("unitCode", model.TextType, "FAH")
+	c.SetAttributeAsText("name", "Kitchen")
+	loc, _ := c.GetAttribute("location")
+	loc.Value.(*model.GeoPoint).Latitude = 40
+	path, _ := c.GetAttribute("path")
+	path.Value.([]*model.GeoPoint)[0].Longitude = 10
+	area, _ := c.GetAttribute("area")
+	area.Value.(*geojson.Geometry).Point[0] = 10
+	address, _ := c.GetAttribute("address")
+	address.Value.(map[string]interface{})["city"] = "Pisa"
+	address.Value.(map[string]interface{})["tags"].([]interface{})[0] = "b"
+
+	if v, _ := temp.GetAsFloat(); v != 21.5 {
+		t.Fatalf("Original temperature changed to %v", v)
+	}
+	if m, _ := temp.GetMetadataAsString("unitCode"); m != "CEL" {
+		t.Fatalf("Original metadata changed to %v", m)
+	}
+	if _, err := e.GetAttribute("name"); err == nil {
+		t.Fatal("Original got a new attribute")
+	}
+	if g, _ := e.GetAttributeAsGeoPoint("location"); g.Latitude != 43.77 {
+		t.Fatalf("Original location changed to %v", g)
+	}
+	if l, _ := e.GetAttributeAsGeoLine("path"); l[0].Longitude != 11.25 {
+		t.Fatalf("Original path changed to %v", l[0])
+	}
+	if g, _ := e.GetAttributeAsGeoJSON("area"); g.Point[0] != 11.25 {
+		t.Fatalf("Original area changed to %v", g.Point)
+	}
+	a, _ := e.GetAttribute("address")
+	if city := a.Value.(map[string]interface{})["city"]; city != "Florence" {
+		t.Fatalf("Original address changed to %v", city)
+	}
+	if tag := a.Value.(map[string]interface{})["tags"].([]interface{})[0]; tag != "a" {
+		t.Fatalf("Original address tags changed to %v", tag)
+	}
+}
+
+func TestEntityDiff(t *testing.T) {
+	e, _ := model.NewEntity("Room1", "Room")
+	e.SetAttributeAsFloat("temperature", 21.5)
+	e.SetAttributeAsInteger("floor", 2)
+	e.SetAttributeAsGeoPoint("location", model.NewGeoPoint(43.77, 11.25))
+	e.SetAttributeAsStructuredValue("address", map[string]interface{}{"city": "Florence"})
+	e.SetAttributeAsText("name", "Kitchen")
+
+	other := e.Clone()
+	other.SetAttributeAsFloat("temperature", 23)
+	other.SetAttributeAsFloat("floor", 2)
+	other.SetAttributeAsGeoPoint("location", model.NewGeoPoint(43.77, 11.25))
+	other.SetAttributeAsStructuredValue("address", map[string]interface{}{"city": "Pisa"})
+	other.SetAttributeAsText("owner", "Alice")
+	delete(other.Attributes, "name")
+
+	changed, removed := e.Diff(other)
+	if len(changed) != 4 {
+		t.Fatalf("Expected 4 changed attributes, got %v", changed)
+	}
+	for _, name := range []string{"temperature", "floor", "address", "owner"} {
+		if changed[name] != other.Attributes[name] {
+			t.Fatalf("Expected '%s' to be changed", name)
+		}
+	}
+	if len(removed) != 1 || removed[0] != "name" {
+		t.Fatalf("Expected 'name' to be removed, got %v", removed)
+	}
+
+	if changed, removed := e.Diff(e.Clone()); len(changed) != 0 || len(removed) != 0 {
+		t.Fatalf("Expected no differences with a clone, got %v and %v", changed, removed)
+	}
+
+	// a nil entity has no attributes
+	changed, removed = e.Diff(nil)
+	if len(changed) != 0 || strings.Join(removed, ",") != "address,floor,location,name,temperature" {
+		t.Fatalf("Expected all the attributes to be removed, got %v and %v", changed, removed)
+	}
+	var none *model.Entity
+	if changed, removed := none.Diff(e); len(changed) != 5 || len(removed) != 0 {
+		t.Fatalf("Expected all the attributes to be changed, got %v and %v", changed, removed)
+	}
+}
+
+func TestGetAsSlice(t *testing.T) {
+	e := &model.Entity{}
+	if err := json.Unmarshal([]byte(`{
+		"id": "Sensor1",
+		"type": "Sensor",
+		"readings": {"type": "StructuredValue", "value": [21.5, 22, 23.25]},
+		"mixed": {"type": "StructuredValue", "value": ["a", 1]},
+		"object": {"type": "StructuredValue", "value": {"a": 1}},
+		"name": {"type": "Text", "value": "sensor"}
+	}`), e); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	readings, err := e.GetAttributeAsFloatSlice("readings")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if len(readings) != 3 || readings[0] != 21.5 || readings[1] != 22 || readings[2] != 23.25 {
+		t.Fatalf("Unexpected readings: %v", readings)
+	}
+	if _, err := e.GetAttributeAsStringSlice("readings"); err == nil {
+		t.Fatal("Expected an error reading numbers as strings")
+	}
+	if _, err := e.GetAttributeAsStringSlice("mixed"); err == nil || !strings.Contains(err.Error(), "Element 1") {
+		t.Fatalf("Expected an error on the second element, got '%v'", err)
+	}
+	if _, err := e.GetAttributeAsFloatSlice("object"); err == nil {
+		t.Fatal("Expected an error on a non array value")
+	}
+	if _, err := e.GetAttributeAsStringSlice("name"); err == nil {
+		t.Fatal("Expected an error on a non structured value")
+	}
+
+	if values, err := model.GetAttributeAs[[]float64](e, "readings"); err != nil || len(values) != 3 {
+		t.Fatalf("Unexpected generic result %v (%v)", values, err)
+	}
+}
+
+func TestDateTimeOffsetRoundTrip(t *testing.T) {
+	e := &model.Entity{}
+	if err := json.Unmarshal([]byte(`{"id":"Room1","type":"Room","lastSeen":{"type":"DateTime","value":"2020-04-01T10:00:00+02:00"}}`), e); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	dt, err := e.GetAttributeAsDateTime("lastSeen")
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if _, offset := dt.Zone(); offset != 2*60*60 {
+		t.Fatalf("Expected +02:00 offset, got %d seconds", offset)
+	}
+
+	sent, _ := model.NewEntity("Room1", "Room")
+	sent.SetAttributeAsDateTime("lastSeen", dt)
+	b, err := json.Marshal(sent)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if !strings.Contains(string(b), `"2020-04-01T10:00:00+02:00"`) {
+		t.Fatalf("Expected the offset to be serialized, got '%s'", b)
+	}
+	received := &model.Entity{}
+	if err := json.Unmarshal(b, received); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	rdt, _ := received.GetAttributeAsDateTime("lastSeen")
+	if _, offset := rdt.Zone(); offset != 2*60*60 || !rdt.Equal(dt) {
+		t.Fatalf("Expected %v, got %v", dt, rdt)
+	}
+
+	// Orion answers in UTC
+	stored := &model.Entity{}
+	json.Unmarshal([]byte(`{"id":"Room1","type":"Room","lastSeen":{"type":"DateTime","value":"2020-04-01T08:00:00.000Z"}}`), stored)
+	rome := time.FixedZone("CEST", 2*60*60)
+	local, err := stored.GetAttributeAsDateTimeInLocation("lastSeen", rome)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if local.Hour() != 10 || !local.Equal(dt) {
+		t.Fatalf("Expected %v, got %v", dt, local)
+	}
+	if _, err := stored.GetAttributeAsDateTimeInLocation("lastSeen", nil); err == nil {
+		t.Fatal("Expected an error for nil location")
+	}
+}
+
+func TestEntityAttributeNamesAndStableMarshal(t *testing.T) {
+	e, _ := model.NewEntity("Room1", "Room")
+	e.SetAttributeAsFloat("temperature", 21.5)
+	e.SetAttributeAsInteger("pressure", 720)
+	e.SetAttributeAsString("name", "Kitchen")
+	e.SetAttributeAsBoolean("active", true)
+
+	names := e.AttributeNames()
+	expected := []string{"active", "name", "pressure", "temperature"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+
+	golden := `{"active":{"type":"Boolean","value":true},"id":"Room1","name":{"type":"String","value":"Kitchen"},"pressure":{"type":"Integer","value":720},"temperature":{"type":"Float","value":21.5},"type":"Room"}`
+	for i := 0; i < 20; i++ {
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatalf("Unexpected error: '%v'", err)
+		}
+		if string(b) != golden {
+			t.Fatalf("Expected '%s', got '%s'", golden, b)
+		}
+	}
+}
+
+func TestDecodeStructuredValueNumbers(t *testing.T) {
+	type Tyre struct {
+		Position string
+		Pressure uint8
+	}
+	type Car struct {
+		Seats    int
+		Weight   float64
+		Mileage  int64
+		Tyres    []Tyre
+		Readings map[string]int
+	}
+
+	sent, _ := model.NewEntity("Car1", "Car")
+	sent.SetAttributeAsStructuredValue("specs", map[string]interface{}{
+		"Seats":    5,
+		"Weight":   1250.5,
+		"Mileage":  int64(123456789),
+		"Tyres":    []interface{}{map[string]interface{}{"Position": "front-left", "Pressure": 32}},
+		"Readings": map[string]interface{}{"odometer": 25, "trip": 25.0},
+	})
+	b, err := json.Marshal(sent)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	received := &model.Entity{}
+	if err := json.Unmarshal(b, received); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	car := new(Car)
+	if err := received.DecodeStructuredValueAttribute("specs", car); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	expected := Car{
+		Seats:    5,
+		Weight:   1250.5,
+		Mileage:  123456789,
+		Tyres:    []Tyre{{"front-left", 32}},
+		Readings: map[string]int{"odometer": 25, "trip": 25},
+	}
+	if !reflect.DeepEqual(*car, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, *car)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"fractional int", `{"Seats": 4.5}`},
+		{"nested fractional", `{"Tyres": [{"Pressure": 31.5}]}`},
+		{"negative uint", `{"Tyres": [{"Pressure": -1}]}`},
+		{"overflow", `{"Tyres": [{"Pressure": 256}]}`},
+		{"string into int", `{"Seats": "5"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &model.Entity{}
+			if err := json.Unmarshal([]byte(`{"id":"Car1","type":"Car","specs":{"type":"StructuredValue","value":`+tt.value+`}}`), e); err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			if err := e.DecodeStructuredValueAttribute("specs", new(Car)); err == nil {
+				t.Fatal("Expected a decoding error")
+			}
+		})
+	}
+}
+
+func TestAttributeUnitCode(t *testing.T) {
+	attr := model.NewAttribute(model.NumberType, 21.5)
+	if _, ok := attr.GetUnitCode(); ok {
+		t.Fatal("Expected no unit code")
+	}
+	attr.SetUnitCode("CEL")
+	if code, ok := attr.GetUnitCode(); !ok || code != "CEL" {
+		t.Fatalf("Expected 'CEL', got '%s'", code)
+	}
+	b, err := json.Marshal(attr)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if expected := `{"type":"Number","value":21.5,"metadata":{"unitCode":{"type":"String","value":"CEL"}}}`; string(b) != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, b)
+	}
+
+	// as often sent by agents, with the Text type
+	var entity model.Entity
+	if err := json.Unmarshal([]byte(`{"id":"Sensor1","type":"Sensor","temperature":{"type":"Number","value":21.5,"metadata":{"unitCode":{"type":"Text","value":"FAH"}}}}`), &entity); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if code, ok := entity.Attributes["temperature"].GetUnitCode(); !ok || code != "FAH" {
+		t.Fatalf("Expected 'FAH', got '%s'", code)
+	}
+	attr.SetMetadata(model.UnitCodeMetadataName, model.NumberType, 12)
+	if _, ok := attr.GetUnitCode(); ok {
+		t.Fatal("Expected no unit code for a non string metadata")
+	}
+}
+
+func TestNewUnarySimpleQueryStatement(t *testing.T) {
+	tests := []struct {
+		name     string
+		attr     string
+		exists   bool
+		expected model.SimpleQueryStatement
+		fails    bool
+	}{
+		{"exists", "temperature", true, "temperature", false},
+		{"not exists", "temperature", false, "!temperature", false},
+		{"invalid attribute", "temp rature", true, "", true},
+		{"empty attribute", "", false, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := model.NewUnarySimpleQueryStatement(tt.attr, tt.exists)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			if st != tt.expected {
+				t.Fatalf("Expected '%s', got '%s'", tt.expected, st)
+			}
+		})
+	}
+}
+
+func TestNewMatchPatternQueryStatement(t *testing.T) {
+	tests := []struct {
+		name     string
+		attr     string
+		pattern  string
+		expected model.SimpleQueryStatement
+		fails    bool
+	}{
+		{"prefix", "name", "^Room", "name~=^Room", false},
+		{"alternatives", "name", "^(Kitchen|Bathroom)[0-9]+$", "name~=^(Kitchen|Bathroom)[0-9]+$", false},
+		{"unbalanced parenthesis", "name", "^(Kitchen", "", true},
+		{"invalid repetition", "name", "*Room", "", true},
+		{"empty pattern", "name", "", "", true},
+		{"invalid attribute", "na me", "^Room", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := model.NewMatchPatternQueryStatement(tt.attr, tt.pattern)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			if st != tt.expected {
+				t.Fatalf("Expected '%s', got '%s'", tt.expected, st)
+			}
+		})
+	}
+}
+
+func TestNestedQueryStatements(t *testing.T) {
+	// dotted paths are accepted by the other constructors as well
+	if st, err := model.NewBinarySimpleQueryStatement("address.city", model.SQEqual, "Madrid"); err != nil || st != "address.city==Madrid" {
+		t.Fatalf("Unexpected statement '%s' (%v)", st, err)
+	}
+	if st, err := model.NewBinarySimpleQueryStatementMultipleValues("address.city", model.SQEqual, "Madrid", "Rome"); err != nil || st != "address.city==Madrid,Rome" {
+		t.Fatalf("Unexpected statement '%s' (%v)", st, err)
+	}
+	if st, err := model.NewBinarySimpleQueryStatementRange("specs.weight", model.SQEqual, "1000", "1500"); err != nil || st != "specs.weight==1000..1500" {
+		t.Fatalf("Unexpected statement '%s' (%v)", st, err)
+	}
+	if st, err := model.NewUnarySimpleQueryStatement("address.city", false); err != nil || st != "!address.city" {
+		t.Fatalf("Unexpected statement '%s' (%v)", st, err)
+	}
+
+	tests := []struct {
+		name     string
+		path     []string
+		operator model.SimpleQueryOperator
+		value    string
+		expected model.SimpleQueryStatement
+		fails    bool
+	}{
+		{"nested", []string{"address", "city"}, model.SQEqual, "Madrid", "address.city==Madrid", false},
+		{"deeply nested", []string{"specs", "engine", "power"}, model.SQGreaterThan, "100", "specs.engine.power>100", false},
+		{"single segment", []string{"temperature"}, model.SQLessThan, "20", "temperature<20", false},
+		{"dotted segment", []string{"address", "v2.0", "city"}, model.SQEqual, "Madrid", "address.'v2.0'.city==Madrid", false},
+		{"comma in value", []string{"address", "street"}, model.SQEqual, "Gran Via, 1", "address.street=='Gran Via, 1'", false},
+		{"empty path", nil, model.SQEqual, "Madrid", "", true},
+		{"reserved attribute", []string{"dateCreated", "year"}, model.SQEqual, "2020", "", true},
+		{"empty segment", []string{"address", ""}, model.SQEqual, "Madrid", "", true},
+		{"quote in segment", []string{"address", "c'ty"}, model.SQEqual, "Madrid", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := model.NewNestedQueryStatement(tt.path, tt.operator, tt.value)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			if st != tt.expected {
+				t.Fatalf("Expected '%s', got '%s'", tt.expected, st)
+			}
+		})
+	}
+}
+
+func TestAttributeEqual(t *testing.T) {
+	when := time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC)
+	withMetadata := func(a *model.Attribute, name string, typ model.AttributeType, value interface{}) *model.Attribute {
+		a.SetMetadata(name, typ, value)
+		return a
+	}
+	tests := []struct {
+		name  string
+		a, b  *model.Attribute
+		equal bool
+	}{
+		{"both nil", nil, nil, true},
+		{"one nil", model.NewAttribute(model.FloatType, 1.0), nil, false},
+		{"same float", model.NewAttribute(model.FloatType, 21.5), model.NewAttribute(model.FloatType, 21.5), true},
+		{"different float", model.NewAttribute(model.FloatType, 21.5), model.NewAttribute(model.FloatType, 22.0), false},
+		{"different type", model.NewAttribute(model.FloatType, 21.0), model.NewAttribute(model.IntegerType, 21), false},
+		{"int and float number", model.NewAttribute(model.NumberType, 21), model.NewAttribute(model.NumberType, 21.0), true},
+		{"geo:point pointers", model.NewAttribute(model.GeoPointType, &model.GeoPoint{Latitude: 43.77, Longitude: 11.25}), model.NewAttribute(model.GeoPointType, &model.GeoPoint{Latitude: 43.77, Longitude: 11.25}), true},
+		{"different geo:point", model.NewAttribute(model.GeoPointType, &model.GeoPoint{Latitude: 43.77, Longitude: 11.25}), model.NewAttribute(model.GeoPointType, &model.GeoPoint{Latitude: 43.78, Longitude: 11.25}), false},
+		{"same instant", model.NewAttribute(model.DateTimeType, when), model.NewAttribute(model.DateTimeType, when.In(time.FixedZone("CEST", 2*60*60))), true},
+		{"structured", model.NewAttribute(model.StructuredValueType, map[string]interface{}{"a": []interface{}{1, "b"}}), model.NewAttribute(model.StructuredValueType, map[string]interface{}{"a": []interface{}{1.0, "b"}}), true},
+		{"different structured", model.NewAttribute(model.StructuredValueType, map[string]interface{}{"a": []interface{}{1, "b"}}), model.NewAttribute(model.StructuredValueType, map[string]interface{}{"a": []interface{}{"b", 1}}), false},
+		{"same metadata",
+			withMetadata(model.NewAttribute(model.FloatType, 21.5), "unitCode", model.TextType, "CEL"),
+			withMetadata(model.NewAttribute(model.FloatType, 21.5), "unitCode", model.TextType, "CEL"), true},
+		{"different metadata value",
+			withMetadata(model.NewAttribute(model.FloatType, 21.5), "unitCode", model.TextType, "CEL"),
+			withMetadata(model.NewAttribute(model.FloatType, 21.5), "unitCode", model.TextType, "FAH"), false},
+		{"missing metadata",
+			withMetadata(model.NewAttribute(model.FloatType, 21.5), "unitCode", model.TextType, "CEL"),
+			model.NewAttribute(model.FloatType, 21.5), false},
+		{"empty and nil metadata", &model.Attribute{Metadata: map[string]*model.Metadata{}}, &model.Attribute{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if eq := tt.a.Equal(tt.b); eq != tt.equal {
+				t.Fatalf("Expected %v, got %v", tt.equal, eq)
+			}
+			if eq := tt.b.Equal(tt.a); eq != tt.equal {
+				t.Fatalf("Expected %v swapping the attributes, got %v", tt.equal, eq)
+			}
+		})
+	}
+}
+
+func TestEntityHasAndRemoveAttribute(t *testing.T) {
+	e, _ := model.NewEntity("Room1", "Room")
+	e.SetAttributeAsFloat("temperature", 21.5)
+	e.SetAttributeAsInteger("pressure", 720)
+
+	if !e.HasAttribute("temperature") {
+		t.Fatal("Expected attribute 'temperature'")
+	}
+	if e.HasAttribute("humidity") {
+		t.Fatal("Unexpected attribute 'humidity'")
+	}
+
+	e.RemoveAttribute("temperature")
+	if e.HasAttribute("temperature") {
+		t.Fatal("Expected attribute 'temperature' to be removed")
+	}
+	if _, err := e.GetAttribute("temperature"); err == nil {
+		t.Fatal("Expected error getting a removed attribute")
+	}
+	if !e.HasAttribute("pressure") {
+		t.Fatal("Expected attribute 'pressure' to be kept")
+	}
+
+	// removing a missing attribute is a no-op
+	e.RemoveAttribute("humidity")
+	if names := e.AttributeNames(); len(names) != 1 || names[0] != "pressure" {
+		t.Fatalf("Expected only 'pressure', got %v", names)
+	}
+}
+
+func TestZeroValueEntitySetters(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(e *model.Entity) error
+	}{
+		{"SetAttribute", func(e *model.Entity) error { return e.SetAttribute("a", model.TextType, "x") }},
+		{"SetAttributeAsString", func(e *model.Entity) error { return e.SetAttributeAsString("a", "x") }},
+		{"SetAttributeAsText", func(e *model.Entity) error { return e.SetAttributeAsText("a", "x") }},
+		{"SetAttributeAsNumber", func(e *model.Entity) error { return e.SetAttributeAsNumber("a", 1) }},
+		{"SetAttributeAsInteger", func(e *model.Entity) error { return e.SetAttributeAsInteger("a", 1) }},
+		{"SetAttributeAsFloat", func(e *model.Entity) error { return e.SetAttributeAsFloat("a", 1.5) }},
+		{"SetAttributeAsPercentage", func(e *model.Entity) error { return e.SetAttributeAsPercentage("a", 0.5) }},
+		{"SetAttributeAsBoolean", func(e *model.Entity) error { return e.SetAttributeAsBoolean("a", true) }},
+		{"SetAttributeAsDateTime", func(e *model.Entity) error { return e.SetAttributeAsDateTime("a", time.Now()) }},
+		{"SetAttributeAsGeoPoint", func(e *model.Entity) error {
+			return e.SetAttributeAsGeoPoint("a", &model.GeoPoint{Latitude: 43.77, Longitude: 11.25})
+		}},
+		{"SetAttributeAsStructuredValue", func(e *model.Entity) error {
+			return e.SetAttributeAsStructuredValue("a", map[string]interface{}{"b": 1})
+		}},
+		{"SetAttributeWithPrevious", func(e *model.Entity) error {
+			return e.SetAttributeWithPrevious("a", model.IntegerType, 2, 1)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &model.Entity{}
+			if err := tt.set(e); err != nil {
+				t.Fatalf("Unexpected error: '%v'", err)
+			}
+			if !e.HasAttribute("a") {
+				t.Fatal("Expected attribute 'a'")
+			}
+		})
+	}
+
+	e := &model.Entity{}
+	if err := e.SetDateExpires(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if !e.HasAttribute(model.DateExpiresAttributeName) {
+		t.Fatalf("Expected attribute '%s'", model.DateExpiresAttributeName)
+	}
+}
+
+func TestSetDateExpires(t *testing.T) {
+	e, _ := model.NewEntity("Alarm1", "Alarm")
+	if err := e.SetDateExpires(time.Now().Add(-time.Minute)); err == nil {
+		t.Fatal("Expected error for a dateExpires in the past")
+	}
+	if e.HasAttribute(model.DateExpiresAttributeName) {
+		t.Fatal("Unexpected dateExpires after failed set")
+	}
+
+	e.SetDateExpiresAllowPast(time.Now().Add(-time.Minute))
+	if _, err := e.GetDateExpires(); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	e.ClearDateExpires()
+	if e.HasAttribute(model.DateExpiresAttributeName) {
+		t.Fatal("Expected dateExpires to be cleared")
+	}
+	if _, err := e.GetDateExpires(); err == nil {
+		t.Fatal("Expected error getting a cleared dateExpires")
+	}
+	// clearing again is a no-op
+	e.ClearDateExpires()
+}
+
+func TestBatchUpdateConstructors(t *testing.T) {
+	tests := []struct {
+		name     string
+		batch    *model.BatchUpdate
+		expected model.ActionType
+	}{
+		{"append", model.NewAppendBatch(), model.AppendAction},
+		{"update", model.NewUpdateBatch(), model.UpdateAction},
+		{"delete", model.NewDeleteBatch(), model.DeleteAction},
+		{"replace", model.NewReplaceBatch(), model.ReplaceAction},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.batch.ActionType != tt.expected {
+				t.Fatalf("Expected action type '%s', got '%s'", tt.expected, tt.batch.ActionType)
+			}
+			if len(tt.batch.Entities) != 0 {
+				t.Fatalf("Expected no entities, got %d", len(tt.batch.Entities))
+			}
+		})
+	}
+}
+
+func TestBatchUpdateAddEntities(t *testing.T) {
+	r1, _ := model.NewEntity("Room1", "Room")
+	r2, _ := model.NewEntity("Room2", "Room")
+	r3, _ := model.NewEntity("Room3", "Room")
+
+	b := model.NewAppendBatch()
+	b.AddEntity(r1)
+	b.AddEntities(r2, r3)
+	b.AddEntities()
+	if len(b.Entities) != 3 || b.Entities[0] != r1 || b.Entities[1] != r2 || b.Entities[2] != r3 {
+		t.Fatalf("Unexpected entities: %v", b.Entities)
+	}
+}
+
+func TestBatchUpdateAddEntityRef(t *testing.T) {
+	b := model.NewDeleteBatch()
+	if err := b.AddEntityRef("Room1", "Room"); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if err := b.AddEntityRef("Room 2", "Room"); err == nil {
+		t.Fatal("Expected error for an invalid id")
+	}
+	if err := b.AddEntityRef("Room3", "Ro#om"); err == nil {
+		t.Fatal("Expected error for an invalid type")
+	}
+	if err := b.AddEntityRef("Room4", ""); err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+
+	bytes, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	expected := `{"actionType":"delete","entities":[{"id":"Room1","type":"Room"},{"id":"Room4"}]}`
+	if string(bytes) != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, bytes)
+	}
+}
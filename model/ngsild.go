@@ -0,0 +1,175 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// Names of the NGSI-LD attribute types understood by EntityFromNGSILD.
+const (
+	ngsiLDProperty     = "Property"
+	ngsiLDGeoProperty  = "GeoProperty"
+	ngsiLDRelationship = "Relationship"
+)
+
+// ObservedAtMetadataName is the metadata holding the NGSI-LD observedAt of an attribute.
+const ObservedAtMetadataName string = "observedAt"
+
+// ngsiLDAttribute is an NGSI-LD Property, GeoProperty or Relationship in normalized form.
+type ngsiLDAttribute struct {
+	Type       string          `json:"type"`
+	Value      json.RawMessage `json:"value"`
+	Object     string          `json:"object"`
+	ObservedAt string          `json:"observedAt"`
+	UnitCode   string          `json:"unitCode"`
+}
+
+// EntityFromNGSILD converts an NGSI-LD entity in normalized form into an NGSIv2 entity.
+// The @context is dropped, and the id and type are taken from either id and type
+// or their @id and @type aliases, so they must be in compacted form.
+// Properties become attributes whose type is inferred from their value, except
+// for DateTime values which keep their type; GeoProperties become geo:json attributes
+// and Relationships become Relationship attributes pointing to their object.
+// The observedAt and unitCode of an attribute, and its nested properties and
+// relationships, become metadata. Multi-attributes, i.e. arrays of instances
+// with different datasetIds, are not supported.
+func EntityFromNGSILD(jsonBytes []byte) (*Entity, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(jsonBytes, &data); err != nil {
+		return nil, err
+	}
+
+	var id, entityType string
+	attrs := make(map[string]json.RawMessage, len(data))
+	for name, raw := range data {
+		switch name {
+		case "@context":
+		case "id", "@id":
+			if err := json.Unmarshal(raw, &id); err != nil {
+				return nil, fmt.Errorf("Invalid entity id: %w", err)
+			}
+		case "type", "@type":
+			if err := json.Unmarshal(raw, &entityType); err != nil {
+				return nil, fmt.Errorf("Invalid entity type: %w", err)
+			}
+		default:
+			attrs[name] = raw
+		}
+	}
+
+	e, err := NewEntity(id, entityType)
+	if err != nil {
+		return nil, err
+	}
+	for name, raw := range attrs {
+		if err := validateAttributeName(name); err != nil {
+			return nil, err
+		}
+		a, err := attributeFromNGSILD(name, raw)
+		if err != nil {
+			return nil, err
+		}
+		e.Attributes[name] = a
+	}
+	return e, nil
+}
+
+func attributeFromNGSILD(name string, raw json.RawMessage) (*Attribute, error) {
+	var instances []json.RawMessage
+	if json.Unmarshal(raw, &instances) == nil {
+		return nil, fmt.Errorf("Attribute '%s' is a multi-attribute, which is not supported", name)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("Attribute '%s' is not an NGSI-LD Property, GeoProperty or Relationship", name)
+	}
+	var ld ngsiLDAttribute
+	if err := json.Unmarshal(raw, &ld); err != nil {
+		return nil, fmt.Errorf("Invalid attribute '%s': %w", name, err)
+	}
+
+	typ, value, err := ld.typeValue()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid attribute '%s': %w", name, err)
+	}
+	a := NewAttribute(typ, value)
+
+	if ld.ObservedAt != "" {
+		t, err := time.Parse(time.RFC3339, ld.ObservedAt)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid observedAt for attribute '%s': %w", name, err)
+		}
+		a.SetMetadata(ObservedAtMetadataName, DateTimeType, t)
+	}
+	if ld.UnitCode != "" {
+		a.SetUnitCode(ld.UnitCode)
+	}
+	for subName, subRaw := range fields {
+		var sub ngsiLDAttribute
+		if json.Unmarshal(subRaw, &sub) != nil || !isNGSILDAttributeType(sub.Type) {
+			// datasetId, createdAt, modifiedAt and the like
+			continue
+		}
+		typ, value, err := sub.typeValue()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sub-attribute '%s' of attribute '%s': %w", subName, name, err)
+		}
+		a.SetMetadata(subName, typ, value)
+	}
+	return a, nil
+}
+
+func isNGSILDAttributeType(typ string) bool {
+	return typ == ngsiLDProperty || typ == ngsiLDGeoProperty || typ == ngsiLDRelationship
+}
+
+// typeValue returns the NGSIv2 type and value of the attribute.
+func (ld *ngsiLDAttribute) typeValue() (AttributeType, interface{}, error) {
+	switch ld.Type {
+	case ngsiLDProperty:
+		return propertyValueFromNGSILD(ld.Value)
+	case ngsiLDGeoProperty:
+		g, err := geojson.UnmarshalGeometry(ld.Value)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid GeoProperty value: %w", err)
+		}
+		return GeoJSONType, g, nil
+	case ngsiLDRelationship:
+		if ld.Object == "" {
+			return "", nil, errors.New("Relationship without object")
+		}
+		return RelationshipType, ld.Object, nil
+	case "":
+		return "", nil, errors.New("Missing NGSI-LD type")
+	default:
+		return "", nil, fmt.Errorf("Unsupported NGSI-LD type '%s'", ld.Type)
+	}
+}
+
+// propertyValueFromNGSILD decodes the value of a Property, which is a plain JSON value
+// or, for dates, a {"@type": "DateTime", "@value": ...} object.
+func propertyValueFromNGSILD(raw json.RawMessage) (AttributeType, interface{}, error) {
+	if len(raw) == 0 {
+		return "", nil, errors.New("Property without value")
+	}
+	var typed struct {
+		Type  string `json:"@type"`
+		Value string `json:"@value"`
+	}
+	if json.Unmarshal(raw, &typed) == nil && typed.Type == string(DateTimeType) {
+		t, err := time.Parse(time.RFC3339, typed.Value)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid DateTime value: %w", err)
+		}
+		return DateTimeType, t, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", nil, err
+	}
+	return inferAttributeType(v), v, nil
+}
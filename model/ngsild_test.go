@@ -0,0 +1,97 @@
+package model_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phoops/ngsiv2/model"
+)
+
+func TestEntityFromNGSILD(t *testing.T) {
+	ld := `{
+		"@context": ["https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"],
+		"id": "urn:ngsi-ld:Room:1",
+		"type": "Room",
+		"temperature": {
+			"type": "Property",
+			"value": 21.5,
+			"observedAt": "2020-04-01T10:00:00Z",
+			"unitCode": "CEL",
+			"accuracy": {"type": "Property", "value": 0.1}
+		},
+		"name": {"type": "Property", "value": "Kitchen"},
+		"lastCleaned": {"type": "Property", "value": {"@type": "DateTime", "@value": "2020-03-31T18:00:00Z"}},
+		"location": {"type": "GeoProperty", "value": {"type": "Point", "coordinates": [11.25, 43.77]}},
+		"isPartOf": {"type": "Relationship", "object": "urn:ngsi-ld:Building:1"}
+	}`
+	e, err := model.EntityFromNGSILD([]byte(ld))
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if e.Id != "urn:ngsi-ld:Room:1" || e.Type != "Room" {
+		t.Fatalf("Unexpected id and type: '%s', '%s'", e.Id, e.Type)
+	}
+	if _, err := e.GetAttribute("@context"); err == nil {
+		t.Fatal("Expected @context to be dropped")
+	}
+
+	temperature, err := e.GetAttributeAsFloat("temperature")
+	if err != nil || temperature != 21.5 {
+		t.Fatalf("Expected temperature 21.5, got %v (%v)", temperature, err)
+	}
+	a, _ := e.GetAttribute("temperature")
+	observedAt, err := a.GetMetadataAsDateTime(model.ObservedAtMetadataName)
+	if err != nil || !observedAt.Equal(time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected observedAt %v (%v)", observedAt, err)
+	}
+	if unit, err := a.GetMetadataAsString("unitCode"); err != nil || unit != "CEL" {
+		t.Fatalf("Expected unitCode 'CEL', got '%s' (%v)", unit, err)
+	}
+	if accuracy, err := a.GetMetadataAsFloat("accuracy"); err != nil || accuracy != 0.1 {
+		t.Fatalf("Expected accuracy 0.1, got %v (%v)", accuracy, err)
+	}
+
+	if name, err := e.GetAttributeAsString("name"); err != nil || name != "Kitchen" {
+		t.Fatalf("Expected name 'Kitchen', got '%s' (%v)", name, err)
+	}
+	lastCleaned, err := e.GetAttributeAsDateTime("lastCleaned")
+	if err != nil || !lastCleaned.Equal(time.Date(2020, 3, 31, 18, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected lastCleaned %v (%v)", lastCleaned, err)
+	}
+	location, err := e.GetAttributeAsGeoJSON("location")
+	if err != nil || !location.IsPoint() || location.Point[0] != 11.25 || location.Point[1] != 43.77 {
+		t.Fatalf("Unexpected location %v (%v)", location, err)
+	}
+	rel, _ := e.GetAttribute("isPartOf")
+	if rel.Type != model.RelationshipType || rel.Value != "urn:ngsi-ld:Building:1" {
+		t.Fatalf("Unexpected relationship %v", rel)
+	}
+}
+
+func TestEntityFromNGSILDErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		ld   string
+		err  string
+	}{
+		{"invalid json", `{`, "unexpected end"},
+		{"missing id", `{"type": "Room"}`, ""},
+		{"multi-attribute", `{"id": "Room1", "type": "Room", "temperature": [{"type": "Property", "value": 21, "datasetId": "urn:a"}]}`, "multi-attribute"},
+		{"bare value", `{"id": "Room1", "type": "Room", "temperature": 21}`, "is not an NGSI-LD"},
+		{"unknown type", `{"id": "Room1", "type": "Room", "name": {"type": "LanguageProperty", "languageMap": {"en": "Kitchen"}}}`, "Unsupported NGSI-LD type"},
+		{"relationship without object", `{"id": "Room1", "type": "Room", "isPartOf": {"type": "Relationship"}}`, "without object"},
+		{"invalid observedAt", `{"id": "Room1", "type": "Room", "temperature": {"type": "Property", "value": 21, "observedAt": "yesterday"}}`, "observedAt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := model.EntityFromNGSILD([]byte(tt.ld))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Expected error containing '%s', got '%v'", tt.err, err)
+			}
+		})
+	}
+}
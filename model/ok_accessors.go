@@ -0,0 +1,79 @@
+package model
+
+import "time"
+
+// The ok accessors mirror the GetAs* methods, reporting failures with a boolean
+// instead of an error, and accepting nil attributes, e.g. the missing ones of
+// an entity, so that they can be chained with a map lookup.
+// They share the conversions of the GetAs* methods, but not their errors,
+// so that neither successful nor failed accesses allocate.
+
+// AsStringOk is like GetAsString, but returns false instead of an error.
+func (a *Attribute) AsStringOk() (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	v, err := a.stringValue()
+	return v, err == nil
+}
+
+// AsIntegerOk is like GetAsInteger, but returns false instead of an error.
+func (a *Attribute) AsIntegerOk() (int, bool) {
+	if a == nil {
+		return 0, false
+	}
+	v, err := a.integerValue()
+	return v, err == nil
+}
+
+// AsFloatOk is like GetAsFloat, but returns false instead of an error.
+func (a *Attribute) AsFloatOk() (float64, bool) {
+	if a == nil {
+		return 0, false
+	}
+	v, err := a.floatValue()
+	return v, err == nil
+}
+
+// AsBooleanOk is like GetAsBoolean, but returns false instead of an error.
+func (a *Attribute) AsBooleanOk() (bool, bool) {
+	if a == nil {
+		return false, false
+	}
+	v, err := a.booleanValue()
+	return v, err == nil
+}
+
+// AsDateTimeOk is like GetAsDateTime, but returns false instead of an error.
+func (a *Attribute) AsDateTimeOk() (time.Time, bool) {
+	if a == nil {
+		return time.Time{}, false
+	}
+	v, err := a.dateTimeValue()
+	return v, err == nil
+}
+
+// StringOk returns the value of the named attribute as a string, see AsStringOk.
+func (e *Entity) StringOk(name string) (string, bool) {
+	return e.Attributes[name].AsStringOk()
+}
+
+// IntegerOk returns the value of the named attribute as an int, see AsIntegerOk.
+func (e *Entity) IntegerOk(name string) (int, bool) {
+	return e.Attributes[name].AsIntegerOk()
+}
+
+// FloatOk returns the value of the named attribute as a float64, see AsFloatOk.
+func (e *Entity) FloatOk(name string) (float64, bool) {
+	return e.Attributes[name].AsFloatOk()
+}
+
+// BooleanOk returns the value of the named attribute as a bool, see AsBooleanOk.
+func (e *Entity) BooleanOk(name string) (bool, bool) {
+	return e.Attributes[name].AsBooleanOk()
+}
+
+// DateTimeOk returns the value of the named attribute as a time.Time, see AsDateTimeOk.
+func (e *Entity) DateTimeOk(name string) (time.Time, bool) {
+	return e.Attributes[name].AsDateTimeOk()
+}
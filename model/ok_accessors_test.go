@@ -0,0 +1,84 @@
+package model_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phoops/ngsiv2/model"
+)
+
+func TestOkAccessors(t *testing.T) {
+	lastSeen := time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC)
+	e, _ := model.NewEntity("Room1", "Room")
+	e.SetAttributeAsText("name", "Kitchen")
+	e.SetAttributeAsInteger("floor", 2)
+	e.SetAttributeAsFloat("temperature", 21.5)
+	e.SetAttributeAsBoolean("occupied", true)
+	e.SetAttributeAsDateTime("lastSeen", lastSeen)
+	e.Attributes["count"] = model.NewAttribute(model.IntegerType, "42")
+
+	if v, ok := e.StringOk("name"); !ok || v != "Kitchen" {
+		t.Fatalf("Unexpected string %v, %v", v, ok)
+	}
+	if v, ok := e.IntegerOk("floor"); !ok || v != 2 {
+		t.Fatalf("Unexpected integer %v, %v", v, ok)
+	}
+	if v, ok := e.IntegerOk("count"); !ok || v != 42 {
+		t.Fatalf("Unexpected string encoded integer %v, %v", v, ok)
+	}
+	if v, ok := e.FloatOk("temperature"); !ok || v != 21.5 {
+		t.Fatalf("Unexpected float %v, %v", v, ok)
+	}
+	if v, ok := e.BooleanOk("occupied"); !ok || !v {
+		t.Fatalf("Unexpected boolean %v, %v", v, ok)
+	}
+	if v, ok := e.DateTimeOk("lastSeen"); !ok || !v.Equal(lastSeen) {
+		t.Fatalf("Unexpected date time %v, %v", v, ok)
+	}
+
+	// wrong types and missing attributes
+	if _, ok := e.StringOk("floor"); ok {
+		t.Fatal("Expected no string from an integer attribute")
+	}
+	if _, ok := e.FloatOk("name"); ok {
+		t.Fatal("Expected no float from a text attribute")
+	}
+	if _, ok := e.IntegerOk("missing"); ok {
+		t.Fatal("Expected no integer from a missing attribute")
+	}
+	if _, ok := e.BooleanOk("missing"); ok {
+		t.Fatal("Expected no boolean from a missing attribute")
+	}
+	if _, ok := e.DateTimeOk("name"); ok {
+		t.Fatal("Expected no date time from a text attribute")
+	}
+
+	// successful accesses don't allocate...
+	temp := e.Attributes["temperature"]
+	if allocs := testing.AllocsPerRun(100, func() {
+		temp.AsFloatOk()
+		e.IntegerOk("floor")
+	}); allocs != 0 {
+		t.Fatalf("Expected no allocations, got %v", allocs)
+	}
+
+	// nor failed ones
+	e.Attributes["bad"] = model.NewAttribute(model.IntegerType, "forty-two")
+	e.Attributes["badFloat"] = model.NewAttribute(model.FloatType, "n/a")
+	if _, ok := e.IntegerOk("bad"); ok {
+		t.Fatal("Expected no integer from a non-numeric string")
+	}
+	if _, ok := e.FloatOk("badFloat"); ok {
+		t.Fatal("Expected no float from a non-numeric string")
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		e.FloatOk("name")
+		e.IntegerOk("bad")
+		e.FloatOk("badFloat")
+		e.StringOk("floor")
+		e.DateTimeOk("name")
+		e.BooleanOk("missing")
+	}); allocs != 0 {
+		t.Fatalf("Expected no allocations for failed accesses, got %v", allocs)
+	}
+}
@@ -0,0 +1,152 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// SubscriptionBuilder builds a Subscription through chained calls.
+// Errors found while chaining are reported by Build.
+type SubscriptionBuilder struct {
+	sub *Subscription
+	err error
+}
+
+func NewSubscriptionBuilder() *SubscriptionBuilder {
+	return &SubscriptionBuilder{sub: &Subscription{}}
+}
+
+func (b *SubscriptionBuilder) subject() *SubscriptionSubject {
+	if b.sub.Subject == nil {
+		b.sub.Subject = &SubscriptionSubject{}
+	}
+	return b.sub.Subject
+}
+
+func (b *SubscriptionBuilder) condition() *SubscriptionSubjectCondition {
+	s := b.subject()
+	if s.Condition == nil {
+		s.Condition = &SubscriptionSubjectCondition{}
+	}
+	return s.Condition
+}
+
+func (b *SubscriptionBuilder) notification() *SubscriptionNotification {
+	if b.sub.Notification == nil {
+		b.sub.Notification = &SubscriptionNotification{}
+	}
+	return b.sub.Notification
+}
+
+func (b *SubscriptionBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Description sets the subscription description.
+func (b *SubscriptionBuilder) Description(description string) *SubscriptionBuilder {
+	b.sub.Description = description
+	return b
+}
+
+// WatchEntities adds the entities the subscription is about.
+func (b *SubscriptionBuilder) WatchEntities(matchers ...*EntityMatcher) *SubscriptionBuilder {
+	for _, m := range matchers {
+		if m == nil {
+			b.setErr(fmt.Errorf("Entity matcher cannot be nil"))
+			continue
+		}
+		if err := m.validate(); err != nil {
+			b.setErr(err)
+			continue
+		}
+		b.subject().Entities = append(b.subject().Entities, m)
+	}
+	return b
+}
+
+// OnAttributes sets the attributes whose change triggers a notification.
+func (b *SubscriptionBuilder) OnAttributes(attrs ...string) *SubscriptionBuilder {
+	b.condition().Attrs = append(b.condition().Attrs, attrs...)
+	return b
+}
+
+// Condition sets the q expression that must hold for a notification to be sent.
+func (b *SubscriptionBuilder) Condition(q string) *SubscriptionBuilder {
+	c := b.condition()
+	if c.Expression == nil {
+		c.Expression = &SubscriptionSubjectConditionExpression{}
+	}
+	c.Expression.Q = q
+	return b
+}
+
+// NotifyHttp sends the notifications to url.
+func (b *SubscriptionBuilder) NotifyHttp(url string) *SubscriptionBuilder {
+	if url == "" {
+		b.setErr(fmt.Errorf("Notification url cannot be empty"))
+		return b
+	}
+	b.notification().Http = &SubscriptionNotificationHttp{Url: url}
+	return b
+}
+
+// NotifyMqtt publishes the notifications to topic on the MQTT broker at url.
+func (b *SubscriptionBuilder) NotifyMqtt(url, topic string, qos uint) *SubscriptionBuilder {
+	if url == "" || topic == "" {
+		b.setErr(fmt.Errorf("MQTT notification requires url and topic"))
+		return b
+	}
+	if qos > 2 {
+		b.setErr(fmt.Errorf("Invalid MQTT qos '%d'", qos))
+		return b
+	}
+	b.notification().Mqtt = &SubscriptionNotificationMqtt{Url: url, Topic: topic, Qos: qos}
+	return b
+}
+
+// WithAttrs sets the attributes included in the notifications.
+func (b *SubscriptionBuilder) WithAttrs(attrs ...string) *SubscriptionBuilder {
+	b.notification().Attrs = append(b.notification().Attrs, attrs...)
+	return b
+}
+
+// WithMetadata sets the metadata included in the notifications.
+func (b *SubscriptionBuilder) WithMetadata(metadata ...string) *SubscriptionBuilder {
+	b.notification().Metadata = append(b.notification().Metadata, metadata...)
+	return b
+}
+
+// WithAttrsFormat sets the format of the entities in the notifications.
+func (b *SubscriptionBuilder) WithAttrsFormat(format AttrsFormat) *SubscriptionBuilder {
+	if !format.IsValid() {
+		b.setErr(fmt.Errorf("Invalid notification attrsFormat '%s'", format))
+		return b
+	}
+	b.notification().AttrsFormat = format
+	return b
+}
+
+// Throttling sets the minimum number of seconds between two notifications.
+func (b *SubscriptionBuilder) Throttling(seconds uint) *SubscriptionBuilder {
+	b.sub.Throttling = seconds
+	return b
+}
+
+// Expires sets the subscription expiration time.
+func (b *SubscriptionBuilder) Expires(t time.Time) *SubscriptionBuilder {
+	b.sub.Expires = &OrionTime{t}
+	return b
+}
+
+// Build returns the subscription, or the first error found while building it.
+func (b *SubscriptionBuilder) Build() (*Subscription, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if err := b.sub.Validate(); err != nil {
+		return nil, err
+	}
+	return b.sub, nil
+}
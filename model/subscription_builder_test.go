@@ -0,0 +1,69 @@
+package model_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/phoops/ngsiv2/model"
+)
+
+func TestSubscriptionBuilder(t *testing.T) {
+	sub, err := model.NewSubscriptionBuilder().
+		Description("Hot rooms").
+		WatchEntities(model.NewEntityMatcher().ByIdPattern(".*").ByType("Room")).
+		OnAttributes("temperature").
+		Condition("temperature>40").
+		NotifyHttp("http://localhost:1234").
+		WithAttrs("temperature", "humidity").
+		Throttling(5).
+		Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	b, _ := json.Marshal(sub)
+	expected := `{"description":"Hot rooms","subject":{"entities":[{"idPattern":".*","type":"Room"}],"condition":{"attrs":["temperature"],"expression":{"q":"temperature\u003e40"}}},"notification":{"attrs":["temperature","humidity"],"http":{"url":"http://localhost:1234"}},"throttling":5}`
+	if string(b) != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, b)
+	}
+
+	tests := []struct {
+		name    string
+		builder *model.SubscriptionBuilder
+	}{
+		{
+			"no subject",
+			model.NewSubscriptionBuilder().NotifyHttp("http://localhost:1234"),
+		},
+		{
+			"no entities",
+			model.NewSubscriptionBuilder().OnAttributes("temperature").NotifyHttp("http://localhost:1234"),
+		},
+		{
+			"no notification",
+			model.NewSubscriptionBuilder().WatchEntities(model.NewEntityMatcher().ById("Room1")),
+		},
+		{
+			"invalid matcher",
+			model.NewSubscriptionBuilder().WatchEntities(model.NewEntityMatcher().ByType("Room")).NotifyHttp("http://localhost:1234"),
+		},
+		{
+			"empty url",
+			model.NewSubscriptionBuilder().WatchEntities(model.NewEntityMatcher().ById("Room1")).NotifyHttp(""),
+		},
+		{
+			"invalid attrsFormat",
+			model.NewSubscriptionBuilder().WatchEntities(model.NewEntityMatcher().ById("Room1")).NotifyHttp("http://localhost:1234").WithAttrsFormat("normalised"),
+		},
+		{
+			"invalid mqtt qos",
+			model.NewSubscriptionBuilder().WatchEntities(model.NewEntityMatcher().ById("Room1")).NotifyMqtt("mqtt://broker:1883", "rooms", 3),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.builder.Build(); err == nil {
+				t.Fatal("Expected an error building the subscription")
+			}
+		})
+	}
+}